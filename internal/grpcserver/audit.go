@@ -0,0 +1,102 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/internal/server"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/balancepb"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+var mutatingMethods = map[string]struct{}{
+	balancepb.Balance_AddFunds_FullMethodName:         {},
+	balancepb.Balance_ReserveFunds_FullMethodName:     {},
+	balancepb.Balance_RecognizeRevenue_FullMethodName: {},
+}
+
+// httpStatus lets gRPC records share outcomes with the HTTP ones.
+var httpStatus = map[codes.Code]int{
+	codes.OK:                 200,
+	codes.InvalidArgument:    400,
+	codes.Unauthenticated:    401,
+	codes.PermissionDenied:   403,
+	codes.NotFound:           404,
+	codes.AlreadyExists:      409,
+	codes.Aborted:            409,
+	codes.FailedPrecondition: 422,
+	codes.ResourceExhausted:  429,
+	codes.Canceled:           499,
+	codes.Unavailable:        503,
+	codes.DeadlineExceeded:   504,
+}
+
+type auditActorKey struct{}
+
+// setAuditActor tells auditCall who made the call, auditCall runs before
+// authentication to record rejected credentials too.
+func setAuditActor(ctx context.Context, id string) {
+	if actor, ok := ctx.Value(auditActorKey{}).(*string); ok {
+		*actor = id
+	}
+}
+
+func (s *Server) auditCall(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if _, ok := mutatingMethods[info.FullMethod]; s.audit == nil || !ok {
+		return handler(ctx, req)
+	}
+	var actor string
+	resp, err := handler(context.WithValue(ctx, auditActorKey{}, &actor), req)
+
+	var payload []byte
+	if msg, ok := req.(proto.Message); ok {
+		payload, _ = proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	}
+	hash := sha256.Sum256(payload)
+	code, ok := httpStatus[status.Code(err)]
+	if !ok {
+		code = 500
+	}
+	record := models.AuditRecord{
+		Actor:       actor,
+		Method:      "GRPC",
+		Path:        info.FullMethod,
+		PayloadHash: hex.EncodeToString(hash[:]),
+		Status:      code,
+		Outcome:     server.AuditOutcome(code),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		record.ClientIP = p.Addr.String()
+		if host, _, e := net.SplitHostPort(record.ClientIP); e == nil {
+			record.ClientIP = host
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("x-request-id"); len(v) > 0 {
+			record.RequestID = v[0]
+		}
+	}
+	auditCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if e := s.audit.RecordAudit(auditCtx, record); e != nil {
+		s.auditFailures.Add(1)
+		s.log.Errorf("err during recording audit of %s: %v", info.FullMethod, e)
+	}
+	return resp, err
+}
+
+// AuditFailures returns the number of audit records that failed to be
+// written.
+func (s *Server) AuditFailures() int64 {
+	return s.auditFailures.Load()
+}
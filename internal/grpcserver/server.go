@@ -0,0 +1,266 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/internal/server"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/balancepb"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var methodScopes = map[string]server.Scope{
+	balancepb.Balance_AddFunds_FullMethodName:         server.ScopeAddFunds,
+	balancepb.Balance_ReserveFunds_FullMethodName:     server.ScopeReserveFunds,
+	balancepb.Balance_RecognizeRevenue_FullMethodName: server.ScopeRecognizeRevenue,
+	balancepb.Balance_WalletBalance_FullMethodName:    server.ScopeReadBalance,
+}
+
+type Server struct {
+	balancepb.UnimplementedBalanceServer
+	log     *logrus.Entry
+	address string
+	server  *grpc.Server
+	app     server.App
+	auth    *server.Authenticator
+	audit   server.AuditLog
+
+	auditFailures atomic.Int64
+}
+
+type Option func(s *Server)
+
+// WithAuthenticator requires an x-api-key or a bearer authorization
+// metadata on every call, with the same scopes as the HTTP API.
+func WithAuthenticator(a *server.Authenticator) Option {
+	return func(s *Server) {
+		s.auth = a
+	}
+}
+
+// WithAuditLog records every mutating call in a, the same way as the HTTP
+// API does. Payload hash is taken of the protobuf encoding of the request.
+func WithAuditLog(a server.AuditLog) Option {
+	return func(s *Server) {
+		s.audit = a
+	}
+}
+
+func New(log *logrus.Logger, address string, app server.App, opts ...Option) *Server {
+	s := Server{
+		log:     log.WithField("module", "grpcserver"),
+		address: address,
+		app:     app,
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	s.server = grpc.NewServer(grpc.ChainUnaryInterceptor(s.recoverer, readYourWrites, s.auditCall, s.authenticate, s.authorize))
+	balancepb.RegisterBalanceServer(s.server, &s)
+	return &s
+}
+
+func (s *Server) Run(ctx context.Context) error {
+	lis, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return fmt.Errorf("listen failed: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		stopped := make(chan struct{})
+		go func() {
+			s.server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(10 * time.Second):
+			s.log.Warnf("err shutting down properly")
+			s.server.Stop()
+		}
+	}()
+	s.log.Infof("starting grpc server on %s", s.address)
+	if err = s.server.Serve(lis); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) AddFunds(ctx context.Context, req *balancepb.AddFundsRequest) (*balancepb.Wallet, error) {
+	resp, err := s.app.AddFunds(ctx, models.AddFundsRequest{
+		TransactionID: req.GetTransactionId(),
+		UserID:        int(req.GetUserId()),
+		Balance:       int(req.GetBalance()),
+		ClientID:      clientID(ctx),
+	})
+	if err != nil {
+		return nil, s.toStatus("add funds", err)
+	}
+	return toWallet(resp), nil
+}
+
+func (s *Server) ReserveFunds(ctx context.Context, req *balancepb.ReserveFundsRequest) (*balancepb.Event, error) {
+	resp, err := s.app.ReserveFunds(ctx, models.ReservedFundsRequest{
+		TransactionID: req.GetTransactionId(),
+		WalletID:      int(req.GetWalletId()),
+		ServiceID:     int(req.GetServiceId()),
+		OrderID:       int(req.GetOrderId()),
+		Price:         int(req.GetPrice()),
+		ClientID:      clientID(ctx),
+	})
+	if err != nil {
+		return nil, s.toStatus("reserve funds", err)
+	}
+	return toEvent(resp), nil
+}
+
+func (s *Server) RecognizeRevenue(ctx context.Context, req *balancepb.RecognizeRevenueRequest) (*balancepb.Event, error) {
+	resp, err := s.app.RecognizeRevenue(ctx, models.RecognizeRevenueRequest{
+		TransactionID: req.GetTransactionId(),
+		WalletID:      int(req.GetWalletId()),
+		ServiceID:     int(req.GetServiceId()),
+		OrderID:       int(req.GetOrderId()),
+		Status:        req.GetStatus(),
+		ClientID:      clientID(ctx),
+	})
+	if err != nil {
+		return nil, s.toStatus("recognize revenue", err)
+	}
+	return toEvent(resp), nil
+}
+
+func (s *Server) WalletBalance(ctx context.Context, req *balancepb.WalletBalanceRequest) (*balancepb.Wallet, error) {
+	resp, err := s.app.WalletBalance(ctx, models.BalanceRequest{UserID: int(req.GetUserId())})
+	if err != nil {
+		return nil, s.toStatus("getting balance", err)
+	}
+	return toWallet(resp), nil
+}
+
+func (s *Server) toStatus(op string, err error) error {
+	switch {
+	case errors.Is(err, pgstore.ErrUserNotExists), errors.Is(err, pgstore.ErrOrderNotExists):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, pgstore.ErrOrderAlreadyAdded), errors.Is(err, pgstore.ErrDuplicateTransaction):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, pgstore.ErrNotEnoughFunds), errors.Is(err, pgstore.ErrOrderAlreadyProcessed):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, pgstore.ErrInvalidStatus):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, pgstore.ErrTxConflict):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, pgstore.ErrTimeout):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, pgstore.ErrCanceled):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	s.log.Warnf("err during %s: %v", op, err)
+	return status.Error(codes.Internal, err.Error())
+}
+
+func toWallet(w models.WalletResponse) *balancepb.Wallet {
+	return &balancepb.Wallet{
+		Id:        int64(w.ID),
+		UserId:    int64(w.UserID),
+		Balance:   int64(w.Balance),
+		Reserved:  int64(w.Reserved),
+		UpdatedAt: timestamppb.New(w.UpdatedAt),
+		UpdatedBy: w.UpdatedBy,
+	}
+}
+
+func toEvent(e models.EventsBodyResponse) *balancepb.Event {
+	return &balancepb.Event{
+		Id:           int64(e.ID),
+		WalletId:     int64(e.WalletID),
+		ServiceId:    int64(e.ServiceID),
+		OrderId:      int64(e.OrderID),
+		Price:        int64(e.Price),
+		Status:       e.Status,
+		DateTime:     timestamppb.New(e.DateTime),
+		ClientId:     e.ClientID,
+		RecognizedBy: e.RecognizedBy,
+	}
+}
+
+type clientCtxKey struct{}
+
+func clientID(ctx context.Context) string {
+	if client, ok := ctx.Value(clientCtxKey{}).(*server.Client); ok {
+		return client.ID
+	}
+	return ""
+}
+
+func (s *Server) authenticate(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if s.auth == nil {
+		return handler(ctx, req)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var apiKey, token string
+	if v := md.Get("x-api-key"); len(v) > 0 {
+		apiKey = v[0]
+	}
+	if v := md.Get("authorization"); len(v) > 0 {
+		var ok bool
+		if token, ok = strings.CutPrefix(v[0], "Bearer "); !ok {
+			s.log.Warnf("err during authentication: authorization is not a bearer token")
+			return nil, status.Error(codes.Unauthenticated, server.ErrUnauthenticated.Error())
+		}
+	}
+	client, err := s.auth.AuthenticateCredentials(apiKey, token)
+	if err != nil {
+		s.log.Warnf("err during authentication: %v", err)
+		return nil, status.Error(codes.Unauthenticated, server.ErrUnauthenticated.Error())
+	}
+	setAuditActor(ctx, client.ID)
+	return handler(context.WithValue(ctx, clientCtxKey{}, client), req)
+}
+
+func (s *Server) authorize(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if s.auth == nil {
+		return handler(ctx, req)
+	}
+	client, ok := ctx.Value(clientCtxKey{}).(*server.Client)
+	if scope, known := methodScopes[info.FullMethod]; !ok || !known || !client.Allowed(scope) {
+		return nil, status.Error(codes.PermissionDenied, server.ErrForbidden.Error())
+	}
+	return handler(ctx, req)
+}
+
+// readYourWrites sends reads of calls with x-consistency: strong metadata
+// to the primary, like the X-Consistency header of the HTTP API.
+func readYourWrites(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get("x-consistency"); len(v) > 0 && v[0] == "strong" {
+		ctx = pgstore.ReadYourWrites(ctx)
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) recoverer(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.log.Errorf("panic in %s: %v", info.FullMethod, r)
+			err = status.Error(codes.Internal, "internal error")
+		}
+	}()
+	return handler(ctx, req)
+}
@@ -0,0 +1,161 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/internal/server"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/balancepb"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	auth, err := server.NewAuthenticator(server.AuthConfig{
+		Clients: []server.ClientConfig{
+			{ID: "billing", APIKeys: []string{"billing-key"}, Scopes: []server.Scope{server.ScopeAddFunds}},
+		},
+		JWTKeys: map[string]string{"k1": "jwt-secret"},
+	})
+	require.NoError(t, err)
+	return New(logrus.New(), "", nil, WithAuthenticator(auth))
+}
+
+func signJWT(claims string) string {
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","kid":"k1"}`)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte("jwt-secret"))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+// call runs the authentication and authorization interceptors around a
+// handler that returns the caller's client id.
+func call(s *Server, method string, md metadata.MD) (string, error) {
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+	info := &grpc.UnaryServerInfo{FullMethod: method}
+	resp, err := s.authenticate(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.authorize(ctx, req, info, func(ctx context.Context, _ interface{}) (interface{}, error) {
+			return clientID(ctx), nil
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.(string), nil
+}
+
+func TestAuth(t *testing.T) {
+	s := newTestServer(t)
+	token := signJWT(`{"sub":"billing","exp":` + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + `}`)
+	addFunds := balancepb.Balance_AddFunds_FullMethodName
+
+	client, err := call(s, addFunds, metadata.Pairs("x-api-key", "billing-key"))
+	require.NoError(t, err)
+	require.Equal(t, "billing", client)
+	client, err = call(s, addFunds, metadata.Pairs("authorization", "Bearer "+token))
+	require.NoError(t, err)
+	require.Equal(t, "billing", client)
+
+	for name, md := range map[string]metadata.MD{
+		"no credentials":  nil,
+		"unknown api key": metadata.Pairs("x-api-key", "nope"),
+		"no bearer":       metadata.Pairs("authorization", token),
+		"basic":           metadata.Pairs("authorization", "Basic "+token),
+		"no bearer key":   metadata.Pairs("x-api-key", "billing-key", "authorization", token),
+	} {
+		_, err = call(s, addFunds, md)
+		require.Equal(t, codes.Unauthenticated, status.Code(err), name)
+	}
+
+	_, err = call(s, balancepb.Balance_WalletBalance_FullMethodName, metadata.Pairs("x-api-key", "billing-key"))
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = call(s, "/balance.Balance/Unknown", metadata.Pairs("x-api-key", "billing-key"))
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestReadYourWrites(t *testing.T) {
+	read := func(md metadata.MD) bool {
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		resp, err := readYourWrites(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, _ interface{}) (interface{}, error) {
+			return ctx, nil
+		})
+		require.NoError(t, err)
+		return resp.(context.Context) != ctx
+	}
+	require.True(t, read(metadata.Pairs("x-consistency", "strong")))
+	require.False(t, read(metadata.Pairs("x-consistency", "eventual")))
+	require.False(t, read(nil))
+}
+
+func TestToStatus(t *testing.T) {
+	s := New(logrus.New(), "", nil)
+	for err, code := range map[error]codes.Code{
+		pgstore.ErrUserNotExists:         codes.NotFound,
+		pgstore.ErrOrderNotExists:        codes.NotFound,
+		pgstore.ErrOrderAlreadyAdded:     codes.AlreadyExists,
+		pgstore.ErrDuplicateTransaction:  codes.AlreadyExists,
+		pgstore.ErrNotEnoughFunds:        codes.FailedPrecondition,
+		pgstore.ErrOrderAlreadyProcessed: codes.FailedPrecondition,
+		pgstore.ErrInvalidStatus:         codes.InvalidArgument,
+		pgstore.ErrTxConflict:            codes.Aborted,
+		pgstore.ErrTimeout:               codes.DeadlineExceeded,
+		pgstore.ErrCanceled:              codes.Unavailable,
+		context.Canceled:                 codes.Canceled,
+		context.DeadlineExceeded:         codes.DeadlineExceeded,
+		fmt.Errorf("connection refused"): codes.Internal,
+	} {
+		require.Equal(t, code, status.Code(s.toStatus("test", fmt.Errorf("service: %w", err))), err.Error())
+	}
+	// A timeout classified by the store is reported as one, not as the
+	// context error it wraps.
+	err := fmt.Errorf("%w: %w", pgstore.ErrTimeout, context.Canceled)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(s.toStatus("test", err)))
+}
+
+type memoryAuditLog struct {
+	server.AuditLog
+	records []models.AuditRecord
+}
+
+func (a *memoryAuditLog) RecordAudit(_ context.Context, data models.AuditRecord) error {
+	a.records = append(a.records, data)
+	return nil
+}
+
+func TestAuditRejected(t *testing.T) {
+	s := newTestServer(t)
+	auditLog := &memoryAuditLog{}
+	s.audit = auditLog
+	info := &grpc.UnaryServerInfo{FullMethod: balancepb.Balance_AddFunds_FullMethodName}
+	send := func(md metadata.MD) {
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		_, _ = s.auditCall(ctx, &balancepb.AddFundsRequest{UserId: 1}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return s.authenticate(ctx, req, info, func(context.Context, interface{}) (interface{}, error) {
+				return nil, nil
+			})
+		})
+	}
+	send(nil)
+	send(metadata.Pairs("x-api-key", "billing-key"))
+
+	require.Len(t, auditLog.records, 2)
+	require.Equal(t, "", auditLog.records[0].Actor)
+	require.Equal(t, 401, auditLog.records[0].Status)
+	require.Equal(t, "billing", auditLog.records[1].Actor)
+	require.Equal(t, 200, auditLog.records[1].Status)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	ScopeProposeAdjustments Scope = "adjustments:propose"
+	ScopeApproveAdjustments Scope = "adjustments:approve"
+)
+
+// ErrOperatorRequired is returned when adjustments are used without
+// authentication, as four-eyes approval needs to know who is who.
+var ErrOperatorRequired = fmt.Errorf("adjustments require an authenticated operator: %w", ErrForbidden)
+
+func (s *Server) adjustmentRoutes(r chi.Router) {
+	r.Use(s.requireOperator)
+	r.With(s.requireScope(ScopeProposeAdjustments), s.rateLimit).Post("/", s.proposeAdjustment)
+	r.With(s.requireScope(ScopeReadBalance), s.rateLimit).Get("/", s.listAdjustments)
+	r.With(s.requireScope(ScopeReadBalance), s.rateLimit).Get("/{id}", s.getAdjustment)
+	r.With(s.requireScope(ScopeApproveAdjustments), s.rateLimit).Post("/{id}:approve", s.approveAdjustment)
+	r.With(s.requireScope(ScopeApproveAdjustments), s.rateLimit).Post("/{id}:reject", s.rejectAdjustment)
+}
+
+func (s *Server) requireOperator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if clientID(r.Context()) == "" {
+			s.writeResponse(w, http.StatusForbidden, ErrOperatorRequired)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) proposeAdjustment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var data models.AdjustmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	data.ProposedBy = clientID(ctx)
+	resp, err := s.app.ProposeAdjustment(ctx, data)
+	if err != nil {
+		s.writeErrorV2(w, "proposing adjustment", err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/v2/adjustments/%d", resp.ID))
+	s.writeResponse(w, http.StatusCreated, resp)
+}
+
+func (s *Server) listAdjustments(w http.ResponseWriter, r *http.Request) {
+	var filter models.AdjustmentsFilter
+	var err error
+	if filter.Limit, filter.Offset, err = pagination(r); err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if v := r.URL.Query().Get("walletID"); v != "" {
+		if filter.WalletID, err = strconv.Atoi(v); err != nil || filter.WalletID <= 0 {
+			s.writeResponse(w, http.StatusBadRequest, fmt.Errorf("walletID must be a positive integer"))
+			return
+		}
+	}
+	switch filter.Status = r.URL.Query().Get("status"); filter.Status {
+	case "", models.AdjustmentPending, models.AdjustmentApproved, models.AdjustmentRejected:
+	default:
+		s.writeResponse(w, http.StatusBadRequest, fmt.Errorf("status must be PENDING, APPROVED or REJECTED"))
+		return
+	}
+	resp, err := s.app.Adjustments(r.Context(), filter)
+	if err != nil {
+		s.writeErrorV2(w, "listing adjustments", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+func (s *Server) getAdjustment(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	resp, err := s.app.Adjustment(r.Context(), id)
+	if err != nil {
+		s.writeErrorV2(w, "getting adjustment", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+func (s *Server) approveAdjustment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := pathID(r, "id")
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	resp, err := s.app.ApproveAdjustment(ctx, id, clientID(ctx))
+	if err != nil {
+		s.writeErrorV2(w, "approving adjustment", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+func (s *Server) rejectAdjustment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := pathID(r, "id")
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	resp, err := s.app.RejectAdjustment(ctx, id, clientID(ctx))
+	if err != nil {
+		s.writeErrorV2(w, "rejecting adjustment", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type adjustmentsApp struct {
+	stubApp
+	adj *models.Adjustment
+}
+
+func (a adjustmentsApp) ProposeAdjustment(_ context.Context, data models.AdjustmentRequest) (models.Adjustment, error) {
+	*a.adj = models.Adjustment{ID: 1, WalletID: data.WalletID, Amount: data.Amount, Reason: data.Reason,
+		Status: models.AdjustmentPending, ProposedBy: data.ProposedBy}
+	return *a.adj, nil
+}
+
+func (a adjustmentsApp) ApproveAdjustment(_ context.Context, _ int, approver string) (models.Adjustment, error) {
+	if approver == a.adj.ProposedBy {
+		return models.Adjustment{}, pgstore.ErrSameApprover
+	}
+	a.adj.Status, a.adj.DecidedBy = models.AdjustmentApproved, approver
+	return *a.adj, nil
+}
+
+func TestAdjustments(t *testing.T) {
+	auth, err := NewAuthenticator(AuthConfig{Clients: []ClientConfig{
+		{ID: "alice", APIKeys: []string{"alice-key"}, Scopes: []Scope{ScopeProposeAdjustments, ScopeApproveAdjustments}},
+		{ID: "bob", APIKeys: []string{"bob-key"}, Scopes: []Scope{ScopeApproveAdjustments}},
+	}})
+	require.NoError(t, err)
+	app := adjustmentsApp{adj: new(models.Adjustment)}
+	s := New(logrus.New(), "", "test", app, WithAuthenticator(auth))
+	send := func(key, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, target, bytes.NewBufferString(body))
+		r.Header.Set(apiKeyHeader, key)
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusForbidden, send("bob-key", "/api/v2/adjustments", `{"walletID":1,"amount":-5,"reason":"refund"}`).Code)
+	w := send("alice-key", "/api/v2/adjustments", `{"walletID":1,"amount":-5,"reason":"refund"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.Equal(t, "alice", app.adj.ProposedBy)
+
+	w = send("alice-key", "/api/v2/adjustments/1:approve", "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Contains(t, w.Body.String(), `"code":"SAME_APPROVER"`)
+	w = send("bob-key", "/api/v2/adjustments/1:approve", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, models.AdjustmentApproved, app.adj.Status)
+	require.Equal(t, "bob", app.adj.DecidedBy)
+}
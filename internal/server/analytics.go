@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+)
+
+// analytics serves aggregates of recognized orders grouped by service or
+// by user, see analyticsFilter for parameters.
+func (s *Server) analytics(groupBy string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := analyticsFilter(r, groupBy)
+		if err != nil {
+			s.writeResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		resp, err := s.app.Analytics(r.Context(), filter)
+		if err != nil {
+			s.writeErrorV2(w, "getting analytics", err)
+			return
+		}
+		s.writeResponse(w, http.StatusOK, resp)
+	}
+}
+
+// analyticsFilter reads required from and to dates (YYYY-MM-DD, to is
+// exclusive), bucket (day, week or month, day by default), serviceID or
+// userID and limit query parameters.
+func analyticsFilter(r *http.Request, groupBy string) (models.AnalyticsFilter, error) {
+	q := r.URL.Query()
+	filter := models.AnalyticsFilter{GroupBy: groupBy, Bucket: q.Get("bucket")}
+	switch filter.Bucket {
+	case "":
+		filter.Bucket = models.AnalyticsDay
+	case models.AnalyticsDay, models.AnalyticsWeek, models.AnalyticsMonth:
+	default:
+		return models.AnalyticsFilter{}, fmt.Errorf("bucket must be day, week or month")
+	}
+	var err error
+	for name, dst := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if *dst, err = time.Parse(time.DateOnly, q.Get(name)); err != nil {
+			return models.AnalyticsFilter{}, fmt.Errorf("%s must be YYYY-MM-DD", name)
+		}
+	}
+	if !filter.From.Before(filter.To) {
+		return models.AnalyticsFilter{}, fmt.Errorf("from must be before to")
+	}
+	idParam := "serviceID"
+	if groupBy == models.AnalyticsByUser {
+		idParam = "userID"
+	}
+	for name, dst := range map[string]*int{idParam: &filter.ID, "limit": &filter.Limit} {
+		if v := q.Get(name); v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil || *dst <= 0 {
+				return models.AnalyticsFilter{}, fmt.Errorf("%s must be a positive integer", name)
+			}
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type analyticsApp struct {
+	stubApp
+	filter *models.AnalyticsFilter
+}
+
+func (a analyticsApp) Analytics(_ context.Context, filter models.AnalyticsFilter) (models.Analytics, error) {
+	*a.filter = filter
+	return models.Analytics{Rows: []models.AnalyticsRow{
+		{Bucket: filter.From, UserID: 7, Orders: 2, Revenue: 300, AvgLatencySeconds: 1.5},
+	}}, nil
+}
+
+func TestAnalytics(t *testing.T) {
+	app := analyticsApp{filter: new(models.AnalyticsFilter)}
+	s := New(logrus.New(), "", "test", app)
+	send := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := send("/api/v2/analytics/users?from=2023-03-01&to=2023-04-01&bucket=week&limit=10")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"refreshedTo":null,"rows":[{"bucket":"2023-03-01T00:00:00Z","userID":7,"orders":2,"revenue":300,"avgLatencySeconds":1.5}]}`, w.Body.String())
+	require.Equal(t, models.AnalyticsFilter{
+		GroupBy: models.AnalyticsByUser,
+		Bucket:  models.AnalyticsWeek,
+		From:    time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC),
+		To:      time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC),
+		Limit:   10,
+	}, *app.filter)
+
+	require.Equal(t, http.StatusOK, send("/api/v2/analytics/services?from=2023-03-01&to=2023-04-01&serviceID=3").Code)
+	require.Equal(t, models.AnalyticsByService, app.filter.GroupBy)
+	require.Equal(t, models.AnalyticsDay, app.filter.Bucket)
+	require.Equal(t, 3, app.filter.ID)
+
+	require.Equal(t, http.StatusBadRequest, send("/api/v2/analytics/services?from=2023-03-01&to=2023-04-01&bucket=year").Code)
+	require.Equal(t, http.StatusBadRequest, send("/api/v2/analytics/services?from=2023-04-01&to=2023-03-01").Code)
+	require.Equal(t, http.StatusBadRequest, send("/api/v2/analytics/users?from=2023-03-01").Code)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const ScopeReadAudit Scope = "audit:read"
+
+type AuditLog interface {
+	RecordAudit(ctx context.Context, data models.AuditRecord) error
+	AuditRecords(ctx context.Context, filter models.AuditFilter) ([]models.AuditRecord, error)
+}
+
+// maxAuditedBody limits the body of a mutating call, the audit reads it
+// whole to hash it.
+const maxAuditedBody = 1 << 20
+
+type auditActorKey struct{}
+
+// setAuditActor tells audit who made the call, audit runs before
+// authentication to record rejected credentials too.
+func setAuditActor(ctx context.Context, id string) {
+	if actor, ok := ctx.Value(auditActorKey{}).(*string); ok {
+		*actor = id
+	}
+}
+
+// audit records every mutating call with its outcome, rejected ones
+// included. The record is written even if the client has gone away.
+func (s *Server) audit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var actor string
+		r = r.WithContext(context.WithValue(r.Context(), auditActorKey{}, &actor))
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		body, err := io.ReadAll(http.MaxBytesReader(ww, r.Body, maxAuditedBody))
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			s.writeResponse(ww, http.StatusRequestEntityTooLarge, fmt.Errorf("request body is larger than %d bytes", maxAuditedBody))
+		case err != nil:
+			s.writeResponse(ww, http.StatusBadRequest, err)
+		default:
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(ww, r)
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		hash := sha256.Sum256(body)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = s.auditLog.RecordAudit(ctx, models.AuditRecord{
+			Actor:       actor,
+			ClientIP:    clientIP(r),
+			RequestID:   middleware.GetReqID(r.Context()),
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			PayloadHash: hex.EncodeToString(hash[:]),
+			Status:      status,
+			Outcome:     AuditOutcome(status),
+		})
+		if err != nil {
+			s.auditFailures.Add(1)
+			s.log.Errorf("err during recording audit of %s %s: %v", r.Method, r.URL.Path, err)
+		}
+	})
+}
+
+// AuditFailures returns the number of audit records that failed to be
+// written.
+func (s *Server) AuditFailures() int64 {
+	return s.auditFailures.Load()
+}
+
+// AuditOutcome classifies an HTTP status of a call.
+func AuditOutcome(status int) string {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return models.AuditFailed
+	case status >= http.StatusBadRequest:
+		return models.AuditRejected
+	}
+	return models.AuditOK
+}
+
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+func (s *Server) auditRecords(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := models.AuditFilter{
+		Actor:     q.Get("actor"),
+		RequestID: q.Get("requestID"),
+		Path:      q.Get("path"),
+		Outcome:   q.Get("outcome"),
+	}
+	var err error
+	if filter.Limit, filter.Offset, err = pagination(r); err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if filter.From, filter.To, err = timeRange(r); err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	resp, err := s.auditLog.AuditRecords(r.Context(), filter)
+	if err != nil {
+		s.writeErrorV2(w, "getting audit records", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
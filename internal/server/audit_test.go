@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryAuditLog struct {
+	AuditLog
+	records []models.AuditRecord
+}
+
+func (a *memoryAuditLog) RecordAudit(_ context.Context, data models.AuditRecord) error {
+	a.records = append(a.records, data)
+	return nil
+}
+
+type rejectingApp struct {
+	stubApp
+}
+
+func (rejectingApp) AddFunds(_ context.Context, data models.AddFundsRequest) (models.WalletResponse, error) {
+	if data.Balance > 100 {
+		return models.WalletResponse{}, pgstore.ErrDuplicateTransaction
+	}
+	return models.WalletResponse{UserID: data.UserID, Balance: data.Balance}, nil
+}
+
+func TestAudit(t *testing.T) {
+	auditLog := &memoryAuditLog{}
+	s := New(logrus.New(), "", "test", rejectingApp{}, WithAuditLog(auditLog))
+	send := func(method, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/v1/addFunds", bytes.NewBufferString(body))
+		r.RemoteAddr = "10.0.0.1:5555"
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, send(http.MethodPost, `{"userID":1,"balance":10}`).Code)
+	require.Equal(t, http.StatusConflict, send(http.MethodPost, `{"userID":1,"balance":500}`).Code)
+	send(http.MethodGet, "")
+
+	require.Len(t, auditLog.records, 2)
+	hash := sha256.Sum256([]byte(`{"userID":1,"balance":10}`))
+	first := auditLog.records[0]
+	require.Equal(t, "10.0.0.1", first.ClientIP)
+	require.NotEmpty(t, first.RequestID)
+	require.Equal(t, hex.EncodeToString(hash[:]), first.PayloadHash)
+	require.Equal(t, models.AuditOK, first.Outcome)
+	require.Equal(t, http.StatusConflict, auditLog.records[1].Status)
+	require.Equal(t, models.AuditRejected, auditLog.records[1].Outcome)
+}
+
+type failingAuditLog struct {
+	AuditLog
+}
+
+func (failingAuditLog) RecordAudit(context.Context, models.AuditRecord) error {
+	return fmt.Errorf("connection refused")
+}
+
+func TestAuditRejected(t *testing.T) {
+	auditLog := &memoryAuditLog{}
+	s := New(logrus.New(), "", "test", rejectingApp{}, WithAuditLog(auditLog), WithAuthenticator(newTestAuthenticator(t)))
+	send := func(apiKey, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/addFunds", bytes.NewBufferString(body))
+		if apiKey != "" {
+			r.Header.Set(apiKeyHeader, apiKey)
+		}
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusUnauthorized, send("", `{"userID":1,"balance":10}`).Code)
+	require.Equal(t, http.StatusForbidden, send("support-key", `{"userID":1,"balance":10}`).Code)
+	require.Equal(t, http.StatusOK, send("billing-key", `{"userID":1,"balance":10}`).Code)
+	large := `{"userID":1,"balance":10,"pad":"` + strings.Repeat("x", maxAuditedBody) + `"}`
+	require.Equal(t, http.StatusRequestEntityTooLarge, send("billing-key", large).Code)
+
+	require.Len(t, auditLog.records, 4)
+	for i, want := range []struct {
+		actor  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"support", http.StatusForbidden},
+		{"billing", http.StatusOK},
+		{"", http.StatusRequestEntityTooLarge},
+	} {
+		require.Equal(t, want.actor, auditLog.records[i].Actor, i)
+		require.Equal(t, want.status, auditLog.records[i].Status, i)
+	}
+	require.Equal(t, models.AuditRejected, auditLog.records[0].Outcome)
+}
+
+func TestAuditFailures(t *testing.T) {
+	s := New(logrus.New(), "", "test", rejectingApp{}, WithAuditLog(failingAuditLog{}))
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/addFunds", bytes.NewBufferString(`{"userID":1,"balance":10}`))
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, int64(1), s.AuditFailures())
+}
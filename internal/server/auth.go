@@ -0,0 +1,342 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Scope string
+
+const (
+	ScopeAddFunds         Scope = "funds:add"
+	ScopeReserveFunds     Scope = "funds:reserve"
+	ScopeRecognizeRevenue Scope = "revenue:recognize"
+	ScopeReadBalance      Scope = "balance:read"
+)
+
+const (
+	apiKeyHeader    = "X-API-Key"
+	clientIDHeader  = "X-Client-ID"
+	timestampHeader = "X-Timestamp"
+	nonceHeader     = "X-Nonce"
+	signatureHeader = "X-Signature"
+
+	maxClockSkew  = 5 * time.Minute
+	maxNonce      = 128
+	maxSignedBody = 1 << 20
+)
+
+var (
+	ErrUnauthenticated = fmt.Errorf("unauthenticated")
+	ErrForbidden       = fmt.Errorf("forbidden")
+)
+
+// AuthConfig describes the clients allowed to call the API and the local
+// keyset used to verify their JWTs.
+type AuthConfig struct {
+	Clients []ClientConfig    `json:"clients"`
+	JWTKeys map[string]string `json:"jwtKeys"`
+}
+
+type ClientConfig struct {
+	ID         string   `json:"id"`
+	APIKeys    []string `json:"apiKeys"`
+	HMACSecret string   `json:"hmacSecret"`
+	Scopes     []Scope  `json:"scopes"`
+}
+
+type Client struct {
+	ID     string
+	scopes map[Scope]struct{}
+}
+
+func (c *Client) Allowed(scope Scope) bool {
+	_, ok := c.scopes[scope]
+	return ok
+}
+
+type Authenticator struct {
+	clients     map[string]*Client
+	apiKeys     map[[sha256.Size]byte]*Client
+	hmacSecrets map[string][]byte
+	jwtKeys     map[string][]byte
+	now         func() time.Time
+
+	mu      sync.Mutex
+	nonces  map[string]time.Time
+	sweptAt time.Time
+}
+
+func LoadAuthConfig(path string) (AuthConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return AuthConfig{}, fmt.Errorf("load auth config failed: %w", err)
+	}
+	var cfg AuthConfig
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return AuthConfig{}, fmt.Errorf("load auth config failed: %w", err)
+	}
+	return cfg, nil
+}
+
+func NewAuthenticator(cfg AuthConfig) (*Authenticator, error) {
+	a := Authenticator{
+		clients:     make(map[string]*Client),
+		apiKeys:     make(map[[sha256.Size]byte]*Client),
+		hmacSecrets: make(map[string][]byte),
+		jwtKeys:     make(map[string][]byte),
+		now:         time.Now,
+		nonces:      make(map[string]time.Time),
+	}
+	for _, c := range cfg.Clients {
+		if c.ID == "" {
+			return nil, fmt.Errorf("new authenticator failed: client without id")
+		}
+		if _, ok := a.clients[c.ID]; ok {
+			return nil, fmt.Errorf("new authenticator failed: duplicate client %q", c.ID)
+		}
+		client := &Client{ID: c.ID, scopes: make(map[Scope]struct{}, len(c.Scopes))}
+		for _, scope := range c.Scopes {
+			client.scopes[scope] = struct{}{}
+		}
+		a.clients[c.ID] = client
+		for _, key := range c.APIKeys {
+			a.apiKeys[sha256.Sum256([]byte(key))] = client
+		}
+		if c.HMACSecret != "" {
+			a.hmacSecrets[c.ID] = []byte(c.HMACSecret)
+		}
+	}
+	for kid, secret := range cfg.JWTKeys {
+		a.jwtKeys[kid] = []byte(secret)
+	}
+	return &a, nil
+}
+
+// Authenticate identifies the caller by an API key, a bearer JWT or an
+// HMAC signature over the request, in that order.
+func (a *Authenticator) Authenticate(r *http.Request) (*Client, error) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if r.Header.Get(apiKeyHeader) == "" && token == "" && r.Header.Get(signatureHeader) != "" {
+		return a.verifySignature(r)
+	}
+	return a.AuthenticateCredentials(r.Header.Get(apiKeyHeader), token)
+}
+
+// AuthenticateCredentials identifies the caller by an API key or a JWT for
+// transports that can't sign the request body.
+func (a *Authenticator) AuthenticateCredentials(apiKey, bearerToken string) (*Client, error) {
+	if apiKey != "" {
+		client, ok := a.apiKeys[sha256.Sum256([]byte(apiKey))]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown api key", ErrUnauthenticated)
+		}
+		return client, nil
+	}
+	if bearerToken != "" {
+		return a.verifyJWT(bearerToken)
+	}
+	return nil, fmt.Errorf("%w: no credentials", ErrUnauthenticated)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+}
+
+func (a *Authenticator) verifyJWT(token string) (*Client, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrUnauthenticated)
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: unsupported alg %q", ErrUnauthenticated, header.Alg)
+	}
+	secret, ok := a.jwtKeys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrUnauthenticated, header.Kid)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrUnauthenticated)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("%w: bad token signature", ErrUnauthenticated)
+	}
+	var claims jwtClaims
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	now := a.now().Unix()
+	if claims.ExpiresAt == 0 || now >= claims.ExpiresAt {
+		return nil, fmt.Errorf("%w: token expired", ErrUnauthenticated)
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, fmt.Errorf("%w: token not valid yet", ErrUnauthenticated)
+	}
+	client, ok := a.clients[claims.Subject]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown client %q", ErrUnauthenticated, claims.Subject)
+	}
+	return client, nil
+}
+
+func decodeJWTPart(part string, dest interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("malformed token: %w", err)
+	}
+	if err = json.Unmarshal(data, dest); err != nil {
+		return fmt.Errorf("malformed token: %w", err)
+	}
+	return nil
+}
+
+func (a *Authenticator) verifySignature(r *http.Request) (*Client, error) {
+	clientID := r.Header.Get(clientIDHeader)
+	secret, ok := a.hmacSecrets[clientID]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown client %q", ErrUnauthenticated, clientID)
+	}
+	timestamp := r.Header.Get(timestampHeader)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad timestamp", ErrUnauthenticated)
+	}
+	if skew := a.now().Sub(time.Unix(ts, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, fmt.Errorf("%w: timestamp out of range", ErrUnauthenticated)
+	}
+	nonce := r.Header.Get(nonceHeader)
+	if nonce == "" || len(nonce) > maxNonce {
+		return nil, fmt.Errorf("%w: bad nonce", ErrUnauthenticated)
+	}
+	signature, err := hex.DecodeString(r.Header.Get(signatureHeader))
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrUnauthenticated)
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxSignedBody))
+	if err != nil {
+		return nil, fmt.Errorf("read body failed: %w", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if !hmac.Equal(signature, SignRequest(secret, r.Method, r.URL.RequestURI(), timestamp, nonce, body)) {
+		return nil, fmt.Errorf("%w: bad request signature", ErrUnauthenticated)
+	}
+	if !a.useNonce(clientID, nonce, time.Unix(ts, 0).Add(maxClockSkew)) {
+		return nil, fmt.Errorf("%w: nonce already used", ErrUnauthenticated)
+	}
+	return a.clients[clientID], nil
+}
+
+// useNonce remembers the nonce of a signed request until its timestamp goes
+// out of range, so the request can't be replayed meanwhile. It reports
+// false if the nonce is remembered already.
+func (a *Authenticator) useNonce(clientID, nonce string, until time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	if now.Sub(a.sweptAt) >= maxClockSkew {
+		for key, expires := range a.nonces {
+			if now.After(expires) {
+				delete(a.nonces, key)
+			}
+		}
+		a.sweptAt = now
+	}
+	key := clientID + "\n" + nonce
+	if expires, ok := a.nonces[key]; ok && !now.After(expires) {
+		return false
+	}
+	a.nonces[key] = until
+	return true
+}
+
+// SignRequest computes the X-Signature value a client sends along with
+// X-Client-ID, X-Timestamp and X-Nonce.
+func SignRequest(secret []byte, method, requestURI, timestamp, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash[:])))
+	return mac.Sum(nil)
+}
+
+type clientCtxKey struct{}
+
+func clientFromContext(ctx context.Context) (*Client, bool) {
+	client, ok := ctx.Value(clientCtxKey{}).(*Client)
+	return client, ok
+}
+
+func clientID(ctx context.Context) string {
+	if client, ok := clientFromContext(ctx); ok {
+		return client.ID
+	}
+	return ""
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, err := s.auth.Authenticate(r)
+		switch {
+		case errors.Is(err, ErrUnauthenticated):
+			s.log.Warnf("err during authentication: %v", err)
+			s.writeResponse(w, http.StatusUnauthorized, ErrUnauthenticated)
+			return
+		case errors.As(err, new(*http.MaxBytesError)):
+			s.writeResponse(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body is larger than %d bytes", maxSignedBody))
+			return
+		case err != nil:
+			s.log.Warnf("err during authentication: %v", err)
+			s.writeResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		setAuditActor(r.Context(), client.ID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientCtxKey{}, client)))
+	})
+}
+
+func (s *Server) allowed(ctx context.Context, scope Scope) bool {
+	if s.auth == nil {
+		return true
+	}
+	client, ok := clientFromContext(ctx)
+	return ok && client.Allowed(scope)
+}
+
+func (s *Server) requireScope(scope Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.allowed(r.Context(), scope) {
+				s.writeResponse(w, http.StatusForbidden, ErrForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
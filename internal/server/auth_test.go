@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	t.Helper()
+	auth, err := NewAuthenticator(AuthConfig{
+		Clients: []ClientConfig{
+			{ID: "billing", APIKeys: []string{"billing-key"}, HMACSecret: "billing-secret", Scopes: []Scope{ScopeAddFunds}},
+			{ID: "support", APIKeys: []string{"support-key"}, Scopes: []Scope{ScopeReadBalance}},
+			{ID: "ops", APIKeys: []string{"ops-key"}, Scopes: []Scope{ScopeReadMetrics}},
+		},
+		JWTKeys: map[string]string{"k1": "jwt-secret"},
+	})
+	require.NoError(t, err)
+	return auth
+}
+
+func signJWT(header, claims, secret string) string {
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthenticate(t *testing.T) {
+	auth := newTestAuthenticator(t)
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+
+	t.Run("api key", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/getUserBalance", nil)
+		r.Header.Set(apiKeyHeader, "support-key")
+		client, err := auth.Authenticate(r)
+		require.NoError(t, err)
+		require.Equal(t, "support", client.ID)
+		require.True(t, client.Allowed(ScopeReadBalance))
+		require.False(t, client.Allowed(ScopeAddFunds))
+	})
+
+	t.Run("unknown api key", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/getUserBalance", nil)
+		r.Header.Set(apiKeyHeader, "nope")
+		_, err := auth.Authenticate(r)
+		require.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("jwt", func(t *testing.T) {
+		token := signJWT(`{"alg":"HS256","kid":"k1"}`, `{"sub":"billing","exp":`+exp+`}`, "jwt-secret")
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/addFunds", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		client, err := auth.Authenticate(r)
+		require.NoError(t, err)
+		require.Equal(t, "billing", client.ID)
+	})
+
+	t.Run("jwt with wrong secret", func(t *testing.T) {
+		token := signJWT(`{"alg":"HS256","kid":"k1"}`, `{"sub":"billing","exp":`+exp+`}`, "other")
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/addFunds", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		_, err := auth.Authenticate(r)
+		require.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("expired jwt", func(t *testing.T) {
+		token := signJWT(`{"alg":"HS256","kid":"k1"}`, `{"sub":"billing","exp":1}`, "jwt-secret")
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/addFunds", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		_, err := auth.Authenticate(r)
+		require.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("hmac signature", func(t *testing.T) {
+		body := `{"userID":1,"balance":100}`
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		signed := func(body, nonce string, sig []byte) *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/addFunds", strings.NewReader(body))
+			r.Header.Set(clientIDHeader, "billing")
+			r.Header.Set(timestampHeader, ts)
+			r.Header.Set(nonceHeader, nonce)
+			r.Header.Set(signatureHeader, hex.EncodeToString(sig))
+			return r
+		}
+		sig := SignRequest([]byte("billing-secret"), http.MethodPost, "/api/v1/addFunds", ts, "n1", []byte(body))
+		client, err := auth.Authenticate(signed(body, "n1", sig))
+		require.NoError(t, err)
+		require.Equal(t, "billing", client.ID)
+
+		_, err = auth.Authenticate(signed(`{"userID":1,"balance":1000000}`, "n1", sig))
+		require.ErrorIs(t, err, ErrUnauthenticated)
+		_, err = auth.Authenticate(signed(body, "n2", sig))
+		require.ErrorIs(t, err, ErrUnauthenticated)
+
+		// The same request can't be replayed.
+		_, err = auth.Authenticate(signed(body, "n1", sig))
+		require.ErrorIs(t, err, ErrUnauthenticated)
+
+		large := strings.Repeat("x", maxSignedBody+1)
+		sig = SignRequest([]byte("billing-secret"), http.MethodPost, "/api/v1/addFunds", ts, "n3", []byte(large))
+		_, err = auth.Authenticate(signed(large, "n3", sig))
+		require.ErrorAs(t, err, new(*http.MaxBytesError))
+	})
+
+	t.Run("no credentials", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/getUserBalance", nil)
+		_, err := auth.Authenticate(r)
+		require.ErrorIs(t, err, ErrUnauthenticated)
+	})
+}
+
+func TestMetricsRequireScope(t *testing.T) {
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+	})
+	s := New(logrus.New(), "", "test", stubApp{}, WithAuthenticator(newTestAuthenticator(t)), WithMetrics(metrics))
+	get := func(apiKey string) int {
+		r := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+		if apiKey != "" {
+			r.Header.Set(apiKeyHeader, apiKey)
+		}
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusUnauthorized, get(""))
+	require.Equal(t, http.StatusForbidden, get("support-key"))
+	require.Equal(t, http.StatusOK, get("ops-key"))
+}
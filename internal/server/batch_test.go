@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/memstore"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/service"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+	app := service.New(logrus.New(), memstore.New())
+	s := New(logrus.New(), "", "test", app)
+	wallet, err := app.AddFunds(ctx, models.AddFundsRequest{UserID: 1, Balance: 100})
+	require.NoError(t, err)
+
+	batch := func(mode string, ops ...string) models.BatchResponse {
+		t.Helper()
+		body := `{"mode":"` + mode + `","operations":[`
+		for i, op := range ops {
+			if i > 0 {
+				body += ","
+			}
+			body += op
+		}
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/batch", bytes.NewBufferString(body+"]}"))
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp models.BatchResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+	reserve := func(orderID, price int) string {
+		b, _ := json.Marshal(models.BatchOperation{Type: models.BatchReserveFunds, ReserveFunds: &models.ReservedFundsRequest{
+			WalletID: wallet.ID, ServiceID: 1, OrderID: orderID, Price: price,
+		}})
+		return string(b)
+	}
+	credit := func(userID, amount int) string {
+		b, _ := json.Marshal(models.BatchOperation{Type: models.BatchAddFunds, AddFunds: &models.AddFundsRequest{
+			UserID: userID, Balance: amount,
+		}})
+		return string(b)
+	}
+	statuses := func(resp models.BatchResponse) []string {
+		var result []string
+		for _, r := range resp.Results {
+			result = append(result, r.Status+" "+r.Code)
+		}
+		return result
+	}
+	balance := func(userID int) models.WalletResponse {
+		w, err := app.WalletBalance(ctx, models.BalanceRequest{UserID: userID})
+		require.NoError(t, err)
+		return w
+	}
+
+	t.Run("atomic rolls back", func(t *testing.T) {
+		resp := batch(models.BatchModeAtomic, credit(2, 50), reserve(1, 40), reserve(2, 70))
+		require.False(t, resp.Applied)
+		require.Equal(t, []string{"SKIPPED ", "SKIPPED ", "FAILED NOT_ENOUGH_FUNDS"}, statuses(resp))
+		require.Equal(t, 0, balance(1).Reserved)
+		_, err := app.WalletBalance(ctx, models.BalanceRequest{UserID: 2})
+		require.Error(t, err)
+	})
+
+	t.Run("best effort applies the rest", func(t *testing.T) {
+		resp := batch(models.BatchModeBestEffort, credit(2, 50), reserve(1, 40), reserve(2, 70), reserve(3, 60))
+		require.True(t, resp.Applied)
+		require.Equal(t, []string{"OK ", "OK ", "FAILED NOT_ENOUGH_FUNDS", "OK "}, statuses(resp))
+		require.Equal(t, 50, balance(2).Balance)
+		require.Equal(t, 100, balance(1).Reserved)
+	})
+
+	t.Run("duplicate order ids", func(t *testing.T) {
+		resp := batch(models.BatchModeBestEffort, reserve(4, 0), reserve(4, 0), reserve(1, 0))
+		require.Equal(t, []string{"OK ", "FAILED ORDER_ALREADY_ADDED", "FAILED ORDER_ALREADY_ADDED"}, statuses(resp))
+
+		resp = batch(models.BatchModeAtomic, reserve(5, 0), reserve(5, 0))
+		require.False(t, resp.Applied)
+		require.Equal(t, []string{"SKIPPED ", "FAILED ORDER_ALREADY_ADDED"}, statuses(resp))
+	})
+
+	t.Run("funds run out midway", func(t *testing.T) {
+		_, err := app.AddFunds(ctx, models.AddFundsRequest{UserID: 1, Balance: 30})
+		require.NoError(t, err)
+		resp := batch(models.BatchModeBestEffort, reserve(6, 20), reserve(7, 20), reserve(8, 10))
+		require.Equal(t, []string{"OK ", "FAILED NOT_ENOUGH_FUNDS", "OK "}, statuses(resp))
+		w := balance(1)
+		require.Equal(t, w.Balance, w.Reserved)
+	})
+}
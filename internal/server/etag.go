@@ -0,0 +1,34 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+)
+
+// setETag exposes the wallet version, clients send it back in If-Match to
+// change the wallet only if nobody has changed it since.
+func setETag(w http.ResponseWriter, version int64) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(version, 10)))
+}
+
+// ifMatch returns the version from If-Match header or zero when the header
+// is missing or "*". A tag that is not a version can't match any wallet.
+func ifMatch(r *http.Request) (int64, error) {
+	v := strings.TrimSpace(r.Header.Get("If-Match"))
+	if v == "" || v == "*" {
+		return 0, nil
+	}
+	tag, err := strconv.Unquote(v)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", pgstore.ErrVersionMismatch, v)
+	}
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("%w: %s", pgstore.ErrVersionMismatch, v)
+	}
+	return version, nil
+}
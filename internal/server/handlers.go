@@ -4,19 +4,37 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
 	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/reportjob"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/webhook"
 )
 
-var txs = make(map[string]struct{})
-
 type App interface {
 	AddFunds(ctx context.Context, data models.AddFundsRequest) (models.WalletResponse, error)
 	WalletBalance(ctx context.Context, data models.BalanceRequest) (models.WalletResponse, error)
+	Order(ctx context.Context, orderID int) (models.EventsBodyResponse, error)
+	Orders(ctx context.Context, filter models.OrdersFilter) ([]models.EventsBodyResponse, error)
 	ReserveFunds(ctx context.Context, data models.ReservedFundsRequest) (models.EventsBodyResponse, error)
 	RecognizeRevenue(ctx context.Context, data models.RecognizeRevenueRequest) (models.EventsBodyResponse, error)
+	Batch(ctx context.Context, data models.BatchRequest) (models.BatchResponse, error)
+	History(ctx context.Context, filter models.HistoryFilter) ([]models.HistoryEntry, error)
+	VerifyChain(ctx context.Context, walletID int) (models.ChainReport, error)
+	Statement(ctx context.Context, filter models.StatementFilter) (models.Statement, error)
+	Statements(ctx context.Context, filter models.StatementFilter) ([]models.Statement, error)
+	RevenueByService(ctx context.Context, from, to time.Time, fn func(models.ServiceRevenue) error) error
+	RecognizedOrders(ctx context.Context, from, to time.Time, fn func(models.RecognizedOrder) error) error
+	Analytics(ctx context.Context, filter models.AnalyticsFilter) (models.Analytics, error)
+	ProposeAdjustment(ctx context.Context, data models.AdjustmentRequest) (models.Adjustment, error)
+	ApproveAdjustment(ctx context.Context, id int, approver string) (models.Adjustment, error)
+	RejectAdjustment(ctx context.Context, id int, approver string) (models.Adjustment, error)
+	Adjustment(ctx context.Context, id int) (models.Adjustment, error)
+	Adjustments(ctx context.Context, filter models.AdjustmentsFilter) ([]models.Adjustment, error)
 }
 
 func (s *Server) addFundsHandler(w http.ResponseWriter, r *http.Request) {
@@ -26,17 +44,27 @@ func (s *Server) addFundsHandler(w http.ResponseWriter, r *http.Request) {
 		s.writeResponse(w, http.StatusBadRequest, err)
 		return
 	}
-	if _, ok := txs[data.TransactionID]; ok {
-		s.writeResponse(w, http.StatusConflict, nil)
+	data.ClientID = clientID(ctx)
+	version, err := ifMatch(r)
+	if err != nil {
+		s.writeResponse(w, http.StatusPreconditionFailed, err)
 		return
 	}
+	data.ExpectedVersion = version
 	resp, err := s.app.AddFunds(ctx, data)
-	if err != nil {
+	switch {
+	case errors.Is(err, pgstore.ErrVersionMismatch):
+		s.writeResponse(w, http.StatusPreconditionFailed, err)
+		return
+	case errors.Is(err, pgstore.ErrDuplicateTransaction):
+		s.writeResponse(w, http.StatusConflict, err)
+		return
+	case err != nil:
 		s.log.Warnf("err during add funds: %v", err)
-		s.writeResponse(w, http.StatusInternalServerError, err)
+		s.writeResponse(w, storeErrorStatus(err), err)
 		return
 	}
-	txs[data.TransactionID] = struct{}{}
+	setETag(w, resp.Version)
 	s.writeResponse(w, http.StatusOK, resp)
 }
 
@@ -47,12 +75,21 @@ func (s *Server) reserveFundsHandler(w http.ResponseWriter, r *http.Request) {
 		s.writeResponse(w, http.StatusBadRequest, err)
 		return
 	}
-	if _, ok := txs[data.TransactionID]; ok {
-		s.writeResponse(w, http.StatusConflict, nil)
+	data.ClientID = clientID(ctx)
+	version, err := ifMatch(r)
+	if err != nil {
+		s.writeResponse(w, http.StatusPreconditionFailed, err)
 		return
 	}
+	data.ExpectedVersion = version
 	resp, err := s.app.ReserveFunds(ctx, data)
 	switch {
+	case errors.Is(err, pgstore.ErrVersionMismatch):
+		s.writeResponse(w, http.StatusPreconditionFailed, err)
+		return
+	case errors.Is(err, pgstore.ErrDuplicateTransaction), errors.Is(err, pgstore.ErrTxConflict):
+		s.writeResponse(w, http.StatusConflict, err)
+		return
 	case errors.Is(err, pgstore.ErrOrderAlreadyAdded):
 		s.log.Warnf("err during reserve funds: %v", err)
 		s.writeResponse(w, http.StatusBadRequest, err)
@@ -63,10 +100,9 @@ func (s *Server) reserveFundsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	case err != nil:
 		s.log.Warnf("err during reserve funds: %v", err)
-		s.writeResponse(w, http.StatusInternalServerError, err)
+		s.writeResponse(w, storeErrorStatus(err), err)
 		return
 	}
-	txs[data.TransactionID] = struct{}{}
 	s.writeResponse(w, http.StatusOK, resp)
 }
 
@@ -77,20 +113,29 @@ func (s *Server) recognizeRevenueHandler(w http.ResponseWriter, r *http.Request)
 		s.writeResponse(w, http.StatusBadRequest, nil)
 		return
 	}
-	if _, ok := txs[data.TransactionID]; ok {
-		s.writeResponse(w, http.StatusConflict, nil)
+	data.ClientID = clientID(ctx)
+	version, err := ifMatch(r)
+	if err != nil {
+		s.writeResponse(w, http.StatusPreconditionFailed, err)
 		return
 	}
+	data.ExpectedVersion = version
 	resp, err := s.app.RecognizeRevenue(ctx, data)
 	switch {
+	case errors.Is(err, pgstore.ErrVersionMismatch):
+		s.writeResponse(w, http.StatusPreconditionFailed, err)
+		return
+	case errors.Is(err, pgstore.ErrDuplicateTransaction), errors.Is(err, pgstore.ErrTxConflict):
+		s.writeResponse(w, http.StatusConflict, err)
+		return
 	case errors.Is(err, pgstore.ErrOrderNotExists):
 		s.writeResponse(w, http.StatusBadRequest, err)
 		return
 	case err != nil:
 		s.log.Warnf("err during recognize revenue: %v", err)
-		s.writeResponse(w, http.StatusInternalServerError, err)
+		s.writeResponse(w, storeErrorStatus(err), err)
+		return
 	}
-	txs[data.TransactionID] = struct{}{}
 	s.writeResponse(w, http.StatusOK, resp)
 }
 
@@ -101,22 +146,113 @@ func (s *Server) getUserBalance(w http.ResponseWriter, r *http.Request) {
 		s.writeResponse(w, http.StatusBadRequest, nil)
 		return
 	}
+	if data.AsOf == nil {
+		// The version is the ETag, it's read from the primary.
+		ctx = pgstore.ReadYourWrites(ctx)
+	}
 	resp, err := s.app.WalletBalance(ctx, data)
 	switch {
 	case errors.Is(err, pgstore.ErrUserNotExists):
 		s.writeResponse(w, http.StatusBadRequest, err)
+		return
 	case err != nil:
 		s.log.Warnf("err during getting balance (id %d): %v", data.UserID, err)
+		s.writeResponse(w, storeErrorStatus(err), err)
+		return
+	}
+	if data.AsOf == nil {
+		setETag(w, resp.Version)
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+func (s *Server) batchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var data models.BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.validateBatch(ctx, data); err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	for _, op := range data.Operations {
+		if !s.allowed(ctx, batchScopes[op.Type]) {
+			s.writeResponse(w, http.StatusForbidden, ErrForbidden)
+			return
+		}
+	}
+	data.ClientID = clientID(ctx)
+
+	resp, err := s.app.Batch(ctx, data)
+	if err != nil {
+		s.log.Warnf("err during batch: %v", err)
+		s.writeResponse(w, storeErrorStatus(err), err)
 		return
 	}
+	for i := range resp.Results {
+		if err = resp.Results[i].Err; err != nil {
+			resp.Results[i].Error = err.Error()
+			resp.Results[i].Code = errorCode(err)
+		}
+	}
 	s.writeResponse(w, http.StatusOK, resp)
 }
 
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+func pagination(r *http.Request) (limit int, offset int, err error) {
+	limit = defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxPageSize {
+			return 0, 0, fmt.Errorf("limit must be from 1 to %d", maxPageSize)
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be non-negative")
+		}
+	}
+	return limit, offset, nil
+}
+
+const maxBatchSize = 10000
+
+var batchScopes = map[string]Scope{
+	models.BatchAddFunds:         ScopeAddFunds,
+	models.BatchReserveFunds:     ScopeReserveFunds,
+	models.BatchRecognizeRevenue: ScopeRecognizeRevenue,
+}
+
+func (s *Server) validateBatch(_ context.Context, data models.BatchRequest) error {
+	if data.Mode != models.BatchModeAtomic && data.Mode != models.BatchModeBestEffort {
+		return fmt.Errorf("mode must be %s or %s", models.BatchModeAtomic, models.BatchModeBestEffort)
+	}
+	if len(data.Operations) == 0 || len(data.Operations) > maxBatchSize {
+		return fmt.Errorf("batch must have from 1 to %d operations", maxBatchSize)
+	}
+	for i, op := range data.Operations {
+		if (op.Type == models.BatchAddFunds && op.AddFunds == nil) ||
+			(op.Type == models.BatchReserveFunds && op.ReserveFunds == nil) ||
+			(op.Type == models.BatchRecognizeRevenue && op.RecognizeRevenue == nil) {
+			return fmt.Errorf("operation %d: missing %s body", i, op.Type)
+		}
+		if _, ok := batchScopes[op.Type]; !ok {
+			return fmt.Errorf("operation %d: unknown type %q", i, op.Type)
+		}
+	}
+	return nil
+}
+
 func (s *Server) writeResponse(w http.ResponseWriter, status int, data interface{}) {
 	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "application/json")
 	if x, ok := data.(error); ok {
-		if err := json.NewEncoder(w).Encode(ErrorResponse{Error: x.Error()}); err != nil {
+		if err := json.NewEncoder(w).Encode(ErrorResponse{Error: x.Error(), Code: errorCode(x)}); err != nil {
 			s.log.Warnf("write response failed: %v", err)
 		}
 		return
@@ -128,4 +264,50 @@ func (s *Server) writeResponse(w http.ResponseWriter, status int, data interface
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+}
+
+// errorCode gives clients a stable name for the errors they may handle.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, pgstore.ErrNotEnoughFunds):
+		return "NOT_ENOUGH_FUNDS"
+	case errors.Is(err, pgstore.ErrUserNotExists):
+		return "USER_NOT_EXISTS"
+	case errors.Is(err, pgstore.ErrOrderAlreadyAdded):
+		return "ORDER_ALREADY_ADDED"
+	case errors.Is(err, pgstore.ErrOrderNotExists):
+		return "ORDER_NOT_EXISTS"
+	case errors.Is(err, pgstore.ErrOrderAlreadyProcessed):
+		return "ORDER_ALREADY_PROCESSED"
+	case errors.Is(err, pgstore.ErrInvalidStatus):
+		return "INVALID_STATUS"
+	case errors.Is(err, pgstore.ErrVersionMismatch):
+		return "VERSION_MISMATCH"
+	case errors.Is(err, pgstore.ErrAdjustmentNotExists):
+		return "ADJUSTMENT_NOT_EXISTS"
+	case errors.Is(err, pgstore.ErrAdjustmentProcessed):
+		return "ADJUSTMENT_ALREADY_DECIDED"
+	case errors.Is(err, pgstore.ErrInvalidAdjustment):
+		return "INVALID_ADJUSTMENT"
+	case errors.Is(err, pgstore.ErrSameApprover):
+		return "SAME_APPROVER"
+	case errors.Is(err, pgstore.ErrReportJobNotExists):
+		return "REPORT_JOB_NOT_EXISTS"
+	case errors.Is(err, reportjob.ErrInvalidJob):
+		return "INVALID_REPORT_JOB"
+	case errors.Is(err, pgstore.ErrWebhookNotExists):
+		return "WEBHOOK_NOT_EXISTS"
+	case errors.Is(err, webhook.ErrInvalidSubscription):
+		return "INVALID_SUBSCRIPTION"
+	case errors.Is(err, pgstore.ErrDuplicateTransaction):
+		return "DUPLICATE_TRANSACTION"
+	case errors.Is(err, ErrUnauthenticated):
+		return "UNAUTHENTICATED"
+	case errors.Is(err, ErrForbidden):
+		return "FORBIDDEN"
+	case errors.Is(err, ErrTooManyRequests):
+		return "TOO_MANY_REQUESTS"
+	}
+	return ""
 }
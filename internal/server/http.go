@@ -4,37 +4,134 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"sync/atomic"
 	"time"
 
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/sirupsen/logrus"
 )
 
+// ConsistencyHeader set to "strong" makes reads of the call see writes
+// made just before it, they skip replicas.
+const ConsistencyHeader = "X-Consistency"
+
 type Server struct {
-	log     *logrus.Entry
-	address string
-	version string
-	server  *http.Server
-	app     App
+	log      *logrus.Entry
+	address  string
+	version  string
+	server   *http.Server
+	app      App
+	auth     *Authenticator
+	limiter  *rateLimiter
+	webhooks Webhooks
+	auditLog AuditLog
+	reports  ReportJobs
+	files    http.Handler
+	metrics  http.Handler
+
+	auditFailures atomic.Int64
 }
 
-func New(log *logrus.Logger, address string, version string, app App) *Server {
+type Option func(s *Server)
+
+// WithAuthenticator makes every API call require credentials known to a.
+// Without it the API stays open.
+func WithAuthenticator(a *Authenticator) Option {
+	return func(s *Server) {
+		s.auth = a
+	}
+}
+
+// WithRateLimiter rejects calls over the limits in cfg with 429. Buckets are
+// kept in limiter, so a shared limiter makes limits hold across replicas.
+func WithRateLimiter(cfg RateLimitConfig, limiter Limiter) Option {
+	return func(s *Server) {
+		s.limiter = &rateLimiter{cfg: cfg, limiter: limiter}
+	}
+}
+
+// WithWebhooks serves CRUD of webhook subscriptions under /api/v1/webhooks.
+func WithWebhooks(webhooks Webhooks) Option {
+	return func(s *Server) {
+		s.webhooks = webhooks
+	}
+}
+
+// WithAuditLog records every mutating call in a and serves the records
+// under /api/v2/audit.
+func WithAuditLog(a AuditLog) Option {
+	return func(s *Server) {
+		s.auditLog = a
+	}
+}
+
+// WithReportJobs serves background report jobs under /api/v2/reports.
+// files, when not nil, serves downloads of finished reports under /files
+// without credentials, links to them are signed.
+func WithReportJobs(jobs ReportJobs, files http.Handler) Option {
+	return func(s *Server) {
+		s.reports = jobs
+		s.files = files
+	}
+}
+
+// ScopeReadMetrics lets a client read metrics, give it to operators only.
+const ScopeReadMetrics Scope = "metrics:read"
+
+// WithMetrics serves metrics from h under /debug/vars to clients with
+// ScopeReadMetrics.
+func WithMetrics(h http.Handler) Option {
+	return func(s *Server) {
+		s.metrics = h
+	}
+}
+
+func New(log *logrus.Logger, address string, version string, app App, opts ...Option) *Server {
 	s := Server{
 		log:     log.WithField("module", "server"),
 		address: address,
 		version: version,
 		app:     app,
 	}
+	for _, opt := range opts {
+		opt(&s)
+	}
 	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
 	r.Use(middleware.Recoverer)
+	if s.files != nil {
+		r.Handle("/files/*", http.StripPrefix("/files", s.files))
+	}
+	if s.metrics != nil {
+		r.Group(func(r chi.Router) {
+			if s.auth != nil {
+				r.Use(s.authenticate)
+			}
+			r.With(s.requireScope(ScopeReadMetrics)).Method(http.MethodGet, "/debug/vars", s.metrics)
+		})
+	}
 	r.Route("/api", func(r chi.Router) {
+		r.Use(readYourWrites)
+		if s.auditLog != nil {
+			r.Use(s.audit)
+		}
+		if s.auth != nil {
+			r.Use(s.authenticate)
+		}
 		r.Route("/v1", func(r chi.Router) {
-			r.Post("/addFunds", s.addFundsHandler)
-			r.Post("/reserveFunds", s.reserveFundsHandler)
-			r.Post("/recognizeRevenue", s.recognizeRevenueHandler)
-			r.Get("/getUserBalance", s.getUserBalance)
+			r.With(s.requireScope(ScopeAddFunds), s.rateLimit).Post("/addFunds", s.addFundsHandler)
+			r.With(s.requireScope(ScopeReserveFunds), s.rateLimit).Post("/reserveFunds", s.reserveFundsHandler)
+			r.With(s.requireScope(ScopeRecognizeRevenue), s.rateLimit).Post("/recognizeRevenue", s.recognizeRevenueHandler)
+			r.With(s.requireScope(ScopeReadBalance), s.rateLimit).Get("/getUserBalance", s.getUserBalance)
+			r.With(s.rateLimit).Post("/batch", s.batchHandler)
+			if s.webhooks != nil {
+				r.Route("/webhooks", s.webhookRoutes)
+			}
 		})
+		r.Route("/v2", s.v2Routes)
 	})
 	s.server = &http.Server{
 		Addr:              s.address,
@@ -44,6 +141,15 @@ func New(log *logrus.Logger, address string, version string, app App) *Server {
 	return &s
 }
 
+func readYourWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ConsistencyHeader) == "strong" {
+			r = r.WithContext(pgstore.ReadYourWrites(r.Context()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *Server) Run(ctx context.Context) error {
 	go func() {
 		<-ctx.Done()
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var ErrTooManyRequests = fmt.Errorf("too many requests")
+
+// Limiter takes one token from each of buckets, identified by their keys.
+// When any of them is empty no token is taken and Limiter returns how long
+// the caller has to wait.
+type Limiter interface {
+	Allow(ctx context.Context, buckets []models.RateBucket) (time.Duration, error)
+}
+
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func (l Limit) enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+func (l Limit) bucket(key string) models.RateBucket {
+	return models.RateBucket{Key: key, Rate: l.Rate, Burst: l.Burst}
+}
+
+// RateLimitConfig sets a bucket per client and route (Routes, falling back
+// to Default) and an overall quota per client (Clients).
+type RateLimitConfig struct {
+	Backend string           `json:"backend"`
+	Default Limit            `json:"default"`
+	Routes  map[string]Limit `json:"routes"`
+	Clients map[string]Limit `json:"clients"`
+}
+
+func LoadRateLimitConfig(path string) (RateLimitConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RateLimitConfig{}, fmt.Errorf("load rate limit config failed: %w", err)
+	}
+	var cfg RateLimitConfig
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return RateLimitConfig{}, fmt.Errorf("load rate limit config failed: %w", err)
+	}
+	return cfg, nil
+}
+
+type rateLimiter struct {
+	cfg     RateLimitConfig
+	limiter Limiter
+}
+
+// sweepEvery is how often MemoryLimiter drops buckets that have refilled,
+// a bucket made again starts full anyway.
+const sweepEvery = time.Minute
+
+type MemoryLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	sweptAt time.Time
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens    float64
+	rate      float64
+	burst     int
+	updatedAt time.Time
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.burst), b.tokens+now.Sub(b.updatedAt).Seconds()*b.rate)
+	b.updatedAt = now
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (l *MemoryLimiter) Allow(_ context.Context, limits []models.RateBucket) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.sweptAt) >= sweepEvery {
+		l.sweep(now)
+	}
+	var wait time.Duration
+	buckets := make([]*bucket, 0, len(limits))
+	for _, limit := range limits {
+		b, ok := l.buckets[limit.Key]
+		if !ok {
+			b = &bucket{tokens: float64(limit.Burst), updatedAt: now}
+			l.buckets[limit.Key] = b
+		}
+		b.rate, b.burst = limit.Rate, limit.Burst
+		b.refill(now)
+		if b.tokens < 1 {
+			if w := retryAfter(b.tokens, b.rate); w > wait {
+				wait = w
+			}
+		}
+		buckets = append(buckets, b)
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0, nil
+}
+
+func (l *MemoryLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= float64(b.burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.sweptAt = now
+}
+
+func retryAfter(tokens float64, rate float64) time.Duration {
+	return time.Duration((1 - tokens) / rate * float64(time.Second))
+}
+
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		caller := clientID(ctx)
+		if caller == "" {
+			caller = clientIP(r)
+		}
+		route := chi.RouteContext(ctx).RoutePattern()
+
+		limit, ok := s.limiter.cfg.Routes[route]
+		if !ok {
+			limit = s.limiter.cfg.Default
+		}
+		var buckets []models.RateBucket
+		if limit.enabled() {
+			buckets = append(buckets, limit.bucket("route:"+caller+":"+route))
+		}
+		if limit = s.limiter.cfg.Clients[caller]; limit.enabled() {
+			buckets = append(buckets, limit.bucket("client:"+caller))
+		}
+		if len(buckets) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		wait, err := s.limiter.limiter.Allow(ctx, buckets)
+		if err != nil {
+			// The limiter must not take the API down with it.
+			s.log.Warnf("err during rate limiting: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			s.writeResponse(w, http.StatusTooManyRequests, ErrTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type stubApp struct {
+	App
+}
+
+func (stubApp) WalletBalance(_ context.Context, data models.BalanceRequest) (models.WalletResponse, error) {
+	return models.WalletResponse{UserID: data.UserID, AsOf: data.AsOf}, nil
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	l := NewMemoryLimiter()
+	l.now = func() time.Time { return now }
+	ctx := context.Background()
+	k := []models.RateBucket{{Key: "k", Rate: 2, Burst: 3}}
+
+	for i := 0; i < 3; i++ {
+		wait, err := l.Allow(ctx, k)
+		require.NoError(t, err)
+		require.Zero(t, wait)
+	}
+	wait, err := l.Allow(ctx, k)
+	require.NoError(t, err)
+	require.Equal(t, 500*time.Millisecond, wait)
+
+	wait, err = l.Allow(ctx, []models.RateBucket{{Key: "other", Rate: 2, Burst: 3}})
+	require.NoError(t, err)
+	require.Zero(t, wait)
+
+	now = now.Add(500 * time.Millisecond)
+	wait, err = l.Allow(ctx, k)
+	require.NoError(t, err)
+	require.Zero(t, wait)
+}
+
+func TestMemoryLimiterTakesAllOrNothing(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	l := NewMemoryLimiter()
+	l.now = func() time.Time { return now }
+	ctx := context.Background()
+	route := models.RateBucket{Key: "route", Rate: 1, Burst: 2}
+	client := models.RateBucket{Key: "client", Rate: 1, Burst: 1}
+
+	wait, err := l.Allow(ctx, []models.RateBucket{route, client})
+	require.NoError(t, err)
+	require.Zero(t, wait)
+	wait, err = l.Allow(ctx, []models.RateBucket{route, client})
+	require.NoError(t, err)
+	require.Equal(t, time.Second, wait)
+
+	// The rejected call didn't take the token left in the route bucket.
+	wait, err = l.Allow(ctx, []models.RateBucket{route})
+	require.NoError(t, err)
+	require.Zero(t, wait)
+}
+
+func TestMemoryLimiterSweep(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	l := NewMemoryLimiter()
+	l.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	_, err := l.Allow(ctx, []models.RateBucket{{Key: "idle", Rate: 1, Burst: 10}})
+	require.NoError(t, err)
+	_, err = l.Allow(ctx, []models.RateBucket{{Key: "busy", Rate: 0.001, Burst: 10}})
+	require.NoError(t, err)
+	require.Len(t, l.buckets, 2)
+
+	now = now.Add(sweepEvery)
+	_, err = l.Allow(ctx, []models.RateBucket{{Key: "new", Rate: 1, Burst: 10}})
+	require.NoError(t, err)
+	require.Contains(t, l.buckets, "busy")
+	require.Contains(t, l.buckets, "new")
+	require.NotContains(t, l.buckets, "idle")
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	cfg := RateLimitConfig{
+		Default: Limit{Rate: 100, Burst: 100},
+		Routes:  map[string]Limit{"/api/v1/getUserBalance": {Rate: 0.5, Burst: 1}},
+	}
+	s := New(logrus.New(), "", "test", stubApp{}, WithRateLimiter(cfg, NewMemoryLimiter()))
+
+	send := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/getUserBalance", bytes.NewBufferString(`{"userID":1}`))
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, r)
+		return w
+	}
+	require.Equal(t, http.StatusOK, send().Code)
+	w := send()
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "2", w.Header().Get("Retry-After"))
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/report"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const ScopeReadReports Scope = "reports:read"
+
+type ReportJobs interface {
+	Create(ctx context.Context, data models.ReportJob) (models.ReportJob, error)
+	Get(ctx context.Context, id int64) (models.ReportJob, error)
+}
+
+// ReportJobRequest asks for a report of a month (YYYY-MM, UTC) or of any
+// period [from, to).
+type ReportJobRequest struct {
+	Kind      string     `json:"kind"`
+	Format    string     `json:"format"`
+	Month     string     `json:"month"`
+	From      *time.Time `json:"from"`
+	To        *time.Time `json:"to"`
+	Delimiter string     `json:"delimiter"`
+	Encoding  string     `json:"encoding"`
+}
+
+// report streams a monthly report, see reportRequest for parameters.
+func (s *Server) report(w http.ResponseWriter, r *http.Request) {
+	req, err := reportRequest(r)
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.kind != report.KindRevenue && req.kind != report.KindOrders {
+		s.writeResponse(w, http.StatusNotFound, fmt.Errorf("%w: %q", report.ErrUnknownKind, req.kind))
+		return
+	}
+	pw := &pendingWriter{w: w}
+	rw, err := report.New(req.format, pw, req.opts)
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	err = report.Build(r.Context(), s.app, req.kind, req.from, req.to, startingWriter{ReportWriter: rw, pw: pw, start: func() {
+		w.Header().Set("Content-Type", report.ContentType(req.format))
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", req.filename()))
+	}})
+	switch {
+	case err != nil && !pw.started:
+		s.log.Warnf("err during building %s report: %v", req.kind, err)
+		s.writeResponse(w, storeErrorStatus(err), err)
+	case err != nil:
+		// The status has been sent with the first row, the client gets a
+		// truncated file.
+		s.log.Warnf("err during building %s report: %v", req.kind, err)
+	}
+}
+
+// pendingWriter holds what a report writes until its first row, so a
+// report failing before it gets an error status instead of 200.
+type pendingWriter struct {
+	w       http.ResponseWriter
+	buf     bytes.Buffer
+	started bool
+}
+
+func (p *pendingWriter) Write(b []byte) (int, error) {
+	if p.started {
+		return p.w.Write(b)
+	}
+	return p.buf.Write(b)
+}
+
+// startingWriter sends the held output with the first row or on Close.
+type startingWriter struct {
+	report.ReportWriter
+	pw    *pendingWriter
+	start func()
+}
+
+func (s startingWriter) begin() error {
+	if s.pw.started {
+		return nil
+	}
+	s.start()
+	s.pw.started = true
+	_, err := s.pw.w.Write(s.pw.buf.Bytes())
+	s.pw.buf.Reset()
+	return err
+}
+
+func (s startingWriter) WriteRow(values []any) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	return s.ReportWriter.WriteRow(values)
+}
+
+func (s startingWriter) Close() error {
+	if err := s.ReportWriter.Close(); err != nil {
+		return err
+	}
+	return s.begin()
+}
+
+func (s *Server) createReportJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var data ReportJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	job := models.ReportJob{
+		Kind:        data.Kind,
+		Format:      data.Format,
+		Delimiter:   data.Delimiter,
+		Encoding:    data.Encoding,
+		RequestedBy: clientID(ctx),
+	}
+	if job.Format == "" {
+		job.Format = report.FormatCSV
+	}
+	switch {
+	case data.Month != "":
+		month, err := time.Parse("2006-01", data.Month)
+		if err != nil {
+			s.writeResponse(w, http.StatusBadRequest, fmt.Errorf("month must be YYYY-MM"))
+			return
+		}
+		job.From, job.To = month, month.AddDate(0, 1, 0)
+	case data.From != nil && data.To != nil:
+		job.From, job.To = *data.From, *data.To
+	default:
+		s.writeResponse(w, http.StatusBadRequest, fmt.Errorf("month or from and to are required"))
+		return
+	}
+	resp, err := s.reports.Create(ctx, job)
+	if err != nil {
+		s.writeErrorV2(w, "creating report job", err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/v2/reports/jobs/%d", resp.ID))
+	s.writeResponse(w, http.StatusAccepted, resp)
+}
+
+func (s *Server) getReportJob(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	resp, err := s.reports.Get(r.Context(), int64(id))
+	if err != nil {
+		s.writeErrorV2(w, "getting report job", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+type reportParams struct {
+	kind     string
+	format   string
+	from, to time.Time
+	opts     report.Options
+}
+
+func (p reportParams) filename() string {
+	return fmt.Sprintf("%s-%s.%s", p.kind, p.from.Format("2006-01"), p.format)
+}
+
+// reportRequest reads the month (YYYY-MM, UTC), format (csv, jsonl, xlsx or
+// parquet, csv by default), and for CSV delimiter and encoding query
+// parameters.
+func reportRequest(r *http.Request) (reportParams, error) {
+	q := r.URL.Query()
+	p := reportParams{kind: chi.URLParam(r, "kind"), format: q.Get("format")}
+	if p.format == "" {
+		p.format = report.FormatCSV
+	}
+	month, err := time.Parse("2006-01", q.Get("month"))
+	if err != nil {
+		return reportParams{}, fmt.Errorf("month must be YYYY-MM")
+	}
+	p.from, p.to = month, month.AddDate(0, 1, 0)
+	if d := q.Get("delimiter"); d != "" {
+		if d == "tab" {
+			d = "\t"
+		}
+		if utf8.RuneCountInString(d) != 1 {
+			return reportParams{}, fmt.Errorf("delimiter must be one character")
+		}
+		p.opts.Delimiter, _ = utf8.DecodeRuneInString(d)
+	}
+	p.opts.Encoding = q.Get("encoding")
+	return p, nil
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type revenueApp struct {
+	stubApp
+	from, to *time.Time
+}
+
+func (a revenueApp) RevenueByService(_ context.Context, from, to time.Time, fn func(models.ServiceRevenue) error) error {
+	*a.from, *a.to = from, to
+	for _, r := range []models.ServiceRevenue{{ServiceID: 1, Orders: 2, Revenue: 300}, {ServiceID: 4, Orders: 1, Revenue: 50}} {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type failingRevenueApp struct {
+	stubApp
+	after int
+}
+
+// RevenueByService fails after passing a.after rows.
+func (a failingRevenueApp) RevenueByService(_ context.Context, _, _ time.Time, fn func(models.ServiceRevenue) error) error {
+	for i := 0; i < a.after; i++ {
+		if err := fn(models.ServiceRevenue{ServiceID: i + 1}); err != nil {
+			return err
+		}
+	}
+	return pgstore.ErrTimeout
+}
+
+func TestReportFailure(t *testing.T) {
+	send := func(app App) *httptest.ResponseRecorder {
+		s := New(logrus.New(), "", "test", app)
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v2/reports/revenue?month=2023-03", nil))
+		return w
+	}
+
+	w := send(failingRevenueApp{})
+	require.Equal(t, http.StatusGatewayTimeout, w.Code)
+	require.Empty(t, w.Header().Get("Content-Disposition"))
+	require.Contains(t, w.Body.String(), pgstore.ErrTimeout.Error())
+
+	// Once rows are sent the status can't change, the file is truncated.
+	w = send(failingRevenueApp{after: 1})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, `attachment; filename="revenue-2023-03.csv"`, w.Header().Get("Content-Disposition"))
+}
+
+func TestReport(t *testing.T) {
+	app := revenueApp{from: new(time.Time), to: new(time.Time)}
+	s := New(logrus.New(), "", "test", app)
+	send := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := send("/api/v2/reports/revenue?month=2023-03")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "serviceID;revenue;orders\n1;300;2\n4;50;1\n", w.Body.String())
+	require.Equal(t, `attachment; filename="revenue-2023-03.csv"`, w.Header().Get("Content-Disposition"))
+	require.Equal(t, time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC), *app.from)
+	require.Equal(t, time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC), *app.to)
+
+	w = send("/api/v2/reports/revenue?month=2023-03&format=jsonl")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `{"orders":2,"revenue":300,"serviceID":1}`)
+
+	w = send("/api/v2/reports/revenue?month=2023-03&delimiter=%2C&encoding=windows-1251")
+	require.Equal(t, "serviceID,revenue,orders\n1,300,2\n4,50,1\n", w.Body.String())
+
+	require.Equal(t, http.StatusBadRequest, send("/api/v2/reports/revenue?month=March").Code)
+	require.Equal(t, http.StatusBadRequest, send("/api/v2/reports/revenue?month=2023-03&format=pdf").Code)
+	require.Equal(t, http.StatusBadRequest, send("/api/v2/reports/revenue?month=2023-03&delimiter=ab").Code)
+	require.Equal(t, http.StatusNotFound, send("/api/v2/reports/taxes?month=2023-03").Code)
+}
+
+type memoryReportJobs struct {
+	jobs []models.ReportJob
+}
+
+func (m *memoryReportJobs) Create(_ context.Context, data models.ReportJob) (models.ReportJob, error) {
+	data.ID = int64(len(m.jobs) + 1)
+	data.Status = models.ReportJobPending
+	m.jobs = append(m.jobs, data)
+	return data, nil
+}
+
+func (m *memoryReportJobs) Get(_ context.Context, id int64) (models.ReportJob, error) {
+	if id > int64(len(m.jobs)) {
+		return models.ReportJob{}, pgstore.ErrReportJobNotExists
+	}
+	return m.jobs[id-1], nil
+}
+
+func TestReportJobs(t *testing.T) {
+	jobs := &memoryReportJobs{}
+	s := New(logrus.New(), "", "test", stubApp{}, WithReportJobs(jobs, http.NotFoundHandler()))
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, httptest.NewRequest(method, target, bytes.NewBufferString(body)))
+		return w
+	}
+
+	w := send(http.MethodPost, "/api/v2/reports", `{"kind":"orders","format":"parquet","from":"2022-01-01T00:00:00Z","to":"2023-01-01T00:00:00Z"}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	require.Equal(t, "/api/v2/reports/jobs/1", w.Header().Get("Location"))
+	require.Equal(t, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), jobs.jobs[0].To)
+
+	w = send(http.MethodPost, "/api/v2/reports", `{"kind":"revenue","month":"2023-03"}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	require.Equal(t, "csv", jobs.jobs[1].Format)
+	require.Equal(t, time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC), jobs.jobs[1].To)
+
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/api/v2/reports", `{"kind":"revenue"}`).Code)
+
+	w = send(http.MethodGet, "/api/v2/reports/jobs/2", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"status":"PENDING"`)
+	require.Equal(t, http.StatusNotFound, send(http.MethodGet, "/api/v2/reports/jobs/3", "").Code)
+	require.Equal(t, http.StatusNotFound, send(http.MethodGet, "/files/reports/1/x.csv", "").Code)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+)
+
+var statementColumns = []string{
+	"userID", "walletID", "from", "to", "openingBalance", "credits", "debits", "closingBalance",
+	"openingReserved", "holds", "releases", "closingReserved",
+}
+
+var statementEntryColumns = []string{
+	"id", "createdAt", "kind", "orderID", "reference", "balanceDelta", "reservedDelta", "balance", "reserved",
+}
+
+// walletStatement serves the statement of the user's wallet with its
+// movements as JSON or, with format=csv, as CSV with a running balance.
+func (s *Server) walletStatement(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathID(r, "userID")
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	filter, err := statementFilter(r)
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	filter.UserID = userID
+	resp, err := s.app.Statement(r.Context(), filter)
+	if err != nil {
+		s.writeErrorV2(w, "getting statement", err)
+		return
+	}
+	if !wantsCSV(r) {
+		s.writeResponse(w, http.StatusOK, resp)
+		return
+	}
+
+	cw := csvWriter(w, fmt.Sprintf("statement-%d-%s-%s.csv", userID,
+		resp.From.Format(time.DateOnly), resp.To.Format(time.DateOnly)))
+	balance, reserved := resp.OpeningBalance, resp.OpeningReserved
+	rows := [][]string{statementEntryColumns, {"", resp.From.Format(time.RFC3339), "OPENING", "", "", "", "", itoa(balance), itoa(reserved)}}
+	for _, e := range resp.Entries {
+		balance += e.BalanceDelta
+		reserved += e.ReservedDelta
+		rows = append(rows, []string{
+			strconv.FormatInt(e.ID, 10), e.CreatedAt.Format(time.RFC3339Nano), e.Kind, itoa(e.OrderID), e.Reference,
+			itoa(e.BalanceDelta), itoa(e.ReservedDelta), itoa(balance), itoa(reserved),
+		})
+	}
+	rows = append(rows, []string{"", resp.To.Format(time.RFC3339), "CLOSING", "", "", "", "", itoa(resp.ClosingBalance), itoa(resp.ClosingReserved)})
+	if err = cw.WriteAll(rows); err != nil {
+		s.log.Warnf("write statement failed: %v", err)
+	}
+}
+
+// statements exports statements of all wallets as JSON or CSV.
+func (s *Server) statements(w http.ResponseWriter, r *http.Request) {
+	filter, err := statementFilter(r)
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	resp, err := s.app.Statements(r.Context(), filter)
+	if err != nil {
+		s.writeErrorV2(w, "getting statements", err)
+		return
+	}
+	if !wantsCSV(r) {
+		s.writeResponse(w, http.StatusOK, resp)
+		return
+	}
+
+	cw := csvWriter(w, fmt.Sprintf("statements-%s-%s.csv",
+		filter.From.Format(time.DateOnly), filter.To.Format(time.DateOnly)))
+	rows := [][]string{statementColumns}
+	for _, st := range resp {
+		rows = append(rows, []string{
+			itoa(st.UserID), itoa(st.WalletID), st.From.Format(time.RFC3339), st.To.Format(time.RFC3339),
+			itoa(st.OpeningBalance), itoa(st.Credits), itoa(st.Debits), itoa(st.ClosingBalance),
+			itoa(st.OpeningReserved), itoa(st.Holds), itoa(st.Releases), itoa(st.ClosingReserved),
+		})
+	}
+	if err = cw.WriteAll(rows); err != nil {
+		s.log.Warnf("write statements failed: %v", err)
+	}
+}
+
+// statementFilter reads required from and to query parameters.
+func statementFilter(r *http.Request) (models.StatementFilter, error) {
+	from, to, err := timeRange(r)
+	if err != nil {
+		return models.StatementFilter{}, err
+	}
+	if from == nil || to == nil || !from.Before(*to) {
+		return models.StatementFilter{}, fmt.Errorf("from and to are required and from must be before to")
+	}
+	return models.StatementFilter{From: *from, To: *to}, nil
+}
+
+func wantsCSV(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "csv" || r.Header.Get("Accept") == "text/csv"
+}
+
+func csvWriter(w http.ResponseWriter, filename string) *csv.Writer {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+	return csv.NewWriter(w)
+}
+
+func itoa(v int) string {
+	return strconv.Itoa(v)
+}
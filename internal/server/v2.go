@@ -0,0 +1,353 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/reportjob"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// IdempotencyKeyHeader is used as transaction id when the body has none.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+type CreditRequest struct {
+	TransactionID string `json:"transactionID"`
+	Amount        int    `json:"amount"`
+}
+
+type RecognizeRequest struct {
+	TransactionID string `json:"transactionID"`
+	Status        string `json:"status"`
+}
+
+// v2Routes serves the same operations as v1 as resources: ids are in the
+// path, reads are bodiless GETs and errors have matching status codes.
+func (s *Server) v2Routes(r chi.Router) {
+	r.With(s.requireScope(ScopeReadBalance), s.rateLimit).Get("/wallets/{userID}", s.getWalletV2)
+	r.With(s.requireScope(ScopeAddFunds), s.rateLimit).Post("/wallets/{userID}/credits", s.creditWalletV2)
+	r.With(s.requireScope(ScopeReadBalance), s.rateLimit).Get("/wallets/{userID}/history", s.walletHistoryV2)
+	r.With(s.requireScope(ScopeReadAudit), s.rateLimit).Get("/wallets/{userID}/history:verify", s.verifyHistoryV2)
+	r.With(s.requireScope(ScopeReadBalance), s.rateLimit).Get("/wallets/{userID}/statement", s.walletStatement)
+	r.With(s.requireScope(ScopeReadBalance), s.rateLimit).Get("/statements", s.statements)
+	r.With(s.requireScope(ScopeReadBalance), s.rateLimit).Get("/orders", s.listOrdersV2)
+	r.With(s.requireScope(ScopeReadBalance), s.rateLimit).Get("/orders/{orderID}", s.getOrderV2)
+	r.With(s.requireScope(ScopeReserveFunds), s.rateLimit).Post("/orders", s.createOrderV2)
+	r.With(s.requireScope(ScopeRecognizeRevenue), s.rateLimit).Post("/orders/{orderID}:recognize", s.recognizeOrderV2)
+	r.With(s.requireScope(ScopeReadReports), s.rateLimit).Get("/reports/{kind}", s.report)
+	r.With(s.requireScope(ScopeReadReports), s.rateLimit).Get("/analytics/services", s.analytics(models.AnalyticsByService))
+	r.With(s.requireScope(ScopeReadReports), s.rateLimit).Get("/analytics/users", s.analytics(models.AnalyticsByUser))
+	if s.reports != nil {
+		r.With(s.requireScope(ScopeReadReports), s.rateLimit).Post("/reports", s.createReportJob)
+		r.With(s.requireScope(ScopeReadReports), s.rateLimit).Get("/reports/jobs/{id}", s.getReportJob)
+	}
+	r.Route("/adjustments", s.adjustmentRoutes)
+	if s.auditLog != nil {
+		r.With(s.requireScope(ScopeReadAudit), s.rateLimit).Get("/audit", s.auditRecords)
+	}
+}
+
+func (s *Server) getWalletV2(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathID(r, "userID")
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	data := models.BalanceRequest{UserID: userID}
+	if v := r.URL.Query().Get("asOf"); v != "" {
+		asOf, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			s.writeResponse(w, http.StatusBadRequest, fmt.Errorf("asOf must be RFC 3339 time"))
+			return
+		}
+		data.AsOf = &asOf
+	}
+	ctx := r.Context()
+	if data.AsOf == nil {
+		// The ETag goes back in If-Match, a stale replica version would fail
+		// the next write.
+		ctx = pgstore.ReadYourWrites(ctx)
+	}
+	resp, err := s.app.WalletBalance(ctx, data)
+	if err != nil {
+		s.writeErrorV2(w, "getting wallet", err)
+		return
+	}
+	if data.AsOf == nil {
+		setETag(w, resp.Version)
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+func (s *Server) creditWalletV2(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID, err := pathID(r, "userID")
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	version, err := ifMatch(r)
+	if err != nil {
+		s.writeResponse(w, http.StatusPreconditionFailed, err)
+		return
+	}
+	var data CreditRequest
+	if err = json.NewDecoder(r.Body).Decode(&data); err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if data.Amount <= 0 {
+		s.writeResponse(w, http.StatusUnprocessableEntity, fmt.Errorf("amount must be positive"))
+		return
+	}
+	resp, err := s.app.AddFunds(ctx, models.AddFundsRequest{
+		TransactionID:   transactionID(r, data.TransactionID),
+		UserID:          userID,
+		Balance:         data.Amount,
+		ClientID:        clientID(ctx),
+		ExpectedVersion: version,
+	})
+	if err != nil {
+		s.writeErrorV2(w, "crediting wallet", err)
+		return
+	}
+	setETag(w, resp.Version)
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+func (s *Server) walletHistoryV2(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathID(r, "userID")
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	filter := models.HistoryFilter{UserID: userID}
+	if filter.Limit, filter.Offset, err = pagination(r); err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if filter.From, filter.To, err = timeRange(r); err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	resp, err := s.app.History(r.Context(), filter)
+	if err != nil {
+		s.writeErrorV2(w, "getting history", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+// verifyHistoryV2 recomputes the hash chain of the wallet history and
+// reports the first broken entry.
+func (s *Server) verifyHistoryV2(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID, err := pathID(r, "userID")
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	wallet, err := s.app.WalletBalance(ctx, models.BalanceRequest{UserID: userID})
+	if err != nil {
+		s.writeErrorV2(w, "verifying history", err)
+		return
+	}
+	resp, err := s.app.VerifyChain(ctx, wallet.ID)
+	if err != nil {
+		s.writeErrorV2(w, "verifying history", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+func (s *Server) getOrderV2(w http.ResponseWriter, r *http.Request) {
+	orderID, err := pathID(r, "orderID")
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	resp, err := s.app.Order(r.Context(), orderID)
+	if err != nil {
+		s.writeErrorV2(w, "getting order", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+func (s *Server) listOrdersV2(w http.ResponseWriter, r *http.Request) {
+	filter, err := ordersFilter(r)
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	resp, err := s.app.Orders(r.Context(), filter)
+	if err != nil {
+		s.writeErrorV2(w, "listing orders", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+// ordersFilter reads walletID, serviceID, status, from, to (RFC 3339),
+// limit and offset query parameters.
+func ordersFilter(r *http.Request) (models.OrdersFilter, error) {
+	var filter models.OrdersFilter
+	var err error
+	if filter.Limit, filter.Offset, err = pagination(r); err != nil {
+		return models.OrdersFilter{}, err
+	}
+	q := r.URL.Query()
+	for name, dst := range map[string]*int{"walletID": &filter.WalletID, "serviceID": &filter.ServiceID} {
+		if v := q.Get(name); v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil || *dst <= 0 {
+				return models.OrdersFilter{}, fmt.Errorf("%s must be a positive integer", name)
+			}
+		}
+	}
+	switch filter.Status = q.Get("status"); filter.Status {
+	case "", "REQUESTED", "DONE", "CANCELED":
+	default:
+		return models.OrdersFilter{}, fmt.Errorf("status must be REQUESTED, DONE or CANCELED")
+	}
+	if filter.From, filter.To, err = timeRange(r); err != nil {
+		return models.OrdersFilter{}, err
+	}
+	return filter, nil
+}
+
+// timeRange reads optional from and to query parameters in RFC 3339.
+func timeRange(r *http.Request) (from *time.Time, to *time.Time, err error) {
+	for name, dst := range map[string]**time.Time{"from": &from, "to": &to} {
+		if v := r.URL.Query().Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s must be RFC 3339 time", name)
+			}
+			*dst = &t
+		}
+	}
+	return from, to, nil
+}
+
+func (s *Server) createOrderV2(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var data models.ReservedFundsRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if data.Price <= 0 {
+		s.writeResponse(w, http.StatusUnprocessableEntity, fmt.Errorf("price must be positive"))
+		return
+	}
+	version, err := ifMatch(r)
+	if err != nil {
+		s.writeResponse(w, http.StatusPreconditionFailed, err)
+		return
+	}
+	data.TransactionID = transactionID(r, data.TransactionID)
+	data.ClientID = clientID(ctx)
+	data.ExpectedVersion = version
+	resp, err := s.app.ReserveFunds(ctx, data)
+	if err != nil {
+		s.writeErrorV2(w, "creating order", err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/v2/orders/%d", resp.OrderID))
+	s.writeResponse(w, http.StatusCreated, resp)
+}
+
+func (s *Server) recognizeOrderV2(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	orderID, err := pathID(r, "orderID")
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	version, err := ifMatch(r)
+	if err != nil {
+		s.writeResponse(w, http.StatusPreconditionFailed, err)
+		return
+	}
+	var data RecognizeRequest
+	if err = json.NewDecoder(r.Body).Decode(&data); err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if data.Status != "DONE" && data.Status != "CANCELED" {
+		s.writeResponse(w, http.StatusUnprocessableEntity, pgstore.ErrInvalidStatus)
+		return
+	}
+	// The store checks the order and changes its wallet in one transaction.
+	resp, err := s.app.RecognizeRevenue(ctx, models.RecognizeRevenueRequest{
+		TransactionID:   transactionID(r, data.TransactionID),
+		OrderID:         orderID,
+		Status:          data.Status,
+		ClientID:        clientID(ctx),
+		ExpectedVersion: version,
+	})
+	if err != nil {
+		s.writeErrorV2(w, "recognizing order", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+// writeErrorV2 maps domain errors to status codes: missing resources to
+// 404, state and transaction conflicts to 409, stale If-Match to 412,
+// rejected amounts to 422 and database timeouts to 504.
+func (s *Server) writeErrorV2(w http.ResponseWriter, op string, err error) {
+	switch {
+	case errors.Is(err, pgstore.ErrVersionMismatch):
+		s.writeResponse(w, http.StatusPreconditionFailed, err)
+	case errors.Is(err, pgstore.ErrUserNotExists), errors.Is(err, pgstore.ErrOrderNotExists),
+		errors.Is(err, pgstore.ErrAdjustmentNotExists), errors.Is(err, pgstore.ErrReportJobNotExists):
+		s.writeResponse(w, http.StatusNotFound, err)
+	case errors.Is(err, pgstore.ErrOrderAlreadyAdded), errors.Is(err, pgstore.ErrOrderAlreadyProcessed),
+		errors.Is(err, pgstore.ErrDuplicateTransaction), errors.Is(err, pgstore.ErrAdjustmentProcessed),
+		errors.Is(err, pgstore.ErrTxConflict):
+		s.writeResponse(w, http.StatusConflict, err)
+	case errors.Is(err, pgstore.ErrSameApprover):
+		s.writeResponse(w, http.StatusForbidden, err)
+	case errors.Is(err, pgstore.ErrNotEnoughFunds), errors.Is(err, pgstore.ErrInvalidStatus),
+		errors.Is(err, pgstore.ErrInvalidAdjustment), errors.Is(err, reportjob.ErrInvalidJob):
+		s.writeResponse(w, http.StatusUnprocessableEntity, err)
+	default:
+		s.log.Warnf("err during %s: %v", op, err)
+		s.writeResponse(w, storeErrorStatus(err), err)
+	}
+}
+
+// storeErrorStatus is 504 when the database didn't answer in time, 503
+// when the query was canceled, e.g. on shutdown, and 500 otherwise.
+func storeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, pgstore.ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, pgstore.ErrCanceled):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func pathID(r *http.Request, name string) (int, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, name))
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+	return id, nil
+}
+
+func transactionID(r *http.Request, id string) string {
+	if id == "" {
+		return r.Header.Get(IdempotencyKeyHeader)
+	}
+	return id
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/memstore"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/service"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type ordersApp struct {
+	stubApp
+	orders map[int]models.EventsBodyResponse
+}
+
+func (a ordersApp) Order(_ context.Context, orderID int) (models.EventsBodyResponse, error) {
+	order, ok := a.orders[orderID]
+	if !ok {
+		return models.EventsBodyResponse{}, pgstore.ErrOrderNotExists
+	}
+	return order, nil
+}
+
+func (a ordersApp) RecognizeRevenue(_ context.Context, data models.RecognizeRevenueRequest) (models.EventsBodyResponse, error) {
+	order, ok := a.orders[data.OrderID]
+	switch {
+	case !ok:
+		return models.EventsBodyResponse{}, pgstore.ErrOrderNotExists
+	case order.Status != "REQUESTED":
+		return models.EventsBodyResponse{}, pgstore.ErrOrderAlreadyProcessed
+	}
+	order.Status = data.Status
+	order.RecognizedBy = data.TransactionID
+	return order, nil
+}
+
+func TestV2(t *testing.T) {
+	app := ordersApp{orders: map[int]models.EventsBodyResponse{
+		1: {OrderID: 1, WalletID: 3, Status: "REQUESTED"},
+		2: {OrderID: 2, WalletID: 3, Status: "DONE"},
+	}}
+	s := New(logrus.New(), "", "test", app)
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		r.Header.Set(IdempotencyKeyHeader, "key")
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send(http.MethodGet, "/api/v2/wallets/7", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"userID":7`)
+	require.NotEmpty(t, w.Header().Get("ETag"))
+	w = send(http.MethodGet, "/api/v2/wallets/7?asOf=2023-03-03T00:00:00Z", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"asOf":"2023-03-03T00:00:00Z"`)
+	require.Empty(t, w.Header().Get("ETag"))
+	require.Equal(t, http.StatusBadRequest, send(http.MethodGet, "/api/v2/wallets/7?asOf=yesterday", "").Code)
+	require.Equal(t, http.StatusBadRequest, send(http.MethodGet, "/api/v2/wallets/abc", "").Code)
+	require.Equal(t, http.StatusNotFound, send(http.MethodGet, "/api/v2/orders/5", "").Code)
+
+	w = send(http.MethodPost, "/api/v2/orders/1:recognize", `{"status":"DONE"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"status":"DONE"`)
+	require.Contains(t, w.Body.String(), `"recognizedBy":"key"`)
+	require.Equal(t, http.StatusConflict, send(http.MethodPost, "/api/v2/orders/2:recognize", `{"status":"DONE"}`).Code)
+	require.Equal(t, http.StatusNotFound, send(http.MethodPost, "/api/v2/orders/5:recognize", `{"status":"DONE"}`).Code)
+	require.Equal(t, http.StatusUnprocessableEntity, send(http.MethodPost, "/api/v2/orders/1:recognize", `{"status":"LOST"}`).Code)
+}
+
+type listApp struct {
+	stubApp
+	filter *models.OrdersFilter
+}
+
+func (a listApp) Orders(_ context.Context, filter models.OrdersFilter) ([]models.EventsBodyResponse, error) {
+	*a.filter = filter
+	return []models.EventsBodyResponse{}, nil
+}
+
+func TestV2ListOrders(t *testing.T) {
+	app := listApp{filter: new(models.OrdersFilter)}
+	s := New(logrus.New(), "", "test", app)
+	send := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := send("/api/v2/orders?walletID=3&status=REQUESTED&from=2022-11-01T00:00:00Z&limit=10&offset=20")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `[]`, w.Body.String())
+	from := time.Date(2022, 11, 1, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, models.OrdersFilter{WalletID: 3, Status: "REQUESTED", From: &from, Limit: 10, Offset: 20}, *app.filter)
+
+	require.Equal(t, http.StatusBadRequest, send("/api/v2/orders?status=LOST").Code)
+	require.Equal(t, http.StatusBadRequest, send("/api/v2/orders?to=yesterday").Code)
+}
+
+func TestIfMatch(t *testing.T) {
+	for header, want := range map[string]int64{"": 0, "*": 0, `"7"`: 7} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("If-Match", header)
+		version, err := ifMatch(r)
+		require.NoError(t, err)
+		require.Equal(t, want, version)
+	}
+	for _, header := range []string{`7`, `W/"7"`, `"abc"`} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("If-Match", header)
+		_, err := ifMatch(r)
+		require.ErrorIs(t, err, pgstore.ErrVersionMismatch)
+	}
+
+	s := New(logrus.New(), "", "test", stubApp{})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/v2/orders/1:recognize", bytes.NewBufferString(`{"status":"DONE"}`))
+	r.Header.Set("If-Match", `"x"`)
+	s.server.Handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusPreconditionFailed, w.Code)
+	require.Contains(t, w.Body.String(), `"code":"VERSION_MISMATCH"`)
+
+	s = New(logrus.New(), "", "test", service.New(logrus.New(), memstore.New()))
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/api/v2/wallets/5/credits", bytes.NewBufferString(`{"amount":100}`))
+	r.Header.Set("If-Match", `"1"`)
+	s.server.Handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+type chainApp struct {
+	stubApp
+}
+
+func (chainApp) VerifyChain(_ context.Context, walletID int) (models.ChainReport, error) {
+	return models.ChainReport{WalletID: walletID, Checked: 2, BrokenEntryID: 3, Reason: "hash doesn't match contents"}, nil
+}
+
+func TestV2VerifyHistory(t *testing.T) {
+	s := New(logrus.New(), "", "test", chainApp{})
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v2/wallets/7/history:verify", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"valid":false`)
+	require.Contains(t, w.Body.String(), `"brokenEntryID":3`)
+}
+
+type statementApp struct {
+	stubApp
+}
+
+func (statementApp) Statement(_ context.Context, filter models.StatementFilter) (models.Statement, error) {
+	return models.Statement{
+		UserID: filter.UserID, WalletID: 3, From: filter.From, To: filter.To,
+		OpeningBalance: 100, Credits: 50, Debits: 30, Holds: 30, Releases: 30, ClosingBalance: 120,
+		Entries: []models.HistoryEntry{
+			{ID: 1, Kind: models.HistoryCredit, BalanceDelta: 50, Reference: "tx-1"},
+			{ID: 2, Kind: models.HistoryReserve, ReservedDelta: 30, OrderID: 9},
+			{ID: 3, Kind: models.HistoryDebit, BalanceDelta: -30, ReservedDelta: -30, OrderID: 9},
+		},
+	}, nil
+}
+
+func TestV2Statement(t *testing.T) {
+	s := New(logrus.New(), "", "test", statementApp{})
+	send := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := send("/api/v2/wallets/7/statement?from=2023-03-01T00:00:00Z&to=2023-04-01T00:00:00Z")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"closingBalance":120`)
+
+	w = send("/api/v2/wallets/7/statement?from=2023-03-01T00:00:00Z&to=2023-04-01T00:00:00Z&format=csv")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	require.Equal(t, `id,createdAt,kind,orderID,reference,balanceDelta,reservedDelta,balance,reserved
+,2023-03-01T00:00:00Z,OPENING,,,,,100,0
+1,0001-01-01T00:00:00Z,CREDIT,0,tx-1,50,0,150,0
+2,0001-01-01T00:00:00Z,RESERVE,9,,0,30,150,30
+3,0001-01-01T00:00:00Z,DEBIT,9,,-30,-30,120,0
+,2023-04-01T00:00:00Z,CLOSING,,,,,120,0
+`, w.Body.String())
+
+	require.Equal(t, http.StatusBadRequest, send("/api/v2/wallets/7/statement?from=2023-03-01T00:00:00Z").Code)
+	require.Equal(t, http.StatusBadRequest, send("/api/v2/statements?from=2023-04-01T00:00:00Z&to=2023-03-01T00:00:00Z").Code)
+}
+
+type failingApp struct {
+	stubApp
+	err error
+}
+
+func (a failingApp) Orders(context.Context, models.OrdersFilter) ([]models.EventsBodyResponse, error) {
+	return nil, a.err
+}
+
+func TestV2StoreErrors(t *testing.T) {
+	for err, code := range map[error]int{
+		fmt.Errorf("service: %w", pgstore.ErrTimeout):    http.StatusGatewayTimeout,
+		fmt.Errorf("service: %w", pgstore.ErrCanceled):   http.StatusServiceUnavailable,
+		fmt.Errorf("service: %w", pgstore.ErrTxConflict): http.StatusConflict,
+		fmt.Errorf("service: broken"):                    http.StatusInternalServerError,
+	} {
+		s := New(logrus.New(), "", "test", failingApp{err: err})
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v2/orders", nil))
+		require.Equal(t, code, w.Code, err)
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/webhook"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const ScopeManageWebhooks Scope = "webhooks:manage"
+
+type Webhooks interface {
+	Create(ctx context.Context, data models.WebhookSubscription) (models.WebhookSubscription, error)
+	List(ctx context.Context) ([]models.WebhookSubscription, error)
+	Get(ctx context.Context, id int) (models.WebhookSubscription, error)
+	Update(ctx context.Context, data models.WebhookSubscription) (models.WebhookSubscription, error)
+	Delete(ctx context.Context, id int) error
+	Deliveries(ctx context.Context, subscriptionID int, status string, limit, offset int) ([]models.WebhookDelivery, error)
+}
+
+func (s *Server) webhookRoutes(r chi.Router) {
+	r.Use(s.requireScope(ScopeManageWebhooks), s.rateLimit)
+	r.Post("/", s.createWebhookHandler)
+	r.Get("/", s.listWebhooksHandler)
+	r.Get("/{id}", s.getWebhookHandler)
+	r.Put("/{id}", s.updateWebhookHandler)
+	r.Delete("/{id}", s.deleteWebhookHandler)
+	r.Get("/{id}/deliveries", s.webhookDeliveriesHandler)
+}
+
+func (s *Server) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var data models.WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	data.CreatedBy = clientID(ctx)
+	resp, err := s.webhooks.Create(ctx, data)
+	if err != nil {
+		s.writeWebhookError(w, "create webhook", err)
+		return
+	}
+	s.writeResponse(w, http.StatusCreated, resp)
+}
+
+func (s *Server) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	resp, err := s.webhooks.List(r.Context())
+	if err != nil {
+		s.writeWebhookError(w, "list webhooks", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+func (s *Server) getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	resp, err := s.webhooks.Get(r.Context(), id)
+	if err != nil {
+		s.writeWebhookError(w, "get webhook", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+func (s *Server) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	var data models.WebhookSubscription
+	if err = json.NewDecoder(r.Body).Decode(&data); err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	data.ID = id
+	resp, err := s.webhooks.Update(r.Context(), data)
+	if err != nil {
+		s.writeWebhookError(w, "update webhook", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+func (s *Server) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if err = s.webhooks.Delete(r.Context(), id); err != nil {
+		s.writeWebhookError(w, "delete webhook", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, offset, err := pagination(r)
+	if err != nil {
+		s.writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	resp, err := s.webhooks.Deliveries(r.Context(), id, r.URL.Query().Get("status"), limit, offset)
+	if err != nil {
+		s.writeWebhookError(w, "get webhook deliveries", err)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+func (s *Server) writeWebhookError(w http.ResponseWriter, op string, err error) {
+	switch {
+	case errors.Is(err, webhook.ErrInvalidSubscription):
+		s.writeResponse(w, http.StatusBadRequest, err)
+	case errors.Is(err, pgstore.ErrWebhookNotExists):
+		s.writeResponse(w, http.StatusNotFound, err)
+	default:
+		s.log.Warnf("err during %s: %v", op, err)
+		s.writeResponse(w, storeErrorStatus(err), err)
+	}
+}
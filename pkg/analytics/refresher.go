@@ -0,0 +1,54 @@
+package analytics
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Store interface {
+	RefreshAnalytics(ctx context.Context, to time.Time) (int, error)
+}
+
+// Refresher keeps the analytics rollups up to date, every interval it
+// rolls up orders recognized since the previous run.
+type Refresher struct {
+	log      *logrus.Entry
+	store    Store
+	interval time.Duration
+	// lag gives transactions that recognize orders time to commit.
+	lag time.Duration
+	now func() time.Time
+}
+
+func New(log *logrus.Logger, store Store, interval time.Duration) *Refresher {
+	return &Refresher{
+		log:      log.WithField("module", "analytics"),
+		store:    store,
+		interval: interval,
+		lag:      time.Minute,
+		now:      time.Now,
+	}
+}
+
+func (r *Refresher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	r.log.Infof("starting analytics refresh every %s", r.interval)
+	for {
+		to := r.now().Add(-r.lag)
+		n, err := r.store.RefreshAnalytics(ctx, to)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			r.log.Warnf("err during refreshing analytics to %s: %v", to, err)
+		case err == nil && n > 0:
+			r.log.Debugf("rolled up %d orders to %s", n, to)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Package archive keeps partitions of events ahead of time and moves
+// closed ones out of the database.
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/blob"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Store interface {
+	CreatePartitions(ctx context.Context, from, to time.Time) (int, error)
+	ClosedPartitions(ctx context.Context, before time.Time) ([]models.EventPartition, error)
+	ExportEvents(ctx context.Context, p models.EventPartition, fn func(models.EventsBodyResponse) error) error
+	ArchivePartition(ctx context.Context, p models.EventPartition, blobKey string, rows int64) error
+}
+
+// Partitioner creates partitions of events for the current and the next
+// months, so orders always have a partition to go to.
+type Partitioner struct {
+	log      *logrus.Entry
+	store    Store
+	ahead    int
+	interval time.Duration
+	now      func() time.Time
+}
+
+func NewPartitioner(log *logrus.Logger, store Store, ahead int, interval time.Duration) *Partitioner {
+	return &Partitioner{
+		log:      log.WithField("module", "partitions"),
+		store:    store,
+		ahead:    ahead,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+func (p *Partitioner) Run(ctx context.Context) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	p.log.Infof("starting partitions %d months ahead", p.ahead)
+	for {
+		from := p.now().UTC()
+		n, err := p.store.CreatePartitions(ctx, from, from.AddDate(0, p.ahead+1, 0))
+		switch {
+		case err != nil && ctx.Err() == nil:
+			p.log.Warnf("err during creating partitions: %v", err)
+		case n > 0:
+			p.log.Infof("created %d partitions", n)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Archiver exports closed partitions to gzipped JSON Lines in the blob
+// store and then detaches and drops them.
+type Archiver struct {
+	log   *logrus.Entry
+	store Store
+	blobs blob.Store
+}
+
+func NewArchiver(log *logrus.Logger, store Store, blobs blob.Store) *Archiver {
+	return &Archiver{
+		log:   log.WithField("module", "archive"),
+		store: store,
+		blobs: blobs,
+	}
+}
+
+// Closed returns partitions Archive would archive.
+func (a *Archiver) Closed(ctx context.Context, before time.Time) ([]models.EventPartition, error) {
+	return a.store.ClosedPartitions(ctx, before)
+}
+
+// Archive archives partitions closed before before, oldest first, and
+// returns how many it has archived.
+func (a *Archiver) Archive(ctx context.Context, before time.Time) (int, error) {
+	partitions, err := a.store.ClosedPartitions(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	for i, p := range partitions {
+		if err = a.archive(ctx, p); err != nil {
+			return i, fmt.Errorf("archive %s failed: %w", p.Name, err)
+		}
+	}
+	return len(partitions), nil
+}
+
+func (a *Archiver) archive(ctx context.Context, p models.EventPartition) error {
+	f, err := os.CreateTemp("", "archive-*.jsonl.gz")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	buf := bufio.NewWriter(f)
+	zw := gzip.NewWriter(buf)
+	enc := json.NewEncoder(zw)
+	var rows int64
+	err = a.store.ExportEvents(ctx, p, func(e models.EventsBodyResponse) error {
+		rows++
+		return enc.Encode(e)
+	})
+	if err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = buf.Flush(); err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	key := blobKey(p)
+	if err = a.blobs.Put(ctx, key, f, size, "application/gzip"); err != nil {
+		return err
+	}
+	if err = a.store.ArchivePartition(ctx, p, key, rows); err != nil {
+		return err
+	}
+	a.log.Infof("archived %s with %d orders to %s", p.Name, rows, key)
+	return nil
+}
+
+// blobKey is where the partition is archived in the blob store.
+func blobKey(p models.EventPartition) string {
+	return "archive/events/" + p.Name + ".jsonl.gz"
+}
@@ -0,0 +1,90 @@
+package archive
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/blob"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryStore struct {
+	partitions []models.EventPartition
+	events     map[string][]models.EventsBodyResponse
+	archived   map[string]string
+	rows       map[string]int64
+}
+
+func (s *memoryStore) CreatePartitions(context.Context, time.Time, time.Time) (int, error) {
+	return 0, nil
+}
+
+func (s *memoryStore) ClosedPartitions(_ context.Context, before time.Time) ([]models.EventPartition, error) {
+	var closed []models.EventPartition
+	for _, p := range s.partitions {
+		if !p.To.After(before) {
+			closed = append(closed, p)
+		}
+	}
+	return closed, nil
+}
+
+func (s *memoryStore) ExportEvents(_ context.Context, p models.EventPartition, fn func(models.EventsBodyResponse) error) error {
+	for _, e := range s.events[p.Name] {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ArchivePartition(_ context.Context, p models.EventPartition, blobKey string, rows int64) error {
+	s.archived[p.Name], s.rows[p.Name] = blobKey, rows
+	return nil
+}
+
+func TestArchiver(t *testing.T) {
+	jan := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := &memoryStore{
+		partitions: []models.EventPartition{
+			{Name: "events_2023_01", From: jan, To: jan.AddDate(0, 1, 0)},
+			{Name: "events_2023_02", From: jan.AddDate(0, 1, 0), To: jan.AddDate(0, 2, 0)},
+		},
+		events: map[string][]models.EventsBodyResponse{"events_2023_01": {
+			{ID: 1, OrderID: 10, Price: 100, Status: "DONE", DateTime: jan.Add(time.Hour)},
+			{ID: 2, OrderID: 11, Price: 50, Status: "CANCELED", DateTime: jan.Add(2 * time.Hour)},
+		}},
+		archived: make(map[string]string),
+		rows:     make(map[string]int64),
+	}
+	blobs, err := blob.NewLocal(t.TempDir(), "", "")
+	require.NoError(t, err)
+	a := NewArchiver(logrus.New(), store, blobs)
+	ctx := context.Background()
+
+	n, err := a.Archive(ctx, jan.AddDate(0, 1, 15))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, map[string]string{"events_2023_01": "archive/events/events_2023_01.jsonl.gz"}, store.archived)
+	require.Equal(t, int64(2), store.rows["events_2023_01"])
+
+	rc, err := blobs.Get(ctx, "archive/events/events_2023_01.jsonl.gz")
+	require.NoError(t, err)
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	require.NoError(t, err)
+	dec := json.NewDecoder(zr)
+	var got []models.EventsBodyResponse
+	for dec.More() {
+		var e models.EventsBodyResponse
+		require.NoError(t, dec.Decode(&e))
+		got = append(got, e)
+	}
+	require.Equal(t, store.events["events_2023_01"], got)
+}
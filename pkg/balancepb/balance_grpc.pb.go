@@ -0,0 +1,220 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v23.4.0
+// source: balance/v1/balance.proto
+
+package balancepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Balance_AddFunds_FullMethodName         = "/balance.v1.Balance/AddFunds"
+	Balance_ReserveFunds_FullMethodName     = "/balance.v1.Balance/ReserveFunds"
+	Balance_RecognizeRevenue_FullMethodName = "/balance.v1.Balance/RecognizeRevenue"
+	Balance_WalletBalance_FullMethodName    = "/balance.v1.Balance/WalletBalance"
+)
+
+// BalanceClient is the client API for Balance service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type BalanceClient interface {
+	AddFunds(ctx context.Context, in *AddFundsRequest, opts ...grpc.CallOption) (*Wallet, error)
+	ReserveFunds(ctx context.Context, in *ReserveFundsRequest, opts ...grpc.CallOption) (*Event, error)
+	RecognizeRevenue(ctx context.Context, in *RecognizeRevenueRequest, opts ...grpc.CallOption) (*Event, error)
+	WalletBalance(ctx context.Context, in *WalletBalanceRequest, opts ...grpc.CallOption) (*Wallet, error)
+}
+
+type balanceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBalanceClient(cc grpc.ClientConnInterface) BalanceClient {
+	return &balanceClient{cc}
+}
+
+func (c *balanceClient) AddFunds(ctx context.Context, in *AddFundsRequest, opts ...grpc.CallOption) (*Wallet, error) {
+	out := new(Wallet)
+	err := c.cc.Invoke(ctx, Balance_AddFunds_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *balanceClient) ReserveFunds(ctx context.Context, in *ReserveFundsRequest, opts ...grpc.CallOption) (*Event, error) {
+	out := new(Event)
+	err := c.cc.Invoke(ctx, Balance_ReserveFunds_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *balanceClient) RecognizeRevenue(ctx context.Context, in *RecognizeRevenueRequest, opts ...grpc.CallOption) (*Event, error) {
+	out := new(Event)
+	err := c.cc.Invoke(ctx, Balance_RecognizeRevenue_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *balanceClient) WalletBalance(ctx context.Context, in *WalletBalanceRequest, opts ...grpc.CallOption) (*Wallet, error) {
+	out := new(Wallet)
+	err := c.cc.Invoke(ctx, Balance_WalletBalance_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BalanceServer is the server API for Balance service.
+// All implementations must embed UnimplementedBalanceServer
+// for forward compatibility
+type BalanceServer interface {
+	AddFunds(context.Context, *AddFundsRequest) (*Wallet, error)
+	ReserveFunds(context.Context, *ReserveFundsRequest) (*Event, error)
+	RecognizeRevenue(context.Context, *RecognizeRevenueRequest) (*Event, error)
+	WalletBalance(context.Context, *WalletBalanceRequest) (*Wallet, error)
+	mustEmbedUnimplementedBalanceServer()
+}
+
+// UnimplementedBalanceServer must be embedded to have forward compatible implementations.
+type UnimplementedBalanceServer struct {
+}
+
+func (UnimplementedBalanceServer) AddFunds(context.Context, *AddFundsRequest) (*Wallet, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddFunds not implemented")
+}
+func (UnimplementedBalanceServer) ReserveFunds(context.Context, *ReserveFundsRequest) (*Event, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReserveFunds not implemented")
+}
+func (UnimplementedBalanceServer) RecognizeRevenue(context.Context, *RecognizeRevenueRequest) (*Event, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RecognizeRevenue not implemented")
+}
+func (UnimplementedBalanceServer) WalletBalance(context.Context, *WalletBalanceRequest) (*Wallet, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method WalletBalance not implemented")
+}
+func (UnimplementedBalanceServer) mustEmbedUnimplementedBalanceServer() {}
+
+// UnsafeBalanceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BalanceServer will
+// result in compilation errors.
+type UnsafeBalanceServer interface {
+	mustEmbedUnimplementedBalanceServer()
+}
+
+func RegisterBalanceServer(s grpc.ServiceRegistrar, srv BalanceServer) {
+	s.RegisterService(&Balance_ServiceDesc, srv)
+}
+
+func _Balance_AddFunds_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddFundsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BalanceServer).AddFunds(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Balance_AddFunds_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BalanceServer).AddFunds(ctx, req.(*AddFundsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Balance_ReserveFunds_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReserveFundsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BalanceServer).ReserveFunds(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Balance_ReserveFunds_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BalanceServer).ReserveFunds(ctx, req.(*ReserveFundsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Balance_RecognizeRevenue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RecognizeRevenueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BalanceServer).RecognizeRevenue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Balance_RecognizeRevenue_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BalanceServer).RecognizeRevenue(ctx, req.(*RecognizeRevenueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Balance_WalletBalance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WalletBalanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BalanceServer).WalletBalance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Balance_WalletBalance_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BalanceServer).WalletBalance(ctx, req.(*WalletBalanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Balance_ServiceDesc is the grpc.ServiceDesc for Balance service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Balance_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "balance.v1.Balance",
+	HandlerType: (*BalanceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AddFunds",
+			Handler:    _Balance_AddFunds_Handler,
+		},
+		{
+			MethodName: "ReserveFunds",
+			Handler:    _Balance_ReserveFunds_Handler,
+		},
+		{
+			MethodName: "RecognizeRevenue",
+			Handler:    _Balance_RecognizeRevenue_Handler,
+		},
+		{
+			MethodName: "WalletBalance",
+			Handler:    _Balance_WalletBalance_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "balance/v1/balance.proto",
+}
@@ -0,0 +1,36 @@
+// Package blob stores generated files and hands out expiring links to them.
+package blob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidKey = fmt.Errorf("invalid blob key")
+	ErrNotFound   = fmt.Errorf("blob doesn't exist")
+)
+
+type Store interface {
+	// Put saves size bytes of body under key, replacing what was there.
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Get opens the blob under key, it fails with ErrNotFound when there is
+	// none.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// SignedURL returns a link that downloads the blob until ttl passes.
+	SignedURL(key string, ttl time.Duration) (string, error)
+}
+
+// checkKey accepts slash separated keys without empty, "." or ".."
+// segments.
+func checkKey(key string) error {
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package blob
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local keeps blobs in a directory. Its links point to baseURL where the
+// Local itself serves files as an http.Handler, the links are signed with
+// HMAC-SHA256 of the key and the expiration time.
+type Local struct {
+	dir     string
+	baseURL string
+	secret  []byte
+	now     func() time.Time
+}
+
+// NewLocal keeps blobs in dir. Without a secret it can't sign links and
+// serves nothing.
+func NewLocal(dir, baseURL, secret string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("create blob dir failed: %w", err)
+	}
+	return &Local{
+		dir:     dir,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		secret:  []byte(secret),
+		now:     time.Now,
+	}, nil
+}
+
+// Put writes to a temporary file first, so a link never serves a half
+// written blob.
+func (l *Local) Put(_ context.Context, key string, body io.Reader, _ int64, _ string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	path := filepath.Join(l.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("put blob failed: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return fmt.Errorf("put blob failed: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = io.Copy(f, body); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("put blob failed: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("put blob failed: %w", err)
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("put blob failed: %w", err)
+	}
+	return nil
+}
+
+func (l *Local) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(l.dir, filepath.FromSlash(key)))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("%w: %q", ErrNotFound, key)
+	case err != nil:
+		return nil, fmt.Errorf("get blob failed: %w", err)
+	}
+	return f, nil
+}
+
+func (l *Local) SignedURL(key string, ttl time.Duration) (string, error) {
+	if len(l.secret) == 0 {
+		return "", fmt.Errorf("local blob store has no secret to sign links")
+	}
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	expires := strconv.FormatInt(l.now().Add(ttl).Unix(), 10)
+	q := url.Values{"expires": {expires}, "signature": {l.signature(key, expires)}}
+	return l.baseURL + "/" + key + "?" + q.Encode(), nil
+}
+
+func (l *Local) signature(key, expires string) string {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ServeHTTP serves a blob by the path of a signed link relative to
+// baseURL, mount it with http.StripPrefix.
+func (l *Local) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	expires := r.URL.Query().Get("expires")
+	sig := r.URL.Query().Get("signature")
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || len(l.secret) == 0 || checkKey(key) != nil || !hmac.Equal([]byte(sig), []byte(l.signature(key, expires))) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+	if l.now().Unix() > unix {
+		http.Error(w, "link has expired", http.StatusForbidden)
+		return
+	}
+	f, err := os.Open(filepath.Join(l.dir, filepath.FromSlash(key)))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(key)))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
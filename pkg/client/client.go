@@ -0,0 +1,246 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/google/uuid"
+)
+
+const (
+	addFundsEndpoint         = "/api/v1/addFunds"
+	reserveFundsEndpoint     = "/api/v1/reserveFunds"
+	recognizeRevenueEndpoint = "/api/v1/recognizeRevenue"
+	getWalletBalanceEndpoint = "/api/v1/getUserBalance"
+)
+
+var (
+	ErrNotEnoughFunds       = fmt.Errorf("not enough funds")
+	ErrUserNotExists        = fmt.Errorf("user doesn't exist")
+	ErrOrderAlreadyAdded    = fmt.Errorf("order has already added")
+	ErrOrderNotExists       = fmt.Errorf("order doesn't exist")
+	ErrDuplicateTransaction = fmt.Errorf("transaction has already been made")
+	ErrVersionMismatch      = fmt.Errorf("wallet version doesn't match")
+	ErrUnauthenticated      = fmt.Errorf("unauthenticated")
+	ErrForbidden            = fmt.Errorf("forbidden")
+	ErrTooManyRequests      = fmt.Errorf("too many requests")
+)
+
+// codes are the values of ErrorResponse.Code sent by the server.
+var codes = map[string]error{
+	"NOT_ENOUGH_FUNDS":      ErrNotEnoughFunds,
+	"USER_NOT_EXISTS":       ErrUserNotExists,
+	"ORDER_ALREADY_ADDED":   ErrOrderAlreadyAdded,
+	"ORDER_NOT_EXISTS":      ErrOrderNotExists,
+	"DUPLICATE_TRANSACTION": ErrDuplicateTransaction,
+	"VERSION_MISMATCH":      ErrVersionMismatch,
+	"UNAUTHENTICATED":       ErrUnauthenticated,
+	"FORBIDDEN":             ErrForbidden,
+	"TOO_MANY_REQUESTS":     ErrTooManyRequests,
+}
+
+// APIError is returned for every non-2xx response. Known codes unwrap to
+// the Err* values, so callers can use errors.Is.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("balance api: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return codes[e.Code]
+}
+
+type Client struct {
+	baseURL     string
+	httpClient  *http.Client
+	header      http.Header
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+}
+
+type Option func(c *Client)
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.header.Set("X-API-Key", key)
+	}
+}
+
+func WithBearerToken(token string) Option {
+	return func(c *Client) {
+		c.header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// WithRetries sets how many times a request is sent at most and the bounds
+// of the exponential backoff between attempts.
+func WithRetries(maxAttempts int, minBackoff, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxAttempts = maxAttempts
+		c.minBackoff = minBackoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+func New(baseURL string, opts ...Option) *Client {
+	c := Client{
+		baseURL:     baseURL,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		header:      make(http.Header),
+		maxAttempts: 4,
+		minBackoff:  100 * time.Millisecond,
+		maxBackoff:  2 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return &c
+}
+
+// AddFunds credits the wallet. An empty TransactionID is filled with a new
+// uuid that is kept across retries, so a retried call is applied once. If an
+// attempt was applied but its response got lost, the retry fails with
+// ErrDuplicateTransaction.
+func (c *Client) AddFunds(ctx context.Context, data models.AddFundsRequest) (models.WalletResponse, error) {
+	if data.TransactionID == "" {
+		data.TransactionID = uuid.NewString()
+	}
+	var result models.WalletResponse
+	if err := c.do(ctx, http.MethodPost, addFundsEndpoint, data, &result); err != nil {
+		return models.WalletResponse{}, fmt.Errorf("add funds failed: %w", err)
+	}
+	return result, nil
+}
+
+func (c *Client) ReserveFunds(ctx context.Context, data models.ReservedFundsRequest) (models.EventsBodyResponse, error) {
+	if data.TransactionID == "" {
+		data.TransactionID = uuid.NewString()
+	}
+	var result models.EventsBodyResponse
+	if err := c.do(ctx, http.MethodPost, reserveFundsEndpoint, data, &result); err != nil {
+		return models.EventsBodyResponse{}, fmt.Errorf("reserve funds failed: %w", err)
+	}
+	return result, nil
+}
+
+func (c *Client) RecognizeRevenue(ctx context.Context, data models.RecognizeRevenueRequest) (models.EventsBodyResponse, error) {
+	if data.TransactionID == "" {
+		data.TransactionID = uuid.NewString()
+	}
+	var result models.EventsBodyResponse
+	if err := c.do(ctx, http.MethodPost, recognizeRevenueEndpoint, data, &result); err != nil {
+		return models.EventsBodyResponse{}, fmt.Errorf("recognize revenue failed: %w", err)
+	}
+	return result, nil
+}
+
+func (c *Client) WalletBalance(ctx context.Context, data models.BalanceRequest) (models.WalletResponse, error) {
+	var result models.WalletResponse
+	if err := c.do(ctx, http.MethodGet, getWalletBalanceEndpoint, data, &result); err != nil {
+		return models.WalletResponse{}, fmt.Errorf("get user balance failed: %w", err)
+	}
+	return result, nil
+}
+
+func (c *Client) do(ctx context.Context, method, endpoint string, body interface{}, dest interface{}) error {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal request failed: %w", err)
+	}
+	var lastErr error
+	for attempt := 0; attempt < c.maxAttempts; attempt++ {
+		var wait time.Duration
+		wait, lastErr = c.send(ctx, method, endpoint, reqBody, dest)
+		if lastErr == nil {
+			return nil
+		}
+		if wait < 0 {
+			return lastErr
+		}
+		if wait == 0 {
+			wait = c.backoff(attempt)
+		}
+		if attempt == c.maxAttempts-1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return lastErr
+}
+
+// send makes a single attempt. It returns a negative wait when the error is
+// final, zero when the request may be retried after the usual backoff and
+// the server's Retry-After otherwise.
+func (c *Client) send(ctx context.Context, method, endpoint string, body []byte, dest interface{}) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return -1, fmt.Errorf("create request failed: %w", err)
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		return 0, fmt.Errorf("send request failed: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(resp.Body).Decode(dest); err != nil {
+			return -1, fmt.Errorf("decode response failed: %w", err)
+		}
+		return 0, nil
+	}
+	var errResp struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&errResp)
+	apiErr := &APIError{StatusCode: resp.StatusCode, Code: errResp.Code, Message: errResp.Error}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return time.Duration(seconds) * time.Second, apiErr
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return 0, apiErr
+	}
+	return -1, apiErr
+}
+
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.minBackoff << attempt
+	if d > c.maxBackoff || d <= 0 {
+		d = c.maxBackoff
+	}
+	//nolint:gosec
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddFundsRetriesWithSameTransaction(t *testing.T) {
+	var txIDs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data models.AddFundsRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&data))
+		require.Equal(t, "key", r.Header.Get("X-API-Key"))
+		txIDs = append(txIDs, data.TransactionID)
+		if len(txIDs) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(models.WalletResponse{UserID: data.UserID, Balance: data.Balance})
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, WithAPIKey("key"), WithRetries(3, time.Millisecond, 5*time.Millisecond))
+	wallet, err := c.AddFunds(context.Background(), models.AddFundsRequest{UserID: 1, Balance: 100})
+	require.NoError(t, err)
+	require.Equal(t, 100, wallet.Balance)
+	require.Len(t, txIDs, 3)
+	require.NotEmpty(t, txIDs[0])
+	require.Equal(t, txIDs[0], txIDs[1])
+	require.Equal(t, txIDs[0], txIDs[2])
+}
+
+func TestErrorsAreComparable(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"not enough funds","code":"NOT_ENOUGH_FUNDS"}`))
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, WithRetries(3, time.Millisecond, 5*time.Millisecond))
+	_, err := c.ReserveFunds(context.Background(), models.ReservedFundsRequest{WalletID: 1, OrderID: 1, Price: 10})
+	require.ErrorIs(t, err, ErrNotEnoughFunds)
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	require.Equal(t, 1, calls)
+}
@@ -0,0 +1,182 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrInvalidCommand = fmt.Errorf("invalid command")
+
+// CommandSource is a queue of commands. A received command that is not
+// replied must be received again later, so no command is lost when the
+// consumer stops in the middle. Result returns the result saved with an
+// applied transaction, or pgstore.ErrTransactionResultNotExists.
+type CommandSource interface {
+	Receive(ctx context.Context, limit int) ([]models.Command, error)
+	Reply(ctx context.Context, reply models.CommandReply) error
+	Result(ctx context.Context, transactionID string) (json.RawMessage, error)
+}
+
+type App interface {
+	AddFunds(ctx context.Context, data models.AddFundsRequest) (models.WalletResponse, error)
+	ReserveFunds(ctx context.Context, data models.ReservedFundsRequest) (models.EventsBodyResponse, error)
+	RecognizeRevenue(ctx context.Context, data models.RecognizeRevenueRequest) (models.EventsBodyResponse, error)
+}
+
+type Consumer struct {
+	log         *logrus.Entry
+	source      CommandSource
+	app         App
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+}
+
+func New(log *logrus.Logger, source CommandSource, app App, interval time.Duration) *Consumer {
+	return &Consumer{
+		log:         log.WithField("module", "consumer"),
+		source:      source,
+		app:         app,
+		interval:    interval,
+		batchSize:   100,
+		maxAttempts: 5,
+	}
+}
+
+func (c *Consumer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	c.log.Infof("starting command consumer")
+	for {
+		n, err := c.consume(ctx)
+		if err != nil && ctx.Err() == nil {
+			c.log.Warnf("err during consuming: %v", err)
+		}
+		if n == c.batchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// consume handles received commands one by one, in the order they were
+// queued, and returns the number of received commands.
+func (c *Consumer) consume(ctx context.Context) (int, error) {
+	cmds, err := c.source.Receive(ctx, c.batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("consume failed: %w", err)
+	}
+	for _, cmd := range cmds {
+		reply, err := c.handle(ctx, cmd)
+		if err != nil {
+			// The command is received again when its lease expires.
+			c.log.Warnf("err during handling command %d (attempt %d): %v", cmd.ID, cmd.Attempts, err)
+			continue
+		}
+		if err = c.source.Reply(ctx, reply); err != nil {
+			return len(cmds), fmt.Errorf("consume failed: %w", err)
+		}
+	}
+	return len(cmds), nil
+}
+
+// handle applies the command. The transaction id of the command makes it
+// idempotent: a command that has already been applied is replied with the
+// result saved when it was applied, or with DUPLICATE_TRANSACTION code when
+// there is none. It returns an error only when the command should be
+// retried.
+func (c *Consumer) handle(ctx context.Context, cmd models.Command) (models.CommandReply, error) {
+	reply := models.CommandReply{
+		CommandID:     cmd.ID,
+		TransactionID: cmd.TransactionID,
+		Kind:          cmd.Kind,
+		Status:        models.CommandStatusOK,
+	}
+	result, err := c.apply(ctx, cmd)
+	if err == nil {
+		if reply.Result, err = json.Marshal(result); err == nil {
+			return reply, nil
+		}
+	}
+	if errors.Is(err, pgstore.ErrDuplicateTransaction) {
+		saved, rerr := c.source.Result(ctx, cmd.TransactionID)
+		switch {
+		case rerr == nil:
+			reply.Result = saved
+			return reply, nil
+		case !errors.Is(rerr, pgstore.ErrTransactionResultNotExists):
+			err = rerr
+		}
+	}
+	code := replyCode(err)
+	if code == "" && cmd.Attempts < c.maxAttempts {
+		return models.CommandReply{}, err
+	}
+	reply.Status = models.CommandStatusFailed
+	reply.Error = err.Error()
+	reply.Code = code
+	return reply, nil
+}
+
+func (c *Consumer) apply(ctx context.Context, cmd models.Command) (interface{}, error) {
+	switch cmd.Kind {
+	case models.CommandAddFunds:
+		var data models.AddFundsRequest
+		if err := json.Unmarshal(cmd.Payload, &data); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+		}
+		data.TransactionID, data.ClientID = cmd.TransactionID, cmd.ClientID
+		return c.app.AddFunds(ctx, data)
+	case models.CommandReserveFunds:
+		var data models.ReservedFundsRequest
+		if err := json.Unmarshal(cmd.Payload, &data); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+		}
+		data.TransactionID, data.ClientID = cmd.TransactionID, cmd.ClientID
+		return c.app.ReserveFunds(ctx, data)
+	case models.CommandRecognizeRevenue:
+		var data models.RecognizeRevenueRequest
+		if err := json.Unmarshal(cmd.Payload, &data); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+		}
+		data.TransactionID, data.ClientID = cmd.TransactionID, cmd.ClientID
+		return c.app.RecognizeRevenue(ctx, data)
+	}
+	return nil, fmt.Errorf("%w: unknown kind %q", ErrInvalidCommand, cmd.Kind)
+}
+
+// replyCode names the errors that retrying can't fix. Other errors are
+// retried.
+func replyCode(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidCommand):
+		return "INVALID_COMMAND"
+	case errors.Is(err, pgstore.ErrDuplicateTransaction):
+		return "DUPLICATE_TRANSACTION"
+	case errors.Is(err, pgstore.ErrNotEnoughFunds):
+		return "NOT_ENOUGH_FUNDS"
+	case errors.Is(err, pgstore.ErrUserNotExists):
+		return "USER_NOT_EXISTS"
+	case errors.Is(err, pgstore.ErrOrderAlreadyAdded):
+		return "ORDER_ALREADY_ADDED"
+	case errors.Is(err, pgstore.ErrOrderNotExists):
+		return "ORDER_NOT_EXISTS"
+	case errors.Is(err, pgstore.ErrOrderAlreadyProcessed):
+		return "ORDER_ALREADY_PROCESSED"
+	case errors.Is(err, pgstore.ErrInvalidStatus):
+		return "INVALID_STATUS"
+	}
+	return ""
+}
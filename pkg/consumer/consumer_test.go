@@ -0,0 +1,119 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSource struct {
+	cmds    []models.Command
+	replies []models.CommandReply
+	results map[string]json.RawMessage
+}
+
+func (s *fakeSource) Receive(_ context.Context, limit int) ([]models.Command, error) {
+	if len(s.cmds) < limit {
+		limit = len(s.cmds)
+	}
+	cmds := s.cmds[:limit]
+	s.cmds = s.cmds[limit:]
+	return cmds, nil
+}
+
+func (s *fakeSource) Reply(_ context.Context, reply models.CommandReply) error {
+	s.replies = append(s.replies, reply)
+	return nil
+}
+
+func (s *fakeSource) Result(_ context.Context, transactionID string) (json.RawMessage, error) {
+	result, ok := s.results[transactionID]
+	if !ok {
+		return nil, pgstore.ErrTransactionResultNotExists
+	}
+	return result, nil
+}
+
+// fakeApp saves results to results like the store does in the transaction
+// of the command.
+type fakeApp struct {
+	App
+	txs     map[string]struct{}
+	results map[string]json.RawMessage
+	err     error
+}
+
+func (a *fakeApp) AddFunds(_ context.Context, data models.AddFundsRequest) (models.WalletResponse, error) {
+	if a.err != nil {
+		return models.WalletResponse{}, a.err
+	}
+	if _, ok := a.txs[data.TransactionID]; ok {
+		return models.WalletResponse{}, fmt.Errorf("service: %w", pgstore.ErrDuplicateTransaction)
+	}
+	a.txs[data.TransactionID] = struct{}{}
+	result := models.WalletResponse{ID: 1, UserID: data.UserID, Balance: data.Balance, UpdatedBy: data.ClientID}
+	if a.results != nil {
+		a.results[data.TransactionID], _ = json.Marshal(result)
+	}
+	return result, nil
+}
+
+func TestConsumer(t *testing.T) {
+	cmd := models.Command{
+		ID:            1,
+		Kind:          models.CommandAddFunds,
+		TransactionID: "tx-1",
+		ClientID:      "manager",
+		Payload:       json.RawMessage(`{"userID":7,"balance":100}`),
+		Attempts:      1,
+	}
+	source := &fakeSource{cmds: []models.Command{
+		cmd,
+		{ID: 2, Kind: cmd.Kind, TransactionID: cmd.TransactionID, Payload: cmd.Payload, Attempts: 1},
+		{ID: 3, Kind: "transfer", TransactionID: "tx-3", Payload: json.RawMessage(`{}`), Attempts: 1},
+		{ID: 4, Kind: cmd.Kind, TransactionID: "tx-0", Payload: cmd.Payload, Attempts: 1},
+	}, results: make(map[string]json.RawMessage)}
+	// tx-0 was applied without a saved result.
+	app := &fakeApp{txs: map[string]struct{}{"tx-0": {}}, results: source.results}
+	c := New(logrus.New(), source, app, 0)
+
+	n, err := c.consume(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+	require.Len(t, source.replies, 4)
+	require.Equal(t, models.CommandStatusOK, source.replies[0].Status)
+	require.JSONEq(t, `{"id":1,"userID":7,"balance":100,"reserved":0,"updatedAt":"0001-01-01T00:00:00Z","updatedBy":"manager","version":0}`,
+		string(source.replies[0].Result))
+	// The command applied before is replied with the first result.
+	require.Equal(t, models.CommandStatusOK, source.replies[1].Status)
+	require.JSONEq(t, string(source.replies[0].Result), string(source.replies[1].Result))
+	require.Equal(t, "INVALID_COMMAND", source.replies[2].Code)
+	require.Equal(t, models.CommandStatusFailed, source.replies[3].Status)
+	require.Equal(t, "DUPLICATE_TRANSACTION", source.replies[3].Code)
+}
+
+func TestConsumerRetry(t *testing.T) {
+	cmd := models.Command{ID: 1, Kind: models.CommandAddFunds, TransactionID: "tx-1", Payload: json.RawMessage(`{}`), Attempts: 1}
+	source := &fakeSource{cmds: []models.Command{cmd}}
+	app := &fakeApp{txs: make(map[string]struct{}), err: fmt.Errorf("connection refused")}
+	c := New(logrus.New(), source, app, 0)
+
+	_, err := c.consume(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, source.replies)
+
+	cmd.Attempts = c.maxAttempts
+	source.cmds = []models.Command{cmd}
+	_, err = c.consume(context.Background())
+	require.NoError(t, err)
+	require.Len(t, source.replies, 1)
+	require.Equal(t, models.CommandStatusFailed, source.replies[0].Status)
+	require.Equal(t, "connection refused", source.replies[0].Error)
+}
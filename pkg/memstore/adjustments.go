@@ -0,0 +1,147 @@
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+)
+
+// ProposeAdjustment saves a pending adjustment. A debit that exceeds the
+// available balance is rejected right away.
+func (s *Store) ProposeAdjustment(ctx context.Context, data models.AdjustmentRequest) (models.Adjustment, error) {
+	data.Reason = strings.TrimSpace(data.Reason)
+	if data.Amount == 0 || data.Reason == "" || data.ProposedBy == "" {
+		return models.Adjustment{}, pgstore.ErrInvalidAdjustment
+	}
+	if err := ctx.Err(); err != nil {
+		return models.Adjustment{}, fmt.Errorf("propose adjustment failed: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.wallets[data.WalletID]
+	switch {
+	case !ok:
+		return models.Adjustment{}, pgstore.ErrUserNotExists
+	case w.Balance-w.Reserved+data.Amount < 0:
+		return models.Adjustment{}, pgstore.ErrNotEnoughFunds
+	}
+	result := models.Adjustment{
+		ID:         len(s.adjustments) + 1,
+		WalletID:   data.WalletID,
+		Amount:     data.Amount,
+		Reason:     data.Reason,
+		Status:     models.AdjustmentPending,
+		ProposedBy: data.ProposedBy,
+		ProposedAt: s.clock(),
+	}
+	s.adjustments = append(s.adjustments, result)
+	return result, nil
+}
+
+// ApproveAdjustment applies a pending adjustment approved by an operator
+// other than the proposer. A debit that would make the available balance
+// negative leaves the adjustment pending.
+func (s *Store) ApproveAdjustment(ctx context.Context, id int, approver string) (models.Adjustment, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Adjustment{}, fmt.Errorf("approve adjustment failed: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	adj, err := s.pendingAdjustment(id, approver)
+	if err != nil {
+		return models.Adjustment{}, err
+	}
+	w, ok := s.wallets[adj.WalletID]
+	if !ok || w.Balance+adj.Amount-w.Reserved < 0 {
+		return models.Adjustment{}, pgstore.ErrNotEnoughFunds
+	}
+	now := s.clock()
+	w.Balance += adj.Amount
+	w.Version++
+	w.UpdatedAt = now
+	w.UpdatedBy = approver
+	adj.Status = models.AdjustmentApproved
+	adj.DecidedBy = approver
+	adj.DecidedAt = &now
+	s.adjustments[id-1] = adj
+	s.addHistory(now, models.HistoryEntry{
+		WalletID:     w.ID,
+		Kind:         models.HistoryAdjustment,
+		BalanceDelta: adj.Amount,
+		Reference:    fmt.Sprintf("adjustment:%d", adj.ID),
+		ClientID:     approver,
+	})
+	wallet := *w
+	adj.Wallet = &wallet
+	return adj, nil
+}
+
+// RejectAdjustment closes a pending adjustment without touching the wallet.
+func (s *Store) RejectAdjustment(ctx context.Context, id int, approver string) (models.Adjustment, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Adjustment{}, fmt.Errorf("reject adjustment failed: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	adj, err := s.pendingAdjustment(id, approver)
+	if err != nil {
+		return models.Adjustment{}, err
+	}
+	now := s.clock()
+	adj.Status = models.AdjustmentRejected
+	adj.DecidedBy = approver
+	adj.DecidedAt = &now
+	s.adjustments[id-1] = adj
+	return adj, nil
+}
+
+// pendingAdjustment checks that approver may decide the adjustment.
+func (st *state) pendingAdjustment(id int, approver string) (models.Adjustment, error) {
+	if id < 1 || id > len(st.adjustments) {
+		return models.Adjustment{}, pgstore.ErrAdjustmentNotExists
+	}
+	result := st.adjustments[id-1]
+	switch {
+	case result.Status != models.AdjustmentPending:
+		return models.Adjustment{}, pgstore.ErrAdjustmentProcessed
+	case approver == "" || approver == result.ProposedBy:
+		return models.Adjustment{}, pgstore.ErrSameApprover
+	}
+	return result, nil
+}
+
+func (s *Store) Adjustment(ctx context.Context, id int) (models.Adjustment, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Adjustment{}, fmt.Errorf("get adjustment failed: %w", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if id < 1 || id > len(s.adjustments) {
+		return models.Adjustment{}, pgstore.ErrAdjustmentNotExists
+	}
+	return s.adjustments[id-1], nil
+}
+
+func (s *Store) Adjustments(ctx context.Context, filter models.AdjustmentsFilter) ([]models.Adjustment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("get adjustments failed: %w", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]models.Adjustment, 0)
+	for i := len(s.adjustments) - 1; i >= 0; i-- {
+		adj := s.adjustments[i]
+		if (filter.WalletID == 0 || adj.WalletID == filter.WalletID) && (filter.Status == "" || adj.Status == filter.Status) {
+			result = append(result, adj)
+		}
+	}
+	return page(result, filter.Limit, filter.Offset), nil
+}
@@ -0,0 +1,231 @@
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+)
+
+// Batch applies credits first, then reservations, then recognitions. In
+// atomic mode nothing is applied if any operation fails.
+func (s *Store) Batch(ctx context.Context, data models.BatchRequest) (models.BatchResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return models.BatchResponse{}, fmt.Errorf("batch failed: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := s.state.clone()
+	results := make([]models.BatchResult, len(data.Operations))
+	for i := range results {
+		results[i] = models.BatchResult{Index: i, Status: models.BatchStatusOK}
+	}
+	now := s.clock()
+	saved := s.batchTransactions(data, results)
+	s.batchAddFunds(now, data, results)
+	s.batchReserveFunds(now, data, results)
+	s.batchRecognizeRevenue(now, data, results)
+
+	if data.Mode == models.BatchModeAtomic && failed(results) {
+		s.state = before
+		for i := range results {
+			if results[i].Status == models.BatchStatusOK {
+				results[i] = models.BatchResult{Index: i, Status: models.BatchStatusSkipped}
+			}
+		}
+		return models.BatchResponse{Results: results}, nil
+	}
+	// Failed operations can be retried with the same transaction ids.
+	for _, i := range saved {
+		if results[i].Status == models.BatchStatusFailed {
+			delete(s.transactions, batchTransactionID(data.Operations[i]))
+		}
+	}
+	s.addHistory(now, batchHistory(data, results)...)
+	return models.BatchResponse{Applied: true, Results: results}, nil
+}
+
+// batchHistory lists movements in the order the operations were applied.
+func batchHistory(data models.BatchRequest, results []models.BatchResult) []models.HistoryEntry {
+	var entries []models.HistoryEntry
+	for _, opType := range []string{models.BatchAddFunds, models.BatchReserveFunds, models.BatchRecognizeRevenue} {
+		for i, op := range data.Operations {
+			r := results[i]
+			if op.Type != opType || r.Status != models.BatchStatusOK {
+				continue
+			}
+			switch op.Type {
+			case models.BatchAddFunds:
+				entries = append(entries, models.HistoryEntry{
+					WalletID:     r.Wallet.ID,
+					Kind:         models.HistoryCredit,
+					BalanceDelta: op.AddFunds.Balance,
+					Reference:    op.AddFunds.TransactionID,
+					ClientID:     data.ClientID,
+				})
+			case models.BatchReserveFunds:
+				entries = append(entries, models.HistoryEntry{
+					WalletID:      r.Event.WalletID,
+					Kind:          models.HistoryReserve,
+					ReservedDelta: r.Event.Price,
+					OrderID:       r.Event.OrderID,
+					Reference:     op.ReserveFunds.TransactionID,
+					ClientID:      data.ClientID,
+				})
+			case models.BatchRecognizeRevenue:
+				entries = append(entries, recognizedHistory(*r.Event, op.RecognizeRevenue.TransactionID))
+			}
+		}
+	}
+	return entries
+}
+
+func failed(results []models.BatchResult) bool {
+	for _, r := range results {
+		if r.Status == models.BatchStatusFailed {
+			return true
+		}
+	}
+	return false
+}
+
+func fail(result *models.BatchResult, err error) {
+	result.Status = models.BatchStatusFailed
+	result.Err = err
+}
+
+func batchTransactionID(op models.BatchOperation) string {
+	switch op.Type {
+	case models.BatchAddFunds:
+		return op.AddFunds.TransactionID
+	case models.BatchReserveFunds:
+		return op.ReserveFunds.TransactionID
+	case models.BatchRecognizeRevenue:
+		return op.RecognizeRevenue.TransactionID
+	}
+	return ""
+}
+
+// batchTransactions saves transaction ids of the operations and fails the
+// operations whose transactions have already been made, in the batch too.
+// It returns the indexes of operations whose ids were saved.
+func (st *state) batchTransactions(data models.BatchRequest, results []models.BatchResult) []int {
+	var saved []int
+	for i, op := range data.Operations {
+		id := batchTransactionID(op)
+		switch {
+		case id == "":
+			continue
+		case st.processed(id):
+			fail(&results[i], pgstore.ErrDuplicateTransaction)
+			continue
+		}
+		st.saveTransaction(id)
+		saved = append(saved, i)
+	}
+	return saved
+}
+
+// batchAddFunds credits every user once with the sum of the user's
+// operations, so all of them return the same wallet.
+func (st *state) batchAddFunds(now time.Time, data models.BatchRequest, results []models.BatchResult) {
+	wallets := make(map[int]*models.WalletResponse)
+	for i, op := range data.Operations {
+		if op.Type != models.BatchAddFunds || results[i].Status != models.BatchStatusOK {
+			continue
+		}
+		req := op.AddFunds
+		w, ok := wallets[req.UserID]
+		if !ok {
+			w, ok = st.wallets[st.users[req.UserID]]
+			if ok {
+				w.Version++
+			} else {
+				w = &models.WalletResponse{ID: len(st.wallets) + 1, UserID: req.UserID, Version: 1}
+				st.wallets[w.ID] = w
+				st.users[req.UserID] = w.ID
+			}
+			w.UpdatedAt = now
+			w.UpdatedBy = data.ClientID
+			wallets[req.UserID] = w
+		}
+		w.Balance += req.Balance
+	}
+	for i, op := range data.Operations {
+		if op.Type == models.BatchAddFunds && results[i].Status == models.BatchStatusOK {
+			w := *wallets[op.AddFunds.UserID]
+			results[i].Wallet = &w
+		}
+	}
+}
+
+func (st *state) batchReserveFunds(now time.Time, data models.BatchRequest, results []models.BatchResult) {
+	reserved := make(map[int]bool)
+	for i, op := range data.Operations {
+		if op.Type != models.BatchReserveFunds || results[i].Status != models.BatchStatusOK {
+			continue
+		}
+		req := op.ReserveFunds
+		w, ok := st.wallets[req.WalletID]
+		switch {
+		case !ok:
+			fail(&results[i], pgstore.ErrUserNotExists)
+			continue
+		case st.orders[req.OrderID] != nil:
+			fail(&results[i], pgstore.ErrOrderAlreadyAdded)
+			continue
+		case w.Balance-w.Reserved < req.Price:
+			fail(&results[i], pgstore.ErrNotEnoughFunds)
+			continue
+		}
+		w.Reserved += req.Price
+		if !reserved[w.ID] {
+			reserved[w.ID] = true
+			w.Version++
+			w.UpdatedAt = now
+		}
+		e := st.addOrder(now, req.WalletID, req.ServiceID, req.OrderID, req.Price, data.ClientID).EventsBodyResponse
+		results[i].Event = &e
+	}
+}
+
+// batchRecognizeRevenue changes the wallets of the orders, not the ones of
+// the requests.
+func (st *state) batchRecognizeRevenue(now time.Time, data models.BatchRequest, results []models.BatchResult) {
+	recognized := make(map[int]bool)
+	for i, op := range data.Operations {
+		if op.Type != models.BatchRecognizeRevenue || results[i].Status != models.BatchStatusOK {
+			continue
+		}
+		req := op.RecognizeRevenue
+		o, ok := st.orders[req.OrderID]
+		switch {
+		case !ok, req.WalletID != 0 && req.WalletID != o.WalletID:
+			fail(&results[i], pgstore.ErrOrderNotExists)
+			continue
+		case req.Status != "DONE" && req.Status != "CANCELED":
+			fail(&results[i], pgstore.ErrInvalidStatus)
+			continue
+		case o.Status != "REQUESTED":
+			fail(&results[i], pgstore.ErrOrderAlreadyProcessed)
+			continue
+		}
+		if w, ok := st.wallets[o.WalletID]; ok {
+			if req.Status == "DONE" {
+				w.Balance -= o.Price
+			}
+			w.Reserved -= o.Price
+			if !recognized[w.ID] {
+				recognized[w.ID] = true
+				w.Version++
+				w.UpdatedAt = now
+			}
+		}
+		st.recognize(now, o, req.Status, data.ClientID)
+		e := o.EventsBodyResponse
+		results[i].Event = &e
+	}
+}
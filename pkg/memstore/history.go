@@ -0,0 +1,171 @@
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+)
+
+// addHistory records movements at now, chaining every entry to the
+// previous entry of its wallet like pgstore does. Nothing is kept outside
+// the store, so hashes are not keyed.
+func (st *state) addHistory(now time.Time, entries ...models.HistoryEntry) {
+	for _, e := range entries {
+		e.ID = int64(len(st.history) + 1)
+		e.CreatedAt = now
+		e.PrevHash = st.lastHash(e.WalletID)
+		e.Hash = pgstore.HistoryHash(nil, e)
+		st.history = append(st.history, e)
+	}
+}
+
+func (st *state) lastHash(walletID int) string {
+	for i := len(st.history) - 1; i >= 0; i-- {
+		if st.history[i].WalletID == walletID {
+			return st.history[i].Hash
+		}
+	}
+	return ""
+}
+
+// History returns movements of the user's wallet, the latest first.
+func (s *Store) History(ctx context.Context, filter models.HistoryFilter) ([]models.HistoryEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("get history failed: %w", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]models.HistoryEntry, 0)
+	walletID, ok := s.users[filter.UserID]
+	if !ok {
+		return result, nil
+	}
+	for i := len(s.history) - 1; i >= 0; i-- {
+		e := s.history[i]
+		if e.WalletID == walletID && within(e.CreatedAt, filter.From, filter.To) {
+			result = append(result, e)
+		}
+	}
+	return page(result, filter.Limit, filter.Offset), nil
+}
+
+// VerifyChain walks the wallet history from the first entry and stops at
+// the first entry that doesn't link to the previous one or whose contents
+// don't match its hash.
+func (s *Store) VerifyChain(ctx context.Context, walletID int) (models.ChainReport, error) {
+	if err := ctx.Err(); err != nil {
+		return models.ChainReport{}, fmt.Errorf("verify chain failed: %w", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	report := models.ChainReport{WalletID: walletID, Valid: true}
+	for _, e := range s.history {
+		if e.WalletID != walletID {
+			continue
+		}
+		switch {
+		case e.PrevHash != report.LastHash:
+			report.Reason = "previous hash doesn't match"
+		case pgstore.HistoryHash(nil, e) != e.Hash:
+			report.Reason = "hash doesn't match contents"
+		}
+		if report.Reason != "" {
+			report.Valid = false
+			report.BrokenEntryID = e.ID
+			return report, nil
+		}
+		report.Checked++
+		report.LastHash = e.Hash
+	}
+	return report, nil
+}
+
+// Statements sums up movements of wallets in the period, balances are
+// counted back from the current ones.
+func (s *Store) Statements(ctx context.Context, filter models.StatementFilter) ([]models.Statement, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("get statements failed: %w", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.statements(filter), nil
+}
+
+func (st *state) statements(filter models.StatementFilter) []models.Statement {
+	result := make([]models.Statement, 0)
+	byWallet := make(map[int]int)
+	for _, w := range st.wallets {
+		if filter.UserID != 0 && w.UserID != filter.UserID {
+			continue
+		}
+		byWallet[w.ID] = len(result)
+		result = append(result, models.Statement{
+			UserID:          w.UserID,
+			WalletID:        w.ID,
+			From:            filter.From,
+			To:              filter.To,
+			OpeningBalance:  w.Balance,
+			OpeningReserved: w.Reserved,
+			ClosingBalance:  w.Balance,
+			ClosingReserved: w.Reserved,
+		})
+	}
+	for _, e := range st.history {
+		i, ok := byWallet[e.WalletID]
+		if !ok || e.CreatedAt.Before(filter.From) {
+			continue
+		}
+		r := &result[i]
+		r.OpeningBalance -= e.BalanceDelta
+		r.OpeningReserved -= e.ReservedDelta
+		if !e.CreatedAt.Before(filter.To) {
+			r.ClosingBalance -= e.BalanceDelta
+			r.ClosingReserved -= e.ReservedDelta
+			continue
+		}
+		if e.BalanceDelta > 0 {
+			r.Credits += e.BalanceDelta
+		} else {
+			r.Debits -= e.BalanceDelta
+		}
+		if e.ReservedDelta > 0 {
+			r.Holds += e.ReservedDelta
+		} else {
+			r.Releases -= e.ReservedDelta
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].UserID < result[j].UserID
+	})
+	return result
+}
+
+// Statement returns the statement of the user's wallet with its movements
+// in the period.
+func (s *Store) Statement(ctx context.Context, filter models.StatementFilter) (models.Statement, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Statement{}, fmt.Errorf("get statement failed: %w", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	statements := s.statements(filter)
+	if len(statements) == 0 {
+		return models.Statement{}, pgstore.ErrUserNotExists
+	}
+	result := statements[0]
+	result.Entries = make([]models.HistoryEntry, 0)
+	for _, e := range s.history {
+		if e.WalletID == result.WalletID && within(e.CreatedAt, &filter.From, &filter.To) {
+			result.Entries = append(result.Entries, e)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,328 @@
+// Package memstore keeps wallets and orders in memory. It implements
+// service.Store with the semantics of pgstore for tests and local
+// development, nothing survives a restart.
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+)
+
+type order struct {
+	models.EventsBodyResponse
+	recognizedAt time.Time
+}
+
+type state struct {
+	wallets      map[int]*models.WalletResponse
+	users        map[int]int
+	orders       map[int]*order
+	history      []models.HistoryEntry
+	transactions map[string]struct{}
+	adjustments  []models.Adjustment
+	lastEventID  int
+}
+
+// Store is safe for concurrent use, every call holds one lock, so calls
+// are applied one after another like serializable transactions.
+type Store struct {
+	mu  sync.RWMutex
+	now func() time.Time
+	state
+}
+
+func New() *Store {
+	return &Store{
+		now: time.Now,
+		state: state{
+			wallets:      make(map[int]*models.WalletResponse),
+			users:        make(map[int]int),
+			orders:       make(map[int]*order),
+			transactions: make(map[string]struct{}),
+		},
+	}
+}
+
+// clock returns the time of a call with the precision of Postgres.
+func (s *Store) clock() time.Time {
+	return s.now().Truncate(time.Microsecond)
+}
+
+// clone copies the state, so a batch can be rolled back.
+func (st *state) clone() state {
+	c := state{
+		wallets:      make(map[int]*models.WalletResponse, len(st.wallets)),
+		users:        make(map[int]int, len(st.users)),
+		orders:       make(map[int]*order, len(st.orders)),
+		history:      append([]models.HistoryEntry(nil), st.history...),
+		transactions: make(map[string]struct{}, len(st.transactions)),
+		adjustments:  append([]models.Adjustment(nil), st.adjustments...),
+		lastEventID:  st.lastEventID,
+	}
+	for id, w := range st.wallets {
+		w := *w
+		c.wallets[id] = &w
+	}
+	for user, id := range st.users {
+		c.users[user] = id
+	}
+	for id, o := range st.orders {
+		o := *o
+		c.orders[id] = &o
+	}
+	for id := range st.transactions {
+		c.transactions[id] = struct{}{}
+	}
+	return c
+}
+
+func (st *state) processed(transactionID string) bool {
+	_, ok := st.transactions[transactionID]
+	return transactionID != "" && ok
+}
+
+func (st *state) saveTransaction(transactionID string) {
+	if transactionID != "" {
+		st.transactions[transactionID] = struct{}{}
+	}
+}
+
+func (s *Store) AddFunds(ctx context.Context, data models.AddFundsRequest) (models.WalletResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return models.WalletResponse{}, fmt.Errorf("add funds failed: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.processed(data.TransactionID) {
+		return models.WalletResponse{}, fmt.Errorf("add funds failed: %w", pgstore.ErrDuplicateTransaction)
+	}
+	now := s.clock()
+	w, ok := s.wallets[s.users[data.UserID]]
+	switch {
+	case !ok && data.ExpectedVersion == 0:
+		w = &models.WalletResponse{ID: len(s.wallets) + 1, UserID: data.UserID, Version: 1}
+		s.wallets[w.ID] = w
+		s.users[data.UserID] = w.ID
+	case !ok:
+		// A wallet with an expected version is not created.
+		return models.WalletResponse{}, pgstore.ErrUserNotExists
+	case data.ExpectedVersion != 0 && w.Version != data.ExpectedVersion:
+		return models.WalletResponse{}, pgstore.ErrVersionMismatch
+	default:
+		w.Version++
+	}
+	w.Balance += data.Balance
+	w.UpdatedAt = now
+	w.UpdatedBy = data.ClientID
+	s.saveTransaction(data.TransactionID)
+	s.addHistory(now, models.HistoryEntry{
+		WalletID:     w.ID,
+		Kind:         models.HistoryCredit,
+		BalanceDelta: data.Balance,
+		Reference:    data.TransactionID,
+		ClientID:     data.ClientID,
+	})
+	return *w, nil
+}
+
+func (s *Store) ReserveFunds(ctx context.Context, data models.ReservedFundsRequest) (models.EventsBodyResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return models.EventsBodyResponse{}, fmt.Errorf("reserve funds failed: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.processed(data.TransactionID) {
+		return models.EventsBodyResponse{}, fmt.Errorf("reserve funds failed: %w", pgstore.ErrDuplicateTransaction)
+	}
+	w, ok := s.wallets[data.WalletID]
+	switch {
+	case !ok || w.Balance-w.Reserved < data.Price:
+		return models.EventsBodyResponse{}, pgstore.ErrNotEnoughFunds
+	case data.ExpectedVersion != 0 && w.Version != data.ExpectedVersion:
+		return models.EventsBodyResponse{}, pgstore.ErrVersionMismatch
+	case s.orders[data.OrderID] != nil:
+		return models.EventsBodyResponse{}, pgstore.ErrOrderAlreadyAdded
+	}
+	now := s.clock()
+	w.Reserved += data.Price
+	w.Version++
+	o := s.addOrder(now, data.WalletID, data.ServiceID, data.OrderID, data.Price, data.ClientID)
+	s.saveTransaction(data.TransactionID)
+	s.addHistory(now, models.HistoryEntry{
+		WalletID:      o.WalletID,
+		Kind:          models.HistoryReserve,
+		ReservedDelta: o.Price,
+		OrderID:       o.OrderID,
+		Reference:     data.TransactionID,
+		ClientID:      data.ClientID,
+	})
+	return o.EventsBodyResponse, nil
+}
+
+func (st *state) addOrder(now time.Time, walletID, serviceID, orderID, price int, clientID string) *order {
+	st.lastEventID++
+	o := &order{EventsBodyResponse: models.EventsBodyResponse{
+		ID:        st.lastEventID,
+		WalletID:  walletID,
+		ServiceID: serviceID,
+		OrderID:   orderID,
+		Price:     price,
+		Status:    "REQUESTED",
+		DateTime:  now,
+		ClientID:  clientID,
+	}}
+	st.orders[orderID] = o
+	return o
+}
+
+// RecognizeRevenue recognizes a REQUESTED order and changes the wallet of
+// the order, like pgstore.
+func (s *Store) RecognizeRevenue(ctx context.Context, data models.RecognizeRevenueRequest) (models.EventsBodyResponse, error) {
+	if data.Status != "DONE" && data.Status != "CANCELED" {
+		return models.EventsBodyResponse{}, pgstore.ErrInvalidStatus
+	}
+	if err := ctx.Err(); err != nil {
+		return models.EventsBodyResponse{}, fmt.Errorf("recognize revenue failed: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.processed(data.TransactionID) {
+		return models.EventsBodyResponse{}, fmt.Errorf("recognize revenue failed: %w", pgstore.ErrDuplicateTransaction)
+	}
+	o, ok := s.orders[data.OrderID]
+	switch {
+	case !ok || data.WalletID != 0 && data.WalletID != o.WalletID:
+		return models.EventsBodyResponse{}, fmt.Errorf("recognize revenue failed: %w", pgstore.ErrOrderNotExists)
+	case o.Status != "REQUESTED":
+		return models.EventsBodyResponse{}, fmt.Errorf("recognize revenue failed: %w", pgstore.ErrOrderAlreadyProcessed)
+	}
+	w := s.wallets[o.WalletID]
+	if data.ExpectedVersion != 0 && w.Version != data.ExpectedVersion {
+		return models.EventsBodyResponse{}, fmt.Errorf("recognize revenue failed: %w", pgstore.ErrVersionMismatch)
+	}
+	if data.Status == "DONE" {
+		w.Balance -= o.Price
+	}
+	w.Reserved -= o.Price
+	w.Version++
+	now := s.clock()
+	s.recognize(now, o, data.Status, data.ClientID)
+	s.saveTransaction(data.TransactionID)
+	s.addHistory(now, recognizedHistory(o.EventsBodyResponse, data.TransactionID))
+	return o.EventsBodyResponse, nil
+}
+
+func (st *state) recognize(now time.Time, o *order, status, clientID string) {
+	o.Status = status
+	o.RecognizedBy = clientID
+	if status == "DONE" {
+		o.recognizedAt = now
+	}
+}
+
+func recognizedHistory(event models.EventsBodyResponse, transactionID string) models.HistoryEntry {
+	entry := models.HistoryEntry{
+		WalletID:      event.WalletID,
+		Kind:          models.HistoryRelease,
+		ReservedDelta: -event.Price,
+		OrderID:       event.OrderID,
+		Reference:     transactionID,
+		ClientID:      event.RecognizedBy,
+	}
+	if event.Status == "DONE" {
+		entry.Kind = models.HistoryDebit
+		entry.BalanceDelta = -event.Price
+	}
+	return entry
+}
+
+func (s *Store) WalletBalance(ctx context.Context, data models.BalanceRequest) (models.WalletResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return models.WalletResponse{}, fmt.Errorf("get user balance failed: %w", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	w, ok := s.wallets[s.users[data.UserID]]
+	if !ok {
+		return models.WalletResponse{}, pgstore.ErrUserNotExists
+	}
+	if data.AsOf == nil {
+		return *w, nil
+	}
+	// The balance at the moment is the current one less the later history.
+	result := models.WalletResponse{ID: w.ID, UserID: w.UserID, Balance: w.Balance, Reserved: w.Reserved, AsOf: data.AsOf}
+	for _, e := range s.history {
+		if e.WalletID == w.ID && e.CreatedAt.After(*data.AsOf) {
+			result.Balance -= e.BalanceDelta
+			result.Reserved -= e.ReservedDelta
+		}
+	}
+	return result, nil
+}
+
+func (s *Store) Order(ctx context.Context, orderID int) (models.EventsBodyResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return models.EventsBodyResponse{}, fmt.Errorf("get order failed: %w", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	o, ok := s.orders[orderID]
+	if !ok {
+		return models.EventsBodyResponse{}, pgstore.ErrOrderNotExists
+	}
+	return o.EventsBodyResponse, nil
+}
+
+// Orders returns orders matching the filter, the latest first.
+func (s *Store) Orders(ctx context.Context, filter models.OrdersFilter) ([]models.EventsBodyResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("get orders failed: %w", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]models.EventsBodyResponse, 0)
+	for _, o := range s.orders {
+		if (filter.WalletID == 0 || o.WalletID == filter.WalletID) &&
+			(filter.ServiceID == 0 || o.ServiceID == filter.ServiceID) &&
+			(filter.Status == "" || o.Status == filter.Status) &&
+			within(o.DateTime, filter.From, filter.To) {
+			result = append(result, o.EventsBodyResponse)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].DateTime.Equal(result[j].DateTime) {
+			return result[i].DateTime.After(result[j].DateTime)
+		}
+		return result[i].ID > result[j].ID
+	})
+	return page(result, filter.Limit, filter.Offset), nil
+}
+
+// within tells if t is in [from, to), nil bounds are open.
+func within(t time.Time, from, to *time.Time) bool {
+	return (from == nil || !t.Before(*from)) && (to == nil || t.Before(*to))
+}
+
+// page cuts a page like LIMIT and OFFSET do.
+func page[T any](list []T, limit, offset int) []T {
+	if offset >= len(list) {
+		return list[:0]
+	}
+	list = list[offset:]
+	if limit < len(list) {
+		list = list[:limit]
+	}
+	return list
+}
@@ -0,0 +1,14 @@
+package memstore
+
+import (
+	"testing"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/service"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/storetest"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestContract(t *testing.T) {
+	suite.Run(t, &storetest.Suite{NewStore: func() service.Store { return New() }})
+}
@@ -0,0 +1,179 @@
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+)
+
+// recognizedOrders returns DONE orders recognized in [from, to) in the
+// order they were recognized.
+func (st *state) recognizedOrders(from, to time.Time) []models.RecognizedOrder {
+	var result []models.RecognizedOrder
+	for _, o := range st.orders {
+		w, ok := st.wallets[o.WalletID]
+		if !ok || o.Status != "DONE" || !o.DateTime.Before(to) || !within(o.recognizedAt, &from, &to) {
+			continue
+		}
+		result = append(result, models.RecognizedOrder{
+			OrderID:      o.OrderID,
+			ServiceID:    o.ServiceID,
+			WalletID:     o.WalletID,
+			UserID:       w.UserID,
+			Price:        o.Price,
+			RecognizedAt: o.recognizedAt,
+			RecognizedBy: o.RecognizedBy,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].RecognizedAt.Equal(result[j].RecognizedAt) {
+			return result[i].RecognizedAt.Before(result[j].RecognizedAt)
+		}
+		return result[i].OrderID < result[j].OrderID
+	})
+	return result
+}
+
+// RevenueByService passes revenue of every service in [from, to) to fn.
+// Rows are collected first, so fn may call the store.
+func (s *Store) RevenueByService(ctx context.Context, from, to time.Time, fn func(models.ServiceRevenue) error) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("get revenue failed: %w", err)
+	}
+	s.mu.RLock()
+	orders := s.recognizedOrders(from, to)
+	s.mu.RUnlock()
+
+	byService := make(map[int]*models.ServiceRevenue)
+	var result []*models.ServiceRevenue
+	for _, o := range orders {
+		r, ok := byService[o.ServiceID]
+		if !ok {
+			r = &models.ServiceRevenue{ServiceID: o.ServiceID}
+			byService[o.ServiceID] = r
+			result = append(result, r)
+		}
+		r.Orders++
+		r.Revenue += o.Price
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ServiceID < result[j].ServiceID
+	})
+	for _, r := range result {
+		if err := fn(*r); err != nil {
+			return fmt.Errorf("get revenue failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// RecognizedOrders passes orders recognized in [from, to) to fn in the
+// order they were recognized.
+func (s *Store) RecognizedOrders(ctx context.Context, from, to time.Time, fn func(models.RecognizedOrder) error) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("get recognized orders failed: %w", err)
+	}
+	s.mu.RLock()
+	orders := s.recognizedOrders(from, to)
+	s.mu.RUnlock()
+
+	for _, o := range orders {
+		if err := fn(o); err != nil {
+			return fmt.Errorf("get recognized orders failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// Analytics aggregates recognized orders on every call, so there is
+// nothing to refresh and RefreshedTo is the time of the call.
+func (s *Store) Analytics(ctx context.Context, filter models.AnalyticsFilter) (models.Analytics, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Analytics{}, fmt.Errorf("get analytics failed: %w", err)
+	}
+	s.mu.RLock()
+	now := s.clock()
+	orders := s.recognizedOrders(time.Time{}, now.Add(time.Microsecond))
+	reservedAt := make(map[int]time.Time, len(orders))
+	for _, o := range orders {
+		reservedAt[o.OrderID] = s.orders[o.OrderID].DateTime
+	}
+	s.mu.RUnlock()
+
+	type group struct {
+		row     models.AnalyticsRow
+		latency float64
+	}
+	from, to := date(filter.From), date(filter.To)
+	groups := make(map[[2]int64]*group)
+	var rows []*group
+	for _, o := range orders {
+		day := date(o.RecognizedAt.UTC())
+		key := o.ServiceID
+		if filter.GroupBy == models.AnalyticsByUser {
+			key = o.UserID
+		}
+		if day.Before(from) || !day.Before(to) || filter.ID != 0 && key != filter.ID {
+			continue
+		}
+		bucket := truncate(day, filter.Bucket)
+		g, ok := groups[[2]int64{bucket.Unix(), int64(key)}]
+		if !ok {
+			g = &group{row: models.AnalyticsRow{Bucket: bucket}}
+			if filter.GroupBy == models.AnalyticsByUser {
+				g.row.UserID = key
+			} else {
+				g.row.ServiceID = key
+			}
+			groups[[2]int64{bucket.Unix(), int64(key)}] = g
+			rows = append(rows, g)
+		}
+		g.row.Orders++
+		g.row.Revenue += o.Price
+		g.latency += o.RecognizedAt.Sub(reservedAt[o.OrderID]).Seconds()
+	}
+	key := func(r models.AnalyticsRow) int { return r.ServiceID + r.UserID }
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i].row, rows[j].row
+		switch {
+		case !a.Bucket.Equal(b.Bucket):
+			return a.Bucket.Before(b.Bucket)
+		case a.Revenue != b.Revenue:
+			return a.Revenue > b.Revenue
+		}
+		return key(a) < key(b)
+	})
+
+	resp := models.Analytics{RefreshedTo: &now, Rows: []models.AnalyticsRow{}}
+	var rank int
+	for i, g := range rows {
+		if i == 0 || !g.row.Bucket.Equal(rows[i-1].row.Bucket) {
+			rank = 0
+		}
+		if rank++; filter.Limit != 0 && rank > filter.Limit {
+			continue
+		}
+		g.row.AvgLatencySeconds = g.latency / float64(g.row.Orders)
+		resp.Rows = append(resp.Rows, g.row)
+	}
+	return resp, nil
+}
+
+// date is the calendar date of t as a UTC midnight, like a Postgres date.
+func date(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// truncate is date_trunc of a date, weeks start on Monday.
+func truncate(day time.Time, bucket string) time.Time {
+	switch bucket {
+	case models.AnalyticsWeek:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case models.AnalyticsMonth:
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day
+}
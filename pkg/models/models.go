@@ -1,23 +1,34 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type AddFundsRequest struct {
 	TransactionID string `json:"transactionID"`
 	UserID        int    `json:"userID" db:"user_id"`
 	Balance       int    `json:"balance" db:"account_balance"`
+	ClientID      string `json:"-" db:"updated_by"`
+	// ExpectedVersion, when set, is the wallet version the caller has seen.
+	ExpectedVersion int64 `json:"-" db:"-"`
 }
 
+// BalanceRequest with AsOf asks for the balance at that moment.
 type BalanceRequest struct {
-	UserID int `json:"userID"`
+	UserID int        `json:"userID"`
+	AsOf   *time.Time `json:"asOf,omitempty"`
 }
 
 type WalletResponse struct {
-	ID        int       `json:"id" db:"id"`
-	UserID    int       `json:"userID" db:"user_id"`
-	Balance   int       `json:"balance" db:"account_balance"`
-	Reserved  int       `json:"reserved" db:"reserved"`
-	UpdatedAt time.Time `json:"updatedAt" db:"updated_at"`
+	ID        int        `json:"id" db:"id"`
+	UserID    int        `json:"userID" db:"user_id"`
+	Balance   int        `json:"balance" db:"account_balance"`
+	Reserved  int        `json:"reserved" db:"reserved"`
+	UpdatedAt time.Time  `json:"updatedAt" db:"updated_at"`
+	UpdatedBy string     `json:"updatedBy" db:"updated_by"`
+	Version   int64      `json:"version" db:"version"`
+	AsOf      *time.Time `json:"asOf,omitempty" db:"-"`
 }
 
 type ReservedFundsRequest struct {
@@ -26,6 +37,9 @@ type ReservedFundsRequest struct {
 	ServiceID     int    `json:"serviceID" db:"service_id"`
 	OrderID       int    `json:"orderID" db:"order_id"`
 	Price         int    `json:"price" db:"price"`
+	ClientID      string `json:"-" db:"client_id"`
+	// ExpectedVersion, when set, is the wallet version the caller has seen.
+	ExpectedVersion int64 `json:"-" db:"-"`
 }
 
 type RecognizeRevenueRequest struct {
@@ -34,14 +48,417 @@ type RecognizeRevenueRequest struct {
 	ServiceID     int    `json:"serviceID" db:"service_id"`
 	OrderID       int    `json:"orderID" db:"order_id"`
 	Status        string `json:"status" db:"status"`
+	ClientID      string `json:"-" db:"recognized_by"`
+	// ExpectedVersion, when set, is the wallet version the caller has seen.
+	ExpectedVersion int64 `json:"-" db:"-"`
 }
 
 type EventsBodyResponse struct {
-	ID        int       `json:"id" db:"id"`
-	WalletID  int       `json:"walletID" db:"wallet_id"`
-	ServiceID int       `json:"serviceID" db:"service_id"`
-	OrderID   int       `json:"orderID" db:"order_id"`
-	Price     int       `json:"price" db:"price"`
-	Status    string    `json:"status" db:"status"`
-	DateTime  time.Time `json:"dateTime" db:"datetime"`
+	ID           int       `json:"id" db:"id"`
+	WalletID     int       `json:"walletID" db:"wallet_id"`
+	ServiceID    int       `json:"serviceID" db:"service_id"`
+	OrderID      int       `json:"orderID" db:"order_id"`
+	Price        int       `json:"price" db:"price"`
+	Status       string    `json:"status" db:"status"`
+	DateTime     time.Time `json:"dateTime" db:"datetime"`
+	ClientID     string    `json:"clientID" db:"client_id"`
+	RecognizedBy string    `json:"recognizedBy" db:"recognized_by"`
+}
+
+// EventPartition is a partition of events with orders reserved in
+// [From, To).
+type EventPartition struct {
+	Name string
+	From time.Time
+	To   time.Time
+}
+
+// OrdersFilter selects orders for listing. Zero fields match any order,
+// From is inclusive and To is exclusive.
+type OrdersFilter struct {
+	WalletID  int
+	ServiceID int
+	Status    string
+	From      *time.Time
+	To        *time.Time
+	Limit     int
+	Offset    int
+}
+
+const (
+	BatchModeAtomic     = "atomic"
+	BatchModeBestEffort = "bestEffort"
+
+	BatchAddFunds         = "addFunds"
+	BatchReserveFunds     = "reserveFunds"
+	BatchRecognizeRevenue = "recognizeRevenue"
+
+	BatchStatusOK      = "OK"
+	BatchStatusFailed  = "FAILED"
+	BatchStatusSkipped = "SKIPPED"
+)
+
+type BatchRequest struct {
+	Mode       string           `json:"mode"`
+	Operations []BatchOperation `json:"operations"`
+	ClientID   string           `json:"-"`
+}
+
+type BatchOperation struct {
+	Type             string                   `json:"type"`
+	AddFunds         *AddFundsRequest         `json:"addFunds,omitempty"`
+	ReserveFunds     *ReservedFundsRequest    `json:"reserveFunds,omitempty"`
+	RecognizeRevenue *RecognizeRevenueRequest `json:"recognizeRevenue,omitempty"`
+}
+
+type BatchResponse struct {
+	Applied bool          `json:"applied"`
+	Results []BatchResult `json:"results"`
+}
+
+type BatchResult struct {
+	Index  int                 `json:"index"`
+	Status string              `json:"status"`
+	Error  string              `json:"error,omitempty"`
+	Code   string              `json:"code,omitempty"`
+	Wallet *WalletResponse     `json:"wallet,omitempty"`
+	Event  *EventsBodyResponse `json:"event,omitempty"`
+	Err    error               `json:"-"`
+}
+
+const (
+	EventWalletCredited        = "wallet.credited"
+	EventReservationCreated    = "reservation.created"
+	EventReservationRecognized = "reservation.recognized"
+	EventReservationCanceled   = "reservation.canceled"
+)
+
+type OutboxMessage struct {
+	ID        int64           `json:"id" db:"id"`
+	WalletID  int             `json:"walletID" db:"wallet_id"`
+	EventType string          `json:"type" db:"event_type"`
+	Payload   json.RawMessage `json:"payload" db:"payload"`
+	CreatedAt time.Time       `json:"createdAt" db:"created_at"`
+	Attempts  int             `json:"-" db:"attempts"`
+}
+
+// OutboxResult tells the store what happened to a fetched message. Messages
+// without a result stay untouched.
+type OutboxResult struct {
+	ID            int64
+	Err           error
+	NextAttemptAt time.Time
+}
+
+type WalletCredited struct {
+	TransactionID string         `json:"transactionID"`
+	Amount        int            `json:"amount"`
+	Wallet        WalletResponse `json:"wallet"`
+}
+
+const (
+	DeliveryPending   = "PENDING"
+	DeliveryDelivered = "DELIVERED"
+	DeliveryDead      = "DEAD"
+)
+
+type WebhookSubscription struct {
+	ID         int       `json:"id" db:"id"`
+	URL        string    `json:"url" db:"url"`
+	EventTypes []string  `json:"eventTypes" db:"-"`
+	Secret     string    `json:"secret,omitempty" db:"secret"`
+	CreatedBy  string    `json:"createdBy" db:"created_by"`
+	CreatedAt  time.Time `json:"createdAt" db:"created_at"`
+	UpdatedAt  time.Time `json:"updatedAt" db:"updated_at"`
+}
+
+type WebhookDelivery struct {
+	ID             int64           `json:"id" db:"id"`
+	SubscriptionID int             `json:"subscriptionID" db:"subscription_id"`
+	OutboxID       int64           `json:"eventID" db:"outbox_id"`
+	EventType      string          `json:"eventType" db:"event_type"`
+	Payload        json.RawMessage `json:"payload" db:"payload"`
+	Status         string          `json:"status" db:"status"`
+	Attempts       int             `json:"attempts" db:"attempts"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt" db:"next_attempt_at"`
+	LastError      string          `json:"lastError" db:"last_error"`
+	ResponseStatus int             `json:"responseStatus" db:"response_status"`
+	CreatedAt      time.Time       `json:"createdAt" db:"created_at"`
+	DeliveredAt    *time.Time      `json:"deliveredAt" db:"delivered_at"`
+	URL            string          `json:"-" db:"url"`
+	Secret         string          `json:"-" db:"secret"`
+}
+
+const (
+	CommandAddFunds         = "addFunds"
+	CommandReserveFunds     = "reserveFunds"
+	CommandRecognizeRevenue = "recognizeRevenue"
+
+	CommandStatusOK     = "OK"
+	CommandStatusFailed = "FAILED"
+)
+
+// Command is a queued request. Payload holds the request of its kind, the
+// transaction id of the command is used instead of the one in payload.
+type Command struct {
+	ID            int64           `json:"id" db:"id"`
+	Kind          string          `json:"kind" db:"kind"`
+	TransactionID string          `json:"transactionID" db:"transaction_id"`
+	ClientID      string          `json:"clientID" db:"client_id"`
+	Payload       json.RawMessage `json:"payload" db:"payload"`
+	Attempts      int             `json:"attempts" db:"attempts"`
+	CreatedAt     time.Time       `json:"createdAt" db:"created_at"`
+}
+
+type CommandReply struct {
+	CommandID     int64           `json:"commandID" db:"command_id"`
+	TransactionID string          `json:"transactionID" db:"transaction_id"`
+	Kind          string          `json:"kind" db:"kind"`
+	Status        string          `json:"status" db:"status"`
+	Result        json.RawMessage `json:"result,omitempty" db:"result"`
+	Error         string          `json:"error,omitempty" db:"error"`
+	Code          string          `json:"code,omitempty" db:"code"`
+	CreatedAt     time.Time       `json:"createdAt" db:"created_at"`
+}
+
+// Kinds of balance movements in wallet history.
+const (
+	HistoryCredit     = "CREDIT"
+	HistoryReserve    = "RESERVE"
+	HistoryDebit      = "DEBIT"
+	HistoryRelease    = "RELEASE"
+	HistoryAdjustment = "ADJUSTMENT"
+)
+
+// HistoryEntry is one movement of wallet money. Summing deltas of all
+// entries of a wallet gives its balance and reserve.
+type HistoryEntry struct {
+	ID            int64     `json:"id" db:"id"`
+	WalletID      int       `json:"walletID" db:"wallet_id"`
+	Kind          string    `json:"kind" db:"kind"`
+	BalanceDelta  int       `json:"balanceDelta" db:"balance_delta"`
+	ReservedDelta int       `json:"reservedDelta" db:"reserved_delta"`
+	OrderID       int       `json:"orderID,omitempty" db:"order_id"`
+	Reference     string    `json:"reference,omitempty" db:"reference"`
+	ClientID      string    `json:"clientID" db:"client_id"`
+	CreatedAt     time.Time `json:"createdAt" db:"created_at"`
+	PrevHash      string    `json:"prevHash" db:"prev_hash"`
+	Hash          string    `json:"hash" db:"hash"`
+}
+
+// ChainReport is the result of checking hashes of a wallet history.
+// BrokenEntryID is the first entry whose hash or link doesn't match.
+type ChainReport struct {
+	WalletID      int    `json:"walletID"`
+	Checked       int    `json:"checked"`
+	Valid         bool   `json:"valid"`
+	BrokenEntryID int64  `json:"brokenEntryID,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+	LastHash      string `json:"lastHash"`
+}
+
+// HistoryFilter selects history of a user's wallet, From is inclusive and
+// To is exclusive.
+type HistoryFilter struct {
+	UserID int
+	From   *time.Time
+	To     *time.Time
+	Limit  int
+	Offset int
+}
+
+const (
+	AdjustmentPending  = "PENDING"
+	AdjustmentApproved = "APPROVED"
+	AdjustmentRejected = "REJECTED"
+
+	EventWalletAdjusted = "wallet.adjusted"
+)
+
+// AdjustmentRequest proposes to credit (positive amount) or debit
+// (negative amount) a wallet.
+type AdjustmentRequest struct {
+	WalletID   int    `json:"walletID"`
+	Amount     int    `json:"amount"`
+	Reason     string `json:"reason"`
+	ProposedBy string `json:"-"`
+}
+
+type Adjustment struct {
+	ID         int             `json:"id" db:"id"`
+	WalletID   int             `json:"walletID" db:"wallet_id"`
+	Amount     int             `json:"amount" db:"amount"`
+	Reason     string          `json:"reason" db:"reason"`
+	Status     string          `json:"status" db:"status"`
+	ProposedBy string          `json:"proposedBy" db:"proposed_by"`
+	ProposedAt time.Time       `json:"proposedAt" db:"proposed_at"`
+	DecidedBy  string          `json:"decidedBy,omitempty" db:"decided_by"`
+	DecidedAt  *time.Time      `json:"decidedAt,omitempty" db:"decided_at"`
+	Wallet     *WalletResponse `json:"wallet,omitempty" db:"-"`
+}
+
+type AdjustmentsFilter struct {
+	WalletID int
+	Status   string
+	Limit    int
+	Offset   int
+}
+
+// WalletAdjusted is the payload of wallet.adjusted event.
+type WalletAdjusted struct {
+	Adjustment Adjustment     `json:"adjustment"`
+	Wallet     WalletResponse `json:"wallet"`
+}
+
+const (
+	AuditOK       = "OK"
+	AuditRejected = "REJECTED"
+	AuditFailed   = "FAILED"
+)
+
+// AuditRecord is a mutating API call. PayloadHash is hex SHA-256 of the
+// request body as received.
+type AuditRecord struct {
+	ID          int64     `json:"id" db:"id"`
+	CreatedAt   time.Time `json:"createdAt" db:"created_at"`
+	Actor       string    `json:"actor" db:"actor"`
+	ClientIP    string    `json:"clientIP" db:"client_ip"`
+	RequestID   string    `json:"requestID" db:"request_id"`
+	Method      string    `json:"method" db:"method"`
+	Path        string    `json:"path" db:"path"`
+	PayloadHash string    `json:"payloadHash" db:"payload_hash"`
+	Status      int       `json:"status" db:"status"`
+	Outcome     string    `json:"outcome" db:"outcome"`
+}
+
+// RateBucket is a token bucket holding up to Burst tokens and refilling at
+// Rate tokens per second.
+type RateBucket struct {
+	Key   string
+	Rate  float64
+	Burst int
+}
+
+// AuditFilter selects audit records, From is inclusive and To is exclusive.
+type AuditFilter struct {
+	Actor     string
+	RequestID string
+	Path      string
+	Outcome   string
+	From      *time.Time
+	To        *time.Time
+	Limit     int
+	Offset    int
+}
+
+// StatementFilter selects statements of the period, From is inclusive and
+// To is exclusive. Zero UserID selects all wallets.
+type StatementFilter struct {
+	UserID int
+	From   time.Time
+	To     time.Time
+}
+
+// Statement sums up movements of a wallet in the period. Debits and
+// Releases are positive amounts that left the balance and the reserve.
+type Statement struct {
+	UserID          int            `json:"userID" db:"user_id"`
+	WalletID        int            `json:"walletID" db:"wallet_id"`
+	From            time.Time      `json:"from" db:"-"`
+	To              time.Time      `json:"to" db:"-"`
+	OpeningBalance  int            `json:"openingBalance" db:"opening_balance"`
+	OpeningReserved int            `json:"openingReserved" db:"opening_reserved"`
+	Credits         int            `json:"credits" db:"credits"`
+	Debits          int            `json:"debits" db:"debits"`
+	Holds           int            `json:"holds" db:"holds"`
+	Releases        int            `json:"releases" db:"releases"`
+	ClosingBalance  int            `json:"closingBalance" db:"closing_balance"`
+	ClosingReserved int            `json:"closingReserved" db:"closing_reserved"`
+	Entries         []HistoryEntry `json:"entries,omitempty" db:"-"`
+}
+
+// ServiceRevenue is revenue of orders of a service recognized in a period.
+type ServiceRevenue struct {
+	ServiceID int `json:"serviceID" db:"service_id"`
+	Orders    int `json:"orders" db:"orders"`
+	Revenue   int `json:"revenue" db:"revenue"`
+}
+
+// RecognizedOrder is a DONE order with the time its revenue was recognized.
+type RecognizedOrder struct {
+	OrderID      int       `json:"orderID" db:"order_id"`
+	ServiceID    int       `json:"serviceID" db:"service_id"`
+	WalletID     int       `json:"walletID" db:"wallet_id"`
+	UserID       int       `json:"userID" db:"user_id"`
+	Price        int       `json:"price" db:"price"`
+	RecognizedAt time.Time `json:"recognizedAt" db:"recognized_at"`
+	RecognizedBy string    `json:"recognizedBy" db:"recognized_by"`
+}
+
+const (
+	ReportJobPending = "PENDING"
+	ReportJobRunning = "RUNNING"
+	ReportJobDone    = "DONE"
+	ReportJobFailed  = "FAILED"
+)
+
+// ReportJob builds a report of the period [From, To) in the background.
+// URL is a signed link to the file of a DONE job.
+type ReportJob struct {
+	ID          int64      `json:"id" db:"id"`
+	Kind        string     `json:"kind" db:"kind"`
+	Format      string     `json:"format" db:"format"`
+	From        time.Time  `json:"from" db:"period_from"`
+	To          time.Time  `json:"to" db:"period_to"`
+	Delimiter   string     `json:"delimiter,omitempty" db:"delimiter"`
+	Encoding    string     `json:"encoding,omitempty" db:"encoding"`
+	Status      string     `json:"status" db:"status"`
+	Error       string     `json:"error,omitempty" db:"error"`
+	BlobKey     string     `json:"-" db:"blob_key"`
+	Size        int64      `json:"size,omitempty" db:"size"`
+	RequestedBy string     `json:"requestedBy" db:"requested_by"`
+	CreatedAt   time.Time  `json:"createdAt" db:"created_at"`
+	StartedAt   *time.Time `json:"startedAt,omitempty" db:"started_at"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty" db:"finished_at"`
+	URL         string     `json:"url,omitempty" db:"-"`
+}
+
+const (
+	AnalyticsByService = "service"
+	AnalyticsByUser    = "user"
+
+	AnalyticsDay   = "day"
+	AnalyticsWeek  = "week"
+	AnalyticsMonth = "month"
+)
+
+// AnalyticsFilter selects aggregates of recognized orders of days in
+// [From, To) (UTC) in buckets of a day, week or month grouped by service or
+// by user. ID keeps only the service or user, Limit keeps the top earning
+// groups of every bucket.
+type AnalyticsFilter struct {
+	GroupBy string
+	Bucket  string
+	From    time.Time
+	To      time.Time
+	ID      int
+	Limit   int
+}
+
+// AnalyticsRow aggregates orders of a service or user recognized in the
+// bucket starting at Bucket. AvgLatencySeconds is the average time from
+// reservation to recognition.
+type AnalyticsRow struct {
+	Bucket            time.Time `json:"bucket" db:"bucket"`
+	ServiceID         int       `json:"serviceID,omitempty" db:"service_id"`
+	UserID            int       `json:"userID,omitempty" db:"user_id"`
+	Orders            int       `json:"orders" db:"orders"`
+	Revenue           int       `json:"revenue" db:"revenue"`
+	AvgLatencySeconds float64   `json:"avgLatencySeconds" db:"avg_latency_seconds"`
+}
+
+// Analytics holds rows built from orders recognized before RefreshedTo.
+type Analytics struct {
+	RefreshedTo *time.Time     `json:"refreshedTo"`
+	Rows        []AnalyticsRow `json:"rows"`
 }
@@ -0,0 +1,94 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+)
+
+// WebhookPublisher posts every message as JSON to a single URL. Any 2xx
+// response acknowledges the message.
+type WebhookPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookPublisher(url string) *WebhookPublisher {
+	return &WebhookPublisher{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *WebhookPublisher) Publish(ctx context.Context, msg models.OutboxMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("publish failed: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("publish failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", strconv.FormatInt(msg.ID, 10))
+	req.Header.Set("X-Event-Type", msg.EventType)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("publish failed: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("publish failed: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// MemoryPublisher keeps published messages in memory for tests. After
+// SetErr it fails every Publish with that error.
+type MemoryPublisher struct {
+	mu       sync.Mutex
+	err      error
+	messages []models.OutboxMessage
+}
+
+func (p *MemoryPublisher) Publish(_ context.Context, msg models.OutboxMessage) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.messages = append(p.messages, msg)
+	return nil
+}
+
+func (p *MemoryPublisher) SetErr(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+func (p *MemoryPublisher) Messages() []models.OutboxMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]models.OutboxMessage(nil), p.messages...)
+}
+
+// MultiPublisher publishes every message to each publisher in turn. A
+// failure makes the relay retry the message on all of them.
+type MultiPublisher []Publisher
+
+func (p MultiPublisher) Publish(ctx context.Context, msg models.OutboxMessage) error {
+	for _, publisher := range p {
+		if err := publisher.Publish(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Store interface {
+	RelayOutbox(ctx context.Context, limit int, publish func(ctx context.Context, msgs []models.OutboxMessage) []models.OutboxResult) (int, error)
+}
+
+// Publisher delivers a message somewhere. A message is retried until
+// Publish returns nil, so consumers must tolerate duplicates.
+type Publisher interface {
+	Publish(ctx context.Context, msg models.OutboxMessage) error
+}
+
+type Relay struct {
+	log        *logrus.Entry
+	store      Store
+	publisher  Publisher
+	interval   time.Duration
+	batchSize  int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	now        func() time.Time
+}
+
+func NewRelay(log *logrus.Logger, store Store, publisher Publisher, interval time.Duration) *Relay {
+	return &Relay{
+		log:        log.WithField("module", "outbox"),
+		store:      store,
+		publisher:  publisher,
+		interval:   interval,
+		batchSize:  100,
+		minBackoff: time.Second,
+		maxBackoff: 5 * time.Minute,
+		now:        time.Now,
+	}
+}
+
+func (r *Relay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	r.log.Infof("starting outbox relay")
+	for {
+		n, err := r.store.RelayOutbox(ctx, r.batchSize, r.publish)
+		if err != nil && ctx.Err() == nil {
+			r.log.Warnf("err during relay: %v", err)
+		}
+		if n == r.batchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// publish sends messages of different wallets concurrently and messages of
+// one wallet in order, stopping at the first failure so that the rest wait
+// for its retry.
+func (r *Relay) publish(ctx context.Context, msgs []models.OutboxMessage) []models.OutboxResult {
+	var wallets []int
+	byWallet := make(map[int][]models.OutboxMessage)
+	for _, msg := range msgs {
+		if _, ok := byWallet[msg.WalletID]; !ok {
+			wallets = append(wallets, msg.WalletID)
+		}
+		byWallet[msg.WalletID] = append(byWallet[msg.WalletID], msg)
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results []models.OutboxResult
+	)
+	for _, walletID := range wallets {
+		wg.Add(1)
+		go func(msgs []models.OutboxMessage) {
+			defer wg.Done()
+			for _, msg := range msgs {
+				result := models.OutboxResult{ID: msg.ID}
+				if err := r.publisher.Publish(ctx, msg); err != nil {
+					r.log.Warnf("err during publishing message %d: %v", msg.ID, err)
+					result.Err = err
+					result.NextAttemptAt = r.now().Add(r.backoff(msg.Attempts))
+				}
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+				if result.Err != nil {
+					return
+				}
+			}
+		}(byWallet[walletID])
+	}
+	wg.Wait()
+	return results
+}
+
+func (r *Relay) backoff(attempts int) time.Duration {
+	d := r.minBackoff
+	for i := 0; i < attempts && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	return d
+}
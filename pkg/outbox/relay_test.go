@@ -0,0 +1,90 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStore keeps the outbox in memory with the same rules as pgstore.
+type fakeStore struct {
+	now       time.Time
+	msgs      []models.OutboxMessage
+	published map[int64]bool
+	next      map[int64]time.Time
+}
+
+func (s *fakeStore) RelayOutbox(ctx context.Context, limit int, publish func(ctx context.Context, msgs []models.OutboxMessage) []models.OutboxResult) (int, error) {
+	var due []models.OutboxMessage
+	blocked := make(map[int]bool)
+	for _, msg := range s.msgs {
+		if s.published[msg.ID] {
+			continue
+		}
+		if s.next[msg.ID].After(s.now) {
+			blocked[msg.WalletID] = true
+			continue
+		}
+		if !blocked[msg.WalletID] && len(due) < limit {
+			due = append(due, msg)
+		}
+	}
+	for _, r := range publish(ctx, due) {
+		if r.Err != nil {
+			s.next[r.ID] = r.NextAttemptAt
+			for i := range s.msgs {
+				if s.msgs[i].ID == r.ID {
+					s.msgs[i].Attempts++
+				}
+			}
+			continue
+		}
+		s.published[r.ID] = true
+	}
+	return len(due), nil
+}
+
+func TestRelayKeepsOrderPerWallet(t *testing.T) {
+	store := &fakeStore{
+		now:       time.Unix(1_000_000, 0),
+		published: make(map[int64]bool),
+		next:      make(map[int64]time.Time),
+	}
+	for i := 1; i <= 6; i++ {
+		store.msgs = append(store.msgs, models.OutboxMessage{ID: int64(i), WalletID: i % 2, EventType: models.EventWalletCredited})
+	}
+	publisher := &MemoryPublisher{}
+	relay := NewRelay(logrus.New(), store, publisher, time.Second)
+	relay.now = func() time.Time { return store.now }
+	ctx := context.Background()
+
+	publisher.SetErr(fmt.Errorf("receiver is down"))
+	n, err := store.RelayOutbox(ctx, 10, relay.publish)
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+	require.Empty(t, publisher.Messages())
+	require.Equal(t, store.now.Add(time.Second), store.next[1])
+
+	publisher.SetErr(nil)
+	n, err = store.RelayOutbox(ctx, 10, relay.publish)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	store.now = store.now.Add(time.Second)
+	n, err = store.RelayOutbox(ctx, 10, relay.publish)
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+
+	perWallet := make(map[int][]int64)
+	for _, msg := range publisher.Messages() {
+		perWallet[msg.WalletID] = append(perWallet[msg.WalletID], msg.ID)
+	}
+	require.Equal(t, []int64{1, 3, 5}, perWallet[1])
+	require.Equal(t, []int64{2, 4, 6}, perWallet[0])
+}
@@ -0,0 +1,202 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrAdjustmentNotExists = fmt.Errorf("adjustment doesn't exist")
+	ErrAdjustmentProcessed = fmt.Errorf("adjustment has already been decided")
+	ErrInvalidAdjustment   = fmt.Errorf("adjustment must have non-zero amount, reason and proposer")
+	ErrSameApprover        = fmt.Errorf("adjustment must be decided by another operator")
+)
+
+const adjustmentColumns = `id, wallet_id, amount, reason, status, proposed_by, proposed_at, decided_by, decided_at`
+
+// ProposeAdjustment saves a pending adjustment. A debit that exceeds the
+// available balance is rejected right away.
+func (s *Store) ProposeAdjustment(ctx context.Context, data models.AdjustmentRequest) (models.Adjustment, error) {
+	data.Reason = strings.TrimSpace(data.Reason)
+	if data.Amount == 0 || data.Reason == "" || data.ProposedBy == "" {
+		return models.Adjustment{}, ErrInvalidAdjustment
+	}
+	query := `
+SELECT account_balance - reserved
+FROM wallets
+WHERE id = $1;`
+	var available int
+
+	err := s.db.GetContext(ctx, &available, query, data.WalletID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return models.Adjustment{}, ErrUserNotExists
+	case err != nil:
+		return models.Adjustment{}, fmt.Errorf("propose adjustment failed: %w", classify(err))
+	}
+	if available+data.Amount < 0 {
+		return models.Adjustment{}, ErrNotEnoughFunds
+	}
+
+	query = `
+INSERT INTO adjustments (wallet_id, amount, reason, proposed_by)
+VALUES ($1, $2, $3, $4)
+RETURNING ` + adjustmentColumns + `;`
+	var result models.Adjustment
+
+	if err = s.db.GetContext(ctx, &result, query, data.WalletID, data.Amount, data.Reason, data.ProposedBy); err != nil {
+		return models.Adjustment{}, fmt.Errorf("propose adjustment failed: %w", classify(err))
+	}
+	return result, nil
+}
+
+// ApproveAdjustment applies a pending adjustment approved by an operator
+// other than the proposer. The wallet, its history and the adjustment are
+// changed in one transaction, a debit that would make the available
+// balance negative leaves the adjustment pending.
+func (s *Store) ApproveAdjustment(ctx context.Context, id int, approver string) (models.Adjustment, error) {
+	var adj models.Adjustment
+	var wallet models.WalletResponse
+	err := s.inTx(ctx, "approve adjustment", sql.LevelDefault, func(tx *sqlx.Tx) error {
+		var err error
+		if adj, err = s.pendingAdjustment(ctx, tx, id, approver); err != nil {
+			return err
+		}
+
+		query := `
+UPDATE wallets
+SET account_balance = account_balance + $2,
+    version = version + 1,
+    updated_at = NOW(),
+    updated_by = $3
+WHERE id = $1
+  AND account_balance + $2 - reserved >= 0
+RETURNING id, user_id, account_balance, reserved, updated_at, updated_by, version;`
+
+		err = tx.GetContext(ctx, &wallet, query, adj.WalletID, adj.Amount, approver)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrNotEnoughFunds
+		case err != nil:
+			return fmt.Errorf("approve adjustment failed: %w", err)
+		}
+
+		query = `
+UPDATE adjustments
+SET status = 'APPROVED',
+    decided_by = $2,
+    decided_at = NOW()
+WHERE id = $1
+RETURNING ` + adjustmentColumns + `;`
+		if err = tx.GetContext(ctx, &adj, query, id, approver); err != nil {
+			return fmt.Errorf("approve adjustment failed: %w", err)
+		}
+		err = s.addHistory(ctx, tx, historyEntry{
+			walletID:     wallet.ID,
+			kind:         models.HistoryAdjustment,
+			balanceDelta: adj.Amount,
+			reference:    fmt.Sprintf("adjustment:%d", adj.ID),
+			clientID:     approver,
+		})
+		if err != nil {
+			return fmt.Errorf("approve adjustment failed: %w", err)
+		}
+		err = s.addToOutbox(ctx, tx, outboxEntry{
+			walletID:  wallet.ID,
+			eventType: models.EventWalletAdjusted,
+			payload:   models.WalletAdjusted{Adjustment: adj, Wallet: wallet},
+		})
+		if err != nil {
+			return fmt.Errorf("approve adjustment failed: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return models.Adjustment{}, err
+	}
+	adj.Wallet = &wallet
+	return adj, nil
+}
+
+// RejectAdjustment closes a pending adjustment without touching the wallet.
+func (s *Store) RejectAdjustment(ctx context.Context, id int, approver string) (models.Adjustment, error) {
+	var result models.Adjustment
+	err := s.inTx(ctx, "reject adjustment", sql.LevelDefault, func(tx *sqlx.Tx) error {
+		if _, err := s.pendingAdjustment(ctx, tx, id, approver); err != nil {
+			return err
+		}
+		query := `
+UPDATE adjustments
+SET status = 'REJECTED',
+    decided_by = $2,
+    decided_at = NOW()
+WHERE id = $1
+RETURNING ` + adjustmentColumns + `;`
+
+		if err := tx.GetContext(ctx, &result, query, id, approver); err != nil {
+			return fmt.Errorf("reject adjustment failed: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return models.Adjustment{}, err
+	}
+	return result, nil
+}
+
+// pendingAdjustment locks the adjustment and checks that approver may
+// decide it.
+func (s *Store) pendingAdjustment(ctx context.Context, q q, id int, approver string) (models.Adjustment, error) {
+	query := `SELECT ` + adjustmentColumns + ` FROM adjustments WHERE id = $1 FOR UPDATE;`
+	var result models.Adjustment
+
+	err := q.GetContext(ctx, &result, query, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return models.Adjustment{}, ErrAdjustmentNotExists
+	case err != nil:
+		return models.Adjustment{}, fmt.Errorf("get adjustment failed: %w", err)
+	case result.Status != models.AdjustmentPending:
+		return models.Adjustment{}, ErrAdjustmentProcessed
+	case approver == "" || approver == result.ProposedBy:
+		return models.Adjustment{}, ErrSameApprover
+	}
+	return result, nil
+}
+
+func (s *Store) Adjustment(ctx context.Context, id int) (models.Adjustment, error) {
+	query := `SELECT ` + adjustmentColumns + ` FROM adjustments WHERE id = $1;`
+	var result models.Adjustment
+
+	err := s.db.GetContext(ctx, &result, query, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return models.Adjustment{}, ErrAdjustmentNotExists
+	case err != nil:
+		return models.Adjustment{}, fmt.Errorf("get adjustment failed: %w", classify(err))
+	}
+	return result, nil
+}
+
+func (s *Store) Adjustments(ctx context.Context, filter models.AdjustmentsFilter) ([]models.Adjustment, error) {
+	query := `
+SELECT ` + adjustmentColumns + `
+FROM adjustments
+WHERE ($1 = 0 OR wallet_id = $1)
+  AND ($2 = '' OR status = $2)
+ORDER BY id DESC
+LIMIT $3 OFFSET $4;`
+	result := make([]models.Adjustment, 0)
+
+	if err := s.db.SelectContext(ctx, &result, query, filter.WalletID, filter.Status, filter.Limit, filter.Offset); err != nil {
+		return nil, fmt.Errorf("get adjustments failed: %w", classify(err))
+	}
+	return result, nil
+}
@@ -0,0 +1,147 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// analyticsRescan is how far before the previous refresh days are rolled
+// up again, so recognitions committed after a refresh that started before
+// it are counted.
+const analyticsRescan = time.Hour
+
+// RefreshAnalytics rolls up again the days from analyticsRescan before the
+// previous refresh up to to, so analytics never scan events. Rollups of
+// these days are replaced, a refresh can be repeated. The first refresh
+// rolls up all orders. Archives are not read: only partitions without
+// REQUESTED orders are archived, nothing in them is recognized after.
+func (s *Store) RefreshAnalytics(ctx context.Context, to time.Time) (int, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("refresh analytics failed: %w", classify(err))
+	}
+	defer func() {
+		if err = tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			s.log.Warnf("refresh analytics failed: %v", err)
+		}
+	}()
+
+	if err = withoutStatementTimeout(ctx, tx); err != nil {
+		return 0, fmt.Errorf("refresh analytics failed: %w", classify(err))
+	}
+	var from sql.NullTime
+	if err = tx.GetContext(ctx, &from, `SELECT refreshed_to FROM analytics_refresh WHERE id = 1 FOR UPDATE;`); err != nil {
+		return 0, fmt.Errorf("refresh analytics failed: %w", classify(err))
+	}
+	if from.Valid && !from.Time.Before(to) {
+		return 0, nil
+	}
+	// Days start at midnight UTC, the rescan starts at the start of a day.
+	start := time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC)
+	if from.Valid {
+		y, m, d := from.Time.Add(-analyticsRescan).UTC().Date()
+		start = time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	for _, table := range []string{"analytics_service_daily", "analytics_user_daily"} {
+		if _, err = tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE day >= $1::date;`, start); err != nil {
+			return 0, fmt.Errorf("refresh analytics failed: %w", classify(err))
+		}
+	}
+	query := `
+WITH o AS (
+    SELECT e.service_id, w.user_id, e.price,
+        (COALESCE(h.created_at, e.datetime) AT TIME ZONE 'UTC')::date AS day,
+        EXTRACT(EPOCH FROM h.created_at - e.datetime)::float8 AS latency` + recognizedOrdersFrom("events") + `
+), by_service AS (
+    INSERT INTO analytics_service_daily (day, service_id, orders, revenue, latency_seconds, latency_orders)
+    SELECT day, service_id, COUNT(*), SUM(price), COALESCE(SUM(latency), 0), COUNT(latency)
+    FROM o
+    GROUP BY day, service_id
+), by_user AS (
+    INSERT INTO analytics_user_daily (day, user_id, orders, revenue, latency_seconds, latency_orders)
+    SELECT day, user_id, COUNT(*), SUM(price), COALESCE(SUM(latency), 0), COUNT(latency)
+    FROM o
+    GROUP BY day, user_id
+)
+SELECT COUNT(*) FROM o;`
+	var n int
+	if err = tx.GetContext(ctx, &n, query, start, to); err != nil {
+		return 0, fmt.Errorf("refresh analytics failed: %w", classify(err))
+	}
+	if _, err = tx.ExecContext(ctx, `UPDATE analytics_refresh SET refreshed_to = $1 WHERE id = 1;`, to); err != nil {
+		return 0, fmt.Errorf("refresh analytics failed: %w", classify(err))
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("refresh analytics failed: %w", classify(err))
+	}
+	return n, nil
+}
+
+// Analytics returns aggregates from the daily rollups, see
+// models.AnalyticsFilter. Rows are ordered by bucket and revenue.
+func (s *Store) Analytics(ctx context.Context, filter models.AnalyticsFilter) (models.Analytics, error) {
+	table, key := "analytics_service_daily", "service_id"
+	if filter.GroupBy == models.AnalyticsByUser {
+		table, key = "analytics_user_daily", "user_id"
+	}
+	query := fmt.Sprintf(`
+SELECT bucket, %[2]s, orders, revenue, avg_latency_seconds
+FROM (
+    SELECT *, ROW_NUMBER() OVER (PARTITION BY bucket ORDER BY revenue DESC, %[2]s) AS rank
+    FROM (
+        SELECT date_trunc($1, day::timestamp)::date AS bucket, %[2]s,
+            SUM(orders)::bigint AS orders, SUM(revenue)::bigint AS revenue,
+            COALESCE(SUM(latency_seconds) / NULLIF(SUM(latency_orders), 0), 0) AS avg_latency_seconds
+        FROM %[1]s
+        WHERE day >= $2::date
+          AND day < $3::date
+          AND ($4 = 0 OR %[2]s = $4)
+        GROUP BY 1, 2
+    ) g
+) r
+WHERE $5 = 0 OR rank <= $5
+ORDER BY bucket, revenue DESC, %[2]s;`, table, key)
+
+	var resp models.Analytics
+	err := s.read(ctx, func(db *sqlx.DB) (err error) {
+		resp, err = s.analytics(ctx, db, query, filter)
+		return err
+	})
+	if err != nil {
+		return models.Analytics{}, fmt.Errorf("get analytics failed: %w", classify(err))
+	}
+	return resp, nil
+}
+
+func (s *Store) analytics(ctx context.Context, db *sqlx.DB, query string, filter models.AnalyticsFilter) (models.Analytics, error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return models.Analytics{}, err
+	}
+	defer func() {
+		if err = tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			s.log.Warnf("get analytics failed: %v", err)
+		}
+	}()
+
+	resp := models.Analytics{Rows: []models.AnalyticsRow{}}
+	var refreshedTo sql.NullTime
+	if err = tx.GetContext(ctx, &refreshedTo, `SELECT refreshed_to FROM analytics_refresh WHERE id = 1;`); err != nil {
+		return models.Analytics{}, err
+	}
+	if refreshedTo.Valid {
+		resp.RefreshedTo = &refreshedTo.Time
+	}
+	if err = tx.SelectContext(ctx, &resp.Rows, query, filter.Bucket,
+		filter.From.Format(time.DateOnly), filter.To.Format(time.DateOnly), filter.ID, filter.Limit); err != nil {
+		return models.Analytics{}, err
+	}
+	return resp, nil
+}
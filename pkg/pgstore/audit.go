@@ -0,0 +1,45 @@
+package pgstore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+)
+
+// RecordAudit appends a record to audit_log. Triggers reject updates and
+// deletes of the table, so records can only be added.
+func (s *Store) RecordAudit(ctx context.Context, data models.AuditRecord) error {
+	query := `
+INSERT INTO audit_log (actor, client_ip, request_id, method, path, payload_hash, status, outcome)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`
+	_, err := s.db.ExecContext(ctx, query, data.Actor, data.ClientIP, data.RequestID, data.Method, data.Path,
+		data.PayloadHash, data.Status, data.Outcome)
+	if err != nil {
+		return fmt.Errorf("record audit failed: %w", classify(err))
+	}
+	return nil
+}
+
+// AuditRecords returns records matching the filter, the latest first.
+func (s *Store) AuditRecords(ctx context.Context, filter models.AuditFilter) ([]models.AuditRecord, error) {
+	query := `
+SELECT id, created_at, actor, client_ip, request_id, method, path, payload_hash, status, outcome
+FROM audit_log
+WHERE ($1 = '' OR actor = $1)
+  AND ($2 = '' OR request_id = $2)
+  AND ($3 = '' OR path = $3)
+  AND ($4 = '' OR outcome = $4)
+  AND ($5::timestamptz IS NULL OR created_at >= $5)
+  AND ($6::timestamptz IS NULL OR created_at < $6)
+ORDER BY id DESC
+LIMIT $7 OFFSET $8;`
+	result := make([]models.AuditRecord, 0)
+
+	err := s.db.SelectContext(ctx, &result, query, filter.Actor, filter.RequestID, filter.Path, filter.Outcome,
+		filter.From, filter.To, filter.Limit, filter.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("get audit records failed: %w", classify(err))
+	}
+	return result, nil
+}
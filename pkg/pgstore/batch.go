@@ -0,0 +1,520 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Batch applies credits first, then reservations, then recognitions, each
+// kind with a fixed number of set-based statements. In atomic mode nothing
+// is applied if any operation fails.
+func (s *Store) Batch(ctx context.Context, data models.BatchRequest) (models.BatchResponse, error) {
+	resp, err := s.batch(ctx, data)
+	return resp, classify(err)
+}
+
+// errBatchRejected rolls back an atomic batch with a failed operation.
+var errBatchRejected = fmt.Errorf("batch rejected")
+
+func (s *Store) batch(ctx context.Context, data models.BatchRequest) (models.BatchResponse, error) {
+	var resp models.BatchResponse
+	err := s.inTx(ctx, "batch", sql.LevelDefault, func(tx *sqlx.Tx) error {
+		results := make([]models.BatchResult, len(data.Operations))
+		for i := range results {
+			results[i] = models.BatchResult{Index: i, Status: models.BatchStatusOK}
+		}
+		saved, err := s.batchTransactions(ctx, tx, data, results)
+		if err != nil {
+			return fmt.Errorf("batch failed: %w", err)
+		}
+		if err = s.batchAddFunds(ctx, tx, data, results); err != nil {
+			return fmt.Errorf("batch failed: %w", err)
+		}
+		if err = s.batchReserveFunds(ctx, tx, data, results); err != nil {
+			return fmt.Errorf("batch failed: %w", err)
+		}
+		if err = s.batchRecognizeRevenue(ctx, tx, data, results); err != nil {
+			return fmt.Errorf("batch failed: %w", err)
+		}
+
+		if data.Mode == models.BatchModeAtomic && failed(results) {
+			for i := range results {
+				if results[i].Status == models.BatchStatusOK {
+					results[i] = models.BatchResult{Index: i, Status: models.BatchStatusSkipped}
+				}
+			}
+			resp = models.BatchResponse{Results: results}
+			return errBatchRejected
+		}
+		if err = s.releaseTransactions(ctx, tx, data, results, saved); err != nil {
+			return fmt.Errorf("batch failed: %w", err)
+		}
+		if err = s.addHistory(ctx, tx, batchHistory(data, results)...); err != nil {
+			return fmt.Errorf("batch failed: %w", err)
+		}
+		if err = s.addToOutbox(ctx, tx, batchOutbox(data, results)...); err != nil {
+			return fmt.Errorf("batch failed: %w", err)
+		}
+		resp = models.BatchResponse{Applied: true, Results: results}
+		return nil
+	})
+	if errors.Is(err, errBatchRejected) {
+		return resp, nil
+	}
+	return resp, err
+}
+
+// batchOutbox lists messages in the order the operations were applied.
+func batchOutbox(data models.BatchRequest, results []models.BatchResult) []outboxEntry {
+	var entries []outboxEntry
+	for _, opType := range []string{models.BatchAddFunds, models.BatchReserveFunds, models.BatchRecognizeRevenue} {
+		for i, op := range data.Operations {
+			r := results[i]
+			if op.Type != opType || r.Status != models.BatchStatusOK {
+				continue
+			}
+			switch op.Type {
+			case models.BatchAddFunds:
+				entries = append(entries, outboxEntry{
+					walletID:  r.Wallet.ID,
+					eventType: models.EventWalletCredited,
+					payload:   models.WalletCredited{TransactionID: op.AddFunds.TransactionID, Amount: op.AddFunds.Balance, Wallet: *r.Wallet},
+				})
+			case models.BatchReserveFunds:
+				entries = append(entries, outboxEntry{walletID: r.Event.WalletID, eventType: models.EventReservationCreated, payload: *r.Event})
+			case models.BatchRecognizeRevenue:
+				entries = append(entries, outboxEntry{walletID: r.Event.WalletID, eventType: recognizedEventType(r.Event.Status), payload: *r.Event})
+			}
+		}
+	}
+	return entries
+}
+
+// batchHistory lists movements in the order the operations were applied.
+func batchHistory(data models.BatchRequest, results []models.BatchResult) []historyEntry {
+	var entries []historyEntry
+	for _, opType := range []string{models.BatchAddFunds, models.BatchReserveFunds, models.BatchRecognizeRevenue} {
+		for i, op := range data.Operations {
+			r := results[i]
+			if op.Type != opType || r.Status != models.BatchStatusOK {
+				continue
+			}
+			switch op.Type {
+			case models.BatchAddFunds:
+				entries = append(entries, historyEntry{
+					walletID:     r.Wallet.ID,
+					kind:         models.HistoryCredit,
+					balanceDelta: op.AddFunds.Balance,
+					reference:    op.AddFunds.TransactionID,
+					clientID:     data.ClientID,
+				})
+			case models.BatchReserveFunds:
+				entries = append(entries, historyEntry{
+					walletID:      r.Event.WalletID,
+					kind:          models.HistoryReserve,
+					reservedDelta: r.Event.Price,
+					orderID:       r.Event.OrderID,
+					reference:     op.ReserveFunds.TransactionID,
+					clientID:      data.ClientID,
+				})
+			case models.BatchRecognizeRevenue:
+				entries = append(entries, recognizedHistory(*r.Event, op.RecognizeRevenue.TransactionID))
+			}
+		}
+	}
+	return entries
+}
+
+func failed(results []models.BatchResult) bool {
+	for _, r := range results {
+		if r.Status == models.BatchStatusFailed {
+			return true
+		}
+	}
+	return false
+}
+
+func fail(result *models.BatchResult, err error) {
+	result.Status = models.BatchStatusFailed
+	result.Err = err
+}
+
+// batchTransactions saves transaction ids of the operations and fails the
+// operations whose transactions have already been made. It returns the
+// indexes of operations whose ids were saved.
+func (s *Store) batchTransactions(ctx context.Context, tx *sqlx.Tx, data models.BatchRequest, results []models.BatchResult) ([]int, error) {
+	var ids []string
+	var indexes []int
+	seen := make(map[string]struct{})
+	for i, op := range data.Operations {
+		id := batchTransactionID(op)
+		if id == "" {
+			continue
+		}
+		if _, ok := seen[id]; ok {
+			fail(&results[i], ErrDuplicateTransaction)
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+		indexes = append(indexes, i)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	query := `
+INSERT INTO processed_transactions (id)
+SELECT unnest($1::varchar[])
+ON CONFLICT (id) DO NOTHING
+RETURNING id;`
+	var inserted []string
+	if err := tx.SelectContext(ctx, &inserted, query, ids); err != nil {
+		return nil, fmt.Errorf("save transactions failed: %w", err)
+	}
+	ok := make(map[string]struct{}, len(inserted))
+	for _, id := range inserted {
+		ok[id] = struct{}{}
+	}
+	var saved []int
+	for j, i := range indexes {
+		if _, found := ok[ids[j]]; !found {
+			fail(&results[i], ErrDuplicateTransaction)
+			continue
+		}
+		saved = append(saved, i)
+	}
+	return saved, nil
+}
+
+// releaseTransactions forgets transaction ids of failed operations, so they
+// can be retried with the same ids.
+func (s *Store) releaseTransactions(ctx context.Context, tx *sqlx.Tx, data models.BatchRequest, results []models.BatchResult, saved []int) error {
+	var ids []string
+	for _, i := range saved {
+		if results[i].Status == models.BatchStatusFailed {
+			ids = append(ids, batchTransactionID(data.Operations[i]))
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM processed_transactions WHERE id = ANY($1::varchar[]);`, ids); err != nil {
+		return fmt.Errorf("release transactions failed: %w", err)
+	}
+	return nil
+}
+
+func batchTransactionID(op models.BatchOperation) string {
+	switch op.Type {
+	case models.BatchAddFunds:
+		return op.AddFunds.TransactionID
+	case models.BatchReserveFunds:
+		return op.ReserveFunds.TransactionID
+	case models.BatchRecognizeRevenue:
+		return op.RecognizeRevenue.TransactionID
+	}
+	return ""
+}
+
+func (s *Store) batchAddFunds(ctx context.Context, tx *sqlx.Tx, data models.BatchRequest, results []models.BatchResult) error {
+	var userIDs, amounts []int
+	for i, op := range data.Operations {
+		if op.Type == models.BatchAddFunds && results[i].Status == models.BatchStatusOK {
+			userIDs = append(userIDs, op.AddFunds.UserID)
+			amounts = append(amounts, op.AddFunds.Balance)
+		}
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+	query := `
+INSERT INTO wallets (user_id, account_balance, updated_by)
+SELECT user_id, SUM(amount), $3
+FROM unnest($1::int[], $2::int[]) AS t (user_id, amount)
+GROUP BY user_id
+ON CONFLICT (user_id) DO UPDATE SET
+	account_balance = wallets.account_balance + EXCLUDED.account_balance,
+	version = wallets.version + 1,
+	updated_at = NOW(),
+	updated_by = EXCLUDED.updated_by
+RETURNING id, user_id, account_balance, reserved, updated_at, updated_by, version;`
+	var wallets []models.WalletResponse
+
+	if err := tx.SelectContext(ctx, &wallets, query, userIDs, amounts, data.ClientID); err != nil {
+		return fmt.Errorf("add funds failed: %w", err)
+	}
+	byUser := make(map[int]models.WalletResponse, len(wallets))
+	for _, w := range wallets {
+		byUser[w.UserID] = w
+	}
+	for i, op := range data.Operations {
+		if op.Type == models.BatchAddFunds && results[i].Status == models.BatchStatusOK {
+			w := byUser[op.AddFunds.UserID]
+			results[i].Wallet = &w
+		}
+	}
+	return nil
+}
+
+func (s *Store) batchReserveFunds(ctx context.Context, tx *sqlx.Tx, data models.BatchRequest, results []models.BatchResult) error {
+	var walletIDs, orderIDs []int
+	for i, op := range data.Operations {
+		if op.Type == models.BatchReserveFunds && results[i].Status == models.BatchStatusOK {
+			walletIDs = append(walletIDs, op.ReserveFunds.WalletID)
+			orderIDs = append(orderIDs, op.ReserveFunds.OrderID)
+		}
+	}
+	if len(walletIDs) == 0 {
+		return nil
+	}
+
+	query := `
+SELECT id, account_balance - reserved AS balance
+FROM wallets
+WHERE id = ANY($1::int[])
+ORDER BY id
+FOR UPDATE;`
+	var wallets []struct {
+		ID      int `db:"id"`
+		Balance int `db:"balance"`
+	}
+	if err := tx.SelectContext(ctx, &wallets, query, walletIDs); err != nil {
+		return fmt.Errorf("reserve funds failed: %w", err)
+	}
+	available := make(map[int]int, len(wallets))
+	for _, w := range wallets {
+		available[w.ID] = w.Balance
+	}
+
+	query = `SELECT order_id FROM event_orders WHERE order_id = ANY($1::int[]);`
+	var existing []int
+	if err := tx.SelectContext(ctx, &existing, query, orderIDs); err != nil {
+		return fmt.Errorf("reserve funds failed: %w", err)
+	}
+	orders := make(map[int]struct{}, len(existing))
+	for _, id := range existing {
+		orders[id] = struct{}{}
+	}
+
+	var (
+		accepted                         []int
+		ids, services, orderNums, prices []int
+	)
+	for i, op := range data.Operations {
+		if op.Type != models.BatchReserveFunds || results[i].Status != models.BatchStatusOK {
+			continue
+		}
+		req := op.ReserveFunds
+		balance, ok := available[req.WalletID]
+		switch {
+		case !ok:
+			fail(&results[i], ErrUserNotExists)
+			continue
+		case hasKey(orders, req.OrderID):
+			fail(&results[i], ErrOrderAlreadyAdded)
+			continue
+		case balance < req.Price:
+			fail(&results[i], ErrNotEnoughFunds)
+			continue
+		}
+		available[req.WalletID] = balance - req.Price
+		orders[req.OrderID] = struct{}{}
+		accepted = append(accepted, i)
+		ids = append(ids, req.WalletID)
+		services = append(services, req.ServiceID)
+		orderNums = append(orderNums, req.OrderID)
+		prices = append(prices, req.Price)
+	}
+	if len(accepted) == 0 {
+		return nil
+	}
+
+	// Orders added by a concurrent transaction since they were checked are
+	// not inserted, their operations fail.
+	query = `
+INSERT INTO event_orders (order_id)
+SELECT unnest($1::int[])
+ON CONFLICT DO NOTHING
+RETURNING order_id;`
+	var inserted []int
+	if err := tx.SelectContext(ctx, &inserted, query, orderNums); err != nil {
+		return fmt.Errorf("reserve funds failed: %w", err)
+	}
+	added := make(map[int]struct{}, len(inserted))
+	for _, id := range inserted {
+		added[id] = struct{}{}
+	}
+	if len(added) < len(orderNums) {
+		var kept []int
+		ids, services, orderNums, prices = nil, nil, nil, nil
+		for _, i := range accepted {
+			req := data.Operations[i].ReserveFunds
+			if !hasKey(added, req.OrderID) {
+				fail(&results[i], ErrOrderAlreadyAdded)
+				continue
+			}
+			kept = append(kept, i)
+			ids = append(ids, req.WalletID)
+			services = append(services, req.ServiceID)
+			orderNums = append(orderNums, req.OrderID)
+			prices = append(prices, req.Price)
+		}
+		if accepted = kept; len(accepted) == 0 {
+			return nil
+		}
+	}
+
+	query = `
+UPDATE wallets w
+SET reserved = w.reserved + t.amount,
+	version = w.version + 1,
+	updated_at = NOW()
+FROM (SELECT id, SUM(amount) AS amount
+	FROM unnest($1::int[], $2::int[]) AS u (id, amount)
+	GROUP BY id) t
+WHERE w.id = t.id;`
+	if _, err := tx.ExecContext(ctx, query, ids, prices); err != nil {
+		return fmt.Errorf("reserve funds failed: %w", err)
+	}
+
+	query = `
+INSERT INTO events (wallet_id, service_id, order_id, price, client_id, datetime)
+SELECT t.wallet_id, t.service_id, t.order_id, t.price, $5, o.datetime
+FROM unnest($1::int[], $2::int[], $3::int[], $4::int[]) AS t (wallet_id, service_id, order_id, price)
+JOIN event_orders o ON o.order_id = t.order_id
+RETURNING id, wallet_id, service_id, order_id, price, status, datetime, client_id, recognized_by;`
+	var events []models.EventsBodyResponse
+	if err := tx.SelectContext(ctx, &events, query, ids, services, orderNums, prices, data.ClientID); err != nil {
+		return fmt.Errorf("reserve funds failed: %w", err)
+	}
+	byOrder := make(map[int]models.EventsBodyResponse, len(events))
+	for _, e := range events {
+		byOrder[e.OrderID] = e
+	}
+	for _, i := range accepted {
+		e := byOrder[data.Operations[i].ReserveFunds.OrderID]
+		results[i].Event = &e
+	}
+	return nil
+}
+
+func (s *Store) batchRecognizeRevenue(ctx context.Context, tx *sqlx.Tx, data models.BatchRequest, results []models.BatchResult) error {
+	var orderIDs []int
+	for i, op := range data.Operations {
+		if op.Type == models.BatchRecognizeRevenue && results[i].Status == models.BatchStatusOK {
+			orderIDs = append(orderIDs, op.RecognizeRevenue.OrderID)
+		}
+	}
+	if len(orderIDs) == 0 {
+		return nil
+	}
+
+	query := `
+SELECT order_id, wallet_id, price, status
+FROM events
+WHERE order_id = ANY($1::int[])
+ORDER BY order_id
+FOR UPDATE;`
+	var events []struct {
+		OrderID  int    `db:"order_id"`
+		WalletID int    `db:"wallet_id"`
+		Price    int    `db:"price"`
+		Status   string `db:"status"`
+	}
+	if err := tx.SelectContext(ctx, &events, query, orderIDs); err != nil {
+		return fmt.Errorf("recognize revenue failed: %w", err)
+	}
+	type order struct {
+		walletID int
+		price    int
+		status   string
+	}
+	orders := make(map[int]*order, len(events))
+	for _, e := range events {
+		orders[e.OrderID] = &order{walletID: e.WalletID, price: e.Price, status: e.Status}
+	}
+
+	var (
+		accepted                               []int
+		walletIDs, debits, releases, orderNums []int
+		statuses                               []string
+	)
+	for i, op := range data.Operations {
+		if op.Type != models.BatchRecognizeRevenue || results[i].Status != models.BatchStatusOK {
+			continue
+		}
+		req := op.RecognizeRevenue
+		o, ok := orders[req.OrderID]
+		switch {
+		case !ok, req.WalletID != 0 && req.WalletID != o.walletID:
+			fail(&results[i], ErrOrderNotExists)
+			continue
+		case req.Status != "DONE" && req.Status != "CANCELED":
+			fail(&results[i], ErrInvalidStatus)
+			continue
+		case o.status != "REQUESTED":
+			fail(&results[i], ErrOrderAlreadyProcessed)
+			continue
+		}
+		o.status = req.Status
+		debit := 0
+		if req.Status == "DONE" {
+			debit = o.price
+		}
+		accepted = append(accepted, i)
+		walletIDs = append(walletIDs, o.walletID)
+		debits = append(debits, debit)
+		releases = append(releases, o.price)
+		orderNums = append(orderNums, req.OrderID)
+		statuses = append(statuses, req.Status)
+	}
+	if len(accepted) == 0 {
+		return nil
+	}
+
+	query = `
+UPDATE wallets w
+SET account_balance = w.account_balance - t.debit,
+	reserved = w.reserved - t.release,
+	version = w.version + 1,
+	updated_at = NOW()
+FROM (SELECT id, SUM(debit) AS debit, SUM(release) AS release
+	FROM unnest($1::int[], $2::int[], $3::int[]) AS u (id, debit, release)
+	GROUP BY id) t
+WHERE w.id = t.id;`
+	if _, err := tx.ExecContext(ctx, query, walletIDs, debits, releases); err != nil {
+		return fmt.Errorf("recognize revenue failed: %w", err)
+	}
+
+	query = `
+UPDATE events e
+SET status = t.status,
+	recognized_by = $3
+FROM unnest($1::int[], $2::varchar[]) AS t (order_id, status)
+WHERE e.order_id = t.order_id
+RETURNING e.id, e.wallet_id, e.service_id, e.order_id, e.price, e.status, e.datetime, e.client_id, e.recognized_by;`
+	var updated []models.EventsBodyResponse
+	if err := tx.SelectContext(ctx, &updated, query, orderNums, statuses, data.ClientID); err != nil {
+		return fmt.Errorf("recognize revenue failed: %w", err)
+	}
+	byOrder := make(map[int]models.EventsBodyResponse, len(updated))
+	for _, e := range updated {
+		byOrder[e.OrderID] = e
+	}
+	for _, i := range accepted {
+		e := byOrder[data.Operations[i].RecognizeRevenue.OrderID]
+		results[i].Event = &e
+	}
+	return nil
+}
+
+func hasKey(m map[int]struct{}, key int) bool {
+	_, ok := m[key]
+	return ok
+}
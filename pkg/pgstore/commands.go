@@ -0,0 +1,130 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+)
+
+var ErrTransactionResultNotExists = fmt.Errorf("transaction result doesn't exist")
+
+// CommandQueue is a command source backed by the command_queue table.
+// Producers insert commands with Enqueue or plain SQL, consumers receive
+// them with SKIP LOCKED, so several consumers never get the same command.
+type CommandQueue struct {
+	store *Store
+	lease time.Duration
+}
+
+// NewCommandQueue returns a queue that hides received commands from other
+// consumers for lease. A command that is not replied in time is received
+// again.
+func NewCommandQueue(store *Store, lease time.Duration) *CommandQueue {
+	return &CommandQueue{
+		store: store,
+		lease: lease,
+	}
+}
+
+// Enqueue adds a command. A command with a transaction id that is already
+// queued is not added twice.
+func (q *CommandQueue) Enqueue(ctx context.Context, cmd models.Command) (models.Command, error) {
+	if cmd.TransactionID == "" {
+		return models.Command{}, fmt.Errorf("enqueue command failed: transaction id is empty")
+	}
+	query := `
+INSERT INTO command_queue (kind, transaction_id, client_id, payload)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (transaction_id) DO NOTHING
+RETURNING id, kind, transaction_id, client_id, payload, attempts, created_at;`
+	var result models.Command
+
+	err := q.store.db.GetContext(ctx, &result, query, cmd.Kind, cmd.TransactionID, cmd.ClientID, []byte(cmd.Payload))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return models.Command{}, ErrDuplicateTransaction
+	case err != nil:
+		return models.Command{}, fmt.Errorf("enqueue command failed: %w", classify(err))
+	}
+	return result, nil
+}
+
+// Receive takes up to limit new commands in the order they were queued.
+func (q *CommandQueue) Receive(ctx context.Context, limit int) ([]models.Command, error) {
+	query := `
+WITH due AS (
+    SELECT id
+    FROM command_queue
+    WHERE status = 'NEW'
+      AND locked_until <= NOW()
+    ORDER BY id
+    LIMIT $1 FOR UPDATE SKIP LOCKED
+)
+UPDATE command_queue c
+SET locked_until = NOW() + $2 * INTERVAL '1 millisecond',
+    attempts = c.attempts + 1
+FROM due
+WHERE c.id = due.id
+RETURNING c.id, c.kind, c.transaction_id, c.client_id, c.payload, c.attempts, c.created_at;`
+	var result []models.Command
+
+	if err := q.store.db.SelectContext(ctx, &result, query, limit, q.lease.Milliseconds()); err != nil {
+		return nil, fmt.Errorf("receive commands failed: %w", classify(err))
+	}
+	return result, nil
+}
+
+// Reply saves the reply and marks its command as done.
+func (q *CommandQueue) Reply(ctx context.Context, reply models.CommandReply) error {
+	tx, err := q.store.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("reply command failed: %w", classify(err))
+	}
+	defer func() {
+		if err = tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			q.store.log.Warnf("reply command failed: %v", err)
+		}
+	}()
+
+	var result []byte
+	if len(reply.Result) > 0 {
+		result = reply.Result
+	}
+	query := `
+INSERT INTO command_replies (command_id, transaction_id, kind, status, result, error, code)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (command_id) DO NOTHING;`
+	_, err = tx.ExecContext(ctx, query, reply.CommandID, reply.TransactionID, reply.Kind, reply.Status,
+		result, reply.Error, reply.Code)
+	if err != nil {
+		return fmt.Errorf("reply command failed: %w", classify(err))
+	}
+	query = `UPDATE command_queue SET status = 'DONE', processed_at = NOW() WHERE id = $1;`
+	if _, err = tx.ExecContext(ctx, query, reply.CommandID); err != nil {
+		return fmt.Errorf("reply command failed: %w", classify(err))
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("reply command failed: %w", classify(err))
+	}
+	return nil
+}
+
+// Result returns the result saved with the transaction of an applied
+// command.
+func (q *CommandQueue) Result(ctx context.Context, transactionID string) (json.RawMessage, error) {
+	var result []byte
+
+	err := q.store.db.GetContext(ctx, &result, `SELECT result FROM processed_transactions WHERE id = $1;`, transactionID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) || err == nil && result == nil:
+		return nil, ErrTransactionResultNotExists
+	case err != nil:
+		return nil, fmt.Errorf("get transaction result failed: %w", classify(err))
+	}
+	return result, nil
+}
@@ -4,16 +4,315 @@ CREATE TABLE wallets
     user_id         int         NOT NULL UNIQUE,
     account_balance int         NOT NULL,
     reserved        int         NOT NULL DEFAULT 0,
-    updated_at      timestamptz NOT NULL DEFAULT NOW()
+    updated_at      timestamptz NOT NULL DEFAULT NOW(),
+    updated_by      varchar     NOT NULL DEFAULT '',
+    version         bigint      NOT NULL DEFAULT 1
 );
 
 CREATE TABLE events
 (
-    id         serial PRIMARY KEY,
-    wallet_id  int         NOT NULL REFERENCES wallets (id),
-    service_id int         NOT NULL,
-    order_id   int         NOT NULL UNIQUE,
-    price      int         NOT NULL,
-    status     varchar     NOT NULL DEFAULT 'REQUESTED',
-    datetime   timestamptz NOT NULL DEFAULT NOW()
-);
\ No newline at end of file
+    id            bigserial,
+    wallet_id     int         NOT NULL REFERENCES wallets (id),
+    service_id    int         NOT NULL,
+    order_id      int         NOT NULL,
+    price         int         NOT NULL,
+    status        varchar     NOT NULL DEFAULT 'REQUESTED',
+    datetime      timestamptz NOT NULL DEFAULT NOW(),
+    client_id     varchar     NOT NULL DEFAULT '',
+    recognized_by varchar     NOT NULL DEFAULT '',
+    PRIMARY KEY (id, datetime)
+) PARTITION BY RANGE (datetime);
+CREATE TABLE rate_limits
+(
+    key        varchar PRIMARY KEY,
+    tokens     double precision NOT NULL,
+    allowed    boolean          NOT NULL,
+    updated_at timestamptz      NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE outbox
+(
+    id              bigserial PRIMARY KEY,
+    wallet_id       int         NOT NULL,
+    event_type      varchar     NOT NULL,
+    payload         jsonb       NOT NULL,
+    created_at      timestamptz NOT NULL DEFAULT NOW(),
+    attempts        int         NOT NULL DEFAULT 0,
+    next_attempt_at timestamptz NOT NULL DEFAULT NOW(),
+    last_error      varchar     NOT NULL DEFAULT '',
+    published_at    timestamptz
+);
+
+CREATE INDEX outbox_unpublished_idx ON outbox (wallet_id, id) WHERE published_at IS NULL;
+
+CREATE TABLE webhook_subscriptions
+(
+    id          serial PRIMARY KEY,
+    url         varchar     NOT NULL,
+    event_types jsonb       NOT NULL,
+    secret      varchar     NOT NULL,
+    created_by  varchar     NOT NULL DEFAULT '',
+    created_at  timestamptz NOT NULL DEFAULT NOW(),
+    updated_at  timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE webhook_deliveries
+(
+    id              bigserial PRIMARY KEY,
+    subscription_id int         NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+    outbox_id       bigint      NOT NULL,
+    event_type      varchar     NOT NULL,
+    payload         jsonb       NOT NULL,
+    status          varchar     NOT NULL DEFAULT 'PENDING',
+    attempts        int         NOT NULL DEFAULT 0,
+    next_attempt_at timestamptz NOT NULL DEFAULT NOW(),
+    last_error      varchar     NOT NULL DEFAULT '',
+    response_status int         NOT NULL DEFAULT 0,
+    created_at      timestamptz NOT NULL DEFAULT NOW(),
+    delivered_at    timestamptz,
+    UNIQUE (subscription_id, outbox_id)
+);
+
+CREATE INDEX webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'PENDING';
+
+CREATE TABLE processed_transactions
+(
+    id         varchar PRIMARY KEY,
+    result     jsonb,
+    created_at timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE command_queue
+(
+    id             bigserial PRIMARY KEY,
+    kind           varchar     NOT NULL,
+    transaction_id varchar     NOT NULL UNIQUE,
+    client_id      varchar     NOT NULL DEFAULT '',
+    payload        jsonb       NOT NULL,
+    status         varchar     NOT NULL DEFAULT 'NEW',
+    attempts       int         NOT NULL DEFAULT 0,
+    locked_until   timestamptz NOT NULL DEFAULT NOW(),
+    created_at     timestamptz NOT NULL DEFAULT NOW(),
+    processed_at   timestamptz
+);
+
+CREATE INDEX command_queue_new_idx ON command_queue (locked_until) WHERE status = 'NEW';
+
+CREATE TABLE command_replies
+(
+    command_id     bigint PRIMARY KEY REFERENCES command_queue (id) ON DELETE CASCADE,
+    transaction_id varchar     NOT NULL,
+    kind           varchar     NOT NULL,
+    status         varchar     NOT NULL,
+    result         jsonb,
+    error          varchar     NOT NULL DEFAULT '',
+    code           varchar     NOT NULL DEFAULT '',
+    created_at     timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX command_replies_transaction_idx ON command_replies (transaction_id);
+
+CREATE INDEX events_wallet_datetime_idx ON events (wallet_id, datetime);
+
+CREATE TABLE wallet_history
+(
+    id             bigserial PRIMARY KEY,
+    wallet_id      int         NOT NULL REFERENCES wallets (id),
+    kind           varchar     NOT NULL,
+    balance_delta  int         NOT NULL DEFAULT 0,
+    reserved_delta int         NOT NULL DEFAULT 0,
+    order_id       int         NOT NULL DEFAULT 0,
+    reference      varchar     NOT NULL DEFAULT '',
+    client_id      varchar     NOT NULL DEFAULT '',
+    created_at     timestamptz NOT NULL DEFAULT NOW(),
+    prev_hash      varchar     NOT NULL DEFAULT '',
+    hash           varchar     NOT NULL DEFAULT ''
+);
+
+CREATE INDEX wallet_history_wallet_idx ON wallet_history (wallet_id, created_at);
+CREATE INDEX wallet_history_chain_idx ON wallet_history (wallet_id, id);
+
+CREATE TABLE adjustments
+(
+    id          serial PRIMARY KEY,
+    wallet_id   int         NOT NULL REFERENCES wallets (id),
+    amount      int         NOT NULL CHECK (amount <> 0),
+    reason      varchar     NOT NULL CHECK (reason <> ''),
+    status      varchar     NOT NULL DEFAULT 'PENDING',
+    proposed_by varchar     NOT NULL,
+    proposed_at timestamptz NOT NULL DEFAULT NOW(),
+    decided_by  varchar     NOT NULL DEFAULT '',
+    decided_at  timestamptz,
+    CHECK (decided_by = '' OR decided_by <> proposed_by)
+);
+
+CREATE TABLE audit_log
+(
+    id           bigserial PRIMARY KEY,
+    created_at   timestamptz NOT NULL DEFAULT NOW(),
+    actor        varchar     NOT NULL DEFAULT '',
+    client_ip    varchar     NOT NULL DEFAULT '',
+    request_id   varchar     NOT NULL DEFAULT '',
+    method       varchar     NOT NULL,
+    path         varchar     NOT NULL,
+    payload_hash varchar     NOT NULL,
+    status       int         NOT NULL,
+    outcome      varchar     NOT NULL
+);
+
+CREATE INDEX audit_log_created_at_idx ON audit_log (created_at);
+CREATE INDEX audit_log_actor_idx ON audit_log (actor, created_at);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS
+$$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_no_update
+    BEFORE UPDATE OR DELETE
+    ON audit_log
+    FOR EACH ROW
+EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TRIGGER audit_log_no_truncate
+    BEFORE TRUNCATE
+    ON audit_log
+    FOR EACH STATEMENT
+EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TABLE balance_snapshots
+(
+    wallet_id       int         NOT NULL REFERENCES wallets (id),
+    taken_at        timestamptz NOT NULL,
+    history_id      bigint      NOT NULL,
+    account_balance int         NOT NULL,
+    reserved        int         NOT NULL,
+    PRIMARY KEY (wallet_id, taken_at)
+);
+
+CREATE TABLE daily_balances
+(
+    business_date   date        NOT NULL,
+    wallet_id       int         NOT NULL REFERENCES wallets (id),
+    account_balance int         NOT NULL,
+    reserved        int         NOT NULL,
+    balances_at     timestamptz NOT NULL,
+    history_hash    varchar     NOT NULL DEFAULT '',
+    closed_at       timestamptz NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (business_date, wallet_id)
+);
+
+CREATE FUNCTION daily_balances_frozen() RETURNS trigger AS
+$$
+BEGIN
+    RAISE EXCEPTION 'daily_balances of a closed day are frozen';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER daily_balances_no_update
+    BEFORE UPDATE OR DELETE
+    ON daily_balances
+    FOR EACH ROW
+EXECUTE FUNCTION daily_balances_frozen();
+
+CREATE INDEX wallet_history_order_idx ON wallet_history (order_id) WHERE order_id <> 0;
+
+CREATE TABLE report_jobs
+(
+    id           bigserial PRIMARY KEY,
+    kind         varchar     NOT NULL,
+    format       varchar     NOT NULL,
+    period_from  timestamptz NOT NULL,
+    period_to    timestamptz NOT NULL,
+    delimiter    varchar     NOT NULL DEFAULT '',
+    encoding     varchar     NOT NULL DEFAULT '',
+    status       varchar     NOT NULL DEFAULT 'PENDING',
+    error        varchar     NOT NULL DEFAULT '',
+    blob_key     varchar     NOT NULL DEFAULT '',
+    size         bigint      NOT NULL DEFAULT 0,
+    requested_by varchar     NOT NULL DEFAULT '',
+    created_at   timestamptz NOT NULL DEFAULT NOW(),
+    started_at   timestamptz,
+    finished_at  timestamptz,
+    locked_until timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX report_jobs_pending_idx ON report_jobs (id) WHERE status IN ('PENDING', 'RUNNING');
+
+CREATE TABLE analytics_service_daily
+(
+    day             date             NOT NULL,
+    service_id      int              NOT NULL,
+    orders          int              NOT NULL,
+    revenue         bigint           NOT NULL,
+    latency_seconds double precision NOT NULL,
+    latency_orders  int              NOT NULL,
+    PRIMARY KEY (day, service_id)
+);
+
+CREATE TABLE analytics_user_daily
+(
+    day             date             NOT NULL,
+    user_id         int              NOT NULL,
+    orders          int              NOT NULL,
+    revenue         bigint           NOT NULL,
+    latency_seconds double precision NOT NULL,
+    latency_orders  int              NOT NULL,
+    PRIMARY KEY (day, user_id)
+);
+
+CREATE TABLE analytics_refresh
+(
+    id           int PRIMARY KEY CHECK (id = 1),
+    refreshed_to timestamptz
+);
+
+INSERT INTO analytics_refresh (id) VALUES (1);
+
+CREATE INDEX events_order_idx ON events (order_id);
+
+-- event_orders keeps order ids unique across partitions of events and
+-- archived ones, datetime points to the partition of the order.
+CREATE TABLE event_orders
+(
+    order_id int PRIMARY KEY,
+    datetime timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE event_archives
+(
+    partition   varchar PRIMARY KEY,
+    range_from  timestamptz NOT NULL,
+    range_to    timestamptz NOT NULL,
+    blob_key    varchar     NOT NULL,
+    row_count   bigint      NOT NULL,
+    archived_at timestamptz NOT NULL DEFAULT NOW()
+);
+
+-- create_events_partitions creates missing partitions events_YYYY_MM of
+-- UTC months in [start, stop) and returns how many it has created.
+CREATE FUNCTION create_events_partitions(start date, stop date) RETURNS int AS
+$$
+DECLARE
+    month   date := date_trunc('month', start::timestamp)::date;
+    part    text;
+    created int  := 0;
+BEGIN
+    WHILE month < stop
+        LOOP
+            part := 'events_' || to_char(month, 'YYYY_MM');
+            IF to_regclass(part) IS NULL AND NOT EXISTS (SELECT 1 FROM event_archives WHERE partition = part) THEN
+                EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF events FOR VALUES FROM (%L) TO (%L)',
+                               part, month::timestamp AT TIME ZONE 'UTC',
+                               (month + interval '1 month') AT TIME ZONE 'UTC');
+                created := created + 1;
+            END IF;
+            month := (month + interval '1 month')::date;
+        END LOOP;
+    RETURN created;
+END;
+$$ LANGUAGE plpgsql;
+
+SELECT create_events_partitions((NOW() AT TIME ZONE 'UTC')::date, ((NOW() AT TIME ZONE 'UTC') + interval '4 months')::date);
@@ -0,0 +1,249 @@
+package pgstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type historyEntry struct {
+	walletID      int
+	kind          string
+	balanceDelta  int
+	reservedDelta int
+	orderID       int
+	reference     string
+	clientID      string
+}
+
+// addHistory records movements in the same transaction that changes
+// wallets, so history always adds up to the balances. Every entry carries
+// the hash of the previous entry of its wallet. Callers have already
+// updated the wallets, so their rows are locked and chains of a wallet
+// can't fork.
+func (s *Store) addHistory(ctx context.Context, tx *sqlx.Tx, entries ...historyEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var now time.Time
+	if err := tx.GetContext(ctx, &now, `SELECT NOW();`); err != nil {
+		return fmt.Errorf("add history failed: %w", err)
+	}
+	var walletIDs []int
+	for _, e := range entries {
+		walletIDs = append(walletIDs, e.walletID)
+	}
+	query := `
+SELECT DISTINCT ON (wallet_id) wallet_id, hash
+FROM wallet_history
+WHERE wallet_id = ANY($1::int[])
+ORDER BY wallet_id, id DESC;`
+	var heads []struct {
+		WalletID int    `db:"wallet_id"`
+		Hash     string `db:"hash"`
+	}
+	if err := tx.SelectContext(ctx, &heads, query, walletIDs); err != nil {
+		return fmt.Errorf("add history failed: %w", err)
+	}
+	last := make(map[int]string, len(heads))
+	for _, h := range heads {
+		last[h.WalletID] = h.Hash
+	}
+
+	var (
+		balanceDeltas, reservedDeltas, orderIDs          []int
+		kinds, references, clientIDs, prevHashes, hashes []string
+	)
+	for _, e := range entries {
+		entry := models.HistoryEntry{
+			WalletID:      e.walletID,
+			Kind:          e.kind,
+			BalanceDelta:  e.balanceDelta,
+			ReservedDelta: e.reservedDelta,
+			OrderID:       e.orderID,
+			Reference:     e.reference,
+			ClientID:      e.clientID,
+			CreatedAt:     now,
+			PrevHash:      last[e.walletID],
+		}
+		last[e.walletID] = HistoryHash(s.historyKey, entry)
+		kinds = append(kinds, e.kind)
+		balanceDeltas = append(balanceDeltas, e.balanceDelta)
+		reservedDeltas = append(reservedDeltas, e.reservedDelta)
+		orderIDs = append(orderIDs, e.orderID)
+		references = append(references, e.reference)
+		clientIDs = append(clientIDs, e.clientID)
+		prevHashes = append(prevHashes, entry.PrevHash)
+		hashes = append(hashes, last[e.walletID])
+	}
+	query = `
+INSERT INTO wallet_history (wallet_id, kind, balance_delta, reserved_delta, order_id, reference, client_id,
+	created_at, prev_hash, hash)
+SELECT wallet_id, kind, balance_delta, reserved_delta, order_id, reference, client_id, $8, prev_hash, hash
+FROM unnest($1::int[], $2::varchar[], $3::int[], $4::int[], $5::int[], $6::varchar[], $7::varchar[],
+	$9::varchar[], $10::varchar[])
+	WITH ORDINALITY AS t (wallet_id, kind, balance_delta, reserved_delta, order_id, reference, client_id,
+	prev_hash, hash, n)
+ORDER BY n;`
+	_, err := tx.ExecContext(ctx, query, walletIDs, kinds, balanceDeltas, reservedDeltas, orderIDs, references,
+		clientIDs, now, prevHashes, hashes)
+	if err != nil {
+		return fmt.Errorf("add history failed: %w", err)
+	}
+	return nil
+}
+
+// HistoryHash is hex HMAC-SHA256 with key of the entry contents and the
+// hash of the previous entry, id of the entry is not included. Without the
+// key, which is kept outside the database, a rewritten chain can't be
+// hashed again.
+func HistoryHash(key []byte, e models.HistoryEntry) string {
+	content := fmt.Sprintf("%s|%d|%q|%d|%d|%d|%q|%q|%d",
+		e.PrevHash, e.WalletID, e.Kind, e.BalanceDelta, e.ReservedDelta, e.OrderID, e.Reference, e.ClientID,
+		e.CreatedAt.UnixMicro())
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(content))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyChain walks the wallet history from the first entry and stops at
+// the first entry that doesn't link to the previous one or whose contents
+// don't match its hash. Heads of the chain anchored by closed days must be
+// in it, so deleted entries at the end of the chain are found too.
+func (s *Store) VerifyChain(ctx context.Context, walletID int) (models.ChainReport, error) {
+	var report models.ChainReport
+	err := s.read(ctx, func(db *sqlx.DB) (err error) {
+		report, err = verifyChain(ctx, db, s.historyKey, walletID)
+		return err
+	})
+	if err != nil {
+		return models.ChainReport{}, fmt.Errorf("verify chain failed: %w", err)
+	}
+	return report, nil
+}
+
+func verifyChain(ctx context.Context, db *sqlx.DB, key []byte, walletID int) (models.ChainReport, error) {
+	const pageSize = 1000
+	report := models.ChainReport{WalletID: walletID, Valid: true}
+	var anchors []struct {
+		BusinessDate time.Time `db:"business_date"`
+		Hash         string    `db:"history_hash"`
+	}
+	query := `
+SELECT business_date, history_hash
+FROM daily_balances
+WHERE wallet_id = $1 AND history_hash <> ''
+ORDER BY business_date;`
+	if err := db.SelectContext(ctx, &anchors, query, walletID); err != nil {
+		return models.ChainReport{}, err
+	}
+	anchored := make(map[string]time.Time, len(anchors))
+	for _, a := range anchors {
+		anchored[a.Hash] = a.BusinessDate
+	}
+
+	query = `
+SELECT id, wallet_id, kind, balance_delta, reserved_delta, order_id, reference, client_id, created_at, prev_hash, hash
+FROM wallet_history
+WHERE wallet_id = $1 AND id > $2
+ORDER BY id
+LIMIT $3;`
+	var lastID int64
+	for {
+		var page []models.HistoryEntry
+		if err := db.SelectContext(ctx, &page, query, walletID, lastID, pageSize); err != nil {
+			return models.ChainReport{}, err
+		}
+		for _, e := range page {
+			switch {
+			case e.PrevHash != report.LastHash:
+				report.Reason = "previous hash doesn't match"
+			case HistoryHash(key, e) != e.Hash:
+				report.Reason = "hash doesn't match contents"
+			}
+			if report.Reason != "" {
+				report.Valid = false
+				report.BrokenEntryID = e.ID
+				return report, nil
+			}
+			delete(anchored, e.Hash)
+			report.Checked++
+			report.LastHash = e.Hash
+			lastID = e.ID
+		}
+		if len(page) < pageSize {
+			break
+		}
+	}
+	if len(anchored) > 0 {
+		missing := make([]time.Time, 0, len(anchored))
+		for _, day := range anchored {
+			missing = append(missing, day)
+		}
+		sort.Slice(missing, func(i, j int) bool { return missing[i].Before(missing[j]) })
+		report.Valid = false
+		report.Reason = fmt.Sprintf("head of the chain at the close of %s is missing", missing[0].Format(time.DateOnly))
+	}
+	return report, nil
+}
+
+// HistoryWallets returns ids of wallets that have history.
+func (s *Store) HistoryWallets(ctx context.Context) ([]int, error) {
+	query := `SELECT DISTINCT wallet_id FROM wallet_history ORDER BY wallet_id;`
+	var result []int
+
+	err := s.read(ctx, func(db *sqlx.DB) error {
+		return db.SelectContext(ctx, &result, query)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get history wallets failed: %w", err)
+	}
+	return result, nil
+}
+
+func recognizedHistory(event models.EventsBodyResponse, transactionID string) historyEntry {
+	entry := historyEntry{
+		walletID:      event.WalletID,
+		kind:          models.HistoryRelease,
+		reservedDelta: -event.Price,
+		orderID:       event.OrderID,
+		reference:     transactionID,
+		clientID:      event.RecognizedBy,
+	}
+	if event.Status == "DONE" {
+		entry.kind = models.HistoryDebit
+		entry.balanceDelta = -event.Price
+	}
+	return entry
+}
+
+// History returns movements of the user's wallet, the latest first.
+func (s *Store) History(ctx context.Context, filter models.HistoryFilter) ([]models.HistoryEntry, error) {
+	query := `
+SELECT h.id, h.wallet_id, h.kind, h.balance_delta, h.reserved_delta, h.order_id, h.reference, h.client_id, h.created_at,
+    h.prev_hash, h.hash
+FROM wallet_history h
+JOIN wallets w ON w.id = h.wallet_id
+WHERE w.user_id = $1
+  AND ($2::timestamptz IS NULL OR h.created_at >= $2)
+  AND ($3::timestamptz IS NULL OR h.created_at < $3)
+ORDER BY h.id DESC
+LIMIT $4 OFFSET $5;`
+	result := make([]models.HistoryEntry, 0)
+
+	err := s.read(ctx, func(db *sqlx.DB) error {
+		return db.SelectContext(ctx, &result, query, filter.UserID, filter.From, filter.To, filter.Limit, filter.Offset)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get history failed: %w", err)
+	}
+	return result, nil
+}
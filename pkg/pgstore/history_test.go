@@ -0,0 +1,27 @@
+package pgstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryHash(t *testing.T) {
+	e := models.HistoryEntry{
+		WalletID:     1,
+		Kind:         models.HistoryCredit,
+		BalanceDelta: 100,
+		CreatedAt:    time.Date(2023, 3, 3, 10, 0, 0, 0, time.UTC),
+	}
+	hash := HistoryHash([]byte("secret"), e)
+	require.Len(t, hash, 64)
+	require.Equal(t, hash, HistoryHash([]byte("secret"), e))
+	require.NotEqual(t, hash, HistoryHash([]byte("other"), e))
+	require.NotEqual(t, hash, HistoryHash(nil, e))
+
+	e.BalanceDelta = 1000
+	require.NotEqual(t, hash, HistoryHash([]byte("secret"), e))
+}
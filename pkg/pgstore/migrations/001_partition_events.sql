@@ -0,0 +1,84 @@
+-- Moves events of a database created before events were partitioned to
+-- monthly partitions. Stop the service, run it once, then start a version
+-- that knows about partitions.
+BEGIN;
+
+CREATE TABLE event_orders
+(
+    order_id int PRIMARY KEY,
+    datetime timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE event_archives
+(
+    partition   varchar PRIMARY KEY,
+    range_from  timestamptz NOT NULL,
+    range_to    timestamptz NOT NULL,
+    blob_key    varchar     NOT NULL,
+    row_count   bigint      NOT NULL,
+    archived_at timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE FUNCTION create_events_partitions(start date, stop date) RETURNS int AS
+$$
+DECLARE
+    month   date := date_trunc('month', start::timestamp)::date;
+    part    text;
+    created int  := 0;
+BEGIN
+    WHILE month < stop
+        LOOP
+            part := 'events_' || to_char(month, 'YYYY_MM');
+            IF to_regclass(part) IS NULL AND NOT EXISTS (SELECT 1 FROM event_archives WHERE partition = part) THEN
+                EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF events FOR VALUES FROM (%L) TO (%L)',
+                               part, month::timestamp AT TIME ZONE 'UTC',
+                               (month + interval '1 month') AT TIME ZONE 'UTC');
+                created := created + 1;
+            END IF;
+            month := (month + interval '1 month')::date;
+        END LOOP;
+    RETURN created;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE events RENAME TO events_unpartitioned;
+ALTER INDEX events_pkey RENAME TO events_unpartitioned_pkey;
+ALTER INDEX events_order_id_key RENAME TO events_unpartitioned_order_id_key;
+ALTER INDEX events_wallet_datetime_idx RENAME TO events_unpartitioned_wallet_datetime_idx;
+ALTER SEQUENCE events_id_seq RENAME TO events_unpartitioned_id_seq;
+
+CREATE TABLE events
+(
+    id            bigserial,
+    wallet_id     int         NOT NULL REFERENCES wallets (id),
+    service_id    int         NOT NULL,
+    order_id      int         NOT NULL,
+    price         int         NOT NULL,
+    status        varchar     NOT NULL DEFAULT 'REQUESTED',
+    datetime      timestamptz NOT NULL DEFAULT NOW(),
+    client_id     varchar     NOT NULL DEFAULT '',
+    recognized_by varchar     NOT NULL DEFAULT '',
+    PRIMARY KEY (id, datetime)
+) PARTITION BY RANGE (datetime);
+
+CREATE INDEX events_wallet_datetime_idx ON events (wallet_id, datetime);
+CREATE INDEX events_order_idx ON events (order_id);
+
+SELECT create_events_partitions((COALESCE(MIN(datetime), NOW()) AT TIME ZONE 'UTC')::date,
+                                ((NOW() AT TIME ZONE 'UTC') + interval '4 months')::date)
+FROM events_unpartitioned;
+
+INSERT INTO events (id, wallet_id, service_id, order_id, price, status, datetime, client_id, recognized_by)
+SELECT id, wallet_id, service_id, order_id, price, status, datetime, client_id, recognized_by
+FROM events_unpartitioned;
+
+INSERT INTO event_orders (order_id, datetime)
+SELECT order_id, datetime
+FROM events_unpartitioned;
+
+SELECT setval('events_id_seq', COALESCE(MAX(id), 0) + 1, false)
+FROM events;
+
+DROP TABLE events_unpartitioned;
+
+COMMIT;
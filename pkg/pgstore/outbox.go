@@ -0,0 +1,194 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// outboxLockID guards claims of outbox messages, so messages of a wallet
+// are never sent out of order.
+const outboxLockID = 2022_0001
+
+type outboxEntry struct {
+	walletID  int
+	eventType string
+	payload   interface{}
+}
+
+func (s *Store) addToOutbox(ctx context.Context, tx *sqlx.Tx, entries ...outboxEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	walletIDs := make([]int, 0, len(entries))
+	eventTypes := make([]string, 0, len(entries))
+	payloads := make([]string, 0, len(entries))
+	for _, e := range entries {
+		payload, err := json.Marshal(e.payload)
+		if err != nil {
+			return fmt.Errorf("add to outbox failed: %w", classify(err))
+		}
+		walletIDs = append(walletIDs, e.walletID)
+		eventTypes = append(eventTypes, e.eventType)
+		payloads = append(payloads, string(payload))
+	}
+	query := `
+INSERT INTO outbox (wallet_id, event_type, payload)
+SELECT wallet_id, event_type, payload::jsonb
+FROM unnest($1::int[], $2::varchar[], $3::text[]) WITH ORDINALITY AS t (wallet_id, event_type, payload, n)
+ORDER BY n;`
+	if _, err := tx.ExecContext(ctx, query, walletIDs, eventTypes, payloads); err != nil {
+		return fmt.Errorf("add to outbox failed: %w", classify(err))
+	}
+	return nil
+}
+
+func recognizedEventType(status string) string {
+	if status == "CANCELED" {
+		return models.EventReservationCanceled
+	}
+	return models.EventReservationRecognized
+}
+
+// RelayOutbox hands up to limit due messages to publish and saves its
+// results. A message is due only when no earlier message of the same wallet
+// is waiting for a retry. Messages are claimed for outboxLease in a short
+// transaction and published with no transaction open, a claim that is not
+// settled in time is taken again. It returns the number of claimed
+// messages, which is zero when another relay is claiming.
+func (s *Store) RelayOutbox(ctx context.Context, limit int, publish func(ctx context.Context, msgs []models.OutboxMessage) []models.OutboxResult) (int, error) {
+	msgs, until, err := s.claimOutbox(ctx, limit)
+	if err != nil {
+		return 0, fmt.Errorf("relay outbox failed: %w", classify(err))
+	}
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	publishCtx, cancel := context.WithTimeout(ctx, outboxLease)
+	results := publish(publishCtx, msgs)
+	cancel()
+	if err = s.settleOutbox(ctx, msgs, results, until); err != nil {
+		return 0, fmt.Errorf("relay outbox failed: %w", classify(err))
+	}
+	return len(msgs), nil
+}
+
+// outboxLease is how long claimed messages are hidden from other relays.
+const outboxLease = 5 * time.Minute
+
+// claimOutbox pushes the next attempt of due messages to the end of the
+// lease and returns them with the end. Claimed messages hold back later
+// messages of their wallets like a retry does.
+func (s *Store) claimOutbox(ctx context.Context, limit int) ([]models.OutboxMessage, time.Time, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer func() {
+		if err = tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			s.log.Warnf("claim outbox failed: %v", err)
+		}
+	}()
+
+	// Claims are made one at a time, so two relays never see messages of
+	// one wallet as due together.
+	var locked bool
+	if err = tx.GetContext(ctx, &locked, `SELECT pg_try_advisory_xact_lock($1);`, outboxLockID); err != nil {
+		return nil, time.Time{}, err
+	}
+	if !locked {
+		return nil, time.Time{}, nil
+	}
+
+	var until time.Time
+	if err = tx.GetContext(ctx, &until, `SELECT NOW() + $1 * INTERVAL '1 millisecond';`, outboxLease.Milliseconds()); err != nil {
+		return nil, time.Time{}, err
+	}
+	query := `
+WITH due AS (
+    SELECT id
+    FROM outbox o
+    WHERE published_at IS NULL
+      AND next_attempt_at <= NOW()
+      AND NOT EXISTS (SELECT 1
+                      FROM outbox p
+                      WHERE p.wallet_id = o.wallet_id
+                        AND p.published_at IS NULL
+                        AND p.id < o.id
+                        AND p.next_attempt_at > NOW())
+    ORDER BY id
+    LIMIT $1
+)
+UPDATE outbox o
+SET next_attempt_at = $2
+FROM due
+WHERE o.id = due.id
+RETURNING o.id, o.wallet_id, o.event_type, o.payload, o.created_at, o.attempts;`
+	var msgs []models.OutboxMessage
+	if err = tx.SelectContext(ctx, &msgs, query, limit, until); err != nil {
+		return nil, time.Time{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, time.Time{}, err
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ID < msgs[j].ID })
+	return msgs, until, nil
+}
+
+// settleOutbox saves results of published messages and releases claimed
+// messages that publish didn't get to. Messages whose claim ran out and
+// was taken by another relay are left to it.
+func (s *Store) settleOutbox(ctx context.Context, msgs []models.OutboxMessage, results []models.OutboxResult, until time.Time) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err = tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			s.log.Warnf("settle outbox failed: %v", err)
+		}
+	}()
+
+	reported := make(map[int64]bool, len(results))
+	var published []int64
+	for _, r := range results {
+		reported[r.ID] = true
+		if r.Err == nil {
+			published = append(published, r.ID)
+			continue
+		}
+		query := `
+UPDATE outbox
+SET attempts = attempts + 1,
+    next_attempt_at = $2,
+    last_error = $3
+WHERE id = $1
+  AND next_attempt_at = $4;`
+		if _, err = tx.ExecContext(ctx, query, r.ID, r.NextAttemptAt, r.Err.Error(), until); err != nil {
+			return err
+		}
+	}
+	var released []int64
+	for _, msg := range msgs {
+		if !reported[msg.ID] {
+			released = append(released, msg.ID)
+		}
+	}
+	query := `UPDATE outbox SET published_at = NOW() WHERE id = ANY($1::bigint[]) AND next_attempt_at = $2;`
+	if _, err = tx.ExecContext(ctx, query, published, until); err != nil {
+		return err
+	}
+	query = `UPDATE outbox SET next_attempt_at = NOW() WHERE id = ANY($1::bigint[]) AND next_attempt_at = $2 AND published_at IS NULL;`
+	if _, err = tx.ExecContext(ctx, query, released, until); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
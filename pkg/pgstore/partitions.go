@@ -0,0 +1,250 @@
+package pgstore
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+const partitionName = "events_2006_01"
+
+var ErrPartitionChanged = fmt.Errorf("partition has changed since export")
+
+// Archive keeps exported partitions of events as gzipped JSON Lines of
+// models.EventsBodyResponse.
+type Archive interface {
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// CreatePartitions creates missing partitions of events for UTC months in
+// [from, to).
+func (s *Store) CreatePartitions(ctx context.Context, from, to time.Time) (int, error) {
+	var n int
+	err := s.db.GetContext(ctx, &n, `SELECT create_events_partitions($1::date, $2::date);`,
+		from.UTC().Format(time.DateOnly), to.UTC().Format(time.DateOnly))
+	if err != nil {
+		return 0, fmt.Errorf("create partitions failed: %w", classify(err))
+	}
+	return n, nil
+}
+
+// ClosedPartitions returns partitions of events that end before before
+// and have no REQUESTED orders, so nothing in them changes any more.
+// Partitions not named events_YYYY_MM are left alone.
+func (s *Store) ClosedPartitions(ctx context.Context, before time.Time) ([]models.EventPartition, error) {
+	query := `
+SELECT c.relname
+FROM pg_inherits i
+JOIN pg_class c ON c.oid = i.inhrelid
+WHERE i.inhparent = 'events'::regclass
+ORDER BY c.relname;`
+	var names []string
+	if err := s.db.SelectContext(ctx, &names, query); err != nil {
+		return nil, fmt.Errorf("get closed partitions failed: %w", classify(err))
+	}
+	var closed []models.EventPartition
+	for _, name := range names {
+		from, err := time.Parse(partitionName, name)
+		if err != nil {
+			continue
+		}
+		p := models.EventPartition{Name: name, From: from, To: from.AddDate(0, 1, 0)}
+		if p.To.After(before) {
+			continue
+		}
+		var open bool
+		query = `SELECT EXISTS (SELECT 1 FROM events WHERE datetime >= $1 AND datetime < $2 AND status = 'REQUESTED');`
+		if err = s.db.GetContext(ctx, &open, query, p.From, p.To); err != nil {
+			return nil, fmt.Errorf("get closed partitions failed: %w", classify(err))
+		}
+		if !open {
+			closed = append(closed, p)
+		}
+	}
+	return closed, nil
+}
+
+// ExportEvents passes orders of the partition to fn in the order of ids,
+// without the statement timeout.
+func (s *Store) ExportEvents(ctx context.Context, p models.EventPartition, fn func(models.EventsBodyResponse) error) error {
+	query := `
+SELECT id, wallet_id, service_id, order_id, price, status, datetime, client_id, recognized_by
+FROM events
+WHERE datetime >= $1
+  AND datetime < $2
+ORDER BY id;`
+	tx, err := s.db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("export events failed: %w", classify(err))
+	}
+	defer func() {
+		if err = tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			s.log.Warnf("export events failed: %v", err)
+		}
+	}()
+	if err = withoutStatementTimeout(ctx, tx); err != nil {
+		return fmt.Errorf("export events failed: %w", classify(err))
+	}
+	if err = streamRows(ctx, s, tx, query, fn, p.From, p.To); err != nil {
+		return fmt.Errorf("export events failed: %w", classify(err))
+	}
+	return nil
+}
+
+// ArchivePartition detaches and drops the partition exported to blobKey
+// with rows orders. It fails with ErrPartitionChanged if the partition has
+// other orders by now.
+func (s *Store) ArchivePartition(ctx context.Context, p models.EventPartition, blobKey string, rows int64) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("archive partition failed: %w", classify(err))
+	}
+	defer func() {
+		if err = tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			s.log.Warnf("archive partition failed: %v", err)
+		}
+	}()
+
+	if err = withoutStatementTimeout(ctx, tx); err != nil {
+		return fmt.Errorf("archive partition failed: %w", classify(err))
+	}
+	table := pgx.Identifier{p.Name}.Sanitize()
+	if _, err = tx.ExecContext(ctx, `LOCK TABLE `+table+` IN SHARE MODE;`); err != nil {
+		return fmt.Errorf("archive partition failed: %w", classify(err))
+	}
+	var count struct {
+		N    int64 `db:"n"`
+		Open bool  `db:"open"`
+	}
+	query := `SELECT COUNT(*) AS n, COALESCE(bool_or(status = 'REQUESTED'), false) AS open FROM ` + table + `;`
+	if err = tx.GetContext(ctx, &count, query); err != nil {
+		return fmt.Errorf("archive partition failed: %w", classify(err))
+	}
+	if count.N != rows || count.Open {
+		return fmt.Errorf("archive partition %s failed: %w", p.Name, ErrPartitionChanged)
+	}
+	for _, query = range []string{
+		`ALTER TABLE events DETACH PARTITION ` + table + `;`,
+		`DROP TABLE ` + table + `;`,
+	} {
+		if _, err = tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("archive partition failed: %w", classify(err))
+		}
+	}
+	query = `
+INSERT INTO event_archives (partition, range_from, range_to, blob_key, row_count)
+VALUES ($1, $2, $3, $4, $5);`
+	if _, err = tx.ExecContext(ctx, query, p.Name, p.From, p.To, blobKey, rows); err != nil {
+		return fmt.Errorf("archive partition failed: %w", classify(err))
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("archive partition failed: %w", classify(err))
+	}
+	return nil
+}
+
+// archivedKeys returns keys of archives that recognized orders of
+// [from, to) may come from: archives of months the period overlaps and of
+// months orders recognized in the period were reserved in.
+func archivedKeys(ctx context.Context, q sqlx.QueryerContext, from, to time.Time) ([]string, error) {
+	query := `
+SELECT a.blob_key
+FROM event_archives a
+WHERE a.range_from < $2
+  AND (a.range_to > $1 OR EXISTS (
+    SELECT 1
+    FROM wallet_history h
+    JOIN event_orders o ON o.order_id = h.order_id
+    WHERE h.kind = 'DEBIT'
+      AND h.created_at >= $1
+      AND h.created_at < $2
+      AND o.datetime >= a.range_from
+      AND o.datetime < a.range_to))
+ORDER BY a.range_from;`
+	var keys []string
+	if err := sqlx.SelectContext(ctx, q, &keys, query, from, to); err != nil {
+		return nil, fmt.Errorf("get archives failed: %w", classify(err))
+	}
+	return keys, nil
+}
+
+// loadArchivedEvents copies DONE orders of the archives to the temporary
+// table archived_events of tx.
+func (s *Store) loadArchivedEvents(ctx context.Context, tx *sqlx.Tx, keys []string) error {
+	if s.archive == nil {
+		return fmt.Errorf("load archived events failed: no archive to read %d partitions from", len(keys))
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE TEMPORARY TABLE archived_events (LIKE events) ON COMMIT DROP;`); err != nil {
+		return fmt.Errorf("load archived events failed: %w", classify(err))
+	}
+	for _, key := range keys {
+		if err := s.loadArchive(ctx, tx, key); err != nil {
+			return fmt.Errorf("load archived events of %s failed: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) loadArchive(ctx context.Context, tx *sqlx.Tx, key string) error {
+	rc, err := s.archive.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(zr)
+	batch := make([]models.EventsBodyResponse, 0, 1000)
+	for {
+		var e models.EventsBodyResponse
+		if err = dec.Decode(&e); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if e.Status != "DONE" {
+			continue
+		}
+		if batch = append(batch, e); len(batch) == cap(batch) {
+			if err = insertArchived(ctx, tx, batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	return insertArchived(ctx, tx, batch)
+}
+
+func insertArchived(ctx context.Context, tx *sqlx.Tx, events []models.EventsBodyResponse) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var (
+		ids, wallets, services, orders, prices []int
+		statuses, clients, recognizers         []string
+		datetimes                              []time.Time
+	)
+	for _, e := range events {
+		ids, wallets, services = append(ids, e.ID), append(wallets, e.WalletID), append(services, e.ServiceID)
+		orders, prices, statuses = append(orders, e.OrderID), append(prices, e.Price), append(statuses, e.Status)
+		datetimes, clients, recognizers = append(datetimes, e.DateTime), append(clients, e.ClientID), append(recognizers, e.RecognizedBy)
+	}
+	query := `
+INSERT INTO archived_events (id, wallet_id, service_id, order_id, price, status, datetime, client_id, recognized_by)
+SELECT *
+FROM unnest($1::bigint[], $2::int[], $3::int[], $4::int[], $5::int[], $6::varchar[], $7::timestamptz[], $8::varchar[], $9::varchar[]);`
+	_, err := tx.ExecContext(ctx, query, ids, wallets, services, orders, prices, statuses, datetimes, clients, recognizers)
+	return err
+}
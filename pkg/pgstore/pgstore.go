@@ -3,9 +3,11 @@ package pgstore
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
 
@@ -18,136 +20,382 @@ var (
 	ErrUserNotExists     = fmt.Errorf("user doesn't exist")
 	ErrOrderAlreadyAdded = fmt.Errorf("order has already added")
 	ErrOrderNotExists    = fmt.Errorf("order doesn't exist")
+
+	ErrOrderAlreadyProcessed = fmt.Errorf("order has already processed")
+	ErrDuplicateTransaction  = fmt.Errorf("transaction has already been made")
+	ErrInvalidStatus         = fmt.Errorf("status must be DONE or CANCELED")
+	ErrVersionMismatch       = fmt.Errorf("wallet version doesn't match")
+
+	ErrTimeout  = fmt.Errorf("database didn't answer in time")
+	ErrCanceled = fmt.Errorf("database query was canceled")
 )
 
 type Store struct {
-	log *logrus.Entry
-	db  *sqlx.DB
+	log         *logrus.Entry
+	db          *sqlx.DB
+	archive     Archive
+	replicaDSNs []string
+	replicas    replicas
+	pool        PoolConfig
+	noPrepare   bool
+	txRetry     TxRetry
+	txStats     txStats
+	historyKey  []byte
+
+	statementTimeout time.Duration
+	lockTimeout      time.Duration
+}
+
+type Option func(s *Store)
+
+// WithArchive reads archived partitions of events back from a, so reports
+// keep covering archived months.
+func WithArchive(a Archive) Option {
+	return func(s *Store) {
+		s.archive = a
+	}
 }
 
-func New(ctx context.Context, log *logrus.Logger, dsn string) (*Store, error) {
-	db, err := sqlx.ConnectContext(ctx, "pgx", dsn)
+// WithHistoryKey keys hashes of wallet history with key, see HistoryHash.
+func WithHistoryKey(key []byte) Option {
+	return func(s *Store) {
+		s.historyKey = key
+	}
+}
+
+func New(ctx context.Context, log *logrus.Logger, dsn string, opts ...Option) (*Store, error) {
+	s := &Store{
+		log: log.WithField("module", "pgstore"),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	db, err := s.open(dsn)
 	if err != nil {
 		return nil, fmt.Errorf("create new strore failed: %w", err)
 	}
-	return &Store{
-		log: log.WithField("module", "pgstore"),
-		db:  db,
-	}, nil
+	if err = db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("create new strore failed: %w", err)
+	}
+	s.db = db
+	if err = s.openReplicas(ctx); err != nil {
+		return nil, fmt.Errorf("create new strore failed: %w", err)
+	}
+	return s, nil
 }
 
 func (s *Store) AddFunds(ctx context.Context, data models.AddFundsRequest) (models.WalletResponse, error) {
-	var query strings.Builder
+	var result models.WalletResponse
+	err := s.inTx(ctx, "add funds", sql.LevelDefault, func(tx *sqlx.Tx) error {
+		if err := s.saveTransaction(ctx, tx, data.TransactionID); err != nil {
+			return fmt.Errorf("add funds failed: %w", err)
+		}
+
+		var query strings.Builder
+		args := []interface{}{data.UserID, data.Balance, data.ClientID}
 
-	query.WriteString(`INSERT INTO wallets (user_id, account_balance)
-VALUES ($1, $2)
+		if data.ExpectedVersion == 0 {
+			query.WriteString(`INSERT INTO wallets (user_id, account_balance, updated_by)
+VALUES ($1, $2, $3)
 ON CONFLICT (user_id) DO UPDATE SET
 				account_balance = wallets.account_balance + $2,
-				updated_at = NOW()
-RETURNING id, user_id, account_balance, reserved, updated_at;`)
-
-	var result models.WalletResponse
+				version = wallets.version + 1,
+				updated_at = NOW(),
+				updated_by = $3`)
+		} else {
+			// A wallet with an expected version is not created.
+			query.WriteString(`UPDATE wallets SET
+				account_balance = account_balance + $2,
+				version = version + 1,
+				updated_at = NOW(),
+				updated_by = $3
+WHERE user_id = $1 AND version = $4`)
+			args = append(args, data.ExpectedVersion)
+		}
+		query.WriteString(`
+RETURNING id, user_id, account_balance, reserved, updated_at, updated_by, version;`)
 
-	if err := s.db.GetContext(ctx, &result, query.String(), data.UserID, data.Balance); err != nil {
-		return models.WalletResponse{}, fmt.Errorf("add funds failed: %w", err)
+		err := tx.GetContext(ctx, &result, query.String(), args...)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			var exists bool
+			if err = tx.GetContext(ctx, &exists, `SELECT EXISTS (SELECT 1 FROM wallets WHERE user_id = $1);`, data.UserID); err != nil {
+				return fmt.Errorf("add funds failed: %w", err)
+			}
+			if !exists {
+				return ErrUserNotExists
+			}
+			return ErrVersionMismatch
+		case err != nil:
+			return fmt.Errorf("add funds failed: %w", err)
+		}
+		err = s.addHistory(ctx, tx, historyEntry{
+			walletID:     result.ID,
+			kind:         models.HistoryCredit,
+			balanceDelta: data.Balance,
+			reference:    data.TransactionID,
+			clientID:     data.ClientID,
+		})
+		if err != nil {
+			return fmt.Errorf("add funds failed: %w", err)
+		}
+		err = s.addToOutbox(ctx, tx, outboxEntry{
+			walletID:  result.ID,
+			eventType: models.EventWalletCredited,
+			payload:   models.WalletCredited{TransactionID: data.TransactionID, Amount: data.Balance, Wallet: result},
+		})
+		if err != nil {
+			return fmt.Errorf("add funds failed: %w", err)
+		}
+		if err = s.saveResult(ctx, tx, data.TransactionID, result); err != nil {
+			return fmt.Errorf("add funds failed: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return models.WalletResponse{}, err
 	}
 	return result, nil
 }
 
 func (s *Store) ReserveFunds(ctx context.Context, data models.ReservedFundsRequest) (models.EventsBodyResponse, error) {
-	tx, err := s.db.Beginx()
-	if err != nil {
-		return models.EventsBodyResponse{}, fmt.Errorf("reserve funds failed: %w", err)
-	}
-	defer func() {
-		if err = tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
-			s.log.Warnf("reserve funds failed: %v", err)
+	var result models.EventsBodyResponse
+	err := s.inTx(ctx, "reserve funds", s.isolation(), func(tx *sqlx.Tx) error {
+		if err := s.saveTransaction(ctx, tx, data.TransactionID); err != nil {
+			return fmt.Errorf("reserve funds failed: %w", err)
 		}
-	}()
 
-	if ok, e := s.isEnoughFunds(ctx, tx, data.WalletID, data.Price); !ok {
-		if e != nil {
-			return models.EventsBodyResponse{}, fmt.Errorf("reserve funds failed: %w", e)
+		if ok, err := s.isEnoughFunds(ctx, tx, data.WalletID, data.Price); !ok {
+			if err != nil {
+				return fmt.Errorf("reserve funds failed: %w", err)
+			}
+			return ErrNotEnoughFunds
 		}
-		return models.EventsBodyResponse{}, ErrNotEnoughFunds
-	}
 
-	if ok, e := s.reserveFunds(ctx, tx, data.WalletID, data.Price); !ok {
-		if e != nil {
-			return models.EventsBodyResponse{}, fmt.Errorf("reserve funds failed: %w", e)
+		if ok, err := s.reserveFunds(ctx, tx, data.WalletID, data.Price, data.ExpectedVersion); !ok {
+			if err != nil {
+				return fmt.Errorf("reserve funds failed: %w", err)
+			}
+			// A concurrent reservation may have taken the funds since the
+			// check above.
+			if ok, err = s.isEnoughFunds(ctx, tx, data.WalletID, data.Price); !ok {
+				if err != nil {
+					return fmt.Errorf("reserve funds failed: %w", err)
+				}
+				return ErrNotEnoughFunds
+			}
+			if data.ExpectedVersion != 0 {
+				return ErrVersionMismatch
+			}
+			return ErrUserNotExists
 		}
-		return models.EventsBodyResponse{}, ErrUserNotExists
-	}
 
-	query := `INSERT INTO events (wallet_id, service_id, order_id, price)
-VALUES ($1, $2, $3, $4)
-ON CONFLICT (order_id) DO NOTHING RETURNING id, wallet_id, service_id, order_id, price, datetime;`
-	var result models.EventsBodyResponse
+		query := `
+WITH o AS (
+    INSERT INTO event_orders (order_id) VALUES ($3)
+    ON CONFLICT (order_id) DO NOTHING RETURNING order_id, datetime
+)
+INSERT INTO events (wallet_id, service_id, order_id, price, client_id, datetime)
+SELECT $1::int, $2::int, o.order_id, $4::int, $5::varchar, o.datetime
+FROM o
+RETURNING id, wallet_id, service_id, order_id, price, status, datetime, client_id;`
 
-	err = tx.GetContext(ctx, &result, query, data.WalletID, data.ServiceID, data.OrderID, data.Price)
-	switch {
-	case errors.Is(err, sql.ErrNoRows):
-		return models.EventsBodyResponse{}, ErrOrderAlreadyAdded
-	case err != nil:
-		return models.EventsBodyResponse{}, fmt.Errorf("reserved funds failed: %w", err)
-	}
-	if err = tx.Commit(); err != nil {
-		return models.EventsBodyResponse{}, fmt.Errorf("reserved funds failed: %w", err)
+		err := tx.GetContext(ctx, &result, query, data.WalletID, data.ServiceID, data.OrderID, data.Price, data.ClientID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrOrderAlreadyAdded
+		case err != nil:
+			return fmt.Errorf("reserved funds failed: %w", err)
+		}
+		err = s.addHistory(ctx, tx, historyEntry{
+			walletID:      result.WalletID,
+			kind:          models.HistoryReserve,
+			reservedDelta: result.Price,
+			orderID:       result.OrderID,
+			reference:     data.TransactionID,
+			clientID:      data.ClientID,
+		})
+		if err != nil {
+			return fmt.Errorf("reserved funds failed: %w", err)
+		}
+		err = s.addToOutbox(ctx, tx, outboxEntry{walletID: result.WalletID, eventType: models.EventReservationCreated, payload: result})
+		if err != nil {
+			return fmt.Errorf("reserved funds failed: %w", err)
+		}
+		if err = s.saveResult(ctx, tx, data.TransactionID, result); err != nil {
+			return fmt.Errorf("reserved funds failed: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return models.EventsBodyResponse{}, err
 	}
 	return result, nil
 }
 
+// RecognizeRevenue recognizes a REQUESTED order and changes the wallet of
+// the order. Zero WalletID of data means the wallet of the order, another
+// wallet doesn't have the order.
 func (s *Store) RecognizeRevenue(ctx context.Context, data models.RecognizeRevenueRequest) (models.EventsBodyResponse, error) {
-	tx, err := s.db.Beginx()
-	if err != nil {
-		return models.EventsBodyResponse{}, fmt.Errorf("recognize revenue failed: %w", err)
+	if data.Status != "DONE" && data.Status != "CANCELED" {
+		return models.EventsBodyResponse{}, ErrInvalidStatus
 	}
-	defer func() {
-		if err = tx.Rollback(); err != nil && errors.Is(err, sql.ErrTxDone) {
-			s.log.Warnf("recognize revenue failed: %v", err)
+	var result models.EventsBodyResponse
+	err := s.inTx(ctx, "recognize revenue", s.isolation(), func(tx *sqlx.Tx) error {
+		if err := s.saveTransaction(ctx, tx, data.TransactionID); err != nil {
+			return fmt.Errorf("recognize revenue failed: %w", err)
+		}
+		order, err := s.lockOrder(ctx, tx, data.OrderID)
+		switch {
+		case err != nil:
+			return fmt.Errorf("recognize revenue failed: %w", err)
+		case data.WalletID != 0 && data.WalletID != order.WalletID:
+			return fmt.Errorf("recognize revenue failed: %w", ErrOrderNotExists)
+		case order.Status != "REQUESTED":
+			return fmt.Errorf("recognize revenue failed: %w", ErrOrderAlreadyProcessed)
+		}
+		if err = s.changeBalance(ctx, tx, order.WalletID, order.Price, data.Status, data.ExpectedVersion); err != nil {
+			return fmt.Errorf("recognize revenue failed: %w", err)
 		}
-	}()
-	price, err := s.checkPrice(ctx, tx, data.OrderID)
+		query := `
+UPDATE events
+SET status = $2,
+    recognized_by = $3
+WHERE order_id = $1
+  AND datetime = (SELECT datetime FROM event_orders WHERE order_id = $1)
+  AND status = 'REQUESTED'
+RETURNING id, wallet_id, service_id, order_id, price, status, datetime, client_id, recognized_by`
+
+		err = tx.GetContext(ctx, &result, query, data.OrderID, data.Status, data.ClientID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("recognize revenue failed: %w", ErrOrderAlreadyProcessed)
+		case err != nil:
+			return fmt.Errorf("recognize revenue failed: %w", err)
+		}
+		if err = s.addHistory(ctx, tx, recognizedHistory(result, data.TransactionID)); err != nil {
+			return fmt.Errorf("recognize revenue failed: %w", err)
+		}
+		err = s.addToOutbox(ctx, tx, outboxEntry{walletID: result.WalletID, eventType: recognizedEventType(result.Status), payload: result})
+		if err != nil {
+			return fmt.Errorf("recognize revenue failed: %w", err)
+		}
+		if err = s.saveResult(ctx, tx, data.TransactionID, result); err != nil {
+			return fmt.Errorf("recognize revenue failed: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return models.EventsBodyResponse{}, fmt.Errorf("recognize revenue failed: %w", err)
+		return models.EventsBodyResponse{}, err
 	}
-	if err = s.changeBalance(ctx, tx, data.WalletID, price, data.Status); err != nil {
-		return models.EventsBodyResponse{}, fmt.Errorf("recognize revenue failed: %w", err)
+	return result, nil
+}
+
+func (s *Store) WalletBalance(ctx context.Context, data models.BalanceRequest) (models.WalletResponse, error) {
+	var result models.WalletResponse
+	if data.AsOf != nil {
+		err := s.read(ctx, func(db *sqlx.DB) (err error) {
+			result, err = s.walletBalanceAt(ctx, db, data.UserID, *data.AsOf)
+			return err
+		})
+		return result, err
 	}
 	query := `
-UPDATE events
-SET status = $2
+SELECT id, user_id, account_balance, reserved, updated_at, updated_by, version FROM wallets
+WHERE user_id = $1`
+
+	err := s.read(ctx, func(db *sqlx.DB) error {
+		return db.GetContext(ctx, &result, query, data.UserID)
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return models.WalletResponse{}, ErrUserNotExists
+	case err != nil:
+		return models.WalletResponse{}, fmt.Errorf("get user balance failed: %w", err)
+	}
+	return result, nil
+}
+
+func (s *Store) Order(ctx context.Context, orderID int) (models.EventsBodyResponse, error) {
+	query := `
+SELECT id, wallet_id, service_id, order_id, price, status, datetime, client_id, recognized_by FROM events
 WHERE order_id = $1
-RETURNING id, wallet_id, service_id, order_id, price, status, datetime`
+  AND datetime = (SELECT datetime FROM event_orders WHERE order_id = $1)`
 	var result models.EventsBodyResponse
 
-	err = tx.GetContext(ctx, &result, query, data.OrderID, data.Status)
+	err := s.read(ctx, func(db *sqlx.DB) error {
+		return db.GetContext(ctx, &result, query, orderID)
+	})
 	switch {
 	case errors.Is(err, sql.ErrNoRows):
-		return models.EventsBodyResponse{}, fmt.Errorf("recognize revenue failed: %w", err)
+		return models.EventsBodyResponse{}, ErrOrderNotExists
 	case err != nil:
-		return models.EventsBodyResponse{}, fmt.Errorf("recognize revenue failed: %w", err)
+		return models.EventsBodyResponse{}, fmt.Errorf("get order failed: %w", err)
 	}
-	if err = tx.Commit(); err != nil {
-		return models.EventsBodyResponse{}, fmt.Errorf("recognize revenue failed: %w", err)
+	return result, nil
+}
+
+// Orders returns orders matching the filter, the latest first.
+func (s *Store) Orders(ctx context.Context, filter models.OrdersFilter) ([]models.EventsBodyResponse, error) {
+	query := `
+SELECT id, wallet_id, service_id, order_id, price, status, datetime, client_id, recognized_by FROM events
+WHERE ($1 = 0 OR wallet_id = $1)
+  AND ($2 = 0 OR service_id = $2)
+  AND ($3 = '' OR status = $3)
+  AND ($4::timestamptz IS NULL OR datetime >= $4)
+  AND ($5::timestamptz IS NULL OR datetime < $5)
+ORDER BY datetime DESC, id DESC
+LIMIT $6 OFFSET $7;`
+	result := make([]models.EventsBodyResponse, 0)
+
+	err := s.read(ctx, func(db *sqlx.DB) error {
+		return db.SelectContext(ctx, &result, query, filter.WalletID, filter.ServiceID, filter.Status,
+			filter.From, filter.To, filter.Limit, filter.Offset)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get orders failed: %w", err)
 	}
 	return result, nil
 }
 
-func (s *Store) WalletBalance(ctx context.Context, data models.BalanceRequest) (models.WalletResponse, error) {
+// saveTransaction remembers the transaction id, so the same transaction is
+// never applied twice. Requests without an id are not checked.
+func (s *Store) saveTransaction(ctx context.Context, q q, id string) error {
+	if id == "" {
+		return nil
+	}
 	query := `
-SELECT id, user_id, account_balance, reserved, updated_at FROM wallets
-WHERE user_id = $1`
-	var result models.WalletResponse
+INSERT INTO processed_transactions (id)
+VALUES ($1)
+ON CONFLICT (id) DO NOTHING
+RETURNING TRUE;`
+	var ok bool
 
-	err := s.db.GetContext(ctx, &result, query, data.UserID)
+	err := q.GetContext(ctx, &ok, query, id)
 	switch {
 	case errors.Is(err, sql.ErrNoRows):
-		return models.WalletResponse{}, ErrUserNotExists
+		return ErrDuplicateTransaction
 	case err != nil:
-		return models.WalletResponse{}, fmt.Errorf("get user balance failed: %w", err)
+		return fmt.Errorf("save transaction failed: %w", err)
 	}
-	return result, nil
+	return nil
+}
+
+// saveResult keeps the result with the transaction id, so a repeated
+// command is replied the same as the first one.
+func (s *Store) saveResult(ctx context.Context, tx *sqlx.Tx, id string, result interface{}) error {
+	if id == "" {
+		return nil
+	}
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("save result failed: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, `UPDATE processed_transactions SET result = $2 WHERE id = $1;`, id, payload); err != nil {
+		return fmt.Errorf("save result failed: %w", err)
+	}
+	return nil
 }
 
 type q interface {
@@ -171,15 +419,22 @@ WHERE id = $1;`
 	return balance >= price, nil
 }
 
-func (s *Store) reserveFunds(ctx context.Context, q q, id int, price int) (bool, error) {
+// reserveFunds and changeBalance update the wallet only when its version is
+// the expected one, zero version matches any. reserveFunds checks available
+// funds in the same statement, so concurrent reservations can't overdraw
+// the wallet at read committed.
+func (s *Store) reserveFunds(ctx context.Context, q q, id int, price int, version int64) (bool, error) {
 	query := `
 UPDATE wallets
-SET reserved = reserved + $2
+SET reserved = reserved + $2,
+    version = version + 1
 WHERE id = $1
+  AND account_balance - reserved >= $2
+  AND ($3::bigint = 0 OR version = $3)
 RETURNING TRUE;`
 	var ok bool
 
-	err := q.GetContext(ctx, &ok, query, id, price)
+	err := q.GetContext(ctx, &ok, query, id, price, version)
 	switch {
 	case errors.Is(err, sql.ErrNoRows):
 		return false, nil
@@ -189,52 +444,72 @@ RETURNING TRUE;`
 	return ok, nil
 }
 
-func (s *Store) changeBalance(ctx context.Context, q q, id int, price int, status string) error {
+func (s *Store) changeBalance(ctx context.Context, q q, id int, price int, status string, version int64) error {
 	var query string
 	switch status {
 	case "DONE":
 		query = `UPDATE wallets
 		SET account_balance = account_balance - $2,
-			reserved = reserved - $2
-		WHERE id = $1
+			reserved = reserved - $2,
+			version = version + 1
+		WHERE id = $1 AND ($3::bigint = 0 OR version = $3)
 		RETURNING TRUE;`
 	case "CANCELED":
 		query = `UPDATE wallets
-		SET reserved = reserved - $2
-		WHERE id = $1
+		SET reserved = reserved - $2,
+			version = version + 1
+		WHERE id = $1 AND ($3::bigint = 0 OR version = $3)
 		RETURNING TRUE;`
 	}
 	var ok bool
 
-	if err := q.GetContext(ctx, &ok, query, id, price); err != nil {
+	err := q.GetContext(ctx, &ok, query, id, price, version)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) && version != 0:
+		return ErrVersionMismatch
+	case err != nil:
 		return fmt.Errorf("change balance failed: %v", err)
 	}
 	return nil
 }
 
-func (s *Store) checkPrice(ctx context.Context, q q, orderID int) (int, error) {
+type lockedOrder struct {
+	WalletID int    `db:"wallet_id"`
+	Price    int    `db:"price"`
+	Status   string `db:"status"`
+}
+
+// lockOrder locks the order until the end of the transaction, so it is
+// recognized once.
+func (s *Store) lockOrder(ctx context.Context, q q, orderID int) (lockedOrder, error) {
 	query := `
-SELECT price FROM events
-WHERE order_id = $1;`
-	var price int
+SELECT wallet_id, price, status FROM events
+WHERE order_id = $1
+  AND datetime = (SELECT datetime FROM event_orders WHERE order_id = $1)
+FOR UPDATE;`
+	var result lockedOrder
 
-	err := q.GetContext(ctx, &price, query, orderID)
+	err := q.GetContext(ctx, &result, query, orderID)
 	switch {
 	case errors.Is(err, sql.ErrNoRows):
-		return 0, ErrOrderNotExists
+		return lockedOrder{}, ErrOrderNotExists
 	case err != nil:
-		return 0, fmt.Errorf("check price failed: %w", err)
+		return lockedOrder{}, fmt.Errorf("lock order failed: %w", err)
 	}
-	return price, nil
+	return result, nil
 }
 
+// ResetTables empties tables and the tables referencing them, and restarts
+// id sequences of tables that have one.
 func (s *Store) ResetTables(ctx context.Context, tables []string) error {
-	_, err := s.db.ExecContext(ctx, `TRUNCATE TABLE`+` `+strings.Join(tables, `, `))
+	if _, err := s.db.ExecContext(ctx, `TRUNCATE TABLE `+strings.Join(tables, `, `)+` CASCADE`); err != nil {
+		return err
+	}
 	for _, table := range tables {
-		_, err = s.db.ExecContext(ctx, fmt.Sprintf(`ALTER SEQUENCE %s_id_seq RESTART`, table))
+		_, err := s.db.ExecContext(ctx, fmt.Sprintf(`ALTER SEQUENCE IF EXISTS %s_id_seq RESTART`, table))
 		if err != nil {
 			return err
 		}
 	}
-	return err
+	return nil
 }
@@ -0,0 +1,80 @@
+package pgstore
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// BenchmarkReserveAndRecognize reserves and recognizes orders on the
+// database at PG_BENCH_DSN, run it with -cpu to vary the concurrency.
+func BenchmarkReserveAndRecognize(b *testing.B) {
+	dsn := os.Getenv("PG_BENCH_DSN")
+	if dsn == "" {
+		b.Skip("PG_BENCH_DSN is not set")
+	}
+	pool := PoolConfig{MaxOpenConns: 20, MaxIdleConns: 20, ConnMaxLifetime: time.Hour}
+	// The pgx driver caches prepared statements by default, so the baseline
+	// settings cache them too.
+	b.Run("baseline", func(b *testing.B) {
+		benchmarkReserveAndRecognize(b, dsn)
+	})
+	b.Run("pool", func(b *testing.B) {
+		benchmarkReserveAndRecognize(b, dsn, WithPool(pool))
+	})
+	b.Run("pool-noprepare", func(b *testing.B) {
+		benchmarkReserveAndRecognize(b, dsn, WithPool(pool), WithoutPreparedStatements())
+	})
+}
+
+func benchmarkReserveAndRecognize(b *testing.B, dsn string, opts ...Option) {
+	log := logrus.New()
+	log.SetLevel(logrus.WarnLevel)
+	ctx := context.Background()
+	s, err := New(ctx, log, dsn, opts...)
+	require.NoError(b, err)
+	defer s.Close()
+
+	// Users and orders of every run are new.
+	var userID, orderID atomic.Int64
+	userID.Store(time.Now().Unix() % 100_000 * 10_000)
+	orderID.Store(time.Now().Unix() % 100_000 * 10_000)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// Every goroutine has its own wallet, so they don't wait for each
+		// other's row locks.
+		wallet, err := s.AddFunds(ctx, models.AddFundsRequest{
+			UserID: int(userID.Add(1)), Balance: 1_000_000_000, ClientID: "bench",
+		})
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		for pb.Next() {
+			id := int(orderID.Add(1))
+			_, err = s.ReserveFunds(ctx, models.ReservedFundsRequest{
+				WalletID: wallet.ID, ServiceID: 1, OrderID: id, Price: 1, ClientID: "bench",
+			})
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			_, err = s.RecognizeRevenue(ctx, models.RecognizeRevenueRequest{
+				WalletID: wallet.ID, ServiceID: 1, OrderID: id, Status: "DONE", ClientID: "bench",
+			})
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
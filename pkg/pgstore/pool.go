@@ -0,0 +1,68 @@
+package pgstore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// PoolConfig sizes the connection pools of the primary and of each
+// replica. Zero fields keep database/sql defaults: no limit of open
+// connections, 2 idle ones and connections that live forever.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// WithPool sizes the connection pools.
+func WithPool(cfg PoolConfig) Option {
+	return func(s *Store) {
+		s.pool = cfg
+	}
+}
+
+// WithoutPreparedStatements turns off the statement cache the pgx driver
+// uses by default to prepare every query once per connection, e.g. behind
+// a pooler that doesn't support prepared statements.
+func WithoutPreparedStatements() Option {
+	return func(s *Store) {
+		s.noPrepare = true
+	}
+}
+
+func (c PoolConfig) apply(db *sqlx.DB) {
+	if c.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	if c.ConnMaxLifetime != 0 {
+		db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	}
+	if c.ConnMaxIdleTime != 0 {
+		db.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+	}
+}
+
+// PoolStats returns usage of the connection pool of the primary.
+func (s *Store) PoolStats() sql.DBStats {
+	return s.db.Stats()
+}
+
+// Close closes connections to the primary and replicas.
+func (s *Store) Close() error {
+	for _, r := range s.replicas.list {
+		if err := r.db.Close(); err != nil {
+			s.log.Warnf("close %s failed: %v", r.name, err)
+		}
+	}
+	if err := s.db.Close(); err != nil {
+		return fmt.Errorf("close store failed: %w", err)
+	}
+	return nil
+}
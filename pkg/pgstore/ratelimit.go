@@ -0,0 +1,79 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Allow implements token buckets kept in rate_limits, so every replica
+// sharing the database shares the limits. Tokens are taken only when every
+// bucket has one.
+func (s *Store) Allow(ctx context.Context, buckets []models.RateBucket) (time.Duration, error) {
+	keys := make([]string, len(buckets))
+	rates := make([]float64, len(buckets))
+	bursts := make([]int, len(buckets))
+	for i, b := range buckets {
+		keys[i], rates[i], bursts[i] = b.Key, b.Rate, b.Burst
+	}
+	var wait time.Duration
+	err := s.inTx(ctx, "rate limit", sql.LevelDefault, func(tx *sqlx.Tx) error {
+		query := `
+INSERT INTO rate_limits (key, tokens, allowed, updated_at)
+SELECT key, burst, TRUE, NOW()
+FROM unnest($1::varchar[], $2::int[]) AS t (key, burst)
+ORDER BY key
+ON CONFLICT (key) DO NOTHING;`
+		if _, err := tx.ExecContext(ctx, query, keys, bursts); err != nil {
+			return fmt.Errorf("rate limit failed: %w", err)
+		}
+		query = `
+SELECT rl.key, LEAST(t.burst, rl.tokens + EXTRACT(EPOCH FROM NOW() - rl.updated_at) * t.rate) AS tokens, t.rate
+FROM unnest($1::varchar[], $2::float8[], $3::int[]) AS t (key, rate, burst)
+JOIN rate_limits rl ON rl.key = t.key
+ORDER BY rl.key
+FOR UPDATE OF rl;`
+		var refilled []struct {
+			Key    string  `db:"key"`
+			Tokens float64 `db:"tokens"`
+			Rate   float64 `db:"rate"`
+		}
+		if err := tx.SelectContext(ctx, &refilled, query, keys, rates, bursts); err != nil {
+			return fmt.Errorf("rate limit failed: %w", err)
+		}
+		wait = 0
+		for _, b := range refilled {
+			if b.Tokens < 1 {
+				if w := time.Duration((1 - b.Tokens) / b.Rate * float64(time.Second)); w > wait {
+					wait = w
+				}
+			}
+		}
+		allowed := wait == 0
+		updated := make([]string, len(refilled))
+		tokens := make([]float64, len(refilled))
+		for i, b := range refilled {
+			updated[i], tokens[i] = b.Key, b.Tokens
+			if allowed {
+				tokens[i]--
+			}
+		}
+		query = `
+UPDATE rate_limits rl
+SET tokens = t.tokens,
+	allowed = $3,
+	updated_at = NOW()
+FROM unnest($1::varchar[], $2::float8[]) AS t (key, tokens)
+WHERE rl.key = t.key;`
+		if _, err := tx.ExecContext(ctx, query, updated, tokens, allowed); err != nil {
+			return fmt.Errorf("rate limit failed: %w", err)
+		}
+		return nil
+	})
+	return wait, err
+}
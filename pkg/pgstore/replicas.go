@@ -0,0 +1,226 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type replica struct {
+	name    string
+	db      *sqlx.DB
+	healthy atomic.Bool
+}
+
+type replicas struct {
+	list   []*replica
+	maxLag time.Duration
+	next   atomic.Uint64
+
+	mu    sync.Mutex
+	marks []walMark
+}
+
+// walMark is the WAL position of the primary at a moment.
+type walMark struct {
+	lsn uint64
+	at  time.Time
+}
+
+type primaryKey struct{}
+
+// WithReplicas sends reads that may see data a bit behind (balances,
+// history, statements, orders, reports and analytics) to streaming
+// replicas at dsns. A replica is used while it answers and lags behind the
+// primary by less than maxLag, reads go to the primary when none is.
+func WithReplicas(maxLag time.Duration, dsns ...string) Option {
+	return func(s *Store) {
+		s.replicaDSNs = dsns
+		s.replicas.maxLag = maxLag
+	}
+}
+
+// ReadYourWrites makes reads with ctx go to the primary, so they see
+// writes made just before.
+func ReadYourWrites(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+func (s *Store) openReplicas(ctx context.Context) error {
+	if len(s.replicaDSNs) > 0 {
+		s.markPrimary(ctx)
+	}
+	for i, dsn := range s.replicaDSNs {
+		// Open doesn't connect, a replica that is down on start is only
+		// unhealthy.
+		db, err := s.open(dsn)
+		if err != nil {
+			return fmt.Errorf("open replica %d failed: %w", i, err)
+		}
+		r := &replica{name: fmt.Sprintf("replica %d", i), db: db}
+		s.replicas.list = append(s.replicas.list, r)
+		s.checkReplica(ctx, r)
+	}
+	return nil
+}
+
+// CheckReplicas checks health of replicas every interval until ctx is
+// done. Lag is measured against positions of the primary taken at the
+// checks, so it is known to within interval.
+func (s *Store) CheckReplicas(ctx context.Context, interval time.Duration) error {
+	if len(s.replicas.list) == 0 {
+		return nil
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		s.markPrimary(ctx)
+		for _, r := range s.replicas.list {
+			s.checkReplica(ctx, r)
+		}
+	}
+}
+
+// markPrimary remembers the current WAL position of the primary and
+// forgets positions older than the allowed lag.
+func (s *Store) markPrimary(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	var lsn string
+	if err := s.db.GetContext(ctx, &lsn, `SELECT pg_current_wal_lsn()::text;`); err != nil {
+		s.log.Warnf("get primary wal position failed: %v", err)
+		return
+	}
+	pos, err := parseLSN(lsn)
+	if err != nil {
+		s.log.Warnf("get primary wal position failed: %v", err)
+		return
+	}
+	now := time.Now()
+	s.replicas.mu.Lock()
+	defer s.replicas.mu.Unlock()
+	s.replicas.marks = append(s.replicas.marks, walMark{lsn: pos, at: now})
+	for len(s.replicas.marks) > 1 && now.Sub(s.replicas.marks[0].at) > s.replicas.maxLag {
+		s.replicas.marks = s.replicas.marks[1:]
+	}
+}
+
+// caughtUp tells if a replica that has replayed WAL up to replayed has
+// everything the primary had maxLag ago. Without a recent enough mark
+// nothing is known about the lag and the replica isn't trusted.
+func caughtUp(marks []walMark, replayed uint64, now time.Time, maxLag time.Duration) bool {
+	for _, m := range marks {
+		if now.Sub(m.at) <= maxLag {
+			return replayed >= m.lsn
+		}
+	}
+	return false
+}
+
+// parseLSN parses a pg_lsn like 16/B374D848.
+func parseLSN(lsn string) (uint64, error) {
+	hi, lo, ok := strings.Cut(lsn, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid wal position %q", lsn)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid wal position %q: %w", lsn, err)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid wal position %q: %w", lsn, err)
+	}
+	return h<<32 | l, nil
+}
+
+// checkReplica marks the replica healthy if it answers and has replayed
+// the WAL the primary had maxLag ago. A replica whose WAL receiver is
+// disconnected stops replaying and becomes unhealthy once the primary
+// moves on. A server that isn't in recovery is up to date.
+func (s *Store) checkReplica(ctx context.Context, r *replica) bool {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	query := `SELECT pg_is_in_recovery() AS recovery, COALESCE(pg_last_wal_replay_lsn()::text, '') AS replayed;`
+	var state struct {
+		Recovery bool   `db:"recovery"`
+		Replayed string `db:"replayed"`
+	}
+	err := r.db.GetContext(ctx, &state, query)
+	var replayed uint64
+	if err == nil && state.Recovery {
+		replayed, err = parseLSN(state.Replayed)
+	}
+	healthy := err == nil
+	if healthy && state.Recovery {
+		s.replicas.mu.Lock()
+		healthy = caughtUp(s.replicas.marks, replayed, time.Now(), s.replicas.maxLag)
+		s.replicas.mu.Unlock()
+	}
+	if was := r.healthy.Swap(healthy); was != healthy {
+		switch {
+		case err != nil:
+			s.log.Warnf("%s is down: %v", r.name, err)
+		case !healthy:
+			s.log.Warnf("%s is behind the primary by more than %s", r.name, s.replicas.maxLag)
+		default:
+			s.log.Infof("%s is up", r.name)
+		}
+	}
+	return healthy
+}
+
+// reader picks a healthy replica in turn, or returns nil when reads of
+// ctx must go to the primary.
+func (s *Store) reader(ctx context.Context) *replica {
+	if ctx.Value(primaryKey{}) != nil {
+		return nil
+	}
+	healthy := make([]*replica, 0, len(s.replicas.list))
+	for _, r := range s.replicas.list {
+		if r.healthy.Load() {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	return healthy[s.replicas.next.Add(1)%uint64(len(healthy))]
+}
+
+// read runs fn on a replica or on the primary. If the replica turns out
+// to be down, it runs fn again on the primary.
+func (s *Store) read(ctx context.Context, fn func(db *sqlx.DB) error) error {
+	r := s.reader(ctx)
+	if r == nil {
+		return classify(fn(s.db))
+	}
+	err := fn(r.db)
+	if err == nil || errors.Is(err, sql.ErrNoRows) || errors.Is(err, ErrUserNotExists) ||
+		ctx.Err() != nil || s.checkReplica(ctx, r) {
+		return classify(err)
+	}
+	return classify(fn(s.db))
+}
+
+// readDB is the database to stream from, failures are not retried since
+// rows may have been passed on already.
+func (s *Store) readDB(ctx context.Context) *sqlx.DB {
+	if r := s.reader(ctx); r != nil {
+		return r.db
+	}
+	return s.db
+}
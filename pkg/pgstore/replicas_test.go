@@ -0,0 +1,205 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	s := &Store{}
+	ctx := context.Background()
+	require.Nil(t, s.reader(ctx))
+
+	a, b, c := &replica{name: "a"}, &replica{name: "b"}, &replica{name: "c"}
+	a.healthy.Store(true)
+	c.healthy.Store(true)
+	s.replicas.list = []*replica{a, b, c}
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		seen[s.reader(ctx).name]++
+	}
+	require.Equal(t, map[string]int{"a": 3, "c": 3}, seen)
+
+	require.Nil(t, s.reader(ReadYourWrites(ctx)))
+	a.healthy.Store(false)
+	c.healthy.Store(false)
+	require.Nil(t, s.reader(ctx))
+}
+
+func TestParseLSN(t *testing.T) {
+	pos, err := parseLSN("16/B374D848")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0x16)<<32|0xB374D848, pos)
+	_, err = parseLSN("")
+	require.Error(t, err)
+	_, err = parseLSN("16/zz")
+	require.Error(t, err)
+}
+
+func TestCaughtUp(t *testing.T) {
+	now := time.Now()
+	marks := []walMark{
+		{lsn: 100, at: now.Add(-20 * time.Second)},
+		{lsn: 200, at: now.Add(-5 * time.Second)},
+		{lsn: 300, at: now},
+	}
+	maxLag := 10 * time.Second
+	require.True(t, caughtUp(marks, 200, now, maxLag))
+	require.True(t, caughtUp(marks, 250, now, maxLag))
+	require.False(t, caughtUp(marks, 150, now, maxLag))
+	// A replica that stopped replaying falls behind once the marks it had
+	// are older than maxLag.
+	require.False(t, caughtUp(marks, 200, now.Add(6*time.Second), maxLag))
+	require.False(t, caughtUp(nil, 300, now, maxLag))
+}
+
+// fakeDriver answers queries of the health check, the dsn is the name of
+// a server in servers.
+type fakeDriver struct{}
+
+type fakeServer struct {
+	down     bool
+	recovery bool
+	lsn      string
+}
+
+var servers sync.Map
+
+func init() {
+	sql.Register("pgstore-fake", fakeDriver{})
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return fakeConn{name: name}, nil
+}
+
+type fakeConn struct{ name string }
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c fakeConn) Close() error                        { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)           { return nil, driver.ErrSkip }
+
+func (c fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	v, _ := servers.Load(c.name)
+	srv := v.(*fakeServer)
+	switch {
+	case srv.down:
+		return nil, errors.New("connection refused")
+	case strings.Contains(query, "pg_current_wal_lsn"):
+		return &fakeRows{cols: []string{"pg_current_wal_lsn"}, row: []driver.Value{srv.lsn}}, nil
+	case strings.Contains(query, "pg_is_in_recovery"):
+		return &fakeRows{cols: []string{"recovery", "replayed"}, row: []driver.Value{srv.recovery, srv.lsn}}, nil
+	}
+	return nil, fmt.Errorf("unexpected query %q", query)
+}
+
+type fakeRows struct {
+	cols []string
+	row  []driver.Value
+	done bool
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.row)
+	return nil
+}
+
+func fakeDB(t *testing.T, name string, srv *fakeServer) *sqlx.DB {
+	name = t.Name() + "/" + name
+	servers.Store(name, srv)
+	db := sqlx.MustOpen("pgstore-fake", name)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestCheckReplica(t *testing.T) {
+	ctx := context.Background()
+	primary := &fakeServer{lsn: "0/100"}
+	standby := &fakeServer{recovery: true, lsn: "0/100"}
+	s := &Store{log: logrus.NewEntry(logrus.New()), db: fakeDB(t, "primary", primary)}
+	s.replicas.maxLag = time.Minute
+	r := &replica{name: "replica", db: fakeDB(t, "standby", standby)}
+
+	// Nothing is known about the lag before the first mark.
+	require.False(t, s.checkReplica(ctx, r))
+	s.markPrimary(ctx)
+	require.True(t, s.checkReplica(ctx, r))
+	require.True(t, r.healthy.Load())
+
+	// The replica that stopped receiving WAL replays everything it has, but
+	// it's behind once the marks it caught up with are too old.
+	primary.lsn = "0/200"
+	s.replicas.marks[0].at = time.Now().Add(-2 * time.Minute)
+	s.markPrimary(ctx)
+	require.Len(t, s.replicas.marks, 1)
+	require.False(t, s.checkReplica(ctx, r))
+
+	standby.lsn = "0/200"
+	require.True(t, s.checkReplica(ctx, r))
+	standby.down = true
+	require.False(t, s.checkReplica(ctx, r))
+	require.False(t, r.healthy.Load())
+}
+
+func TestReadFallback(t *testing.T) {
+	ctx := context.Background()
+	primary := &fakeServer{lsn: "0/100"}
+	standby := &fakeServer{recovery: true, lsn: "0/100"}
+	s := &Store{log: logrus.NewEntry(logrus.New()), db: fakeDB(t, "primary", primary)}
+	s.replicas.maxLag = time.Minute
+	r := &replica{name: "replica", db: fakeDB(t, "standby", standby)}
+	s.replicas.list = []*replica{r}
+	s.markPrimary(ctx)
+	require.True(t, s.checkReplica(ctx, r))
+
+	var used []*sqlx.DB
+	failing := func(db *sqlx.DB) error {
+		used = append(used, db)
+		if db == r.db {
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+	// The replica that still passes the check keeps the error.
+	require.Error(t, s.read(ctx, failing))
+	require.Equal(t, []*sqlx.DB{r.db}, used)
+
+	// The one that doesn't is marked unhealthy and the primary answers.
+	used = nil
+	standby.down = true
+	require.NoError(t, s.read(ctx, failing))
+	require.Equal(t, []*sqlx.DB{r.db, s.db}, used)
+	require.False(t, r.healthy.Load())
+
+	// Missing rows are an answer, not a failure of the replica.
+	used = nil
+	r.healthy.Store(true)
+	require.ErrorIs(t, s.read(ctx, func(db *sqlx.DB) error {
+		used = append(used, db)
+		return sql.ErrNoRows
+	}), sql.ErrNoRows)
+	require.Equal(t, []*sqlx.DB{r.db}, used)
+
+	used = nil
+	require.NoError(t, s.read(ReadYourWrites(ctx), failing))
+	require.Equal(t, []*sqlx.DB{s.db}, used)
+}
@@ -0,0 +1,117 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+)
+
+var ErrReportJobNotExists = fmt.Errorf("report job doesn't exist")
+
+const reportJobColumns = `id, kind, format, period_from, period_to, delimiter, encoding, status, error, blob_key, size,
+    requested_by, created_at, started_at, finished_at`
+
+func (s *Store) CreateReportJob(ctx context.Context, data models.ReportJob) (models.ReportJob, error) {
+	query := `
+INSERT INTO report_jobs (kind, format, period_from, period_to, delimiter, encoding, requested_by)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING ` + reportJobColumns + `;`
+	var result models.ReportJob
+
+	err := s.db.GetContext(ctx, &result, query, data.Kind, data.Format, data.From, data.To, data.Delimiter,
+		data.Encoding, data.RequestedBy)
+	if err != nil {
+		return models.ReportJob{}, fmt.Errorf("create report job failed: %w", classify(err))
+	}
+	return result, nil
+}
+
+func (s *Store) ReportJob(ctx context.Context, id int64) (models.ReportJob, error) {
+	query := `SELECT ` + reportJobColumns + ` FROM report_jobs WHERE id = $1;`
+	var result models.ReportJob
+
+	err := s.db.GetContext(ctx, &result, query, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return models.ReportJob{}, ErrReportJobNotExists
+	case err != nil:
+		return models.ReportJob{}, fmt.Errorf("get report job failed: %w", classify(err))
+	}
+	return result, nil
+}
+
+// ClaimReportJob takes the oldest pending job, or a running one whose
+// worker has not finished it within lease. It returns false when there is
+// nothing to do.
+func (s *Store) ClaimReportJob(ctx context.Context, lease time.Duration) (models.ReportJob, bool, error) {
+	query := `
+WITH next AS (
+    SELECT id
+    FROM report_jobs
+    WHERE status = 'PENDING'
+       OR (status = 'RUNNING' AND locked_until <= NOW())
+    ORDER BY id
+    LIMIT 1 FOR UPDATE SKIP LOCKED
+)
+UPDATE report_jobs j
+SET status = 'RUNNING',
+    started_at = NOW(),
+    locked_until = NOW() + $1 * INTERVAL '1 millisecond'
+FROM next
+WHERE j.id = next.id
+RETURNING ` + reportJobColumns + `;`
+	var result models.ReportJob
+
+	err := s.db.GetContext(ctx, &result, query, lease.Milliseconds())
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return models.ReportJob{}, false, nil
+	case err != nil:
+		return models.ReportJob{}, false, fmt.Errorf("claim report job failed: %w", classify(err))
+	}
+	return result, true, nil
+}
+
+// ExtendReportJob moves the lease of a running job to lease from now.
+func (s *Store) ExtendReportJob(ctx context.Context, id int64, lease time.Duration) error {
+	query := `
+UPDATE report_jobs
+SET locked_until = NOW() + $2 * INTERVAL '1 millisecond'
+WHERE id = $1
+  AND status = 'RUNNING';`
+	if _, err := s.db.ExecContext(ctx, query, id, lease.Milliseconds()); err != nil {
+		return fmt.Errorf("extend report job failed: %w", classify(err))
+	}
+	return nil
+}
+
+func (s *Store) FinishReportJob(ctx context.Context, id int64, blobKey string, size int64) error {
+	query := `
+UPDATE report_jobs
+SET status = 'DONE',
+    blob_key = $2,
+    size = $3,
+    finished_at = NOW()
+WHERE id = $1;`
+	if _, err := s.db.ExecContext(ctx, query, id, blobKey, size); err != nil {
+		return fmt.Errorf("finish report job failed: %w", classify(err))
+	}
+	return nil
+}
+
+func (s *Store) FailReportJob(ctx context.Context, id int64, reason string) error {
+	query := `
+UPDATE report_jobs
+SET status = 'FAILED',
+    error = $2,
+    finished_at = NOW()
+WHERE id = $1;`
+	if _, err := s.db.ExecContext(ctx, query, id, reason); err != nil {
+		return fmt.Errorf("fail report job failed: %w", classify(err))
+	}
+	return nil
+}
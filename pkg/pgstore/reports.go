@@ -0,0 +1,130 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// withArchivedEvents is events together with the archived ones loaded by
+// loadArchivedEvents.
+const withArchivedEvents = `(SELECT * FROM events UNION ALL SELECT * FROM archived_events)`
+
+// recognizedOrders selects DONE orders recognized in [$1, $2) from events,
+// a table or a subquery with its columns.
+func recognizedOrders(events string) string {
+	return `
+SELECT e.order_id, e.service_id, e.wallet_id, w.user_id, e.price, e.recognized_by,
+    COALESCE(h.created_at, e.datetime) AS recognized_at` + recognizedOrdersFrom(events)
+}
+
+// recognizedOrdersFrom joins DONE orders recognized in [$1, $2) with their
+// wallets as w and DEBIT entries as h. Orders recognized before history
+// was recorded have no entry and count at the time they were reserved.
+func recognizedOrdersFrom(events string) string {
+	return `
+FROM ` + events + ` e
+JOIN wallets w ON w.id = e.wallet_id
+LEFT JOIN wallet_history h ON h.order_id = e.order_id AND h.kind = 'DEBIT'
+WHERE e.status = 'DONE'
+  AND e.datetime < $2
+  AND COALESCE(h.created_at, e.datetime) >= $1
+  AND COALESCE(h.created_at, e.datetime) < $2`
+}
+
+// RevenueByService passes revenue of every service in [from, to) to fn.
+func (s *Store) RevenueByService(ctx context.Context, from, to time.Time, fn func(models.ServiceRevenue) error) error {
+	query := func(events string) string {
+		return `
+SELECT service_id, COUNT(*) AS orders, SUM(price) AS revenue
+FROM (` + recognizedOrders(events) + `) o
+GROUP BY service_id
+ORDER BY service_id;`
+	}
+	if err := streamRecognized(ctx, s, query, from, to, fn); err != nil {
+		return fmt.Errorf("get revenue failed: %w", err)
+	}
+	return nil
+}
+
+// RecognizedOrders passes orders recognized in [from, to) to fn in the
+// order they were recognized.
+func (s *Store) RecognizedOrders(ctx context.Context, from, to time.Time, fn func(models.RecognizedOrder) error) error {
+	query := func(events string) string {
+		return recognizedOrders(events) + `
+ORDER BY recognized_at, e.order_id;`
+	}
+	if err := streamRecognized(ctx, s, query, from, to, fn); err != nil {
+		return fmt.Errorf("get recognized orders failed: %w", err)
+	}
+	return nil
+}
+
+// streamRecognized streams a query over recognized orders of [from, to),
+// query gets what to select orders from: events or, when the period
+// needs archived partitions, events with archived ones. Reports scan a
+// lot, so they run without the statement timeout.
+func streamRecognized[T any](ctx context.Context, s *Store, query func(events string) string, from, to time.Time, fn func(T) error) (err error) {
+	defer func() {
+		err = classify(err)
+	}()
+	db := s.readDB(ctx)
+	keys, err := archivedKeys(ctx, db, from, to)
+	if err != nil {
+		return err
+	}
+	// Archived events go to a temporary table, replicas can't have one.
+	opts := &sql.TxOptions{ReadOnly: true}
+	if len(keys) > 0 {
+		db, opts = s.db, nil
+	}
+	tx, err := db.BeginTxx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			s.log.Warnf("rollback failed: %v", err)
+		}
+	}()
+	if err = withoutStatementTimeout(ctx, tx); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return streamRows(ctx, s, tx, query("events"), fn, from, to)
+	}
+	if err = s.loadArchivedEvents(ctx, tx, keys); err != nil {
+		return err
+	}
+	return streamRows(ctx, s, tx, query(withArchivedEvents), fn, from, to)
+}
+
+// streamRows scans rows one at a time, so results of any size don't have
+// to fit in memory. An error of fn stops the query.
+func streamRows[T any](ctx context.Context, s *Store, q sqlx.QueryerContext, query string, fn func(T) error, args ...any) error {
+	rows, err := q.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			s.log.Warnf("close rows failed: %v", err)
+		}
+	}()
+	for rows.Next() {
+		var row T
+		if err = rows.StructScan(&row); err != nil {
+			return err
+		}
+		if err = fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
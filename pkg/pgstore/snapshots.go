@@ -0,0 +1,91 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// TakeSnapshots saves current balances of wallets that moved since their
+// previous snapshot as snapshots at the moment at. A snapshot keeps the
+// id of the last history entry its balance includes: entries of a wallet
+// are added under the lock of the wallet row, so entries committed later
+// have greater ids and are never missed, whenever they were started.
+func (s *Store) TakeSnapshots(ctx context.Context, at time.Time) (int, error) {
+	query := `
+INSERT INTO balance_snapshots (wallet_id, taken_at, history_id, account_balance, reserved)
+SELECT w.id, $1, h.id, w.account_balance, w.reserved
+FROM wallets w
+JOIN LATERAL (SELECT MAX(id) AS id FROM wallet_history WHERE wallet_id = w.id) h ON TRUE
+WHERE h.id > COALESCE((SELECT MAX(history_id) FROM balance_snapshots s WHERE s.wallet_id = w.id), 0)
+ON CONFLICT (wallet_id, taken_at) DO NOTHING;`
+	n, err := s.execWithoutStatementTimeout(ctx, query, at)
+	if err != nil {
+		return 0, fmt.Errorf("take snapshots failed: %w", classify(err))
+	}
+	return int(n), nil
+}
+
+// walletBalanceAt rebuilds the balance at the moment from the latest
+// snapshot before it: entries after the snapshot made up to the moment
+// are added and entries in the snapshot made after the moment are
+// subtracted. Without a snapshot the history after the moment is
+// subtracted from the current balance.
+func (s *Store) walletBalanceAt(ctx context.Context, db *sqlx.DB, userID int, at time.Time) (models.WalletResponse, error) {
+	query := `
+SELECT w.id, w.user_id, s.account_balance, s.reserved, s.history_id
+FROM wallets w
+JOIN balance_snapshots s ON s.wallet_id = w.id
+WHERE w.user_id = $1
+  AND s.taken_at <= $2
+ORDER BY s.taken_at DESC
+LIMIT 1;`
+	var snapshot struct {
+		models.WalletResponse
+		HistoryID int64 `db:"history_id"`
+	}
+
+	err := db.GetContext(ctx, &snapshot, query, userID, at)
+	result := snapshot.WalletResponse
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		query = `
+SELECT w.id, w.user_id,
+    w.account_balance - COALESCE(SUM(h.balance_delta), 0) AS account_balance,
+    w.reserved - COALESCE(SUM(h.reserved_delta), 0) AS reserved
+FROM wallets w
+LEFT JOIN wallet_history h ON h.wallet_id = w.id AND h.created_at > $2
+WHERE w.user_id = $1
+GROUP BY w.id;`
+		err = db.GetContext(ctx, &result, query, userID, at)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return models.WalletResponse{}, ErrUserNotExists
+		case err != nil:
+			return models.WalletResponse{}, fmt.Errorf("get user balance failed: %w", classify(err))
+		}
+	case err != nil:
+		return models.WalletResponse{}, fmt.Errorf("get user balance failed: %w", classify(err))
+	default:
+		query = `
+SELECT COALESCE(SUM(balance_delta) FILTER (WHERE id > $2), 0) - COALESCE(SUM(balance_delta) FILTER (WHERE id <= $2), 0),
+    COALESCE(SUM(reserved_delta) FILTER (WHERE id > $2), 0) - COALESCE(SUM(reserved_delta) FILTER (WHERE id <= $2), 0)
+FROM wallet_history
+WHERE wallet_id = $1
+  AND (id > $2 AND created_at <= $3 OR id <= $2 AND created_at > $3);`
+		var balance, reserved int
+		if err = db.QueryRowxContext(ctx, query, result.ID, snapshot.HistoryID, at).Scan(&balance, &reserved); err != nil {
+			return models.WalletResponse{}, fmt.Errorf("get user balance failed: %w", classify(err))
+		}
+		result.Balance += balance
+		result.Reserved += reserved
+	}
+	result.AsOf = &at
+	return result, nil
+}
@@ -0,0 +1,183 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// CloseDay freezes balances of wallets at the end of the business day,
+// which is the moment end, with the hash of the last history entry before
+// it to anchor the chain. A day is closed once, repeated calls keep the
+// first balances.
+func (s *Store) CloseDay(ctx context.Context, day time.Time, end time.Time) (int, error) {
+	query := `
+INSERT INTO daily_balances (business_date, wallet_id, account_balance, reserved, balances_at, history_hash)
+SELECT $1::date, w.id, w.account_balance - COALESCE(SUM(h.balance_delta), 0), w.reserved - COALESCE(SUM(h.reserved_delta), 0), $2,
+    COALESCE((SELECT p.hash FROM wallet_history p WHERE p.wallet_id = w.id AND p.created_at < $2 ORDER BY p.id DESC LIMIT 1), '')
+FROM wallets w
+LEFT JOIN wallet_history h ON h.wallet_id = w.id AND h.created_at >= $2
+GROUP BY w.id
+HAVING w.account_balance - COALESCE(SUM(h.balance_delta), 0) <> 0
+    OR w.reserved - COALESCE(SUM(h.reserved_delta), 0) <> 0
+    OR EXISTS (SELECT 1 FROM wallet_history p WHERE p.wallet_id = w.id AND p.created_at < $2)
+ON CONFLICT (business_date, wallet_id) DO NOTHING;`
+	n, err := s.execWithoutStatementTimeout(ctx, query, day.Format(time.DateOnly), end)
+	if err != nil {
+		return 0, fmt.Errorf("close day failed: %w", classify(err))
+	}
+	return int(n), nil
+}
+
+// LastClosedDay returns the latest closed business date or zero time.
+func (s *Store) LastClosedDay(ctx context.Context) (time.Time, error) {
+	var result sql.NullTime
+	if err := s.db.GetContext(ctx, &result, `SELECT MAX(business_date) FROM daily_balances;`); err != nil {
+		return time.Time{}, fmt.Errorf("get last closed day failed: %w", classify(err))
+	}
+	return result.Time, nil
+}
+
+// Statements sums up movements of wallets in the period. Balances open
+// from the last day closed before the period and add the history after
+// its end, without a closed day they are counted back from the current
+// ones.
+func (s *Store) Statements(ctx context.Context, filter models.StatementFilter) ([]models.Statement, error) {
+	var result []models.Statement
+	err := s.read(ctx, func(db *sqlx.DB) (err error) {
+		result, err = s.statements(ctx, db, filter)
+		return err
+	})
+	return result, err
+}
+
+// closedDay is the day whose balances statements open from.
+type closedDay struct {
+	BusinessDate time.Time `db:"business_date"`
+	BalancesAt   time.Time `db:"balances_at"`
+}
+
+func (s *Store) statements(ctx context.Context, q sqlx.QueryerContext, filter models.StatementFilter) ([]models.Statement, error) {
+	var day closedDay
+	err := sqlx.GetContext(ctx, q, &day, `
+SELECT business_date, balances_at
+FROM daily_balances
+WHERE balances_at <= $1
+ORDER BY business_date DESC
+LIMIT 1;`, filter.From)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return s.statementsFromCurrent(ctx, q, filter)
+	case err != nil:
+		return nil, fmt.Errorf("get statements failed: %w", classify(err))
+	}
+
+	query := `
+SELECT w.id AS wallet_id, w.user_id,
+    COALESCE(d.account_balance, 0) + COALESCE(SUM(h.balance_delta) FILTER (WHERE h.created_at < $1), 0) AS opening_balance,
+    COALESCE(d.reserved, 0) + COALESCE(SUM(h.reserved_delta) FILTER (WHERE h.created_at < $1), 0) AS opening_reserved,
+    COALESCE(SUM(h.balance_delta) FILTER (WHERE h.created_at >= $1 AND h.balance_delta > 0), 0) AS credits,
+    COALESCE(-SUM(h.balance_delta) FILTER (WHERE h.created_at >= $1 AND h.balance_delta < 0), 0) AS debits,
+    COALESCE(SUM(h.reserved_delta) FILTER (WHERE h.created_at >= $1 AND h.reserved_delta > 0), 0) AS holds,
+    COALESCE(-SUM(h.reserved_delta) FILTER (WHERE h.created_at >= $1 AND h.reserved_delta < 0), 0) AS releases,
+    COALESCE(d.account_balance, 0) + COALESCE(SUM(h.balance_delta), 0) AS closing_balance,
+    COALESCE(d.reserved, 0) + COALESCE(SUM(h.reserved_delta), 0) AS closing_reserved
+FROM wallets w
+LEFT JOIN daily_balances d ON d.business_date = $4 AND d.wallet_id = w.id
+LEFT JOIN wallet_history h ON h.wallet_id = w.id AND h.created_at >= $5 AND h.created_at < $2
+WHERE ($3 = 0 OR w.user_id = $3)
+GROUP BY w.id, d.account_balance, d.reserved
+ORDER BY w.user_id;`
+	result := make([]models.Statement, 0)
+
+	if err = sqlx.SelectContext(ctx, q, &result, query, filter.From, filter.To, filter.UserID, day.BusinessDate, day.BalancesAt); err != nil {
+		return nil, fmt.Errorf("get statements failed: %w", classify(err))
+	}
+	for i := range result {
+		result[i].From, result[i].To = filter.From, filter.To
+	}
+	return result, nil
+}
+
+// statementsFromCurrent counts balances back from the current ones, when
+// no day was closed before the period.
+func (s *Store) statementsFromCurrent(ctx context.Context, q sqlx.QueryerContext, filter models.StatementFilter) ([]models.Statement, error) {
+	query := `
+SELECT w.id AS wallet_id, w.user_id,
+    w.account_balance - COALESCE(SUM(h.balance_delta), 0) AS opening_balance,
+    w.reserved - COALESCE(SUM(h.reserved_delta), 0) AS opening_reserved,
+    COALESCE(SUM(h.balance_delta) FILTER (WHERE h.created_at < $2 AND h.balance_delta > 0), 0) AS credits,
+    COALESCE(-SUM(h.balance_delta) FILTER (WHERE h.created_at < $2 AND h.balance_delta < 0), 0) AS debits,
+    COALESCE(SUM(h.reserved_delta) FILTER (WHERE h.created_at < $2 AND h.reserved_delta > 0), 0) AS holds,
+    COALESCE(-SUM(h.reserved_delta) FILTER (WHERE h.created_at < $2 AND h.reserved_delta < 0), 0) AS releases,
+    w.account_balance - COALESCE(SUM(h.balance_delta) FILTER (WHERE h.created_at >= $2), 0) AS closing_balance,
+    w.reserved - COALESCE(SUM(h.reserved_delta) FILTER (WHERE h.created_at >= $2), 0) AS closing_reserved
+FROM wallets w
+LEFT JOIN wallet_history h ON h.wallet_id = w.id AND h.created_at >= $1
+WHERE ($3 = 0 OR w.user_id = $3)
+GROUP BY w.id
+ORDER BY w.user_id;`
+	result := make([]models.Statement, 0)
+
+	if err := sqlx.SelectContext(ctx, q, &result, query, filter.From, filter.To, filter.UserID); err != nil {
+		return nil, fmt.Errorf("get statements failed: %w", classify(err))
+	}
+	for i := range result {
+		result[i].From, result[i].To = filter.From, filter.To
+	}
+	return result, nil
+}
+
+// Statement returns the statement of the user's wallet with its movements
+// in the period, read from one snapshot of the database.
+func (s *Store) Statement(ctx context.Context, filter models.StatementFilter) (models.Statement, error) {
+	var result models.Statement
+	err := s.read(ctx, func(db *sqlx.DB) (err error) {
+		result, err = s.statement(ctx, db, filter)
+		return err
+	})
+	return result, err
+}
+
+func (s *Store) statement(ctx context.Context, db *sqlx.DB, filter models.StatementFilter) (models.Statement, error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return models.Statement{}, fmt.Errorf("get statement failed: %w", classify(err))
+	}
+	defer func() {
+		if err = tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			s.log.Warnf("get statement failed: %v", err)
+		}
+	}()
+
+	statements, err := s.statements(ctx, tx, filter)
+	if err != nil {
+		return models.Statement{}, err
+	}
+	if len(statements) == 0 {
+		return models.Statement{}, ErrUserNotExists
+	}
+	result := statements[0]
+
+	query := `
+SELECT id, wallet_id, kind, balance_delta, reserved_delta, order_id, reference, client_id, created_at, prev_hash, hash
+FROM wallet_history
+WHERE wallet_id = $1
+  AND created_at >= $2
+  AND created_at < $3
+ORDER BY id;`
+	result.Entries = make([]models.HistoryEntry, 0)
+	if err = tx.SelectContext(ctx, &result.Entries, query, result.WalletID, filter.From, filter.To); err != nil {
+		return models.Statement{}, fmt.Errorf("get statement failed: %w", classify(err))
+	}
+	if err = tx.Commit(); err != nil {
+		return models.Statement{}, fmt.Errorf("get statement failed: %w", classify(err))
+	}
+	return result, nil
+}
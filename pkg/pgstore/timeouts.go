@@ -0,0 +1,105 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	codeQueryCanceled    = "57014"
+	codeLockNotAvailable = "55P03"
+)
+
+// WithTimeouts makes Postgres cancel a statement running longer than
+// statement and a wait for a lock longer than lock, zero keeps the server
+// setting. Background jobs and reports that scan a lot of rows run
+// without the statement timeout.
+func WithTimeouts(statement, lock time.Duration) Option {
+	return func(s *Store) {
+		s.statementTimeout = statement
+		s.lockTimeout = lock
+	}
+}
+
+// open opens a pool of connections to dsn with the timeouts and the size
+// of the store, it doesn't connect.
+func (s *Store) open(dsn string) (*sqlx.DB, error) {
+	cfg, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if s.statementTimeout > 0 {
+		cfg.RuntimeParams["statement_timeout"] = strconv.FormatInt(s.statementTimeout.Milliseconds(), 10)
+	}
+	if s.lockTimeout > 0 {
+		cfg.RuntimeParams["lock_timeout"] = strconv.FormatInt(s.lockTimeout.Milliseconds(), 10)
+	}
+	if s.noPrepare {
+		cfg.DefaultQueryExecMode = pgx.QueryExecModeDescribeExec
+	}
+	db := sqlx.NewDb(stdlib.OpenDB(*cfg), "pgx")
+	s.pool.apply(db)
+	return db, nil
+}
+
+// withoutStatementTimeout lifts the statement timeout for the rest of tx.
+func withoutStatementTimeout(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, `SET LOCAL statement_timeout = 0;`)
+	return err
+}
+
+// execWithoutStatementTimeout runs a statement of a background job that
+// scans a lot of rows and returns the number of rows it affected.
+func (s *Store) execWithoutStatementTimeout(ctx context.Context, query string, args ...any) (int64, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err = tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			s.log.Warnf("rollback failed: %v", err)
+		}
+	}()
+	if err = withoutStatementTimeout(ctx, tx); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// classify marks err with ErrTimeout when the caller's deadline passed or
+// Postgres gave up on a statement or a lock, and with ErrCanceled when the
+// caller went away.
+func classify(err error) error {
+	var pgErr *pgconn.PgError
+	switch {
+	case err == nil, errors.Is(err, ErrTimeout), errors.Is(err, ErrCanceled):
+		return err
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	case errors.Is(err, context.Canceled):
+		return fmt.Errorf("%w: %w", ErrCanceled, err)
+	case errors.As(err, &pgErr) && (pgErr.Code == codeQueryCanceled || pgErr.Code == codeLockNotAvailable):
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
@@ -0,0 +1,26 @@
+package pgstore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassify(t *testing.T) {
+	require.NoError(t, classify(nil))
+
+	err := classify(fmt.Errorf("get order failed: %w", context.DeadlineExceeded))
+	require.ErrorIs(t, err, ErrTimeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorIs(t, classify(context.Canceled), ErrCanceled)
+	require.ErrorIs(t, classify(&pgconn.PgError{Code: codeQueryCanceled}), ErrTimeout)
+	require.ErrorIs(t, classify(&pgconn.PgError{Code: codeLockNotAvailable}), ErrTimeout)
+	require.Equal(t, err, classify(err))
+
+	other := &pgconn.PgError{Code: "23505"}
+	require.Equal(t, error(other), classify(other))
+	require.Equal(t, ErrNotEnoughFunds, classify(ErrNotEnoughFunds))
+}
@@ -0,0 +1,170 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrTxConflict is returned when a transaction keeps failing on
+// serialization failures or deadlocks after all attempts.
+var ErrTxConflict = fmt.Errorf("transaction conflicts with concurrent ones")
+
+const (
+	codeSerializationFailure = "40001"
+	codeDeadlockDetected     = "40P01"
+)
+
+// TxRetry sets the isolation level of ReserveFunds and RecognizeRevenue
+// and how their transactions are retried on serialization failures and
+// deadlocks: up to MaxAttempts times, waiting a random delay up to
+// BaseDelay doubled on every attempt but no longer than MaxDelay.
+type TxRetry struct {
+	Isolation   sql.IsolationLevel
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var defaultTxRetry = TxRetry{
+	Isolation:   sql.LevelDefault,
+	MaxAttempts: 5,
+	BaseDelay:   10 * time.Millisecond,
+	MaxDelay:    500 * time.Millisecond,
+}
+
+// WithTxRetry replaces the default read committed isolation and 5 attempts
+// 10ms to 500ms apart, zero fields keep their defaults.
+func WithTxRetry(cfg TxRetry) Option {
+	return func(s *Store) {
+		s.txRetry = cfg
+	}
+}
+
+// withDefaults fills zero fields with defaultTxRetry.
+func (cfg TxRetry) withDefaults() TxRetry {
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = defaultTxRetry.MaxAttempts
+	}
+	if cfg.BaseDelay == 0 {
+		cfg.BaseDelay = defaultTxRetry.BaseDelay
+	}
+	if cfg.MaxDelay == 0 {
+		cfg.MaxDelay = defaultTxRetry.MaxDelay
+	}
+	return cfg
+}
+
+func (s *Store) isolation() sql.IsolationLevel {
+	return s.txRetry.Isolation
+}
+
+// TxStats counts transactions run by the retrying helper since start.
+type TxStats struct {
+	Transactions          uint64 `json:"transactions"`
+	Retries               uint64 `json:"retries"`
+	SerializationFailures uint64 `json:"serializationFailures"`
+	Deadlocks             uint64 `json:"deadlocks"`
+	Conflicts             uint64 `json:"conflicts"`
+}
+
+type txStats struct {
+	transactions          atomic.Uint64
+	retries               atomic.Uint64
+	serializationFailures atomic.Uint64
+	deadlocks             atomic.Uint64
+	conflicts             atomic.Uint64
+}
+
+// TxStats returns the counters of retried transactions, Conflicts are
+// those that ran out of attempts.
+func (s *Store) TxStats() TxStats {
+	return TxStats{
+		Transactions:          s.txStats.transactions.Load(),
+		Retries:               s.txStats.retries.Load(),
+		SerializationFailures: s.txStats.serializationFailures.Load(),
+		Deadlocks:             s.txStats.deadlocks.Load(),
+		Conflicts:             s.txStats.conflicts.Load(),
+	}
+}
+
+// inTx runs fn in a transaction at level and commits it, retrying the
+// whole transaction on serialization failures and deadlocks. fn may run
+// several times, so it must not keep state between runs. Errors of fn are
+// returned as is, others are wrapped with op; timeouts and cancellations
+// are marked with ErrTimeout and ErrCanceled.
+func (s *Store) inTx(ctx context.Context, op string, level sql.IsolationLevel, fn func(tx *sqlx.Tx) error) error {
+	s.txStats.transactions.Add(1)
+	err := s.retry(ctx, func() error {
+		tx, err := s.db.BeginTxx(ctx, &sql.TxOptions{Isolation: level})
+		if err != nil {
+			return fmt.Errorf("%s failed: %w", op, err)
+		}
+		defer func() {
+			if err = tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+				s.log.Warnf("%s failed: %v", op, err)
+			}
+		}()
+		if err = fn(tx); err != nil {
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("%s failed: %w", op, err)
+		}
+		return nil
+	})
+	return classify(err)
+}
+
+// retry runs fn until it doesn't fail on a serialization failure or a
+// deadlock, attempts run out or ctx is done.
+func (s *Store) retry(ctx context.Context, fn func() error) error {
+	cfg := s.txRetry.withDefaults()
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) {
+			return err
+		}
+		switch pgErr.Code {
+		case codeSerializationFailure:
+			s.txStats.serializationFailures.Add(1)
+		case codeDeadlockDetected:
+			s.txStats.deadlocks.Add(1)
+		default:
+			return err
+		}
+		if attempt >= cfg.MaxAttempts {
+			s.txStats.conflicts.Add(1)
+			return fmt.Errorf("%w after %d attempts: %v", ErrTxConflict, attempt, err)
+		}
+		timer := time.NewTimer(cfg.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		s.txStats.retries.Add(1)
+	}
+}
+
+// backoff is a random delay up to BaseDelay doubled attempt-1 times and
+// capped by MaxDelay, so conflicting transactions don't retry in step.
+func (c TxRetry) backoff(attempt int) time.Duration {
+	d := c.MaxDelay
+	if attempt < 32 && c.BaseDelay<<(attempt-1) < d {
+		d = c.BaseDelay << (attempt - 1)
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
@@ -0,0 +1,82 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetry(t *testing.T) {
+	s := &Store{
+		log:     logrus.New().WithField("module", "pgstore"),
+		txRetry: TxRetry{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	}
+	ctx := context.Background()
+	serialization := fmt.Errorf("reserve funds failed: %w", &pgconn.PgError{Code: codeSerializationFailure})
+	deadlock := &pgconn.PgError{Code: codeDeadlockDetected}
+
+	errs := []error{serialization, deadlock, nil}
+	calls := 0
+	err := s.retry(ctx, func() error {
+		calls++
+		return errs[calls-1]
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+
+	calls = 0
+	err = s.retry(ctx, func() error {
+		calls++
+		return serialization
+	})
+	require.ErrorIs(t, err, ErrTxConflict)
+	require.Equal(t, 3, calls)
+
+	calls = 0
+	err = s.retry(ctx, func() error {
+		calls++
+		return ErrNotEnoughFunds
+	})
+	require.ErrorIs(t, err, ErrNotEnoughFunds)
+	require.Equal(t, 1, calls)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	s.txRetry.BaseDelay, s.txRetry.MaxDelay = time.Hour, time.Hour
+	calls = 0
+	err = s.retry(canceled, func() error {
+		calls++
+		return deadlock
+	})
+	require.True(t, errors.As(err, new(*pgconn.PgError)))
+	require.Equal(t, 1, calls)
+
+	require.Equal(t, TxStats{Retries: 4, SerializationFailures: 4, Deadlocks: 2, Conflicts: 1}, s.TxStats())
+}
+
+func TestBackoff(t *testing.T) {
+	cfg := TxRetry{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	for attempt, limit := range map[int]time.Duration{1: 10, 2: 20, 3: 40, 4: 50, 40: 50} {
+		for i := 0; i < 100; i++ {
+			require.LessOrEqual(t, cfg.backoff(attempt), limit*time.Millisecond)
+		}
+	}
+}
+
+func TestTxRetryDefaults(t *testing.T) {
+	require.Equal(t, defaultTxRetry, TxRetry{}.withDefaults())
+	cfg := TxRetry{Isolation: sql.LevelSerializable, BaseDelay: time.Millisecond}.withDefaults()
+	require.Equal(t, TxRetry{
+		Isolation:   sql.LevelSerializable,
+		MaxAttempts: defaultTxRetry.MaxAttempts,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    defaultTxRetry.MaxDelay,
+	}, cfg)
+}
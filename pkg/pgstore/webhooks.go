@@ -0,0 +1,199 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+)
+
+var ErrWebhookNotExists = fmt.Errorf("webhook subscription doesn't exist")
+
+type webhookRow struct {
+	models.WebhookSubscription
+	EventTypes []byte `db:"event_types"`
+}
+
+func (r webhookRow) subscription() (models.WebhookSubscription, error) {
+	sub := r.WebhookSubscription
+	if err := json.Unmarshal(r.EventTypes, &sub.EventTypes); err != nil {
+		return models.WebhookSubscription{}, fmt.Errorf("decode event types failed: %w", classify(err))
+	}
+	return sub, nil
+}
+
+func (s *Store) CreateWebhook(ctx context.Context, data models.WebhookSubscription) (models.WebhookSubscription, error) {
+	eventTypes, err := json.Marshal(data.EventTypes)
+	if err != nil {
+		return models.WebhookSubscription{}, fmt.Errorf("create webhook failed: %w", classify(err))
+	}
+	query := `
+INSERT INTO webhook_subscriptions (url, event_types, secret, created_by)
+VALUES ($1, $2, $3, $4)
+RETURNING id, url, event_types, secret, created_by, created_at, updated_at;`
+	var result webhookRow
+
+	if err = s.db.GetContext(ctx, &result, query, data.URL, eventTypes, data.Secret, data.CreatedBy); err != nil {
+		return models.WebhookSubscription{}, fmt.Errorf("create webhook failed: %w", classify(err))
+	}
+	return result.subscription()
+}
+
+func (s *Store) Webhooks(ctx context.Context) ([]models.WebhookSubscription, error) {
+	query := `
+SELECT id, url, event_types, secret, created_by, created_at, updated_at
+FROM webhook_subscriptions
+ORDER BY id;`
+	var rows []webhookRow
+
+	if err := s.db.SelectContext(ctx, &rows, query); err != nil {
+		return nil, fmt.Errorf("get webhooks failed: %w", classify(err))
+	}
+	result := make([]models.WebhookSubscription, 0, len(rows))
+	for _, row := range rows {
+		sub, err := row.subscription()
+		if err != nil {
+			return nil, fmt.Errorf("get webhooks failed: %w", classify(err))
+		}
+		result = append(result, sub)
+	}
+	return result, nil
+}
+
+func (s *Store) Webhook(ctx context.Context, id int) (models.WebhookSubscription, error) {
+	query := `
+SELECT id, url, event_types, secret, created_by, created_at, updated_at
+FROM webhook_subscriptions
+WHERE id = $1;`
+	var result webhookRow
+
+	err := s.db.GetContext(ctx, &result, query, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return models.WebhookSubscription{}, ErrWebhookNotExists
+	case err != nil:
+		return models.WebhookSubscription{}, fmt.Errorf("get webhook failed: %w", classify(err))
+	}
+	return result.subscription()
+}
+
+func (s *Store) UpdateWebhook(ctx context.Context, data models.WebhookSubscription) (models.WebhookSubscription, error) {
+	eventTypes, err := json.Marshal(data.EventTypes)
+	if err != nil {
+		return models.WebhookSubscription{}, fmt.Errorf("update webhook failed: %w", classify(err))
+	}
+	query := `
+UPDATE webhook_subscriptions
+SET url = $2,
+    event_types = $3,
+    secret = COALESCE(NULLIF($4, ''), secret),
+    updated_at = NOW()
+WHERE id = $1
+RETURNING id, url, event_types, secret, created_by, created_at, updated_at;`
+	var result webhookRow
+
+	err = s.db.GetContext(ctx, &result, query, data.ID, data.URL, eventTypes, data.Secret)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return models.WebhookSubscription{}, ErrWebhookNotExists
+	case err != nil:
+		return models.WebhookSubscription{}, fmt.Errorf("update webhook failed: %w", classify(err))
+	}
+	return result.subscription()
+}
+
+func (s *Store) DeleteWebhook(ctx context.Context, id int) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM webhook_subscriptions WHERE id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("delete webhook failed: %w", classify(err))
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrWebhookNotExists
+	}
+	return nil
+}
+
+// EnqueueWebhookDeliveries creates a pending delivery of msg for every
+// subscription to its type. A message published twice is enqueued once.
+func (s *Store) EnqueueWebhookDeliveries(ctx context.Context, msg models.OutboxMessage) error {
+	query := `
+INSERT INTO webhook_deliveries (subscription_id, outbox_id, event_type, payload)
+SELECT id, $1, $2, $3
+FROM webhook_subscriptions
+WHERE event_types @> jsonb_build_array($2::text)
+ON CONFLICT (subscription_id, outbox_id) DO NOTHING;`
+	if _, err := s.db.ExecContext(ctx, query, msg.ID, msg.EventType, []byte(msg.Payload)); err != nil {
+		return fmt.Errorf("enqueue webhook deliveries failed: %w", classify(err))
+	}
+	return nil
+}
+
+// ClaimWebhookDeliveries takes up to limit due deliveries and hides them
+// from other dispatchers for lease.
+func (s *Store) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	query := `
+WITH due AS (
+    SELECT id
+    FROM webhook_deliveries
+    WHERE status = 'PENDING'
+      AND next_attempt_at <= NOW()
+    ORDER BY next_attempt_at
+    LIMIT $1 FOR UPDATE SKIP LOCKED
+)
+UPDATE webhook_deliveries d
+SET next_attempt_at = NOW() + $2 * INTERVAL '1 millisecond'
+FROM due, webhook_subscriptions ws
+WHERE d.id = due.id
+  AND ws.id = d.subscription_id
+RETURNING d.id, d.subscription_id, d.outbox_id, d.event_type, d.payload, d.status, d.attempts,
+    d.next_attempt_at, d.last_error, d.response_status, d.created_at, d.delivered_at, ws.url, ws.secret;`
+	var result []models.WebhookDelivery
+
+	if err := s.db.SelectContext(ctx, &result, query, limit, lease.Milliseconds()); err != nil {
+		return nil, fmt.Errorf("claim webhook deliveries failed: %w", classify(err))
+	}
+	return result, nil
+}
+
+// SaveWebhookDelivery saves the attempt of a delivery claimed until
+// claimedUntil. Nothing is saved if the claim has run out and the delivery
+// has been claimed again since.
+func (s *Store) SaveWebhookDelivery(ctx context.Context, data models.WebhookDelivery, claimedUntil time.Time) error {
+	query := `
+UPDATE webhook_deliveries
+SET status = $2,
+    attempts = $3,
+    next_attempt_at = $4,
+    last_error = $5,
+    response_status = $6,
+    delivered_at = $7
+WHERE id = $1
+  AND next_attempt_at = $8;`
+	_, err := s.db.ExecContext(ctx, query, data.ID, data.Status, data.Attempts, data.NextAttemptAt,
+		data.LastError, data.ResponseStatus, data.DeliveredAt, claimedUntil)
+	if err != nil {
+		return fmt.Errorf("save webhook delivery failed: %w", classify(err))
+	}
+	return nil
+}
+
+func (s *Store) WebhookDeliveries(ctx context.Context, subscriptionID int, status string, limit, offset int) ([]models.WebhookDelivery, error) {
+	query := `
+SELECT id, subscription_id, outbox_id, event_type, payload, status, attempts,
+    next_attempt_at, last_error, response_status, created_at, delivered_at
+FROM webhook_deliveries
+WHERE subscription_id = $1
+  AND ($2 = '' OR status = $2)
+ORDER BY id DESC
+LIMIT $3 OFFSET $4;`
+	result := make([]models.WebhookDelivery, 0)
+
+	if err := s.db.SelectContext(ctx, &result, query, subscriptionID, status, limit, offset); err != nil {
+		return nil, fmt.Errorf("get webhook deliveries failed: %w", classify(err))
+	}
+	return result, nil
+}
@@ -0,0 +1,61 @@
+package report
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+type CSVWriter struct {
+	w       *csv.Writer
+	columns []Column
+	record  []string
+}
+
+func NewCSVWriter(w io.Writer, opts Options) (*CSVWriter, error) {
+	switch strings.ToLower(opts.Encoding) {
+	case "", "utf-8", "utf8":
+	case "windows-1251", "cp1251":
+		w = charmap.Windows1251.NewEncoder().Writer(w)
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", opts.Encoding)
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = ';'
+	if opts.Delimiter != 0 {
+		switch opts.Delimiter {
+		case '"', '\r', '\n', utf8.RuneError:
+			return nil, fmt.Errorf("invalid delimiter %q", opts.Delimiter)
+		}
+		cw.Comma = opts.Delimiter
+	}
+	return &CSVWriter{w: cw}, nil
+}
+
+func (c *CSVWriter) WriteHeader(columns []Column) error {
+	c.columns = columns
+	c.record = make([]string, len(columns))
+	for i, col := range columns {
+		c.record[i] = col.Name
+	}
+	return c.w.Write(c.record)
+}
+
+func (c *CSVWriter) WriteRow(values []any) error {
+	if err := checkRow(c.columns, values); err != nil {
+		return err
+	}
+	for i, v := range values {
+		c.record[i] = format(v)
+	}
+	return c.w.Write(c.record)
+}
+
+func (c *CSVWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
@@ -0,0 +1,39 @@
+package report
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+// JSONLWriter writes every row as a JSON object keyed by column names.
+type JSONLWriter struct {
+	w       *bufio.Writer
+	enc     *json.Encoder
+	columns []Column
+}
+
+func NewJSONLWriter(w io.Writer) *JSONLWriter {
+	bw := bufio.NewWriter(w)
+	return &JSONLWriter{w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (j *JSONLWriter) WriteHeader(columns []Column) error {
+	j.columns = columns
+	return nil
+}
+
+func (j *JSONLWriter) WriteRow(values []any) error {
+	if err := checkRow(j.columns, values); err != nil {
+		return err
+	}
+	row := make(map[string]any, len(values))
+	for i, v := range values {
+		row[j.columns[i].Name] = v
+	}
+	return j.enc.Encode(row)
+}
+
+func (j *JSONLWriter) Close() error {
+	return j.w.Flush()
+}
@@ -0,0 +1,293 @@
+package report
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// parquetRowGroupSize bounds rows kept in memory before a row group is
+// written.
+const parquetRowGroupSize = 10000
+
+// Parquet types and enums used by the writer, see parquet.thrift.
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetRequired = 0
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetDataPage = 0
+)
+
+// ParquetWriter writes required columns with plain encoding and without
+// compression: Int as INT64, String as UTF8 BYTE_ARRAY and Time as
+// TIMESTAMP_MILLIS. Rows are written in row groups of
+// parquetRowGroupSize.
+type ParquetWriter struct {
+	w         *countingWriter
+	columns   []Column
+	pages     []bytes.Buffer
+	rows      int
+	rowGroups []parquetRowGroup
+	numRows   int64
+}
+
+type parquetRowGroup struct {
+	numRows int64
+	chunks  []parquetChunk
+}
+
+type parquetChunk struct {
+	offset int64
+	size   int64
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func NewParquetWriter(w io.Writer) *ParquetWriter {
+	return &ParquetWriter{w: &countingWriter{w: w}}
+}
+
+func (p *ParquetWriter) WriteHeader(columns []Column) error {
+	p.columns = columns
+	p.pages = make([]bytes.Buffer, len(columns))
+	_, err := io.WriteString(p.w, "PAR1")
+	return err
+}
+
+func (p *ParquetWriter) WriteRow(values []any) error {
+	if err := checkRow(p.columns, values); err != nil {
+		return err
+	}
+	var b [8]byte
+	for i, v := range values {
+		switch v := v.(type) {
+		case int64:
+			binary.LittleEndian.PutUint64(b[:], uint64(v))
+			p.pages[i].Write(b[:])
+		case time.Time:
+			binary.LittleEndian.PutUint64(b[:], uint64(v.UnixMilli()))
+			p.pages[i].Write(b[:])
+		case string:
+			binary.LittleEndian.PutUint32(b[:4], uint32(len(v)))
+			p.pages[i].Write(b[:4])
+			p.pages[i].WriteString(v)
+		}
+	}
+	p.rows++
+	if p.rows == parquetRowGroupSize {
+		return p.flush()
+	}
+	return nil
+}
+
+// flush writes buffered rows as a row group with one page per column.
+func (p *ParquetWriter) flush() error {
+	if p.rows == 0 {
+		return nil
+	}
+	group := parquetRowGroup{numRows: int64(p.rows)}
+	for i := range p.columns {
+		offset := p.w.n
+		var header thriftWriter
+		header.i32Field(1, parquetDataPage)
+		header.i32Field(2, int32(p.pages[i].Len()))
+		header.i32Field(3, int32(p.pages[i].Len()))
+		header.structField(5)
+		header.i32Field(1, int32(p.rows))
+		header.i32Field(2, parquetPlain)
+		header.i32Field(3, parquetRLE)
+		header.i32Field(4, parquetRLE)
+		header.stop()
+		header.stop()
+		if _, err := p.w.Write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if _, err := p.w.Write(p.pages[i].Bytes()); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, parquetChunk{offset: offset, size: p.w.n - offset})
+		p.pages[i].Reset()
+	}
+	p.rowGroups = append(p.rowGroups, group)
+	p.numRows += int64(p.rows)
+	p.rows = 0
+	return nil
+}
+
+// Close writes the last row group and the footer.
+func (p *ParquetWriter) Close() error {
+	if err := p.flush(); err != nil {
+		return err
+	}
+	var meta thriftWriter
+	meta.i32Field(1, 1)
+	meta.listField(2, thriftStruct, len(p.columns)+1)
+	meta.binaryField(4, "schema")
+	meta.i32Field(5, int32(len(p.columns)))
+	meta.stop()
+	for _, c := range p.columns {
+		meta.i32Field(1, int32(parquetType(c)))
+		meta.i32Field(3, parquetRequired)
+		meta.binaryField(4, c.Name)
+		switch c.Type {
+		case String:
+			meta.i32Field(6, parquetUTF8)
+		case Time:
+			meta.i32Field(6, parquetTimestampMillis)
+		}
+		meta.stop()
+	}
+	meta.i64Field(3, p.numRows)
+	meta.listField(4, thriftStruct, len(p.rowGroups))
+	for _, g := range p.rowGroups {
+		var total int64
+		meta.listField(1, thriftStruct, len(g.chunks))
+		for i, chunk := range g.chunks {
+			total += chunk.size
+			meta.i64Field(2, chunk.offset)
+			meta.structField(3)
+			meta.i32Field(1, int32(parquetType(p.columns[i])))
+			meta.listField(2, thriftI32, 1)
+			meta.varint(zigzag(parquetPlain))
+			meta.listField(3, thriftBinary, 1)
+			meta.binary(p.columns[i].Name)
+			meta.i32Field(4, 0)
+			meta.i64Field(5, g.numRows)
+			meta.i64Field(6, chunk.size)
+			meta.i64Field(7, chunk.size)
+			meta.i64Field(9, chunk.offset)
+			meta.stop()
+			meta.stop()
+		}
+		meta.i64Field(2, total)
+		meta.i64Field(3, g.numRows)
+		meta.stop()
+	}
+	meta.binaryField(6, "internship_backend_2022")
+	meta.stop()
+
+	if _, err := p.w.Write(meta.buf.Bytes()); err != nil {
+		return err
+	}
+	var tail [8]byte
+	binary.LittleEndian.PutUint32(tail[:4], uint32(meta.buf.Len()))
+	copy(tail[4:], "PAR1")
+	_, err := p.w.Write(tail[:])
+	return err
+}
+
+func parquetType(c Column) int {
+	if c.Type == String {
+		return parquetByteArray
+	}
+	return parquetInt64
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs in the thrift compact protocol. It tracks
+// the last field id of every open struct, since field headers hold deltas.
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int
+}
+
+func (t *thriftWriter) fieldHeader(id int, typ byte) {
+	if len(t.last) == 0 {
+		t.last = append(t.last, 0)
+	}
+	delta := id - t.last[len(t.last)-1]
+	if delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta<<4) | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(zigzag(int64(id)))
+	}
+	t.last[len(t.last)-1] = id
+}
+
+func (t *thriftWriter) i32Field(id int, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64Field(id int, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) binaryField(id int, v string) {
+	t.fieldHeader(id, thriftBinary)
+	t.binary(v)
+}
+
+// structField opens a nested struct, close it with stop.
+func (t *thriftWriter) structField(id int) {
+	t.fieldHeader(id, thriftStruct)
+	t.last = append(t.last, 0)
+}
+
+// listField starts a list of n elements. Struct elements are written as
+// fields followed by stop.
+func (t *thriftWriter) listField(id int, elem byte, n int) {
+	t.fieldHeader(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n<<4) | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		t.varint(uint64(n))
+	}
+	if elem == thriftStruct {
+		// Every element is a struct closed with stop.
+		for i := 0; i < n; i++ {
+			t.last = append(t.last, 0)
+		}
+	}
+}
+
+// stop closes the current struct.
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+	if len(t.last) > 0 {
+		t.last = t.last[:len(t.last)-1]
+	}
+}
+
+func (t *thriftWriter) binary(v string) {
+	t.varint(uint64(len(v)))
+	t.buf.WriteString(v)
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
@@ -0,0 +1,111 @@
+// Package report writes tabular reports in several formats. Writers get
+// rows one by one, so a report never has to be in memory as a whole.
+package report
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+var ErrUnknownFormat = fmt.Errorf("unknown report format")
+
+const (
+	FormatCSV     = "csv"
+	FormatJSONL   = "jsonl"
+	FormatXLSX    = "xlsx"
+	FormatParquet = "parquet"
+)
+
+type ColumnType int
+
+const (
+	Int ColumnType = iota
+	String
+	Time
+)
+
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// ReportWriter writes rows of a report. Values of a row follow the columns
+// passed to WriteHeader: int64 for Int, string for String and time.Time
+// for Time. Close flushes the rest of the report, it doesn't close the
+// underlying writer.
+type ReportWriter interface {
+	WriteHeader(columns []Column) error
+	WriteRow(values []any) error
+	Close() error
+}
+
+// Options tune CSV output: Delimiter defaults to ';' and Encoding is
+// "utf-8" (default) or "windows-1251".
+type Options struct {
+	Delimiter rune
+	Encoding  string
+}
+
+// New returns a writer of the format to w.
+func New(format string, w io.Writer, opts Options) (ReportWriter, error) {
+	switch format {
+	case FormatCSV:
+		return NewCSVWriter(w, opts)
+	case FormatJSONL:
+		return NewJSONLWriter(w), nil
+	case FormatXLSX:
+		return NewXLSXWriter(w), nil
+	case FormatParquet:
+		return NewParquetWriter(w), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+	}
+}
+
+// ContentType is the media type of files of the format.
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv"
+	case FormatJSONL:
+		return "application/x-ndjson"
+	case FormatXLSX:
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+func checkRow(columns []Column, values []any) error {
+	if len(values) != len(columns) {
+		return fmt.Errorf("row has %d values for %d columns", len(values), len(columns))
+	}
+	for i, c := range columns {
+		var ok bool
+		switch c.Type {
+		case Int:
+			_, ok = values[i].(int64)
+		case String:
+			_, ok = values[i].(string)
+		case Time:
+			_, ok = values[i].(time.Time)
+		}
+		if !ok {
+			return fmt.Errorf("value %v of column %s has type %T", values[i], c.Name, values[i])
+		}
+	}
+	return nil
+}
+
+// format renders a value as text for text formats.
+func format(v any) string {
+	switch v := v.(type) {
+	case int64:
+		return fmt.Sprint(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,118 @@
+package report
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/encoding/charmap"
+)
+
+var (
+	testColumns = []Column{{"orderID", Int}, {"service", String}, {"recognizedAt", Time}}
+	testRows    = [][]any{
+		{int64(1), "Доставка", time.Date(2023, 3, 3, 10, 0, 0, 0, time.UTC)},
+		{int64(2), `a "quoted"; value`, time.Date(2023, 3, 4, 0, 0, 0, 0, time.UTC)},
+	}
+)
+
+func write(t *testing.T, format string, opts Options) []byte {
+	var buf bytes.Buffer
+	w, err := New(format, &buf, opts)
+	require.NoError(t, err)
+	require.NoError(t, w.WriteHeader(testColumns))
+	for _, row := range testRows {
+		require.NoError(t, w.WriteRow(row))
+	}
+	require.Error(t, w.WriteRow([]any{"1", "x", time.Time{}}))
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestCSV(t *testing.T) {
+	want := "orderID;service;recognizedAt\n" +
+		"1;Доставка;2023-03-03T10:00:00Z\n" +
+		"2;\"a \"\"quoted\"\"; value\";2023-03-04T00:00:00Z\n"
+	require.Equal(t, want, string(write(t, FormatCSV, Options{})))
+
+	win, err := charmap.Windows1251.NewDecoder().Bytes(write(t, FormatCSV, Options{Delimiter: ',', Encoding: "windows-1251"}))
+	require.NoError(t, err)
+	require.Contains(t, string(win), "1,Доставка,2023-03-03T10:00:00Z\n")
+
+	_, err = New(FormatCSV, io.Discard, Options{Encoding: "koi8"})
+	require.Error(t, err)
+	_, err = New("pdf", io.Discard, Options{})
+	require.ErrorIs(t, err, ErrUnknownFormat)
+}
+
+func TestJSONL(t *testing.T) {
+	want := `{"orderID":1,"recognizedAt":"2023-03-03T10:00:00Z","service":"Доставка"}
+{"orderID":2,"recognizedAt":"2023-03-04T00:00:00Z","service":"a \"quoted\"; value"}
+`
+	require.Equal(t, want, string(write(t, FormatJSONL, Options{})))
+}
+
+func TestXLSX(t *testing.T) {
+	data := write(t, FormatXLSX, Options{})
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	var sheet []byte
+	for _, f := range zr.File {
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			rc, err := f.Open()
+			require.NoError(t, err)
+			sheet, err = io.ReadAll(rc)
+			require.NoError(t, err)
+		}
+	}
+	require.Contains(t, string(sheet), `<c r="B1" t="inlineStr"><is><t xml:space="preserve">service</t></is></c>`)
+	require.Contains(t, string(sheet), `<c r="A2"><v>1</v></c>`)
+	require.Contains(t, string(sheet), `a &#34;quoted&#34;; value`)
+	require.Contains(t, string(sheet), `<c r="C3" s="1"><v>44989.000000</v></c>`)
+	require.Equal(t, "AB", xlsxColumn(27))
+}
+
+func TestParquet(t *testing.T) {
+	data := write(t, FormatParquet, Options{})
+	require.Equal(t, "PAR1", string(data[:4]))
+	require.Equal(t, "PAR1", string(data[len(data)-4:]))
+	footer := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	meta := data[len(data)-8-footer : len(data)-8]
+	require.Contains(t, string(meta), "recognizedAt")
+	// The first page holds order ids right after its header.
+	require.Contains(t, string(data[4:len(data)-8-footer]), string([]byte{1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0}))
+	require.Contains(t, string(data), "\x10\x00\x00\x00Доставка")
+}
+
+// TestParquetRoundTrip reads the file back with another implementation.
+func TestParquetRoundTrip(t *testing.T) {
+	data := write(t, FormatParquet, Options{})
+	f, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(testRows)), f.NumRows())
+	fields := f.Schema().Fields()
+	require.Len(t, fields, len(testColumns))
+	for i, c := range testColumns {
+		require.Equal(t, c.Name, fields[i].Name())
+	}
+	require.NotNil(t, fields[2].Type().LogicalType().Timestamp)
+
+	r := parquet.NewReader(bytes.NewReader(data))
+	rows := make([]parquet.Row, len(testRows)+1)
+	n, err := r.ReadRows(rows)
+	if err != nil {
+		require.ErrorIs(t, err, io.EOF)
+	}
+	require.Equal(t, len(testRows), n)
+	for i, want := range testRows {
+		row := rows[i]
+		require.Equal(t, want[0], row[0].Int64())
+		require.Equal(t, want[1], string(row[1].ByteArray()))
+		require.Equal(t, want[2].(time.Time).UnixMilli(), row[2].Int64())
+	}
+}
@@ -0,0 +1,57 @@
+package report
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+)
+
+var ErrUnknownKind = fmt.Errorf("unknown report kind")
+
+const (
+	// KindRevenue is the accounting report: revenue of every service.
+	KindRevenue = "revenue"
+	// KindOrders lists every recognized order.
+	KindOrders = "orders"
+)
+
+type Source interface {
+	RevenueByService(ctx context.Context, from, to time.Time, fn func(models.ServiceRevenue) error) error
+	RecognizedOrders(ctx context.Context, from, to time.Time, fn func(models.RecognizedOrder) error) error
+}
+
+// Build writes the report of kind for [from, to) and closes w.
+func Build(ctx context.Context, src Source, kind string, from, to time.Time, w ReportWriter) error {
+	var err error
+	switch kind {
+	case KindRevenue:
+		if err = w.WriteHeader([]Column{{"serviceID", Int}, {"revenue", Int}, {"orders", Int}}); err != nil {
+			return err
+		}
+		err = src.RevenueByService(ctx, from, to, func(r models.ServiceRevenue) error {
+			return w.WriteRow([]any{int64(r.ServiceID), int64(r.Revenue), int64(r.Orders)})
+		})
+	case KindOrders:
+		columns := []Column{
+			{"orderID", Int}, {"serviceID", Int}, {"walletID", Int}, {"userID", Int}, {"price", Int},
+			{"recognizedAt", Time}, {"recognizedBy", String},
+		}
+		if err = w.WriteHeader(columns); err != nil {
+			return err
+		}
+		err = src.RecognizedOrders(ctx, from, to, func(o models.RecognizedOrder) error {
+			return w.WriteRow([]any{
+				int64(o.OrderID), int64(o.ServiceID), int64(o.WalletID), int64(o.UserID), int64(o.Price),
+				o.RecognizedAt, o.RecognizedBy,
+			})
+		})
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownKind, kind)
+	}
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,141 @@
+package report
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// XLSXWriter writes a workbook with one sheet. The sheet is the last part
+// of the archive, so rows go straight to the output. Times are written as
+// dates in UTC.
+type XLSXWriter struct {
+	zw      *zip.Writer
+	sheet   *bufio.Writer
+	columns []Column
+	row     int
+}
+
+func NewXLSXWriter(w io.Writer) *XLSXWriter {
+	return &XLSXWriter{zw: zip.NewWriter(w)}
+}
+
+var xlsxParts = []struct{ name, body string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Report" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`</Relationships>`},
+	// Style 1 formats date cells, 22 is the built-in "m/d/yy h:mm".
+	{"xl/styles.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<fonts count="1"><font/></fonts><fills count="1"><fill/></fills><borders count="1"><border/></borders>` +
+		`<cellStyleXfs count="1"><xf/></cellStyleXfs>` +
+		`<cellXfs count="2"><xf/><xf numFmtId="22" applyNumberFormat="1"/></cellXfs>` +
+		`</styleSheet>`},
+}
+
+func (x *XLSXWriter) WriteHeader(columns []Column) error {
+	x.columns = columns
+	for _, part := range xlsxParts {
+		f, err := x.zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(f, part.body); err != nil {
+			return err
+		}
+	}
+	f, err := x.zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	x.sheet = bufio.NewWriter(f)
+	x.sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	names := make([]any, len(columns))
+	for i, c := range columns {
+		names[i] = c.Name
+	}
+	return x.writeRow(names)
+}
+
+func (x *XLSXWriter) WriteRow(values []any) error {
+	if err := checkRow(x.columns, values); err != nil {
+		return err
+	}
+	return x.writeRow(values)
+}
+
+func (x *XLSXWriter) writeRow(values []any) error {
+	x.row++
+	fmt.Fprintf(x.sheet, `<row r="%d">`, x.row)
+	for i, v := range values {
+		ref := fmt.Sprintf("%s%d", xlsxColumn(i), x.row)
+		switch v := v.(type) {
+		case int64:
+			fmt.Fprintf(x.sheet, `<c r="%s"><v>%d</v></c>`, ref, v)
+		case time.Time:
+			fmt.Fprintf(x.sheet, `<c r="%s" s="1"><v>%s</v></c>`, ref, excelDate(v))
+		default:
+			fmt.Fprintf(x.sheet, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+			if err := xml.EscapeText(x.sheet, []byte(fmt.Sprint(v))); err != nil {
+				return err
+			}
+			x.sheet.WriteString(`</t></is></c>`)
+		}
+	}
+	_, err := x.sheet.WriteString(`</row>`)
+	return err
+}
+
+func (x *XLSXWriter) Close() error {
+	if x.sheet == nil {
+		if err := x.WriteHeader(x.columns); err != nil {
+			return err
+		}
+	}
+	x.sheet.WriteString(`</sheetData></worksheet>`)
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zw.Close()
+}
+
+// xlsxColumn converts a zero based index to a column name: A, ..., Z, AA.
+func xlsxColumn(i int) string {
+	var b strings.Builder
+	for i++; i > 0; i = (i - 1) / 26 {
+		b.WriteByte(byte('A' + (i-1)%26))
+	}
+	name := []byte(b.String())
+	for l, r := 0, len(name)-1; l < r; l, r = l+1, r-1 {
+		name[l], name[r] = name[r], name[l]
+	}
+	return string(name)
+}
+
+// excelDate is a serial date: days since 1899-12-30.
+func excelDate(t time.Time) string {
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	return fmt.Sprintf("%.6f", t.UTC().Sub(epoch).Hours()/24)
+}
@@ -0,0 +1,97 @@
+// Package reportjob builds reports in the background and stores the files
+// in a blob store.
+package reportjob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/blob"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/report"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrInvalidJob = fmt.Errorf("invalid report job")
+
+type Store interface {
+	CreateReportJob(ctx context.Context, data models.ReportJob) (models.ReportJob, error)
+	ReportJob(ctx context.Context, id int64) (models.ReportJob, error)
+	ClaimReportJob(ctx context.Context, lease time.Duration) (models.ReportJob, bool, error)
+	ExtendReportJob(ctx context.Context, id int64, lease time.Duration) error
+	FinishReportJob(ctx context.Context, id int64, blobKey string, size int64) error
+	FailReportJob(ctx context.Context, id int64, reason string) error
+}
+
+// Jobs accepts jobs and hands out links to finished reports.
+type Jobs struct {
+	log     *logrus.Entry
+	store   Store
+	blobs   blob.Store
+	linkTTL time.Duration
+}
+
+func NewJobs(log *logrus.Logger, store Store, blobs blob.Store) *Jobs {
+	return &Jobs{
+		log:     log.WithField("module", "reportjob"),
+		store:   store,
+		blobs:   blobs,
+		linkTTL: 15 * time.Minute,
+	}
+}
+
+// Create queues a job, the pool picks it up.
+func (j *Jobs) Create(ctx context.Context, data models.ReportJob) (models.ReportJob, error) {
+	if err := validate(data); err != nil {
+		return models.ReportJob{}, err
+	}
+	job, err := j.store.CreateReportJob(ctx, data)
+	if err != nil {
+		return models.ReportJob{}, fmt.Errorf("reportjob: %w", err)
+	}
+	j.log.Infof("report job %d: %s %s for %s - %s requested by %q", job.ID, job.Kind, job.Format,
+		job.From.Format(time.RFC3339), job.To.Format(time.RFC3339), job.RequestedBy)
+	return job, nil
+}
+
+// Get returns the job, a DONE job has a link to its file.
+func (j *Jobs) Get(ctx context.Context, id int64) (models.ReportJob, error) {
+	job, err := j.store.ReportJob(ctx, id)
+	if err != nil {
+		return models.ReportJob{}, fmt.Errorf("reportjob: %w", err)
+	}
+	if job.Status == models.ReportJobDone {
+		if job.URL, err = j.blobs.SignedURL(job.BlobKey, j.linkTTL); err != nil {
+			return models.ReportJob{}, fmt.Errorf("reportjob: %w", err)
+		}
+	}
+	return job, nil
+}
+
+func validate(data models.ReportJob) error {
+	if data.Kind != report.KindRevenue && data.Kind != report.KindOrders {
+		return fmt.Errorf("%w: %v: %q", ErrInvalidJob, report.ErrUnknownKind, data.Kind)
+	}
+	if data.From.IsZero() || !data.From.Before(data.To) {
+		return fmt.Errorf("%w: from must be before to", ErrInvalidJob)
+	}
+	if data.Delimiter != "" && utf8.RuneCountInString(data.Delimiter) != 1 {
+		return fmt.Errorf("%w: delimiter must be one character", ErrInvalidJob)
+	}
+	if _, err := report.New(data.Format, io.Discard, options(data)); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJob, err)
+	}
+	return nil
+}
+
+func options(job models.ReportJob) report.Options {
+	opts := report.Options{Encoding: job.Encoding}
+	if job.Delimiter != "" {
+		opts.Delimiter, _ = utf8.DecodeRuneInString(job.Delimiter)
+	}
+	return opts
+}
@@ -0,0 +1,158 @@
+package reportjob
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/blob"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/report"
+
+	"github.com/sirupsen/logrus"
+)
+
+// failedReason is saved for a failed job, details are only logged since
+// the job is shown to whoever requested it.
+const failedReason = "report could not be built"
+
+// Pool builds jobs with several workers. A report is written to a
+// temporary file and then put to the blob store. A worker renews the lease
+// of its job while building it, jobs of a stopped worker are taken again
+// after lease.
+type Pool struct {
+	log      *logrus.Entry
+	store    Store
+	source   report.Source
+	blobs    blob.Store
+	workers  int
+	interval time.Duration
+	lease    time.Duration
+}
+
+func NewPool(log *logrus.Logger, store Store, source report.Source, blobs blob.Store, workers int, interval time.Duration) *Pool {
+	return &Pool{
+		log:      log.WithField("module", "reportjob"),
+		store:    store,
+		source:   source,
+		blobs:    blobs,
+		workers:  workers,
+		interval: interval,
+		lease:    30 * time.Minute,
+	}
+}
+
+func (p *Pool) Run(ctx context.Context) error {
+	p.log.Infof("starting %d report workers", p.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (p *Pool) work(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		job, ok, err := p.store.ClaimReportJob(ctx, p.lease)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			p.log.Warnf("err during claiming report job: %v", err)
+		case ok:
+			p.run(ctx, job)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) run(ctx context.Context, job models.ReportJob) {
+	buildCtx, cancel := context.WithCancel(ctx)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		p.renew(buildCtx, job.ID)
+	}()
+	key, size, err := p.build(buildCtx, job)
+	cancel()
+	<-renewed
+	if ctx.Err() != nil {
+		// The job is taken again after lease.
+		return
+	}
+	if err != nil {
+		p.log.Warnf("report job %d failed: %v", job.ID, err)
+		err = p.store.FailReportJob(ctx, job.ID, failedReason)
+	} else {
+		p.log.Infof("report job %d is done: %s, %d bytes", job.ID, key, size)
+		err = p.store.FinishReportJob(ctx, job.ID, key, size)
+	}
+	if err != nil {
+		p.log.Warnf("err during saving report job %d: %v", job.ID, err)
+	}
+}
+
+// renew extends the lease of the job every third of it until ctx is done.
+func (p *Pool) renew(ctx context.Context, id int64) {
+	ticker := time.NewTicker(p.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := p.store.ExtendReportJob(ctx, id, p.lease); err != nil && ctx.Err() == nil {
+			p.log.Warnf("err during renewing report job %d: %v", id, err)
+		}
+	}
+}
+
+func (p *Pool) build(ctx context.Context, job models.ReportJob) (string, int64, error) {
+	f, err := os.CreateTemp("", "report-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	buf := bufio.NewWriter(f)
+	rw, err := report.New(job.Format, buf, options(job))
+	if err != nil {
+		return "", 0, err
+	}
+	if err = report.Build(ctx, p.source, job.Kind, job.From, job.To, rw); err != nil {
+		return "", 0, err
+	}
+	if err = buf.Flush(); err != nil {
+		return "", 0, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	key := fmt.Sprintf("reports/%d/%s-%s-%s.%s", job.ID, job.Kind,
+		job.From.UTC().Format("20060102"), job.To.UTC().Format("20060102"), job.Format)
+	if err = p.blobs.Put(ctx, key, f, size, report.ContentType(job.Format)); err != nil {
+		return "", 0, err
+	}
+	return key, size, nil
+}
@@ -0,0 +1,171 @@
+package reportjob
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/blob"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/report"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryStore struct {
+	mu       sync.Mutex
+	jobs     []models.ReportJob
+	renewals int
+}
+
+func (s *memoryStore) CreateReportJob(_ context.Context, data models.ReportJob) (models.ReportJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data.ID = int64(len(s.jobs) + 1)
+	data.Status = models.ReportJobPending
+	s.jobs = append(s.jobs, data)
+	return data, nil
+}
+
+func (s *memoryStore) ReportJob(_ context.Context, id int64) (models.ReportJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[id-1], nil
+}
+
+func (s *memoryStore) ClaimReportJob(context.Context, time.Duration) (models.ReportJob, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, job := range s.jobs {
+		if job.Status == models.ReportJobPending {
+			s.jobs[i].Status = models.ReportJobRunning
+			return s.jobs[i], true, nil
+		}
+	}
+	return models.ReportJob{}, false, nil
+}
+
+func (s *memoryStore) ExtendReportJob(context.Context, int64, time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.renewals++
+	return nil
+}
+
+func (s *memoryStore) FinishReportJob(_ context.Context, id int64, blobKey string, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[id-1].Status, s.jobs[id-1].BlobKey, s.jobs[id-1].Size = models.ReportJobDone, blobKey, size
+	return nil
+}
+
+func (s *memoryStore) FailReportJob(_ context.Context, id int64, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[id-1].Status, s.jobs[id-1].Error = models.ReportJobFailed, reason
+	return nil
+}
+
+type source struct{}
+
+func (source) RevenueByService(_ context.Context, _, _ time.Time, fn func(models.ServiceRevenue) error) error {
+	return fn(models.ServiceRevenue{ServiceID: 1, Orders: 2, Revenue: 300})
+}
+
+func (source) RecognizedOrders(context.Context, time.Time, time.Time, func(models.RecognizedOrder) error) error {
+	return fmt.Errorf("connection refused")
+}
+
+func TestPool(t *testing.T) {
+	dir := t.TempDir()
+	blobs, err := blob.NewLocal(dir, "http://localhost:8080/files", "secret")
+	require.NoError(t, err)
+	store := &memoryStore{}
+	jobs := NewJobs(logrus.New(), store, blobs)
+	ctx := context.Background()
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	_, err = jobs.Create(ctx, models.ReportJob{Kind: "taxes", Format: report.FormatCSV, From: from, To: from.AddDate(1, 0, 0)})
+	require.ErrorIs(t, err, ErrInvalidJob)
+	_, err = jobs.Create(ctx, models.ReportJob{Kind: report.KindRevenue, Format: report.FormatCSV, From: from, To: from})
+	require.ErrorIs(t, err, ErrInvalidJob)
+	_, err = jobs.Create(ctx, models.ReportJob{Kind: report.KindRevenue, Format: "pdf", From: from, To: from.AddDate(1, 0, 0)})
+	require.ErrorIs(t, err, ErrInvalidJob)
+
+	done, err := jobs.Create(ctx, models.ReportJob{Kind: report.KindRevenue, Format: report.FormatCSV, From: from, To: from.AddDate(1, 0, 0)})
+	require.NoError(t, err)
+	failed, err := jobs.Create(ctx, models.ReportJob{Kind: report.KindOrders, Format: report.FormatParquet, From: from, To: from.AddDate(1, 0, 0)})
+	require.NoError(t, err)
+
+	pool := NewPool(logrus.New(), store, source{}, blobs, 2, 10*time.Millisecond)
+	runCtx, cancel := context.WithCancel(ctx)
+	go func() { _ = pool.Run(runCtx) }()
+	require.Eventually(t, func() bool {
+		a, _ := store.ReportJob(ctx, done.ID)
+		b, _ := store.ReportJob(ctx, failed.ID)
+		return a.Status == models.ReportJobDone && b.Status == models.ReportJobFailed
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+
+	job, err := jobs.Get(ctx, done.ID)
+	require.NoError(t, err)
+	require.Equal(t, "reports/1/revenue-20220101-20230101.csv", job.BlobKey)
+	require.Contains(t, job.URL, "http://localhost:8080/files/reports/1/revenue-20220101-20230101.csv?expires=")
+	data, err := os.ReadFile(filepath.Join(dir, "reports", "1", "revenue-20220101-20230101.csv"))
+	require.NoError(t, err)
+	require.Equal(t, "serviceID;revenue;orders\n1;300;2\n", string(data))
+	require.Equal(t, int64(len(data)), job.Size)
+
+	job, err = jobs.Get(ctx, failed.ID)
+	require.NoError(t, err)
+	require.Equal(t, failedReason, job.Error)
+	require.Empty(t, job.URL)
+}
+
+type slowSource struct {
+	source
+	done chan struct{}
+}
+
+func (s slowSource) RevenueByService(ctx context.Context, from, to time.Time, fn func(models.ServiceRevenue) error) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.done:
+	}
+	return s.source.RevenueByService(ctx, from, to, fn)
+}
+
+func TestPoolRenewsLease(t *testing.T) {
+	blobs, err := blob.NewLocal(t.TempDir(), "http://localhost:8080/files", "secret")
+	require.NoError(t, err)
+	store := &memoryStore{}
+	ctx := context.Background()
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	job, err := NewJobs(logrus.New(), store, blobs).Create(ctx,
+		models.ReportJob{Kind: report.KindRevenue, Format: report.FormatCSV, From: from, To: from.AddDate(1, 0, 0)})
+	require.NoError(t, err)
+
+	src := slowSource{done: make(chan struct{})}
+	pool := NewPool(logrus.New(), store, src, blobs, 1, 10*time.Millisecond)
+	pool.lease = 30 * time.Millisecond
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() { _ = pool.Run(runCtx) }()
+
+	require.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.renewals >= 3
+	}, time.Second, 10*time.Millisecond)
+	close(src.done)
+	require.Eventually(t, func() bool {
+		j, _ := store.ReportJob(ctx, job.ID)
+		return j.Status == models.ReportJobDone
+	}, time.Second, 10*time.Millisecond)
+}
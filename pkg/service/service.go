@@ -3,6 +3,7 @@ package service
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
 
@@ -14,6 +15,21 @@ type Store interface {
 	ReserveFunds(ctx context.Context, data models.ReservedFundsRequest) (models.EventsBodyResponse, error)
 	RecognizeRevenue(ctx context.Context, data models.RecognizeRevenueRequest) (models.EventsBodyResponse, error)
 	WalletBalance(ctx context.Context, data models.BalanceRequest) (models.WalletResponse, error)
+	Order(ctx context.Context, orderID int) (models.EventsBodyResponse, error)
+	Orders(ctx context.Context, filter models.OrdersFilter) ([]models.EventsBodyResponse, error)
+	Batch(ctx context.Context, data models.BatchRequest) (models.BatchResponse, error)
+	History(ctx context.Context, filter models.HistoryFilter) ([]models.HistoryEntry, error)
+	VerifyChain(ctx context.Context, walletID int) (models.ChainReport, error)
+	Statement(ctx context.Context, filter models.StatementFilter) (models.Statement, error)
+	Statements(ctx context.Context, filter models.StatementFilter) ([]models.Statement, error)
+	RevenueByService(ctx context.Context, from, to time.Time, fn func(models.ServiceRevenue) error) error
+	RecognizedOrders(ctx context.Context, from, to time.Time, fn func(models.RecognizedOrder) error) error
+	Analytics(ctx context.Context, filter models.AnalyticsFilter) (models.Analytics, error)
+	ProposeAdjustment(ctx context.Context, data models.AdjustmentRequest) (models.Adjustment, error)
+	ApproveAdjustment(ctx context.Context, id int, approver string) (models.Adjustment, error)
+	RejectAdjustment(ctx context.Context, id int, approver string) (models.Adjustment, error)
+	Adjustment(ctx context.Context, id int) (models.Adjustment, error)
+	Adjustments(ctx context.Context, filter models.AdjustmentsFilter) ([]models.Adjustment, error)
 }
 
 type Service struct {
@@ -59,3 +75,127 @@ func (s *Service) WalletBalance(ctx context.Context, data models.BalanceRequest)
 	}
 	return balance, nil
 }
+
+func (s *Service) Order(ctx context.Context, orderID int) (models.EventsBodyResponse, error) {
+	order, err := s.store.Order(ctx, orderID)
+	if err != nil {
+		return models.EventsBodyResponse{}, fmt.Errorf("service: %w", err)
+	}
+	return order, nil
+}
+
+func (s *Service) Orders(ctx context.Context, filter models.OrdersFilter) ([]models.EventsBodyResponse, error) {
+	orders, err := s.store.Orders(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("service: %w", err)
+	}
+	return orders, nil
+}
+
+func (s *Service) Batch(ctx context.Context, data models.BatchRequest) (models.BatchResponse, error) {
+	result, err := s.store.Batch(ctx, data)
+	if err != nil {
+		return models.BatchResponse{}, fmt.Errorf("service: %w", err)
+	}
+	return result, nil
+}
+
+func (s *Service) History(ctx context.Context, filter models.HistoryFilter) ([]models.HistoryEntry, error) {
+	history, err := s.store.History(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("service: %w", err)
+	}
+	return history, nil
+}
+
+func (s *Service) VerifyChain(ctx context.Context, walletID int) (models.ChainReport, error) {
+	report, err := s.store.VerifyChain(ctx, walletID)
+	if err != nil {
+		return models.ChainReport{}, fmt.Errorf("service: %w", err)
+	}
+	if !report.Valid {
+		s.log.Warnf("history of wallet %d is broken at entry %d: %s", walletID, report.BrokenEntryID, report.Reason)
+	}
+	return report, nil
+}
+
+func (s *Service) Statement(ctx context.Context, filter models.StatementFilter) (models.Statement, error) {
+	statement, err := s.store.Statement(ctx, filter)
+	if err != nil {
+		return models.Statement{}, fmt.Errorf("service: %w", err)
+	}
+	return statement, nil
+}
+
+func (s *Service) Statements(ctx context.Context, filter models.StatementFilter) ([]models.Statement, error) {
+	statements, err := s.store.Statements(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("service: %w", err)
+	}
+	return statements, nil
+}
+
+func (s *Service) RevenueByService(ctx context.Context, from, to time.Time, fn func(models.ServiceRevenue) error) error {
+	if err := s.store.RevenueByService(ctx, from, to, fn); err != nil {
+		return fmt.Errorf("service: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) RecognizedOrders(ctx context.Context, from, to time.Time, fn func(models.RecognizedOrder) error) error {
+	if err := s.store.RecognizedOrders(ctx, from, to, fn); err != nil {
+		return fmt.Errorf("service: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) Analytics(ctx context.Context, filter models.AnalyticsFilter) (models.Analytics, error) {
+	analytics, err := s.store.Analytics(ctx, filter)
+	if err != nil {
+		return models.Analytics{}, fmt.Errorf("service: %w", err)
+	}
+	return analytics, nil
+}
+
+func (s *Service) ProposeAdjustment(ctx context.Context, data models.AdjustmentRequest) (models.Adjustment, error) {
+	adj, err := s.store.ProposeAdjustment(ctx, data)
+	if err != nil {
+		return models.Adjustment{}, fmt.Errorf("service: %w", err)
+	}
+	s.log.Infof("adjustment %d of wallet %d by %d proposed by %q: %s", adj.ID, adj.WalletID, adj.Amount, adj.ProposedBy, adj.Reason)
+	return adj, nil
+}
+
+func (s *Service) ApproveAdjustment(ctx context.Context, id int, approver string) (models.Adjustment, error) {
+	adj, err := s.store.ApproveAdjustment(ctx, id, approver)
+	if err != nil {
+		return models.Adjustment{}, fmt.Errorf("service: %w", err)
+	}
+	s.log.Infof("adjustment %d approved by %q", adj.ID, approver)
+	return adj, nil
+}
+
+func (s *Service) RejectAdjustment(ctx context.Context, id int, approver string) (models.Adjustment, error) {
+	adj, err := s.store.RejectAdjustment(ctx, id, approver)
+	if err != nil {
+		return models.Adjustment{}, fmt.Errorf("service: %w", err)
+	}
+	s.log.Infof("adjustment %d rejected by %q", adj.ID, approver)
+	return adj, nil
+}
+
+func (s *Service) Adjustment(ctx context.Context, id int) (models.Adjustment, error) {
+	adj, err := s.store.Adjustment(ctx, id)
+	if err != nil {
+		return models.Adjustment{}, fmt.Errorf("service: %w", err)
+	}
+	return adj, nil
+}
+
+func (s *Service) Adjustments(ctx context.Context, filter models.AdjustmentsFilter) ([]models.Adjustment, error) {
+	adjs, err := s.store.Adjustments(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("service: %w", err)
+	}
+	return adjs, nil
+}
@@ -0,0 +1,79 @@
+package snapshot
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type DayStore interface {
+	CloseDay(ctx context.Context, day time.Time, end time.Time) (int, error)
+	LastClosedDay(ctx context.Context) (time.Time, error)
+}
+
+// EndOfDay freezes balances of every finished business day. Days missed
+// while the service was down are closed on start, oldest first.
+type EndOfDay struct {
+	log      *logrus.Entry
+	store    DayStore
+	location *time.Location
+	interval time.Duration
+	lag      time.Duration
+	now      func() time.Time
+}
+
+// NewEndOfDay returns a job for business days in location, it checks for
+// a finished day every interval.
+func NewEndOfDay(log *logrus.Logger, store DayStore, location *time.Location, interval time.Duration) *EndOfDay {
+	return &EndOfDay{
+		log:      log.WithField("module", "eod"),
+		store:    store,
+		location: location,
+		interval: interval,
+		lag:      time.Minute,
+		now:      time.Now,
+	}
+}
+
+func (e *EndOfDay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	e.log.Infof("starting end of day in %s", e.location)
+	for {
+		if err := e.closeDays(ctx); err != nil && ctx.Err() == nil {
+			e.log.Warnf("err during closing days: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *EndOfDay) closeDays(ctx context.Context) error {
+	today := e.date(e.now().Add(-e.lag))
+	day := today.AddDate(0, 0, -1)
+	last, err := e.store.LastClosedDay(ctx)
+	if err != nil {
+		return err
+	}
+	if !last.IsZero() {
+		day = time.Date(last.Year(), last.Month(), last.Day()+1, 0, 0, 0, 0, e.location)
+	}
+	for ; day.Before(today); day = day.AddDate(0, 0, 1) {
+		n, err := e.store.CloseDay(ctx, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			return err
+		}
+		e.log.Infof("closed %s with %d wallets", day.Format(time.DateOnly), n)
+	}
+	return nil
+}
+
+// date is the midnight that starts the business day of t.
+func (e *EndOfDay) date(t time.Time) time.Time {
+	t = t.In(e.location)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, e.location)
+}
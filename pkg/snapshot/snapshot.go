@@ -0,0 +1,61 @@
+package snapshot
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Store interface {
+	TakeSnapshots(ctx context.Context, at time.Time) (int, error)
+}
+
+// Snapshotter saves wallet balances at every interval boundary, so a
+// balance at a past moment is rebuilt from the nearest snapshot instead of
+// the whole history.
+type Snapshotter struct {
+	log      *logrus.Entry
+	store    Store
+	interval time.Duration
+	now      func() time.Time
+}
+
+func New(log *logrus.Logger, store Store, interval time.Duration) *Snapshotter {
+	return &Snapshotter{
+		log:      log.WithField("module", "snapshot"),
+		store:    store,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+func (s *Snapshotter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	s.log.Infof("starting snapshots every %s", s.interval)
+	var last time.Time
+	for {
+		at := s.boundary()
+		if at.After(last) {
+			n, err := s.store.TakeSnapshots(ctx, at)
+			switch {
+			case err != nil && ctx.Err() == nil:
+				s.log.Warnf("err during taking snapshots at %s: %v", at, err)
+			case err == nil:
+				last = at
+				s.log.Debugf("took %d snapshots at %s", n, at)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// boundary is the latest interval boundary.
+func (s *Snapshotter) boundary() time.Time {
+	return s.now().Truncate(s.interval)
+}
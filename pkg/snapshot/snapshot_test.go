@@ -0,0 +1,60 @@
+package snapshot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingStore struct {
+	at chan time.Time
+}
+
+func (s recordingStore) TakeSnapshots(_ context.Context, at time.Time) (int, error) {
+	s.at <- at
+	return 1, nil
+}
+
+func TestSnapshotterBoundary(t *testing.T) {
+	store := recordingStore{at: make(chan time.Time, 1)}
+	s := New(logrus.New(), store, time.Hour)
+	s.now = func() time.Time { return time.Date(2023, 3, 3, 10, 0, 30, 0, time.UTC) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = s.Run(ctx) }()
+
+	require.Equal(t, time.Date(2023, 3, 3, 10, 0, 0, 0, time.UTC), <-store.at)
+}
+
+type dayStore struct {
+	last   time.Time
+	closed []string
+}
+
+func (s *dayStore) CloseDay(_ context.Context, day time.Time, end time.Time) (int, error) {
+	s.closed = append(s.closed, day.Format(time.DateOnly)+"/"+end.UTC().Format(time.RFC3339))
+	return 1, nil
+}
+
+func (s *dayStore) LastClosedDay(context.Context) (time.Time, error) {
+	return s.last, nil
+}
+
+func TestEndOfDayClosesMissedDays(t *testing.T) {
+	moscow := time.FixedZone("MSK", 3*60*60)
+	store := &dayStore{last: time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)}
+	e := NewEndOfDay(logrus.New(), store, moscow, time.Minute)
+	e.now = func() time.Time { return time.Date(2023, 3, 3, 21, 30, 0, 0, time.UTC) }
+
+	require.NoError(t, e.closeDays(context.Background()))
+	require.Equal(t, []string{"2023-03-02/2023-03-02T21:00:00Z", "2023-03-03/2023-03-03T21:00:00Z"}, store.closed)
+
+	store.closed = nil
+	store.last = time.Date(2023, 3, 3, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, e.closeDays(context.Background()))
+	require.Empty(t, store.closed)
+}
@@ -0,0 +1,457 @@
+// Package storetest is the contract of service.Store. Every implementation
+// runs the same suite, so they behave the same for the service.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/service"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// Suite runs against a store returned by NewStore before every test. The
+// store may have data of other runs: tests use users, orders and services
+// of their own.
+type Suite struct {
+	suite.Suite
+	NewStore func() service.Store
+
+	ctx    context.Context
+	store  service.Store
+	lastID int
+}
+
+func (s *Suite) SetupTest() {
+	s.ctx = context.Background()
+	s.store = s.NewStore()
+	s.lastID = rand.Intn(1_000_000) * 1000
+}
+
+// id returns a user, order or service id unused by other runs.
+func (s *Suite) id() int {
+	s.lastID++
+	return s.lastID
+}
+
+func (s *Suite) addFunds(userID, amount int) models.WalletResponse {
+	wallet, err := s.store.AddFunds(s.ctx, models.AddFundsRequest{
+		TransactionID: uuid.NewString(), UserID: userID, Balance: amount, ClientID: "contract",
+	})
+	s.Require().NoError(err)
+	return wallet
+}
+
+func (s *Suite) reserve(walletID, serviceID, orderID, price int) (models.EventsBodyResponse, error) {
+	return s.store.ReserveFunds(s.ctx, models.ReservedFundsRequest{
+		TransactionID: uuid.NewString(), WalletID: walletID, ServiceID: serviceID, OrderID: orderID, Price: price,
+		ClientID: "contract",
+	})
+}
+
+func (s *Suite) recognize(walletID, orderID int, status string) (models.EventsBodyResponse, error) {
+	return s.store.RecognizeRevenue(s.ctx, models.RecognizeRevenueRequest{
+		TransactionID: uuid.NewString(), WalletID: walletID, OrderID: orderID, Status: status, ClientID: "contract",
+	})
+}
+
+func (s *Suite) balance(userID int) models.WalletResponse {
+	wallet, err := s.store.WalletBalance(s.ctx, models.BalanceRequest{UserID: userID})
+	s.Require().NoError(err)
+	return wallet
+}
+
+func (s *Suite) TestAddFunds() {
+	userID := s.id()
+	req := models.AddFundsRequest{TransactionID: uuid.NewString(), UserID: userID, Balance: 100, ClientID: "contract"}
+	wallet, err := s.store.AddFunds(s.ctx, req)
+	s.Require().NoError(err)
+	s.Equal(userID, wallet.UserID)
+	s.Equal(100, wallet.Balance)
+	s.Equal(int64(1), wallet.Version)
+	s.Equal("contract", wallet.UpdatedBy)
+
+	_, err = s.store.AddFunds(s.ctx, req)
+	s.ErrorIs(err, pgstore.ErrDuplicateTransaction)
+
+	wallet = s.addFunds(userID, 50)
+	s.Equal(150, wallet.Balance)
+	s.Equal(int64(2), wallet.Version)
+
+	req.TransactionID, req.ExpectedVersion = uuid.NewString(), 1
+	_, err = s.store.AddFunds(s.ctx, req)
+	s.ErrorIs(err, pgstore.ErrVersionMismatch)
+
+	req.TransactionID, req.ExpectedVersion = uuid.NewString(), 2
+	wallet, err = s.store.AddFunds(s.ctx, req)
+	s.Require().NoError(err)
+	s.Equal(250, wallet.Balance)
+	s.Equal(wallet, s.balance(userID))
+}
+
+func (s *Suite) TestAddFundsExpectedVersionUserNotExists() {
+	userID := s.id()
+	req := models.AddFundsRequest{TransactionID: uuid.NewString(), UserID: userID, Balance: 100, ExpectedVersion: 1}
+	_, err := s.store.AddFunds(s.ctx, req)
+	s.ErrorIs(err, pgstore.ErrUserNotExists)
+
+	_, err = s.store.WalletBalance(s.ctx, models.BalanceRequest{UserID: userID})
+	s.ErrorIs(err, pgstore.ErrUserNotExists)
+}
+
+func (s *Suite) TestWalletBalanceUserNotExists() {
+	_, err := s.store.WalletBalance(s.ctx, models.BalanceRequest{UserID: s.id()})
+	s.ErrorIs(err, pgstore.ErrUserNotExists)
+}
+
+func (s *Suite) TestReserveFunds() {
+	userID, serviceID, orderID := s.id(), s.id(), s.id()
+	wallet := s.addFunds(userID, 100)
+
+	_, err := s.reserve(wallet.ID, serviceID, orderID, 101)
+	s.ErrorIs(err, pgstore.ErrNotEnoughFunds)
+
+	event, err := s.reserve(wallet.ID, serviceID, orderID, 60)
+	s.Require().NoError(err)
+	s.Equal(wallet.ID, event.WalletID)
+	s.Equal(serviceID, event.ServiceID)
+	s.Equal(orderID, event.OrderID)
+	s.Equal(60, event.Price)
+	s.Equal("REQUESTED", event.Status)
+	s.Equal("contract", event.ClientID)
+
+	_, err = s.reserve(wallet.ID, serviceID, orderID, 10)
+	s.ErrorIs(err, pgstore.ErrOrderAlreadyAdded)
+	_, err = s.reserve(wallet.ID, serviceID, s.id(), 41)
+	s.ErrorIs(err, pgstore.ErrNotEnoughFunds)
+
+	wallet = s.balance(userID)
+	s.Equal(100, wallet.Balance)
+	s.Equal(60, wallet.Reserved)
+}
+
+func (s *Suite) TestReserveFundsWalletNotExists() {
+	_, err := s.reserve(-s.id(), s.id(), s.id(), 10)
+	s.ErrorIs(err, pgstore.ErrNotEnoughFunds)
+}
+
+func (s *Suite) TestRecognizeRevenue() {
+	userID, serviceID, done, canceled := s.id(), s.id(), s.id(), s.id()
+	wallet := s.addFunds(userID, 100)
+	_, err := s.reserve(wallet.ID, serviceID, done, 30)
+	s.Require().NoError(err)
+	_, err = s.reserve(wallet.ID, serviceID, canceled, 20)
+	s.Require().NoError(err)
+
+	event, err := s.recognize(wallet.ID, done, "DONE")
+	s.Require().NoError(err)
+	s.Equal("DONE", event.Status)
+	s.Equal("contract", event.RecognizedBy)
+	event, err = s.recognize(wallet.ID, canceled, "CANCELED")
+	s.Require().NoError(err)
+	s.Equal("CANCELED", event.Status)
+
+	wallet = s.balance(userID)
+	s.Equal(70, wallet.Balance)
+	s.Equal(0, wallet.Reserved)
+
+	// A processed order is recognized once, whatever the new status is.
+	_, err = s.recognize(wallet.ID, done, "DONE")
+	s.ErrorIs(err, pgstore.ErrOrderAlreadyProcessed)
+	_, err = s.recognize(wallet.ID, done, "CANCELED")
+	s.ErrorIs(err, pgstore.ErrOrderAlreadyProcessed)
+	_, err = s.recognize(wallet.ID, canceled, "DONE")
+	s.ErrorIs(err, pgstore.ErrOrderAlreadyProcessed)
+	wallet = s.balance(userID)
+	s.Equal(70, wallet.Balance)
+	s.Equal(0, wallet.Reserved)
+
+	_, err = s.recognize(wallet.ID, s.id(), "DONE")
+	s.ErrorIs(err, pgstore.ErrOrderNotExists)
+	_, err = s.recognize(wallet.ID, done, "PAID")
+	s.ErrorIs(err, pgstore.ErrInvalidStatus)
+
+	// Another wallet doesn't have the order.
+	other := s.addFunds(s.id(), 100)
+	order := s.id()
+	_, err = s.reserve(wallet.ID, serviceID, order, 10)
+	s.Require().NoError(err)
+	_, err = s.recognize(other.ID, order, "DONE")
+	s.ErrorIs(err, pgstore.ErrOrderNotExists)
+	s.Equal(100, s.balance(other.UserID).Balance)
+}
+
+func (s *Suite) TestOrders() {
+	wallet := s.addFunds(s.id(), 100)
+	serviceID := s.id()
+	var orderIDs []int
+	for i := 0; i < 3; i++ {
+		orderIDs = append(orderIDs, s.id())
+		_, err := s.reserve(wallet.ID, serviceID, orderIDs[i], 10)
+		s.Require().NoError(err)
+	}
+	_, err := s.recognize(wallet.ID, orderIDs[1], "DONE")
+	s.Require().NoError(err)
+
+	order, err := s.store.Order(s.ctx, orderIDs[1])
+	s.Require().NoError(err)
+	s.Equal("DONE", order.Status)
+	_, err = s.store.Order(s.ctx, s.id())
+	s.ErrorIs(err, pgstore.ErrOrderNotExists)
+
+	orders, err := s.store.Orders(s.ctx, models.OrdersFilter{WalletID: wallet.ID, Limit: 10})
+	s.Require().NoError(err)
+	s.Require().Len(orders, 3)
+	s.Equal(orderIDs[2], orders[0].OrderID)
+	s.Equal(orderIDs[0], orders[2].OrderID)
+
+	orders, err = s.store.Orders(s.ctx, models.OrdersFilter{ServiceID: serviceID, Status: "REQUESTED", Limit: 1, Offset: 1})
+	s.Require().NoError(err)
+	s.Require().Len(orders, 1)
+	s.Equal(orderIDs[0], orders[0].OrderID)
+}
+
+func (s *Suite) batch(mode string, ops ...models.BatchOperation) models.BatchResponse {
+	resp, err := s.store.Batch(s.ctx, models.BatchRequest{Mode: mode, Operations: ops, ClientID: "contract"})
+	s.Require().NoError(err)
+	s.Require().Len(resp.Results, len(ops))
+	return resp
+}
+
+func addFundsOp(transactionID string, userID, amount int) models.BatchOperation {
+	return models.BatchOperation{Type: models.BatchAddFunds, AddFunds: &models.AddFundsRequest{
+		TransactionID: transactionID, UserID: userID, Balance: amount,
+	}}
+}
+
+func reserveOp(transactionID string, walletID, serviceID, orderID, price int) models.BatchOperation {
+	return models.BatchOperation{Type: models.BatchReserveFunds, ReserveFunds: &models.ReservedFundsRequest{
+		TransactionID: transactionID, WalletID: walletID, ServiceID: serviceID, OrderID: orderID, Price: price,
+	}}
+}
+
+func recognizeOp(transactionID string, walletID, orderID int, status string) models.BatchOperation {
+	return models.BatchOperation{Type: models.BatchRecognizeRevenue, RecognizeRevenue: &models.RecognizeRevenueRequest{
+		TransactionID: transactionID, WalletID: walletID, OrderID: orderID, Status: status,
+	}}
+}
+
+func (s *Suite) TestBatchAtomic() {
+	userID := s.id()
+	wallet := s.addFunds(userID, 100)
+	resp := s.batch(models.BatchModeAtomic,
+		addFundsOp(uuid.NewString(), userID, 50),
+		reserveOp(uuid.NewString(), wallet.ID, s.id(), s.id(), 500),
+	)
+	s.False(resp.Applied)
+	s.Equal(models.BatchStatusSkipped, resp.Results[0].Status)
+	s.Equal(models.BatchStatusFailed, resp.Results[1].Status)
+	s.ErrorIs(resp.Results[1].Err, pgstore.ErrNotEnoughFunds)
+	s.Equal(100, s.balance(userID).Balance)
+}
+
+func (s *Suite) TestBatchBestEffort() {
+	userID, serviceID, orderID := s.id(), s.id(), s.id()
+	wallet := s.addFunds(userID, 100)
+	transactionID := uuid.NewString()
+	resp := s.batch(models.BatchModeBestEffort,
+		addFundsOp(uuid.NewString(), userID, 50),
+		addFundsOp(uuid.NewString(), userID, 25),
+		reserveOp(uuid.NewString(), wallet.ID, serviceID, orderID, 100),
+		reserveOp(transactionID, wallet.ID, serviceID, s.id(), 100),
+	)
+	s.True(resp.Applied)
+	s.Equal(models.BatchStatusOK, resp.Results[0].Status)
+	s.Equal(175, resp.Results[0].Wallet.Balance)
+	s.Equal(resp.Results[0].Wallet, resp.Results[1].Wallet)
+	s.Equal(orderID, resp.Results[2].Event.OrderID)
+	s.ErrorIs(resp.Results[3].Err, pgstore.ErrNotEnoughFunds)
+
+	wallet = s.balance(userID)
+	s.Equal(175, wallet.Balance)
+	s.Equal(100, wallet.Reserved)
+
+	// The transaction of the failed operation can be retried.
+	resp = s.batch(models.BatchModeBestEffort, reserveOp(transactionID, wallet.ID, serviceID, s.id(), 75))
+	s.True(resp.Applied)
+	s.Equal(models.BatchStatusOK, resp.Results[0].Status)
+	resp = s.batch(models.BatchModeBestEffort, reserveOp(transactionID, wallet.ID, serviceID, s.id(), 0))
+	s.ErrorIs(resp.Results[0].Err, pgstore.ErrDuplicateTransaction)
+}
+
+func (s *Suite) TestBatchRecognizeOtherWallet() {
+	userID, orderID := s.id(), s.id()
+	wallet := s.addFunds(userID, 100)
+	other := s.addFunds(s.id(), 100)
+	_, err := s.reserve(wallet.ID, s.id(), orderID, 10)
+	s.Require().NoError(err)
+
+	resp := s.batch(models.BatchModeBestEffort, recognizeOp(uuid.NewString(), other.ID, orderID, "DONE"))
+	s.ErrorIs(resp.Results[0].Err, pgstore.ErrOrderNotExists)
+	resp = s.batch(models.BatchModeBestEffort, recognizeOp(uuid.NewString(), wallet.ID, orderID, "DONE"))
+	s.Equal(models.BatchStatusOK, resp.Results[0].Status)
+	s.Equal(90, s.balance(userID).Balance)
+}
+
+func (s *Suite) TestHistoryAndStatement() {
+	from := time.Now().Add(-time.Hour)
+	userID, orderID := s.id(), s.id()
+	wallet := s.addFunds(userID, 100)
+	_, err := s.reserve(wallet.ID, s.id(), orderID, 10)
+	s.Require().NoError(err)
+	_, err = s.recognize(wallet.ID, orderID, "DONE")
+	s.Require().NoError(err)
+
+	history, err := s.store.History(s.ctx, models.HistoryFilter{UserID: userID, Limit: 10})
+	s.Require().NoError(err)
+	s.Require().Len(history, 3)
+	s.Equal(models.HistoryDebit, history[0].Kind)
+	s.Equal(models.HistoryReserve, history[1].Kind)
+	s.Equal(models.HistoryCredit, history[2].Kind)
+	s.Equal(orderID, history[0].OrderID)
+	s.Equal(history[1].Hash, history[0].PrevHash)
+
+	report, err := s.store.VerifyChain(s.ctx, wallet.ID)
+	s.Require().NoError(err)
+	s.True(report.Valid)
+	s.Equal(3, report.Checked)
+	s.Equal(history[0].Hash, report.LastHash)
+
+	statement, err := s.store.Statement(s.ctx, models.StatementFilter{UserID: userID, From: from, To: time.Now().Add(time.Hour)})
+	s.Require().NoError(err)
+	s.Equal(0, statement.OpeningBalance)
+	s.Equal(100, statement.Credits)
+	s.Equal(10, statement.Debits)
+	s.Equal(10, statement.Holds)
+	s.Equal(10, statement.Releases)
+	s.Equal(90, statement.ClosingBalance)
+	s.Equal(0, statement.ClosingReserved)
+	s.Len(statement.Entries, 3)
+
+	_, err = s.store.Statement(s.ctx, models.StatementFilter{UserID: s.id(), From: from, To: time.Now()})
+	s.ErrorIs(err, pgstore.ErrUserNotExists)
+}
+
+func (s *Suite) TestReports() {
+	from := time.Now().Add(-time.Hour)
+	userID, serviceID, done, canceled := s.id(), s.id(), s.id(), s.id()
+	wallet := s.addFunds(userID, 100)
+	for _, orderID := range []int{done, canceled} {
+		_, err := s.reserve(wallet.ID, serviceID, orderID, 40)
+		s.Require().NoError(err)
+	}
+	_, err := s.recognize(wallet.ID, done, "DONE")
+	s.Require().NoError(err)
+	_, err = s.recognize(wallet.ID, canceled, "CANCELED")
+	s.Require().NoError(err)
+	to := time.Now().Add(time.Hour)
+
+	var orders []models.RecognizedOrder
+	err = s.store.RecognizedOrders(s.ctx, from, to, func(o models.RecognizedOrder) error {
+		if o.ServiceID == serviceID {
+			orders = append(orders, o)
+		}
+		return nil
+	})
+	s.Require().NoError(err)
+	s.Require().Len(orders, 1)
+	s.Equal(done, orders[0].OrderID)
+	s.Equal(userID, orders[0].UserID)
+	s.Equal(40, orders[0].Price)
+
+	var revenue []models.ServiceRevenue
+	err = s.store.RevenueByService(s.ctx, from, to, func(r models.ServiceRevenue) error {
+		if r.ServiceID == serviceID {
+			revenue = append(revenue, r)
+		}
+		return nil
+	})
+	s.Require().NoError(err)
+	s.Equal([]models.ServiceRevenue{{ServiceID: serviceID, Orders: 1, Revenue: 40}}, revenue)
+}
+
+func (s *Suite) TestAdjustments() {
+	userID := s.id()
+	wallet := s.addFunds(userID, 100)
+
+	_, err := s.store.ProposeAdjustment(s.ctx, models.AdjustmentRequest{WalletID: wallet.ID, Amount: 10, Reason: " ", ProposedBy: "alice"})
+	s.ErrorIs(err, pgstore.ErrInvalidAdjustment)
+	_, err = s.store.ProposeAdjustment(s.ctx, models.AdjustmentRequest{WalletID: wallet.ID, Amount: -101, Reason: "fee", ProposedBy: "alice"})
+	s.ErrorIs(err, pgstore.ErrNotEnoughFunds)
+
+	credit, err := s.store.ProposeAdjustment(s.ctx, models.AdjustmentRequest{WalletID: wallet.ID, Amount: 20, Reason: "refund", ProposedBy: "alice"})
+	s.Require().NoError(err)
+	s.Equal(models.AdjustmentPending, credit.Status)
+	_, err = s.store.ApproveAdjustment(s.ctx, credit.ID, "alice")
+	s.ErrorIs(err, pgstore.ErrSameApprover)
+
+	credit, err = s.store.ApproveAdjustment(s.ctx, credit.ID, "bob")
+	s.Require().NoError(err)
+	s.Equal(models.AdjustmentApproved, credit.Status)
+	s.Equal("bob", credit.DecidedBy)
+	s.Require().NotNil(credit.Wallet)
+	s.Equal(120, credit.Wallet.Balance)
+	_, err = s.store.ApproveAdjustment(s.ctx, credit.ID, "bob")
+	s.ErrorIs(err, pgstore.ErrAdjustmentProcessed)
+
+	debit, err := s.store.ProposeAdjustment(s.ctx, models.AdjustmentRequest{WalletID: wallet.ID, Amount: -5, Reason: "fee", ProposedBy: "alice"})
+	s.Require().NoError(err)
+	debit, err = s.store.RejectAdjustment(s.ctx, debit.ID, "bob")
+	s.Require().NoError(err)
+	s.Equal(models.AdjustmentRejected, debit.Status)
+	s.Equal(120, s.balance(userID).Balance)
+
+	adjustments, err := s.store.Adjustments(s.ctx, models.AdjustmentsFilter{WalletID: wallet.ID, Limit: 10})
+	s.Require().NoError(err)
+	s.Require().Len(adjustments, 2)
+	s.Equal(debit.ID, adjustments[0].ID)
+	s.Equal(credit.ID, adjustments[1].ID)
+
+	_, err = s.store.Adjustment(s.ctx, debit.ID+1_000_000)
+	s.ErrorIs(err, pgstore.ErrAdjustmentNotExists)
+}
+
+// TestConcurrentReserves reserves more than the wallet has in parallel,
+// reservations must never exceed the balance.
+func (s *Suite) TestConcurrentReserves() {
+	const workers, price = 20, 10
+	userID, serviceID := s.id(), s.id()
+	wallet := s.addFunds(userID, 100)
+	orderIDs := make([]int, workers)
+	for i := range orderIDs {
+		orderIDs[i] = s.id()
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for i := range orderIDs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = s.reserve(wallet.ID, serviceID, orderIDs[i], price)
+		}(i)
+	}
+	wg.Wait()
+
+	var reserved int
+	for _, err := range errs {
+		if err == nil {
+			reserved += price
+			continue
+		}
+		// Postgres may give up on a transaction that keeps conflicting.
+		if !errors.Is(err, pgstore.ErrNotEnoughFunds) && !errors.Is(err, pgstore.ErrTxConflict) {
+			s.Failf("unexpected error", "%v", err)
+		}
+	}
+	wallet = s.balance(userID)
+	s.LessOrEqual(wallet.Reserved, wallet.Balance)
+	s.Equal(reserved, wallet.Reserved)
+}
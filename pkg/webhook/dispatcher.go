@@ -0,0 +1,200 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	TimestampHeader = "X-Webhook-Timestamp"
+)
+
+const (
+	batchSize   = 50
+	sendTimeout = 10 * time.Second
+)
+
+// Dispatcher sends pending deliveries. A failed delivery is retried with
+// exponential backoff and is marked DEAD after maxAttempts. Deliveries are
+// claimed for longer than sending the whole batch may take, so no other
+// dispatcher sends them meanwhile.
+type Dispatcher struct {
+	log         *logrus.Entry
+	store       Store
+	client      *http.Client
+	interval    time.Duration
+	batchSize   int
+	lease       time.Duration
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	now         func() time.Time
+}
+
+func NewDispatcher(log *logrus.Logger, store Store, interval time.Duration) *Dispatcher {
+	return &Dispatcher{
+		log:         log.WithField("module", "webhook"),
+		store:       store,
+		client:      newClient(),
+		interval:    interval,
+		batchSize:   batchSize,
+		lease:       batchSize*sendTimeout + time.Minute,
+		maxAttempts: 10,
+		minBackoff:  10 * time.Second,
+		maxBackoff:  6 * time.Hour,
+		now:         time.Now,
+	}
+}
+
+// newClient returns a client that refuses to connect to addresses that are
+// not public, host names of subscriptions may resolve to any address.
+func newClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: sendTimeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip, err := netip.ParseAddr(host); err != nil || !public(ip) {
+				return fmt.Errorf("address %s is not public", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: sendTimeout, Transport: transport}
+}
+
+type payload struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+func (d *Dispatcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	d.log.Infof("starting webhook dispatcher")
+	for {
+		n, err := d.dispatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			d.log.Warnf("err during dispatch: %v", err)
+		}
+		if n == d.batchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context) (int, error) {
+	deliveries, err := d.store.ClaimWebhookDeliveries(ctx, d.batchSize, d.lease)
+	if err != nil {
+		return 0, err
+	}
+	for _, delivery := range deliveries {
+		claimedUntil := delivery.NextAttemptAt
+		if err = d.store.SaveWebhookDelivery(ctx, d.deliver(ctx, delivery), claimedUntil); err != nil {
+			return 0, err
+		}
+	}
+	return len(deliveries), nil
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery models.WebhookDelivery) models.WebhookDelivery {
+	delivery.Attempts++
+	status, err := d.send(ctx, delivery)
+	delivery.ResponseStatus = status
+	now := d.now()
+	switch {
+	case err == nil:
+		delivery.Status = models.DeliveryDelivered
+		delivery.LastError = ""
+		delivery.DeliveredAt = &now
+	case delivery.Attempts >= d.maxAttempts:
+		d.log.Warnf("webhook delivery %d is dead: %v", delivery.ID, err)
+		delivery.Status = models.DeliveryDead
+		delivery.LastError = err.Error()
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = now.Add(d.backoff(delivery.Attempts))
+	}
+	return delivery
+}
+
+func (d *Dispatcher) send(ctx context.Context, delivery models.WebhookDelivery) (int, error) {
+	body, err := json.Marshal(payload{
+		ID:        delivery.OutboxID,
+		Type:      delivery.EventType,
+		Payload:   delivery.Payload,
+		CreatedAt: delivery.CreatedAt,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("marshal payload failed: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("create request failed: %w", err)
+	}
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, "sha256="+Sign([]byte(delivery.Secret), timestamp, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("send failed: %w", err)
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	b := d.minBackoff
+	for i := 1; i < attempts && b < d.maxBackoff; i++ {
+		b *= 2
+	}
+	if b > d.maxBackoff {
+		b = d.maxBackoff
+	}
+	return b
+}
+
+// Sign returns the hex HMAC-SHA256 of "timestamp.body" that receivers
+// compare with the X-Webhook-Signature header.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,151 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeStore struct {
+	Store
+	mu         sync.Mutex
+	now        time.Time
+	deliveries map[int64]models.WebhookDelivery
+}
+
+func (s *fakeStore) ClaimWebhookDeliveries(_ context.Context, limit int, _ time.Duration) ([]models.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []models.WebhookDelivery
+	for _, d := range s.deliveries {
+		if d.Status == models.DeliveryPending && !d.NextAttemptAt.After(s.now) && len(result) < limit {
+			result = append(result, d)
+		}
+	}
+	return result, nil
+}
+
+func (s *fakeStore) SaveWebhookDelivery(_ context.Context, data models.WebhookDelivery, claimedUntil time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.deliveries[data.ID].NextAttemptAt.Equal(claimedUntil) {
+		return nil
+	}
+	s.deliveries[data.ID] = data
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received [][]byte
+		fail     = true
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		sig := "sha256=" + Sign([]byte("secret"), r.Header.Get(TimestampHeader), body)
+		require.Equal(t, sig, r.Header.Get(SignatureHeader))
+		require.Equal(t, models.EventReservationCreated, r.Header.Get("X-Webhook-Event"))
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		received = append(received, body)
+	}))
+	defer receiver.Close()
+
+	store := &fakeStore{
+		now: time.Unix(1_000_000, 0),
+		deliveries: map[int64]models.WebhookDelivery{
+			1: {
+				ID:        1,
+				OutboxID:  42,
+				EventType: models.EventReservationCreated,
+				Payload:   json.RawMessage(`{"orderID":1}`),
+				Status:    models.DeliveryPending,
+				URL:       receiver.URL,
+				Secret:    "secret",
+			},
+		},
+	}
+	d := NewDispatcher(logrus.New(), store, time.Second)
+	d.client = receiver.Client()
+	d.now = func() time.Time { return store.now }
+	d.maxAttempts = 3
+	ctx := context.Background()
+
+	n, err := d.dispatch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	delivery := store.deliveries[1]
+	require.Equal(t, models.DeliveryPending, delivery.Status)
+	require.Equal(t, 1, delivery.Attempts)
+	require.Equal(t, http.StatusBadGateway, delivery.ResponseStatus)
+	require.Equal(t, store.now.Add(10*time.Second), delivery.NextAttemptAt)
+
+	n, err = d.dispatch(ctx)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	store.now = store.now.Add(10 * time.Second)
+	_, err = d.dispatch(ctx)
+	require.NoError(t, err)
+	delivery = store.deliveries[1]
+	require.Equal(t, models.DeliveryDelivered, delivery.Status)
+	require.NotNil(t, delivery.DeliveredAt)
+	require.Len(t, received, 1)
+	require.JSONEq(t, `{"id":42,"type":"reservation.created","payload":{"orderID":1},"createdAt":"0001-01-01T00:00:00Z"}`, string(received[0]))
+}
+
+func TestDispatcherDeadLetter(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	store := &fakeStore{
+		now: time.Unix(1_000_000, 0),
+		deliveries: map[int64]models.WebhookDelivery{
+			1: {ID: 1, Status: models.DeliveryPending, URL: receiver.URL, Payload: json.RawMessage(`{}`)},
+		},
+	}
+	d := NewDispatcher(logrus.New(), store, time.Second)
+	d.client = receiver.Client()
+	d.now = func() time.Time { return store.now }
+	d.maxAttempts = 3
+	for i := 0; i < 3; i++ {
+		_, err := d.dispatch(context.Background())
+		require.NoError(t, err)
+		store.now = store.now.Add(time.Hour)
+	}
+	require.Equal(t, models.DeliveryDead, store.deliveries[1].Status)
+	require.Equal(t, 3, store.deliveries[1].Attempts)
+}
+
+func TestDispatcherRefusesPrivateAddresses(t *testing.T) {
+	var received int
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer receiver.Close()
+
+	_, err := newClient().Post(receiver.URL, "application/json", nil)
+	require.ErrorContains(t, err, "is not public")
+	require.Zero(t, received)
+}
@@ -0,0 +1,158 @@
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrInvalidSubscription = fmt.Errorf("invalid subscription")
+
+var eventTypes = map[string]struct{}{
+	models.EventWalletCredited:        {},
+	models.EventReservationCreated:    {},
+	models.EventReservationRecognized: {},
+	models.EventReservationCanceled:   {},
+	models.EventWalletAdjusted:        {},
+}
+
+type Store interface {
+	CreateWebhook(ctx context.Context, data models.WebhookSubscription) (models.WebhookSubscription, error)
+	Webhooks(ctx context.Context) ([]models.WebhookSubscription, error)
+	Webhook(ctx context.Context, id int) (models.WebhookSubscription, error)
+	UpdateWebhook(ctx context.Context, data models.WebhookSubscription) (models.WebhookSubscription, error)
+	DeleteWebhook(ctx context.Context, id int) error
+	WebhookDeliveries(ctx context.Context, subscriptionID int, status string, limit, offset int) ([]models.WebhookDelivery, error)
+	EnqueueWebhookDeliveries(ctx context.Context, msg models.OutboxMessage) error
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error)
+	SaveWebhookDelivery(ctx context.Context, data models.WebhookDelivery, claimedUntil time.Time) error
+}
+
+// Registry manages subscriptions. It is also an outbox.Publisher that turns
+// every published message into deliveries for the subscribers.
+type Registry struct {
+	log   *logrus.Entry
+	store Store
+}
+
+func NewRegistry(log *logrus.Logger, store Store) *Registry {
+	return &Registry{
+		log:   log.WithField("module", "webhook"),
+		store: store,
+	}
+}
+
+// Create saves the subscription. The secret is generated when it's empty
+// and is returned only here.
+func (r *Registry) Create(ctx context.Context, data models.WebhookSubscription) (models.WebhookSubscription, error) {
+	if err := validate(data); err != nil {
+		return models.WebhookSubscription{}, err
+	}
+	if data.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return models.WebhookSubscription{}, fmt.Errorf("webhook: %w", err)
+		}
+		data.Secret = hex.EncodeToString(secret)
+	}
+	sub, err := r.store.CreateWebhook(ctx, data)
+	if err != nil {
+		return models.WebhookSubscription{}, fmt.Errorf("webhook: %w", err)
+	}
+	return sub, nil
+}
+
+func (r *Registry) List(ctx context.Context) ([]models.WebhookSubscription, error) {
+	subs, err := r.store.Webhooks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: %w", err)
+	}
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	return subs, nil
+}
+
+func (r *Registry) Get(ctx context.Context, id int) (models.WebhookSubscription, error) {
+	sub, err := r.store.Webhook(ctx, id)
+	if err != nil {
+		return models.WebhookSubscription{}, fmt.Errorf("webhook: %w", err)
+	}
+	sub.Secret = ""
+	return sub, nil
+}
+
+// Update replaces url and event types. The secret is rotated only when a
+// new one is given.
+func (r *Registry) Update(ctx context.Context, data models.WebhookSubscription) (models.WebhookSubscription, error) {
+	if err := validate(data); err != nil {
+		return models.WebhookSubscription{}, err
+	}
+	sub, err := r.store.UpdateWebhook(ctx, data)
+	if err != nil {
+		return models.WebhookSubscription{}, fmt.Errorf("webhook: %w", err)
+	}
+	sub.Secret = ""
+	return sub, nil
+}
+
+func (r *Registry) Delete(ctx context.Context, id int) error {
+	if err := r.store.DeleteWebhook(ctx, id); err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	return nil
+}
+
+func (r *Registry) Deliveries(ctx context.Context, subscriptionID int, status string, limit, offset int) ([]models.WebhookDelivery, error) {
+	if _, err := r.store.Webhook(ctx, subscriptionID); err != nil {
+		return nil, fmt.Errorf("webhook: %w", err)
+	}
+	deliveries, err := r.store.WebhookDeliveries(ctx, subscriptionID, status, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: %w", err)
+	}
+	return deliveries, nil
+}
+
+func (r *Registry) Publish(ctx context.Context, msg models.OutboxMessage) error {
+	if err := r.store.EnqueueWebhookDeliveries(ctx, msg); err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	return nil
+}
+
+func validate(data models.WebhookSubscription) error {
+	u, err := url.Parse(data.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be absolute http(s) url", ErrInvalidSubscription)
+	}
+	host := strings.ToLower(u.Hostname())
+	if ip, err := netip.ParseAddr(host); (err == nil && !public(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: url must not point to a loopback or private address", ErrInvalidSubscription)
+	}
+	if len(data.EventTypes) == 0 {
+		return fmt.Errorf("%w: no event types", ErrInvalidSubscription)
+	}
+	for _, t := range data.EventTypes {
+		if _, ok := eventTypes[t]; !ok {
+			return fmt.Errorf("%w: unknown event type %q", ErrInvalidSubscription, t)
+		}
+	}
+	return nil
+}
+
+// public reports whether deliveries may be sent to ip. Loopback, private,
+// link-local and multicast addresses belong to our own network.
+func public(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
@@ -0,0 +1,33 @@
+package webhook
+
+import (
+	"testing"
+
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateURL(t *testing.T) {
+	for url, valid := range map[string]bool{
+		"https://partner.example/hook":    true,
+		"http://93.184.216.34:8080/hook":  true,
+		"ftp://partner.example/hook":      false,
+		"http://localhost/hook":           false,
+		"http://api.localhost/hook":       false,
+		"http://127.0.0.1/hook":           false,
+		"http://[::1]/hook":               false,
+		"http://10.0.0.5/hook":            false,
+		"http://192.168.1.1/hook":         false,
+		"http://169.254.169.254/latest":   false,
+		"http://0.0.0.0/hook":             false,
+		"http://[::ffff:172.16.0.1]/hook": false,
+	} {
+		err := validate(models.WebhookSubscription{URL: url, EventTypes: []string{models.EventWalletCredited}})
+		if valid {
+			require.NoError(t, err, url)
+		} else {
+			require.ErrorIs(t, err, ErrInvalidSubscription, url)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/internal/logger"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/archive"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/blob"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+// unpartitionedEvents turns events of a new database back into the table
+// databases had before events were partitioned.
+const unpartitionedEvents = `
+DROP TABLE events, event_orders, event_archives CASCADE;
+DROP FUNCTION create_events_partitions(date, date);
+
+CREATE TABLE events
+(
+    id            serial PRIMARY KEY,
+    wallet_id     int         NOT NULL REFERENCES wallets (id),
+    service_id    int         NOT NULL,
+    order_id      int         NOT NULL UNIQUE,
+    price         int         NOT NULL,
+    status        varchar     NOT NULL DEFAULT 'REQUESTED',
+    datetime      timestamptz NOT NULL DEFAULT NOW(),
+    client_id     varchar     NOT NULL DEFAULT '',
+    recognized_by varchar     NOT NULL DEFAULT ''
+);
+
+CREATE INDEX events_wallet_datetime_idx ON events (wallet_id, datetime);`
+
+// populated has orders of January and February 2022, order 5 is reserved
+// in January and recognized in February.
+const populated = `
+INSERT INTO wallets (user_id, account_balance) VALUES (1, 1000);
+
+INSERT INTO events (wallet_id, service_id, order_id, price, status, datetime)
+VALUES (1, 1, 1, 100, 'DONE', '2022-01-10T10:00:00Z'),
+       (1, 2, 2, 50, 'DONE', '2022-01-11T10:00:00Z'),
+       (1, 1, 3, 25, 'DONE', '2022-01-20T10:00:00Z'),
+       (1, 2, 4, 70, 'CANCELED', '2022-01-21T10:00:00Z'),
+       (1, 2, 5, 40, 'DONE', '2022-01-31T23:00:00Z'),
+       (1, 1, 6, 10, 'DONE', '2022-02-10T10:00:00Z');
+
+INSERT INTO wallet_history (wallet_id, kind, balance_delta, reserved_delta, order_id, created_at)
+VALUES (1, 'DEBIT', -40, -40, 5, '2022-02-01T01:00:00Z');`
+
+// TestArchiveMigratedEvents migrates a populated database to partitioned
+// events, archives January and checks reports over it stay the same.
+func TestArchiveMigratedEvents(t *testing.T) {
+	ctx := context.Background()
+	schema, dsn := newSchema(t, "archive_test")
+	_, err := schema.ExecContext(ctx, unpartitionedEvents+populated)
+	require.NoError(t, err)
+	execFile(t, schema, "../pkg/pgstore/migrations/001_partition_events.sql")
+
+	blobs, err := blob.NewLocal(t.TempDir(), "http://localhost:8080/files", "secret")
+	require.NoError(t, err)
+	store, err := pgstore.New(ctx, logger.New(), dsn, pgstore.WithArchive(blobs))
+	require.NoError(t, err)
+	defer store.Close()
+
+	january := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	february := january.AddDate(0, 1, 0)
+	revenue := func(from, to time.Time) []models.ServiceRevenue {
+		var result []models.ServiceRevenue
+		err := store.RevenueByService(ctx, from, to, func(r models.ServiceRevenue) error {
+			result = append(result, r)
+			return nil
+		})
+		require.NoError(t, err)
+		return result
+	}
+	orders := func(from, to time.Time) []int {
+		var result []int
+		err := store.RecognizedOrders(ctx, from, to, func(o models.RecognizedOrder) error {
+			result = append(result, o.OrderID)
+			return nil
+		})
+		require.NoError(t, err)
+		return result
+	}
+
+	wantJanuary := []models.ServiceRevenue{
+		{ServiceID: 1, Orders: 2, Revenue: 125},
+		{ServiceID: 2, Orders: 1, Revenue: 50},
+	}
+	wantFebruary := []models.ServiceRevenue{
+		{ServiceID: 1, Orders: 1, Revenue: 10},
+		{ServiceID: 2, Orders: 1, Revenue: 40},
+	}
+	require.Equal(t, wantJanuary, revenue(january, february))
+	require.Equal(t, wantFebruary, revenue(february, february.AddDate(0, 1, 0)))
+
+	n, err := archive.NewArchiver(logger.New(), store, blobs).Archive(ctx, february)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	var partitions int
+	require.NoError(t, schema.GetContext(ctx, &partitions,
+		`SELECT COUNT(*) FROM event_archives WHERE partition = 'events_2022_01' AND row_count = 5;`))
+	require.Equal(t, 1, partitions)
+
+	require.Equal(t, wantJanuary, revenue(january, february))
+	require.Equal(t, wantFebruary, revenue(february, february.AddDate(0, 1, 0)))
+	require.Equal(t, []int{1, 2, 3}, orders(january, february))
+	require.Equal(t, []int{5, 6}, orders(february, february.AddDate(0, 1, 0)))
+}
+
+// newSchema creates the schema name with the tables of a new database and
+// returns a connection and a DSN using it. The schema is dropped after
+// the test.
+func newSchema(t *testing.T, name string) (*sqlx.DB, string) {
+	ctx := context.Background()
+	db, err := sqlx.ConnectContext(ctx, "pgx", pgDSN)
+	require.NoError(t, err)
+	drop := `DROP SCHEMA IF EXISTS ` + name + ` CASCADE;`
+	_, err = db.ExecContext(ctx, drop+`CREATE SCHEMA `+name+`;`)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = db.ExecContext(context.Background(), drop)
+		_ = db.Close()
+	})
+
+	dsn := pgDSN + "&search_path=" + name
+	schema, err := sqlx.ConnectContext(ctx, "pgx", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = schema.Close() })
+	execFile(t, schema, "../pkg/pgstore/create_table.sql")
+	return schema, dsn
+}
+
+func execFile(t *testing.T, db *sqlx.DB, path string) {
+	script, err := os.ReadFile(path)
+	require.NoError(t, err)
+	_, err = db.ExecContext(context.Background(), string(script))
+	require.NoError(t, err, path)
+}
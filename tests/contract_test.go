@@ -0,0 +1,24 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pershin-daniil/internship_backend_2022/internal/logger"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/service"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/storetest"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// TestPgStoreContract runs the store contract on Postgres with default
+// options, in its own schema so it leaves nothing to other tests.
+func TestPgStoreContract(t *testing.T) {
+	_, dsn := newSchema(t, "contract_test")
+	store, err := pgstore.New(context.Background(), logger.New(), dsn)
+	require.NoError(t, err)
+	defer store.Close()
+	suite.Run(t, &storetest.Suite{NewStore: func() service.Store { return store }})
+}
@@ -59,7 +59,7 @@ func (s *IntegrationTestSuite) SetupSuite() {
 		_ = s.server.Run(ctx)
 	}()
 	time.Sleep(100 * time.Millisecond)
-	err = s.store.ResetTables(ctx, []string{"events", "wallets"})
+	err = s.store.ResetTables(ctx, []string{"events", "event_orders", "wallets"})
 	s.Require().NoError(err)
 }
 
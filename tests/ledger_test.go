@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pershin-daniil/internship_backend_2022/internal/logger"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/models"
+	"github.com/pershin-daniil/internship_backend_2022/pkg/pgstore"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLedger checks balances in the past, statements, analytics and hash
+// chains built from wallet history on Postgres.
+func TestLedger(t *testing.T) {
+	ctx := context.Background()
+	schema, dsn := newSchema(t, "ledger_test")
+	store, err := pgstore.New(ctx, logger.New(), dsn, pgstore.WithHistoryKey([]byte("secret")))
+	require.NoError(t, err)
+	defer store.Close()
+
+	addFunds := func(amount int) {
+		_, err := store.AddFunds(ctx, models.AddFundsRequest{TransactionID: uuid.NewString(), UserID: 1, Balance: amount})
+		require.NoError(t, err)
+	}
+	addFunds(100)
+	first := now(t, schema)
+	addFunds(50)
+	_, err = store.ReserveFunds(ctx, models.ReservedFundsRequest{
+		TransactionID: uuid.NewString(), WalletID: 1, ServiceID: 7, OrderID: 1, Price: 30,
+	})
+	require.NoError(t, err)
+	_, err = store.RecognizeRevenue(ctx, models.RecognizeRevenueRequest{
+		TransactionID: uuid.NewString(), WalletID: 1, ServiceID: 7, OrderID: 1, Status: "DONE",
+	})
+	require.NoError(t, err)
+	last := now(t, schema)
+
+	t.Run("balance in the past", func(t *testing.T) {
+		for _, at := range []time.Time{first, last} {
+			_, err := store.TakeSnapshots(ctx, at)
+			require.NoError(t, err)
+		}
+		wallet, err := store.WalletBalance(ctx, models.BalanceRequest{UserID: 1, AsOf: &first})
+		require.NoError(t, err)
+		require.Equal(t, 100, wallet.Balance)
+		wallet, err = store.WalletBalance(ctx, models.BalanceRequest{UserID: 1, AsOf: &last})
+		require.NoError(t, err)
+		require.Equal(t, 120, wallet.Balance)
+		require.Equal(t, 0, wallet.Reserved)
+	})
+
+	t.Run("statements open from the closed day", func(t *testing.T) {
+		to := last.Add(time.Hour)
+		want := models.Statement{UserID: 1, WalletID: 1, From: first, To: to, OpeningBalance: 100,
+			Credits: 50, Debits: 30, Holds: 30, Releases: 30, ClosingBalance: 120}
+		statements, err := store.Statements(ctx, models.StatementFilter{From: first, To: to})
+		require.NoError(t, err)
+		require.Equal(t, []models.Statement{want}, statements)
+
+		_, err = store.CloseDay(ctx, first, first)
+		require.NoError(t, err)
+		statements, err = store.Statements(ctx, models.StatementFilter{From: first, To: to})
+		require.NoError(t, err)
+		require.Equal(t, []models.Statement{want}, statements)
+	})
+
+	t.Run("analytics are rolled up once", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			_, err := store.RefreshAnalytics(ctx, now(t, schema))
+			require.NoError(t, err)
+		}
+		day := last.UTC().Truncate(24 * time.Hour)
+		analytics, err := store.Analytics(ctx, models.AnalyticsFilter{
+			GroupBy: models.AnalyticsByService, Bucket: "day", From: day, To: day.AddDate(0, 0, 1),
+		})
+		require.NoError(t, err)
+		require.Len(t, analytics.Rows, 1)
+		require.Equal(t, 7, analytics.Rows[0].ServiceID)
+		require.Equal(t, 1, analytics.Rows[0].Orders)
+		require.Equal(t, 30, analytics.Rows[0].Revenue)
+	})
+
+	t.Run("deleted tail of the chain is found", func(t *testing.T) {
+		report, err := store.VerifyChain(ctx, 1)
+		require.NoError(t, err)
+		require.True(t, report.Valid)
+		require.Equal(t, 4, report.Checked)
+
+		// The next business date, the first one is closed already.
+		_, err = store.CloseDay(ctx, last.AddDate(0, 0, 1), last)
+		require.NoError(t, err)
+		_, err = schema.ExecContext(ctx, `DELETE FROM wallet_history WHERE id = (SELECT MAX(id) FROM wallet_history);`)
+		require.NoError(t, err)
+		report, err = store.VerifyChain(ctx, 1)
+		require.NoError(t, err)
+		require.False(t, report.Valid)
+		require.Equal(t, 3, report.Checked)
+	})
+}
+
+// now is the time of the database after everything committed before.
+func now(t *testing.T, db *sqlx.DB) time.Time {
+	var result time.Time
+	require.NoError(t, db.Get(&result, `SELECT clock_timestamp();`))
+	return result
+}